@@ -0,0 +1,17 @@
+// Package apidoc holds OpenAPI document of the API and Swagger UI page for it.
+// Swagger UI scripts and styles are served from github.com/swaggo/files
+package apidoc
+
+import (
+	_ "embed" // for go:embed
+)
+
+// Spec : OpenAPI 3 document, keep it in sync with routes in main
+//
+//go:embed openapi.json
+var Spec []byte
+
+// Index : Swagger UI page loading Spec from /api/v1/openapi.json
+//
+//go:embed index.html
+var Index []byte
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./audit"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// apiKeyPrefix starts every API key, so keys are told from session tokens
+// in Authorization header and are easy to find by secret scanners
+const apiKeyPrefix = "fsk_"
+
+// maxAPIKeys : active keys one user may have
+const maxAPIKeys = 20
+
+// API key scopes. Read allows GET requests, tasks:write also changes of
+// tasks and task commands, admin allows everything the user can do
+// including admin privileges
+const (
+	scopeRead       = "read"
+	scopeTasksWrite = "tasks:write"
+	scopeAdmin      = "admin"
+)
+
+var apiKeyScopes = []string{scopeRead, scopeTasksWrite, scopeAdmin}
+
+// contextAPIKeyUser : user authorized by API key in apiKeyMiddleware
+const contextAPIKeyUser = "apikey.user"
+
+// contextAPIKeyNoAdmin : set when API key has no admin scope. The user
+// itself is left intact, it may be saved by handlers
+const contextAPIKeyNoAdmin = "apikey.no_admin"
+
+type apiKeyView struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at,omitempty"`
+	RevokedAt  string   `json:"revoked_at,omitempty"`
+}
+
+func toAPIKeyView(k *storage.APIKey) apiKeyView {
+	v := apiKeyView{ID: k.ID, Name: k.Name, Prefix: k.Prefix, Scopes: k.Scopes, CreatedAt: k.CreatedAt.Format(validate.TimeLayout)}
+	if !k.LastUsedAt.IsZero() {
+		v.LastUsedAt = k.LastUsedAt.Format(validate.TimeLayout)
+	}
+	if !k.RevokedAt.IsZero() {
+		v.RevokedAt = k.RevokedAt.Format(validate.TimeLayout)
+	}
+	return v
+}
+
+// hashAPIKey returns stored form of API key
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func hasScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// scopeAllows tells whether key with scopes may make request
+func scopeAllows(scopes []string, c echo.Context) bool {
+	if hasScope(scopes, scopeAdmin) {
+		return true
+	}
+	switch c.Request().Method {
+	case http.MethodGet, http.MethodHead:
+		return hasScope(scopes, scopeRead) || hasScope(scopes, scopeTasksWrite)
+	}
+	return hasScope(scopes, scopeTasksWrite) && strings.HasPrefix(c.Path(), "/api/v1/tasks")
+}
+
+// apiKeyMiddleware authorizes requests with API key in Authorization
+// header instead of session token and checks scopes of the key. Key
+// without admin scope doesn't get admin privileges of its user
+func apiKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(key, apiKeyPrefix) {
+			return next(c)
+		}
+		ctx := c.Request().Context()
+		k, err := storage.GetAPIKeyByHash(ctx, hashAPIKey(key))
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.String(http.StatusUnauthorized, "")
+		}
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		u, err := storage.GetUserByID(ctx, k.UserID)
+		if errors.Is(err, storage.ErrNotFound) || (err == nil && u.Disabled) {
+			return c.String(http.StatusUnauthorized, "")
+		}
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		if !scopeAllows(k.Scopes, c) {
+			return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "api key scope doesn't allow this request", "error_code": 160}`))
+		}
+		if !hasScope(k.Scopes, scopeAdmin) {
+			c.Set(contextAPIKeyNoAdmin, true)
+		}
+		if err := storage.TouchAPIKey(ctx, k.ID); err != nil {
+			slog.WarnContext(ctx, "can't record api key use", "err", err)
+		}
+		c.Set(contextAPIKeyUser, u)
+		return next(c)
+	}
+}
+
+// isAdmin tells if request of u is made with admin privileges: u is admin
+// and request isn't made with API key lacking admin scope
+func isAdmin(c echo.Context, u *storage.User) bool {
+	noAdmin, _ := c.Get(contextAPIKeyNoAdmin).(bool)
+	return u.IsAdmin && !noAdmin
+}
+
+// slugOwner returns user in slug if request is made by the user or by
+// admin, on failure writes answer and returns nil. what names managed
+// things in the answer
+func slugOwner(c echo.Context, u *storage.User, what string) (*storage.User, error) {
+	slug := c.Param("slug")
+	if slug == u.UserName {
+		return u, nil
+	}
+	if !isAdmin(c, u) {
+		return nil, c.JSONBlob(http.StatusForbidden, []byte(fmt.Sprintf(`{"error_message": "insufficient permission to manage %s of user", "error_code": 3}`, what)))
+	}
+	owner, err := storage.GetUserByName(c.Request().Context(), slug)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 123}`))
+	}
+	if err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	return owner, nil
+}
+
+// apiKeysHandlerGet lists keys of user without secrets. User or admin
+func apiKeysHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "api keys")
+	if owner == nil {
+		return err
+	}
+	keys, err := storage.GetAPIKeys(c.Request().Context(), owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]apiKeyView, 0, len(keys))
+	for _, k := range keys {
+		views = append(views, toAPIKeyView(k))
+	}
+	answer, _ := json.Marshal(struct {
+		APIKeys   []apiKeyView `json:"api_keys"`
+		ErrorCode int          `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// apiKeysHandlerCreate creates key of the user, the key is answered once.
+// Keys act as their user, so only the user creates them
+func apiKeysHandlerCreate(c echo.Context) error {
+	var req apiKeyCreateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if c.Param("slug") != u.UserName {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "api keys are created by their user only", "error_code": 3}`))
+	}
+	audit.SetAction(c, "apikey.create")
+	ctx := c.Request().Context()
+	keys, err := storage.GetAPIKeys(ctx, u.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	active := 0
+	for _, k := range keys {
+		if k.RevokedAt.IsZero() {
+			active++
+		}
+	}
+	if active >= maxAPIKeys {
+		return c.JSONBlob(http.StatusConflict, []byte(fmt.Sprintf(`{"error_message": "at most %d active api keys are allowed, revoke unused ones", "error_code": 161}`, maxAPIKeys)))
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	secret := hex.EncodeToString(b)
+	key := apiKeyPrefix + secret
+	k := &storage.APIKey{
+		UserID:    u.ID,
+		Name:      req.Name,
+		Prefix:    apiKeyPrefix + secret[:8],
+		Hash:      hashAPIKey(key),
+		Scopes:    strings.Split(req.Scopes, ","),
+		CreatedAt: time.Now().Truncate(time.Second)}
+	if k.ID, err = storage.CreateAPIKey(ctx, k); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "apikey:"+strconv.Itoa(k.ID), nil, map[string]interface{}{
+		"user_id": u.ID,
+		"name":    k.Name,
+		"prefix":  k.Prefix,
+		"scopes":  req.Scopes})
+	answer, _ := json.Marshal(struct {
+		apiKeyView
+		Key          string `json:"key"`
+		ErrorMessage string `json:"error_message"`
+		ErrorCode    int    `json:"error_code"`
+	}{toAPIKeyView(k), key, "api key created, it is shown only once", 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+// apiKeysHandlerDelete revokes key of user. User or admin
+func apiKeysHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "api keys")
+	if owner == nil {
+		return err
+	}
+	audit.SetAction(c, "apikey.revoke")
+	keyID, err := strconv.Atoi(c.Param("key_id"))
+	if err == nil {
+		err = storage.RevokeAPIKey(c.Request().Context(), owner.ID, keyID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "active api key not found", "error_code": 162}`))
+	}
+	audit.AddChange(c, "apikey:"+strconv.Itoa(keyID), map[string]interface{}{"revoked": false}, map[string]interface{}{"revoked": true})
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "api key revoked", "error_code": 0}`))
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"./audit"
+	"./blobstore"
+	"./logging"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// maxAttachments : files one task may have
+const maxAttachments = 20
+
+// multipartMemory : part of upload kept in memory, the rest goes to temporary file
+const multipartMemory = 1 << 20
+
+// attachmentTypes : content types files may have, sniffed from content
+// instead of trusting the client
+var attachmentTypes = []string{
+	"text/plain", "application/pdf", "application/zip", "application/x-gzip",
+	"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// blobs keeps attachment contents, set up in run
+var blobs blobstore.BlobStore = blobstore.FS{Dir: "blobs"}
+
+// maxAttachmentSize : bytes one file may have, set up in run
+var maxAttachmentSize int64 = 10 << 20
+
+type attachmentView struct {
+	ID          int    `json:"id"`
+	Kind        string `json:"kind"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	SHA256      string `json:"sha256"`
+	UploaderID  int    `json:"uploader_id"`
+	CreatedAt   string `json:"created_at"`
+}
+
+func toAttachmentView(a *storage.Attachment) attachmentView {
+	return attachmentView{
+		ID:          a.ID,
+		Kind:        a.Kind,
+		FileName:    a.FileName,
+		ContentType: a.ContentType,
+		Size:        a.Size,
+		SHA256:      a.SHA256,
+		UploaderID:  a.UploaderID,
+		CreatedAt:   a.CreatedAt.Format(validate.TimeLayout)}
+}
+
+// setupBlobStore configures where attachments are kept from BLOB_* and S3_*
+// variables and their size limit from ATTACHMENT_MAX_SIZE
+func setupBlobStore() error {
+	switch kind := os.Getenv("BLOB_STORE"); kind {
+	case "", "fs":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "blobs"
+		}
+		blobs = blobstore.FS{Dir: dir}
+	case "s3":
+		s := blobstore.S3{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY")}
+		if s.Endpoint == "" || s.Bucket == "" {
+			return errors.New("S3_ENDPOINT and S3_BUCKET are required")
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		blobs = s
+	default:
+		return fmt.Errorf("unknown BLOB_STORE %q", kind)
+	}
+	if size := os.Getenv("ATTACHMENT_MAX_SIZE"); size != "" {
+		val, err := strconv.ParseInt(size, 10, 64)
+		if err != nil || val <= 0 {
+			return fmt.Errorf("bad ATTACHMENT_MAX_SIZE %q", size)
+		}
+		maxAttachmentSize = val
+	}
+	return nil
+}
+
+// canAttach tells if user may add or remove attachments of kind: customer
+// to problem of free task, executor to solution of task in work, admin always
+func canAttach(c echo.Context, u *storage.User, t *storage.Task, kind string) bool {
+	if isAdmin(c, u) {
+		return true
+	}
+	if kind == storage.AttachmentProblem {
+		return t.CustomerID == u.ID && t.State == storage.StateFree
+	}
+	return t.ExecutionerID == u.ID && t.State == storage.StateExecuting
+}
+
+// canList tells if user may see attachment in the list. Solution files are
+// listed only to task participants and admins
+func canList(c echo.Context, u *storage.User, t *storage.Task, a *storage.Attachment) bool {
+	return canDownload(c, u, t, a) || t.CustomerID == u.ID
+}
+
+// canDownload tells if user may get content of attachment. Solution files are
+// held in escrow: customer sees only their metadata until paying for them
+func canDownload(c echo.Context, u *storage.User, t *storage.Task, a *storage.Attachment) bool {
+	return a.Kind == storage.AttachmentProblem || canSeeSolution(c, u, t)
+}
+
+// taskOf returns task in path. On failure writes answer and returns nil
+func taskOf(c echo.Context) (*storage.Task, error) {
+	taskID, err := strconv.Atoi(c.Param("task_id"))
+	if err != nil {
+		return nil, c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "task_id must be integer type", "error_code": 10}`))
+	}
+	logging.SetTaskID(c, taskID)
+	t, err := storage.GetTaskByID(c.Request().Context(), taskID)
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return nil, c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	return t, nil
+}
+
+// attachmentOf returns attachment in path of task the user may see. On
+// failure writes answer and returns nil
+func attachmentOf(c echo.Context, u *storage.User, t *storage.Task) (*storage.Attachment, error) {
+	attachmentID, err := strconv.Atoi(c.Param("attachment_id"))
+	var a *storage.Attachment
+	if err == nil {
+		a, err = storage.GetAttachment(c.Request().Context(), t.ID, attachmentID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return nil, c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "attachment not found", "error_code": 210}`))
+	}
+	if !canDownload(c, u, t, a) {
+		return nil, c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "solution files are available to executor, admins and customer who accepted the solution", "error_code": 217}`))
+	}
+	return a, nil
+}
+
+// attachmentsHandlerGet lists attachments of task the user may see
+func attachmentsHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	attachments, err := storage.GetAttachments(c.Request().Context(), t.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := []attachmentView{}
+	for _, a := range attachments {
+		if canList(c, u, t, a) {
+			views = append(views, toAttachmentView(a))
+		}
+	}
+	answer, _ := json.Marshal(struct {
+		Attachments []attachmentView `json:"attachments"`
+		ErrorCode   int              `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// attachmentsHandlerCreate uploads file of multipart form to problem or
+// solution of task. Content type is sniffed, checksum is computed while the
+// file is stored and compared with sha256 field if client sent it. Body is
+// read only after user is known to be allowed to attach files to the task
+func attachmentsHandlerCreate(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	audit.SetAction(c, "task.attachment.create")
+	// kind is in the body, so here it is enough to attach either kind
+	if !canAttach(c, u, t, storage.AttachmentProblem) && !canAttach(c, u, t, storage.AttachmentSolution) {
+		return attachForbiddenAnswer(c)
+	}
+	r := c.Request()
+	r.Body = http.MaxBytesReader(c.Response(), r.Body, maxAttachmentSize+multipartMemory)
+	if err := r.ParseMultipartForm(multipartMemory); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return attachmentTooLargeAnswer(c)
+		}
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "body must be multipart/form-data with file", "error_code": 214}`))
+	}
+	defer r.MultipartForm.RemoveAll()
+	var req attachmentCreateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	if !canAttach(c, u, t, req.Kind) {
+		return attachForbiddenAnswer(c)
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "body must be multipart/form-data with file", "error_code": 214}`))
+	}
+	if header.Size > maxAttachmentSize {
+		return attachmentTooLargeAnswer(c)
+	}
+	ctx := r.Context()
+	attachments, err := storage.GetAttachments(ctx, t.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if len(attachments) >= maxAttachments {
+		return c.JSONBlob(http.StatusConflict, []byte(fmt.Sprintf(`{"error_message": "task may have at most %d files", "error_code": 215}`, maxAttachments)))
+	}
+	file, err := header.Open()
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	defer file.Close()
+	sniff := make([]byte, 512)
+	n, err := io.ReadFull(file, sniff)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return storageErrorAnswer(c, err)
+	}
+	contentType, _, _ := mime.ParseMediaType(http.DetectContentType(sniff[:n]))
+	if !hasScope(attachmentTypes, contentType) {
+		answer := fmt.Sprintf(`{"error_message": "file type %s is not allowed, allowed are: %s", "error_code": 212}`, contentType, strings.Join(attachmentTypes, ", "))
+		return c.JSONBlob(http.StatusUnsupportedMediaType, []byte(answer))
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	a := &storage.Attachment{
+		TaskID:      t.ID,
+		UploaderID:  u.ID,
+		Kind:        req.Kind,
+		FileName:    attachmentFileName(header.Filename),
+		ContentType: contentType,
+		Size:        header.Size,
+		BlobKey:     fmt.Sprintf("tasks/%d/%s", t.ID, hex.EncodeToString(b)),
+		CreatedAt:   time.Now().Truncate(time.Second)}
+	sum := sha256.New()
+	if err := blobs.Put(ctx, a.BlobKey, io.TeeReader(file, sum), a.Size, a.ContentType); err != nil {
+		slog.ErrorContext(ctx, "can't store attachment", "key", a.BlobKey, "err", err)
+		return storageErrorAnswer(c, err)
+	}
+	a.SHA256 = hex.EncodeToString(sum.Sum(nil))
+	if req.SHA256 != "" && !strings.EqualFold(req.SHA256, a.SHA256) {
+		deleteBlob(c, a.BlobKey)
+		answer := fmt.Sprintf(`{"error_message": "file is damaged, its sha256 is %s", "error_code": 216}`, a.SHA256)
+		return c.JSONBlob(http.StatusUnprocessableEntity, []byte(answer))
+	}
+	if err := storage.CreateAttachment(ctx, a); err != nil {
+		deleteBlob(c, a.BlobKey)
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "task_attachment:"+strconv.Itoa(a.ID), nil, map[string]interface{}{
+		"task_id":   t.ID,
+		"kind":      a.Kind,
+		"file_name": a.FileName,
+		"size":      a.Size,
+		"sha256":    a.SHA256})
+	answer, _ := json.Marshal(struct {
+		attachmentView
+		ErrorCode int `json:"error_code"`
+	}{toAttachmentView(a), 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+func attachForbiddenAnswer(c echo.Context) error {
+	return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "files are attached to problem by customer of free task and to solution by executor of task in work", "error_code": 211}`))
+}
+
+func attachmentTooLargeAnswer(c echo.Context) error {
+	answer := fmt.Sprintf(`{"error_message": "file may have at most %d bytes", "error_code": 213}`, maxAttachmentSize)
+	return c.JSONBlob(http.StatusRequestEntityTooLarge, []byte(answer))
+}
+
+// attachmentFileName returns name of uploaded file without directories,
+// control characters and quotes, it goes into Content-Disposition later
+func attachmentFileName(name string) string {
+	name = filepath.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, name)
+	if runes := []rune(name); len(runes) > 255 {
+		name = string(runes[:255])
+	}
+	if name == "" || name == "." || name == "/" {
+		name = "file"
+	}
+	return name
+}
+
+// deleteBlob removes blob no attachment refers to, failures are only logged
+func deleteBlob(c echo.Context, key string) {
+	ctx := c.Request().Context()
+	if err := blobs.Delete(ctx, key); err != nil {
+		slog.WarnContext(ctx, "can't delete blob", "key", key, "err", err)
+	}
+}
+
+// attachmentHandlerDownload sends file with its checksum. Solution files
+// only to participants and admins until the solution is accepted
+func attachmentHandlerDownload(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	a, err := attachmentOf(c, u, t)
+	if a == nil {
+		return err
+	}
+	body, err := blobs.Get(c.Request().Context(), a.BlobKey)
+	if errors.Is(err, blobstore.ErrNotFound) {
+		slog.ErrorContext(c.Request().Context(), "attachment file is missing", "key", a.BlobKey)
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "file of attachment is missing", "error_code": 218}`))
+	}
+	if err != nil {
+		slog.ErrorContext(c.Request().Context(), "can't read attachment", "key", a.BlobKey, "err", err)
+		return storageErrorAnswer(c, err)
+	}
+	defer body.Close()
+	h := c.Response().Header()
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.FileName}))
+	h.Set("Content-Length", strconv.FormatInt(a.Size, 10))
+	h.Set("X-Checksum-Sha256", a.SHA256)
+	h.Set("X-Content-Type-Options", "nosniff")
+	return c.Stream(http.StatusOK, a.ContentType, body)
+}
+
+// attachmentHandlerDelete removes file. Uploader while files of its kind
+// may be changed, admin any time
+func attachmentHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	a, err := attachmentOf(c, u, t)
+	if a == nil {
+		return err
+	}
+	audit.SetAction(c, "task.attachment.delete")
+	if !isAdmin(c, u) && (a.UploaderID != u.ID || !canAttach(c, u, t, a.Kind)) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "files are removed by uploader while they may be changed or by admin", "error_code": 211}`))
+	}
+	err = storage.DeleteAttachment(c.Request().Context(), t.ID, a.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "attachment not found", "error_code": 210}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	deleteBlob(c, a.BlobKey)
+	audit.AddChange(c, "task_attachment:"+strconv.Itoa(a.ID), map[string]interface{}{
+		"task_id":   t.ID,
+		"kind":      a.Kind,
+		"file_name": a.FileName,
+		"sha256":    a.SHA256}, nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "attachment deleted", "error_code": 0}`))
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// unreadBody fails test when request body is read
+type unreadBody struct{ t *testing.T }
+
+func (b unreadBody) Read(p []byte) (int, error) {
+	b.t.Error("body of unauthorized upload is read")
+	return 0, http.ErrBodyReadAfterClose
+}
+
+func TestAttachmentUploadIsAuthorizedBeforeReading(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/tasks/1/attachments", unreadBody{t})
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	rec := httptest.NewRecorder()
+	testServer().ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+}
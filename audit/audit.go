@@ -0,0 +1,189 @@
+// Package audit records privileged and financial actions into append-only
+// audit_log table. Every record contains hash of the previous one, so
+// editing or removing records in the middle of the log breaks the chain
+// and is detected by Verify
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"../storage"
+)
+
+// Change : entity changed by action, Before is nil for created entity
+// and After is nil for deleted one
+type Change struct {
+	Target string
+	Before map[string]interface{}
+	After  map[string]interface{}
+}
+
+// Entry : action to be recorded
+type Entry struct {
+	ActorID   int
+	ActorName string
+	Action    string // e.g. "task.accept", "user.update"
+	IP        string
+	RequestID string
+	Status    int
+	Changes   []Change
+}
+
+const recordAttempts = 3
+
+// Record appends entry to audit log
+func Record(ctx context.Context, e Entry) error {
+	targets := make([]string, 0, len(e.Changes))
+	diff := make(map[string]map[string][2]interface{}, len(e.Changes))
+	for _, c := range e.Changes {
+		targets = append(targets, c.Target)
+		diff[c.Target] = Diff(c.Before, c.After)
+	}
+	diffJSON, err := json.Marshal(diff)
+	if err != nil {
+		return err
+	}
+	rec := storage.AuditRecord{
+		CreatedAt: time.Now().Truncate(time.Second),
+		ActorID:   e.ActorID,
+		ActorName: e.ActorName,
+		Action:    e.Action,
+		Targets:   targets,
+		Diff:      string(diffJSON),
+		IP:        e.IP,
+		RequestID: e.RequestID,
+		Status:    e.Status}
+	// concurrent writers may deadlock on the last record lock, retry them
+	for attempt := 1; ; attempt++ {
+		err = appendRecord(ctx, &rec)
+		if err == nil || !errors.Is(err, storage.ErrConflict) || attempt == recordAttempts {
+			return err
+		}
+	}
+}
+
+func appendRecord(ctx context.Context, rec *storage.AuditRecord) error {
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackTransaction(tx)
+	rec.PrevHash, err = storage.LastAuditHashTx(tx)
+	if err != nil {
+		return err
+	}
+	rec.Hash = Hash(rec)
+	if err := storage.InsertAuditRecordTx(tx, rec); err != nil {
+		return err
+	}
+	return storage.CommitTransaction(tx)
+}
+
+// Hash computes hash of record chained to rec.PrevHash
+func Hash(rec *storage.AuditRecord) string {
+	canonical, _ := json.Marshal([]interface{}{
+		rec.PrevHash,
+		rec.CreatedAt.Format("2006-01-02 15:04:05"), // wall clock, as stored
+		rec.ActorID,
+		rec.ActorName,
+		rec.Action,
+		strings.Join(rec.Targets, ","),
+		rec.Diff,
+		rec.IP,
+		rec.RequestID,
+		rec.Status})
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// Verify walks the whole log and checks hash chain. Returns number of
+// checked records and ID of the first broken record, 0 if chain is intact
+func Verify(ctx context.Context) (checked, brokenAt int, err error) {
+	const batch = 1000
+	prevHash, lastID := "", 0
+	for {
+		records, err := storage.GetAuditRecordsAfter(ctx, lastID, batch)
+		if err != nil {
+			return checked, 0, err
+		}
+		for _, rec := range records {
+			if rec.PrevHash != prevHash || Hash(rec) != rec.Hash {
+				return checked, rec.ID, nil
+			}
+			checked++
+			prevHash, lastID = rec.Hash, rec.ID
+		}
+		if len(records) < batch {
+			return checked, 0, nil
+		}
+	}
+}
+
+// Diff returns changed fields as field -> [before, after]
+func Diff(before, after map[string]interface{}) map[string][2]interface{} {
+	diff := map[string][2]interface{}{}
+	for name, val := range before {
+		if afterVal, ok := after[name]; !ok || !reflect.DeepEqual(val, afterVal) {
+			diff[name] = [2]interface{}{val, after[name]}
+		}
+	}
+	for name, val := range after {
+		if _, ok := before[name]; !ok {
+			diff[name] = [2]interface{}{nil, val}
+		}
+	}
+	return diff
+}
+
+// UserTarget names user in audit records
+func UserTarget(userID int) string {
+	return fmt.Sprintf("user:%d", userID)
+}
+
+// TaskTarget names task in audit records
+func TaskTarget(taskID int) string {
+	return fmt.Sprintf("task:%d", taskID)
+}
+
+// UserSnapshot returns audited user fields. Password hash is replaced
+// by its fingerprint, so password change is visible but hash is not leaked
+func UserSnapshot(u *storage.User) map[string]interface{} {
+	fingerprint := sha256.Sum256([]byte(u.PasswordHash))
+	return map[string]interface{}{
+		"login":          u.UserName,
+		"email":          u.Email,
+		"email_verified": u.EmailVerified,
+		"is_admin":       u.IsAdmin,
+		"disabled":       u.Disabled,
+		"totp_enabled":   u.TOTPEnabled,
+		"balance":        u.Balance.GetVal(),
+		"frozen_amount":  u.FrozenAmount.GetVal(),
+		"password":       hex.EncodeToString(fingerprint[:4]),
+	}
+}
+
+// TaskSnapshot returns audited task fields
+func TaskSnapshot(t *storage.Task) map[string]interface{} {
+	return map[string]interface{}{
+		"customer_id":      t.CustomerID,
+		"executor_id":      t.ExecutionerID,
+		"title":            t.Title,
+		"state":            int(t.State),
+		"cost":             t.Cost.GetVal(),
+		"category_id":      t.CategoryID,
+		"tags":             strings.Join(t.Tags, ","),
+		"problem":          t.Problem,
+		"solution":         t.Solution,
+		"solution_preview": t.SolutionPreview,
+		"begin_time":       t.BeginTime.Format("2006-01-02 15:04:05"),
+		"end_time":         t.EndTime.Format("2006-01-02 15:04:05"),
+	}
+}
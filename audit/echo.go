@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"../storage"
+	"github.com/labstack/echo"
+)
+
+// context keys, handlers fill them with AddChange, SetAction and SetActor
+const (
+	contextUser      = "user"
+	contextActorName = "audit.actor_name"
+	contextAction    = "audit.action"
+	contextChanges   = "audit.changes"
+)
+
+// Middleware records every mutating request after handler finished,
+// including failed ones. Handlers describe what they changed with
+// SetAction and AddChange, otherwise action is method and route. Reading
+// requests are recorded only when handler sets action, e.g. SSO callback
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		method := c.Request().Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			if _, ok := c.Get(contextAction).(string); !ok {
+				return err
+			}
+		}
+
+		e := Entry{
+			Action:    method + " " + c.Path(),
+			IP:        c.RealIP(),
+			RequestID: c.Response().Header().Get(echo.HeaderXRequestID),
+			Status:    c.Response().Status}
+		if err != nil {
+			e.Status = http.StatusInternalServerError
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				e.Status = httpErr.Code
+			}
+		}
+		if u, ok := c.Get(contextUser).(*storage.User); ok && u != nil {
+			e.ActorID, e.ActorName = u.ID, u.UserName
+		} else if name, ok := c.Get(contextActorName).(string); ok {
+			e.ActorName = name
+		}
+		if action, ok := c.Get(contextAction).(string); ok {
+			e.Action = action
+		}
+		if changes, ok := c.Get(contextChanges).([]Change); ok {
+			e.Changes = changes
+		}
+		// record even if client has gone and request context is canceled
+		ctx := context.WithoutCancel(c.Request().Context())
+		if recordErr := Record(ctx, e); recordErr != nil {
+			slog.ErrorContext(ctx, "can't record audit entry", "action", e.Action, "actor", e.ActorName, "err", recordErr)
+		}
+		return err
+	}
+}
+
+// SetUser remembers authorized user as actor of request
+func SetUser(c echo.Context, u *storage.User) {
+	c.Set(contextUser, u)
+}
+
+// SetActor names actor of request without authorized user, e.g. on login
+func SetActor(c echo.Context, name string) {
+	c.Set(contextActorName, name)
+}
+
+// SetAction names action performed by request
+func SetAction(c echo.Context, action string) {
+	c.Set(contextAction, action)
+}
+
+// AddChange adds changed entity to request audit record
+func AddChange(c echo.Context, target string, before, after map[string]interface{}) {
+	changes, _ := c.Get(contextChanges).([]Change)
+	c.Set(contextChanges, append(changes, Change{Target: target, Before: before, After: after}))
+}
@@ -0,0 +1,102 @@
+// Package blobstore keeps uploaded files. FS stores them in local
+// directory, S3 in bucket of Amazon S3 or compatible storage like MinIO
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by Get for unknown key
+var ErrNotFound = errors.New("blob not found")
+
+// errBadKey : key escaping the store, keys are made by the app so it's a bug
+var errBadKey = errors.New("bad blob key")
+
+// BlobStore keeps blobs by keys like "tasks/5/0f3a..."
+type BlobStore interface {
+	// Put saves size bytes of r under key, replacing blob with the same key
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens blob, ErrNotFound if there is no such blob
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes blob, deleting absent blob isn't an error
+	Delete(ctx context.Context, key string) error
+}
+
+// FS keeps blobs as files in Dir
+type FS struct {
+	Dir string
+}
+
+// checkKey rejects keys which are empty, not clean or lead out of the store
+func checkKey(key string) error {
+	if key == "" || path.Clean("/"+key) != "/"+key || strings.HasSuffix(key, "/") {
+		return errBadKey
+	}
+	return nil
+}
+
+func (s FS) path(key string) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put implements BlobStore. Blob is written to temporary file and renamed,
+// so readers never see part of it
+func (s FS) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0o750); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(name), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	n, err := io.Copy(f, r)
+	if err == nil && n != size {
+		err = io.ErrUnexpectedEOF
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+// Get implements BlobStore
+func (s FS) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// Delete implements BlobStore
+func (s FS) Delete(ctx context.Context, key string) error {
+	name, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
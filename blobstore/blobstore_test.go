@@ -0,0 +1,153 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"tasks/5/0f3a", true},
+		{"blob", true},
+		{"", false},
+		{"/tasks/5", false},
+		{"tasks/5/", false},
+		{"tasks//5", false},
+		{"tasks/./5", false},
+		{"..", false},
+		{"../outside", false},
+		{"tasks/../../outside", false},
+	}
+	for _, tt := range tests {
+		if err := checkKey(tt.key); (err == nil) != tt.ok {
+			t.Errorf("key %q: %v, want ok %v", tt.key, err, tt.ok)
+		}
+	}
+}
+
+// files returns names of files under dir
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			name, _ := filepath.Rel(dir, path)
+			names = append(names, filepath.ToSlash(name))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func read(t *testing.T, s BlobStore, key string) string {
+	t.Helper()
+	r, err := s.Get(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFS(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	s := FS{Dir: filepath.Join(root, "blobs")}
+	if err := s.Put(ctx, "tasks/5/a", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, "tasks/5/a"); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+	if err := s.Put(ctx, "tasks/5/a", strings.NewReader(""), 0, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, "tasks/5/a"); got != "" {
+		t.Errorf("replaced blob is %q", got)
+	}
+	if err := s.Delete(ctx, "tasks/5/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "tasks/5/a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted blob: %v", err)
+	}
+	if err := s.Delete(ctx, "tasks/5/a"); err != nil {
+		t.Errorf("deleting absent blob: %v", err)
+	}
+	for _, key := range []string{"../outside", "tasks/../../outside", ""} {
+		if err := s.Put(ctx, key, strings.NewReader("x"), 1, "text/plain"); !errors.Is(err, errBadKey) {
+			t.Errorf("put %q: %v", key, err)
+		}
+		if _, err := s.Get(ctx, key); !errors.Is(err, errBadKey) {
+			t.Errorf("get %q: %v", key, err)
+		}
+		if err := s.Delete(ctx, key); !errors.Is(err, errBadKey) {
+			t.Errorf("delete %q: %v", key, err)
+		}
+	}
+	if names := files(t, root); len(names) != 0 {
+		t.Errorf("files left %v", names)
+	}
+}
+
+// failingReader gives data and then err
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFSPutKeepsOldBlobOnFailure(t *testing.T) {
+	ctx := context.Background()
+	s := FS{Dir: t.TempDir()}
+	if err := s.Put(ctx, "tasks/5/a", strings.NewReader("old"), 3, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	errRead := errors.New("connection reset")
+	tests := []struct {
+		name string
+		r    io.Reader
+		size int64
+		err  error
+	}{
+		{"short body", strings.NewReader("new"), 10, io.ErrUnexpectedEOF},
+		{"long body", strings.NewReader("new body"), 3, io.ErrUnexpectedEOF},
+		{"read error", &failingReader{"ne", errRead}, 3, errRead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := s.Put(ctx, "tasks/5/a", tt.r, tt.size, "text/plain"); !errors.Is(err, tt.err) {
+				t.Errorf("error %v, want %v", err, tt.err)
+			}
+			if got := read(t, s, "tasks/5/a"); got != "old" {
+				t.Errorf("blob is %q, want old one", got)
+			}
+			if names := files(t, s.Dir); len(names) != 1 || names[0] != "tasks/5/a" {
+				t.Errorf("files %v, want temporary file removed", names)
+			}
+		})
+	}
+}
@@ -0,0 +1,166 @@
+// Package fakes3 is in-memory S3 compatible storage for development and
+// tests of blobstore.S3. It knows one bucket, path-style PUT, GET and
+// DELETE of objects and checks AWS Signature Version 4 of requests signed
+// with UNSIGNED-PAYLOAD. Objects are lost on exit
+package fakes3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxSkew : how far request time may be from server time
+const maxSkew = 15 * time.Minute
+
+// Server : storage with one bucket and one access key
+type Server struct {
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Logf      func(format string, args ...interface{}) // log.Printf by default
+
+	lock    sync.Mutex
+	objects map[string]Object // key is object key
+}
+
+// Object : stored object
+type Object struct {
+	Data        []byte
+	ContentType string
+	Modified    time.Time
+}
+
+// New returns empty storage
+func New(bucket, region, accessKey, secretKey string) *Server {
+	return &Server{Bucket: bucket, Region: region, AccessKey: accessKey, SecretKey: secretKey, objects: map[string]Object{}}
+}
+
+// Object returns stored object
+func (s *Server) Object(key string) (Object, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	o, ok := s.objects[key]
+	return o, ok
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+		return
+	}
+	log.Printf(format, args...)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// checkSignature returns why request signature is wrong, empty if it's right
+func (s *Server) checkSignature(r *http.Request) string {
+	amzDate := r.Header.Get("X-Amz-Date")
+	at, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return "bad X-Amz-Date"
+	}
+	if d := time.Since(at); d > maxSkew || d < -maxSkew {
+		return "request time is too skewed"
+	}
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	fields := map[string]string{}
+	for _, f := range strings.Split(auth, ", ") {
+		name, val, _ := strings.Cut(f, "=")
+		fields[name] = val
+	}
+	scope := amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+	if fields["Credential"] != s.AccessKey+"/"+scope {
+		return "unknown access key or bad credential scope"
+	}
+	payload := r.Header.Get("X-Amz-Content-Sha256")
+	var headers strings.Builder
+	for _, h := range strings.Split(fields["SignedHeaders"], ";") {
+		val := r.Header.Get(h)
+		if h == "host" {
+			val = r.Host
+		}
+		fmt.Fprintf(&headers, "%s:%s\n", h, strings.TrimSpace(val))
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, headers.String(), fields["SignedHeaders"], payload}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{amzDate[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	expected := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+hex.EncodeToString(sum[:])))
+	if !hmac.Equal([]byte(expected), []byte(fields["Signature"])) {
+		return "signature does not match"
+	}
+	return ""
+}
+
+// s3Error writes error answer in S3 format
+func s3Error(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, message)
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if problem := s.checkSignature(r); problem != "" {
+		s.logf("%s %s: %s", r.Method, r.URL.Path, problem)
+		s3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", problem)
+		return
+	}
+	if name != s.Bucket {
+		s3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+		return
+	}
+	if key == "" {
+		s3Error(w, http.StatusNotImplemented, "NotImplemented", "only object requests are supported")
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			s3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+			return
+		}
+		s.objects[key] = Object{Data: data, ContentType: r.Header.Get("Content-Type"), Modified: time.Now()}
+		sum := sha256.Sum256(data)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		s.logf("put %s, %d bytes", key, len(data))
+	case http.MethodGet, http.MethodHead:
+		o, ok := s.objects[key]
+		if !ok {
+			s3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+			return
+		}
+		w.Header().Set("Content-Type", o.ContentType)
+		w.Header().Set("Content-Length", fmt.Sprint(len(o.Data)))
+		w.Header().Set("Last-Modified", o.Modified.UTC().Format(http.TimeFormat))
+		if r.Method == http.MethodGet {
+			w.Write(o.Data)
+		}
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+		s.logf("deleted %s", key)
+	default:
+		s3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed")
+	}
+}
@@ -0,0 +1,79 @@
+package blobstore
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"./fakes3"
+)
+
+// testS3 returns store using fake S3 server
+func testS3(t *testing.T) (S3, *fakes3.Server) {
+	t.Helper()
+	fake := fakes3.New("attachments", "us-east-1", "fake", "fake-secret")
+	fake.Logf = t.Logf
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	s := S3{Endpoint: server.URL + "/", Region: "us-east-1", Bucket: "attachments", AccessKey: "fake", SecretKey: "fake-secret", Client: server.Client()}
+	return s, fake
+}
+
+func TestS3(t *testing.T) {
+	ctx := context.Background()
+	s, fake := testS3(t)
+	if err := s.Put(ctx, "tasks/5/a", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if o, ok := fake.Object("tasks/5/a"); !ok || string(o.Data) != "hello" || o.ContentType != "text/plain" {
+		t.Errorf("stored %+v %v", o, ok)
+	}
+	if got := read(t, s, "tasks/5/a"); got != "hello" {
+		t.Errorf("got %q", got)
+	}
+	if err := s.Put(ctx, "tasks/5/empty", strings.NewReader(""), 0, "text/plain"); err != nil {
+		t.Fatal(err)
+	}
+	if got := read(t, s, "tasks/5/empty"); got != "" {
+		t.Errorf("empty blob is %q", got)
+	}
+	if err := s.Delete(ctx, "tasks/5/a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(ctx, "tasks/5/a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("deleted blob: %v", err)
+	}
+	if err := s.Delete(ctx, "tasks/5/a"); err != nil {
+		t.Errorf("deleting absent blob: %v", err)
+	}
+}
+
+func TestS3Errors(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name   string
+		change func(*S3)
+		key    string
+		want   string
+	}{
+		{"wrong secret", func(s *S3) { s.SecretKey = "guess" }, "tasks/5/a", "403 Forbidden"},
+		{"wrong region", func(s *S3) { s.Region = "eu-central-1" }, "tasks/5/a", "403 Forbidden"},
+		{"wrong bucket", func(s *S3) { s.Bucket = "other" }, "tasks/5/a", "bucket other not found"},
+		{"bad key", func(s *S3) {}, "../outside", errBadKey.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, fake := testS3(t)
+			tt.change(&s)
+			err := s.Put(ctx, tt.key, strings.NewReader("x"), 1, "text/plain")
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+			if _, ok := fake.Object(tt.key); ok {
+				t.Error("rejected blob is stored")
+			}
+		})
+	}
+}
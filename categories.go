@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"./audit"
+	"./recommend"
+	"./storage"
+	"github.com/labstack/echo"
+)
+
+// maxTaskTags : how many tags task may have
+const maxTaskTags = 10
+
+// tasksShown : how many tasks are listed by default
+const tasksShown = 50
+
+// recommendedShown : how many recommended tasks are listed by default
+const recommendedShown = 20
+
+// recommendCandidates : how many newest free tasks are ranked for recommendations
+const recommendCandidates = 500
+
+type categoryView struct {
+	ID       int    `json:"id"`
+	ParentID int    `json:"parent_id"`
+	Name     string `json:"name"`
+	Path     string `json:"path"` // names from the top level category, e.g. "Design / Logos"
+}
+
+// categoryPath returns names of category and its parents from the top
+func categoryPath(byID map[int]*storage.Category, cat *storage.Category) string {
+	names := []string{}
+	seen := map[int]bool{}
+	for ; cat != nil && !seen[cat.ID]; cat = byID[cat.ParentID] {
+		seen[cat.ID] = true
+		names = append([]string{cat.Name}, names...)
+	}
+	return strings.Join(names, " / ")
+}
+
+// subcategories returns ID of category with IDs of all categories under it
+func subcategories(categories []*storage.Category, categoryID int) []int {
+	ids := []int{categoryID}
+	for i := 0; i < len(ids); i++ {
+		for _, cat := range categories {
+			if cat.ParentID == ids[i] && !containsInt(ids, cat.ID) {
+				ids = append(ids, cat.ID)
+			}
+		}
+	}
+	return ids
+}
+
+func containsInt(list []int, n int) bool {
+	for _, v := range list {
+		if v == n {
+			return true
+		}
+	}
+	return false
+}
+
+// categoriesHandlerGet lists all categories with their paths
+func categoriesHandlerGet(c echo.Context) error {
+	if u, err := authorize(c); u == nil {
+		return err
+	}
+	categories, err := storage.GetCategories(c.Request().Context())
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	byID := make(map[int]*storage.Category, len(categories))
+	for _, cat := range categories {
+		byID[cat.ID] = cat
+	}
+	views := make([]categoryView, 0, len(categories))
+	for _, cat := range categories {
+		views = append(views, categoryView{cat.ID, cat.ParentID, cat.Name, categoryPath(byID, cat)})
+	}
+	answer, _ := json.Marshal(struct {
+		Categories []categoryView `json:"categories"`
+		ErrorCode  int            `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// categoriesHandlerCreate adds category under parent_id, top level if it
+// is 0. Admin only
+func categoriesHandlerCreate(c echo.Context) error {
+	var req categoryCreateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to manage categories", "error_code": 125}`))
+	}
+	audit.SetAction(c, "category.create")
+	cat := &storage.Category{ParentID: req.ParentID, Name: strings.TrimSpace(req.Name)}
+	err = storage.CreateCategory(c.Request().Context(), cat)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "parent has category with this name already", "error_code": 252}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "category:"+strconv.Itoa(cat.ID), nil, map[string]interface{}{"parent_id": cat.ParentID, "name": cat.Name})
+	answer, _ := json.Marshal(struct {
+		ID           int    `json:"id"`
+		ParentID     int    `json:"parent_id"`
+		Name         string `json:"name"`
+		ErrorMessage string `json:"error_message"`
+		ErrorCode    int    `json:"error_code"`
+	}{cat.ID, cat.ParentID, cat.Name, "category created", 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+// categoriesHandlerDelete deletes category without subcategories and
+// tasks. Admin only
+func categoriesHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to manage categories", "error_code": 125}`))
+	}
+	categoryID, err := strconv.Atoi(c.Param("category_id"))
+	if err != nil {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "category not found", "error_code": 250}`))
+	}
+	audit.SetAction(c, "category.delete")
+	err = storage.DeleteCategory(c.Request().Context(), categoryID)
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "category not found", "error_code": 250}`))
+	case errors.Is(err, storage.ErrConflict):
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "category has subcategories or tasks", "error_code": 251}`))
+	case err != nil:
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "category:"+strconv.Itoa(categoryID), map[string]interface{}{"id": categoryID}, nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "category deleted", "error_code": 0}`))
+}
+
+// tasksHandlerList lists tasks, newest first, all but closed ones unless
+// state is given. Solutions aren't listed, see toTaskListView
+func tasksHandlerList(c echo.Context) error {
+	var req tasksQueryRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	if u, err := authorize(c); u == nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	f := storage.TaskFilter{Limit: tasksShown}
+	if req.State != nil {
+		f.States = []storage.State{storage.State(*req.State)}
+	} else {
+		f.States = []storage.State{storage.StateFree, storage.StateExecuting, storage.StatePaused, storage.StateCompleted, storage.StateAccepted, storage.StateDisputed}
+	}
+	if req.CategoryID != nil {
+		categories, err := storage.GetCategories(ctx)
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		f.CategoryIDs = subcategories(categories, *req.CategoryID)
+	}
+	if req.Tags != nil {
+		f.Tags = parseTags(*req.Tags)
+	}
+	if req.BeforeID != nil {
+		f.BeforeID = *req.BeforeID
+	}
+	if req.Limit != nil {
+		f.Limit = *req.Limit
+	}
+	tasks, err := storage.FindTasks(ctx, f)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]taskView, 0, len(tasks))
+	for _, t := range tasks {
+		views = append(views, toTaskListView(t))
+	}
+	answer, _ := json.Marshal(struct {
+		Tasks     []taskView `json:"tasks"`
+		ErrorCode int        `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// recommendedTasksHandlerGet ranks free tasks of other users for the
+// current user by their skills and tasks they were paid for
+func recommendedTasksHandlerGet(c echo.Context) error {
+	var req recommendedTasksQueryRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	limit := recommendedShown
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	ctx := c.Request().Context()
+	skills, err := storage.GetUserSkills(ctx, u.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	history, err := storage.GetTaskHistory(ctx, u.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	categories, err := storage.GetCategories(ctx)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	free, err := storage.FindTasks(ctx, storage.TaskFilter{States: []storage.State{storage.StateFree}, Limit: recommendCandidates})
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	candidates := make([]*storage.Task, 0, len(free))
+	for _, t := range free {
+		if t.CustomerID != u.ID {
+			candidates = append(candidates, t)
+		}
+	}
+	type recommendedView struct {
+		taskView
+		Score   int      `json:"score"`
+		Reasons []string `json:"reasons"`
+	}
+	views := []recommendedView{}
+	for _, m := range recommend.Rank(candidates, recommend.Profile{Skills: skills, History: history}, categories, limit) {
+		views = append(views, recommendedView{toTaskListView(m.Task), m.Score, m.Reasons})
+	}
+	answer, _ := json.Marshal(struct {
+		Tasks     []recommendedView `json:"tasks"`
+		ErrorCode int               `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
@@ -0,0 +1,7 @@
+// Package client is Go client of the API generated from apidoc/openapi.json.
+// Regenerate it after changing the document:
+//
+//	go generate ./client
+package client
+
+//go:generate go run github.com/oapi-codegen/oapi-codegen/v2/cmd/oapi-codegen@v2.4.1 -config oapi-codegen.yaml ../apidoc/openapi.json
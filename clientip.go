@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// trustedProxies : networks of reverse proxies whose X-Forwarded-For and
+// X-Real-IP are believed, set up in run from TRUSTED_PROXIES. Headers of
+// other clients are ignored, anyone can send them
+var trustedProxies []*net.IPNet
+
+// parseProxies parses comma separated CIDRs, single IPs are allowed too
+func parseProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy network %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns address of client. Forwarding headers count only when
+// request comes from trusted proxy: X-Forwarded-For is read from the end,
+// the first address not of trusted proxy is the client, proxies before
+// it are not trusted to tell the truth
+func clientIP(r *http.Request) string {
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	if ip := net.ParseIP(remote); ip == nil || !isTrustedProxy(ip) {
+		return remote
+	}
+	values := r.Header.Values(echo.HeaderXForwardedFor)
+	if len(values) == 0 {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get(echo.HeaderXRealIP))); ip != nil {
+			return ip.String()
+		}
+		return remote
+	}
+	forwarded := strings.Split(strings.Join(values, ","), ",")
+	client := remote
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// clientIPMiddleware replaces forwarding headers with client address found
+// by clientIP, so c.RealIP() of logs, audit and traces answers it
+func clientIPMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		ip := clientIP(r)
+		r.Header.Del(echo.HeaderXForwardedFor)
+		r.Header.Set(echo.HeaderXRealIP, ip)
+		return next(c)
+	}
+}
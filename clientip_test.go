@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestClientIP(t *testing.T) {
+	proxies, err := parseProxies("10.0.0.0/8, 192.0.2.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := trustedProxies
+	t.Cleanup(func() { trustedProxies = saved })
+	trustedProxies = proxies
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		realIP    string
+		want      string
+	}{
+		{"direct client", "203.0.113.5:4000", nil, "", "203.0.113.5"},
+		{"forged headers of direct client", "203.0.113.5:4000", []string{"1.2.3.4"}, "5.6.7.8", "203.0.113.5"},
+		{"proxy", "10.1.1.1:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"single IP proxy", "192.0.2.7:4000", []string{"203.0.113.5"}, "", "203.0.113.5"},
+		{"chain of proxies", "10.1.1.1:4000", []string{"203.0.113.5, 10.2.2.2"}, "", "203.0.113.5"},
+		{"header lines", "10.1.1.1:4000", []string{"203.0.113.5", "10.2.2.2"}, "", "203.0.113.5"},
+		{"address forged before proxy", "10.1.1.1:4000", []string{"1.2.3.4, 203.0.113.5"}, "", "203.0.113.5"},
+		{"garbage in chain", "10.1.1.1:4000", []string{"1.2.3.4, junk, 10.2.2.2"}, "", "10.2.2.2"},
+		{"real IP of proxy", "10.1.1.1:4000", nil, "203.0.113.5", "203.0.113.5"},
+		{"proxy without headers", "10.1.1.1:4000", nil, "", "10.1.1.1"},
+		{"untrusted IPv6 client", "[2001:db8::1]:4000", []string{"1.2.3.4"}, "", "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, val := range tt.forwarded {
+				r.Header.Add(echo.HeaderXForwardedFor, val)
+			}
+			if tt.realIP != "" {
+				r.Header.Set(echo.HeaderXRealIP, tt.realIP)
+			}
+			if got := clientIP(r); got != tt.want {
+				t.Errorf("clientIP %q, want %q", got, tt.want)
+			}
+			c := echo.New().NewContext(r, httptest.NewRecorder())
+			clientIPMiddleware(func(c echo.Context) error { return nil })(c)
+			if got := c.RealIP(); got != tt.want {
+				t.Errorf("RealIP after middleware %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := parseProxies("10.0.0.0/33"); err == nil {
+		t.Error("bad network accepted")
+	}
+}
@@ -0,0 +1,31 @@
+// fake-s3 is in-memory S3 compatible storage for development and manual
+// testing of BLOB_STORE=s3. It knows one bucket, path-style PUT, GET and
+// DELETE of objects and checks AWS Signature Version 4 of requests signed
+// with UNSIGNED-PAYLOAD. Objects are lost on exit.
+//
+// Usage:
+//
+//	fake-s3 [-addr :9001] [-bucket attachments] [-region us-east-1] [-access-key fake] [-secret-key fake-secret]
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"../../blobstore/fakes3"
+)
+
+var (
+	addr      = flag.String("addr", ":9001", "listen address")
+	bucket    = flag.String("bucket", "attachments", "the only bucket")
+	region    = flag.String("region", "us-east-1", "region in signatures")
+	accessKey = flag.String("access-key", "fake", "accepted access key")
+	secretKey = flag.String("secret-key", "fake-secret", "secret of access key")
+)
+
+func main() {
+	flag.Parse()
+	log.Printf("fake s3 on %s, bucket %s", *addr, *bucket)
+	log.Fatal(http.ListenAndServe(*addr, fakes3.New(*bucket, *region, *accessKey, *secretKey)))
+}
@@ -0,0 +1,699 @@
+// freelance-admin is command line tool for administration of freelance stock
+// database. It works with storage package directly, no API token is needed.
+//
+// Usage:
+//
+//	freelance-admin [-json] [-actor name] [-log-level level] [-dsn dsn] <command> [flags]
+//
+// Run freelance-admin without arguments to see list of commands.
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"../../audit"
+	"../../currency"
+	"../../logging"
+	"../../storage"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands = []command{
+	{"user-list", "list users", userList},
+	{"user-show", "-login L: show user", userShow},
+	{"user-create", "-login L -password P [-email E] [-admin]: create user", userCreate},
+	{"user-disable", "-login L: disable user, login and sessions stop working", userDisable},
+	{"user-enable", "-login L: enable disabled user", userEnable},
+	{"user-password", "-login L -password P: reset user password", userPassword},
+	{"user-verify-email", "-login L: mark email of registered user verified, so the user can log in", userVerifyEmail},
+	{"user-admin", "-login L [-revoke]: grant or revoke admin privileges", userAdmin},
+	{"user-2fa-reset", "-login L: disable two-factor authentication of user who lost device and recovery codes", userTwoFactorReset},
+	{"task-list", "[-state N]: list tasks, optionally in given state", taskList},
+	{"task-show", "-id N: show task with forced state changes", taskShow},
+	{"task-state", "-id N -state N -reason R: force task state", taskState},
+	{"balance-adjust", "-login L -amount A -reason R: add amount to user balance, negative amount withdraws", balanceAdjust},
+	{"balance-history", "[-login L]: list balance movements", balanceHistory},
+	{"apikey-list", "-login L: list api keys of user", apiKeyList},
+	{"apikey-revoke", "-login L -id N: revoke api key of user", apiKeyRevoke},
+	{"export", "[-out file]: export users, tasks and movements as JSON", export},
+	{"audit-verify", "check hash chain of audit log", auditVerify},
+}
+
+var (
+	jsonOutput = flag.Bool("json", false, "print JSON instead of table")
+	actor      = flag.String("actor", currentOSUser(), "name recorded as actor of changes and in audit log")
+	logLevel   = flag.String("log-level", "warn", "log level of storage messages: debug, info, warn, error")
+	dsn        = flag.String("dsn", defaultDSN(), "database DSN, DATABASE_DSN environment variable by default")
+)
+
+// connectTimeout : how long database connection is retried
+const connectTimeout = 30 * time.Second
+
+// ctx is canceled on interrupt, commands pass it to storage
+var ctx = context.Background()
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	if err := logging.Setup(os.Stderr, *logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, "freelance-admin: -log-level:", err)
+		os.Exit(2)
+	}
+	var stop context.CancelFunc
+	ctx, stop = signal.NotifyContext(ctx, os.Interrupt)
+	defer stop()
+	name := flag.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := open(); err != nil {
+				fmt.Fprintln(os.Stderr, "freelance-admin:", err)
+				os.Exit(1)
+			}
+			err := cmd.run(flag.Args()[1:])
+			storage.Close()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "freelance-admin:", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "freelance-admin: unknown command %q\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: freelance-admin [-json] [-actor name] [-log-level level] [-dsn dsn] <command> [flags]")
+	flag.PrintDefaults()
+	fmt.Fprintln(os.Stderr, "commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-16s %s\n", cmd.name, cmd.usage)
+	}
+}
+
+func defaultDSN() string {
+	if dsn := os.Getenv("DATABASE_DSN"); dsn != "" {
+		return dsn
+	}
+	return storage.DefaultDSN
+}
+
+// open connects to database, retrying for connectTimeout
+func open() error {
+	connectCtx, cancel := context.WithTimeout(ctx, connectTimeout)
+	defer cancel()
+	return storage.Open(connectCtx, *dsn)
+}
+
+func currentOSUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "freelance-admin"
+}
+
+// parseFlags parses command flags, required lists flags which must be set
+func parseFlags(fs *flag.FlagSet, args []string, required ...string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, name := range required {
+		if !set[name] {
+			return fmt.Errorf("%s: flag -%s is required", fs.Name(), name)
+		}
+	}
+	return nil
+}
+
+// record appends action to audit log as "cli:<actor>". Failure is reported
+// but doesn't fail the command, the change is already saved
+func record(action string, changes ...audit.Change) {
+	if err := audit.Record(ctx, audit.Entry{ActorName: "cli:" + *actor, Action: action, Changes: changes}); err != nil {
+		fmt.Fprintln(os.Stderr, "freelance-admin: audit:", err)
+	}
+}
+
+func passwordHash(password string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(password)))
+}
+
+type userView struct {
+	ID           int     `json:"id"`
+	Login        string  `json:"login"`
+	Email        string  `json:"email"`
+	IsAdmin      bool    `json:"is_admin"`
+	Disabled     bool    `json:"disabled"`
+	TwoFactor    bool    `json:"two_factor"`
+	Balance      float64 `json:"balance"`
+	FrozenAmount float64 `json:"frozen_amount"`
+	Version      int     `json:"version"`
+}
+
+func toUserView(u *storage.User) userView {
+	return userView{u.ID, u.UserName, u.Email, u.IsAdmin, u.Disabled, u.TOTPEnabled, u.Balance.GetVal(), u.FrozenAmount.GetVal(), u.Version}
+}
+
+type taskView struct {
+	ID            int     `json:"id"`
+	Title         string  `json:"title"`
+	CustomerID    int     `json:"customer_id"`
+	ExecutionerID int     `json:"executor_id"`
+	State         int     `json:"state"`
+	Cost          float64 `json:"cost"`
+	Problem       string  `json:"problem,omitempty"`
+	Solution      string  `json:"solution,omitempty"`
+	BeginTime     string  `json:"begin_time"`
+	EndTime       string  `json:"end_time"`
+	Version       int     `json:"version"`
+}
+
+func toTaskView(t *storage.Task, full bool) taskView {
+	v := taskView{t.ID, t.Title, t.CustomerID, t.ExecutionerID, int(t.State), t.Cost.GetVal(), "", "",
+		t.BeginTime.Format(time.RFC3339), t.EndTime.Format(time.RFC3339), t.Version}
+	if full {
+		v.Problem, v.Solution = t.Problem, t.Solution
+	}
+	return v
+}
+
+type movementView struct {
+	ID        int     `json:"id"`
+	UserID    int     `json:"user_id"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason"`
+	Actor     string  `json:"actor"`
+	CreatedAt string  `json:"created_at"`
+}
+
+func toMovementView(m *storage.BalanceMovement) movementView {
+	return movementView{m.ID, m.UserID, m.Amount.GetVal(), m.Reason, m.Actor, m.CreatedAt.Format(time.RFC3339)}
+}
+
+type stateChangeView struct {
+	ID        int    `json:"id"`
+	TaskID    int    `json:"task_id"`
+	FromState int    `json:"from_state"`
+	ToState   int    `json:"to_state"`
+	Reason    string `json:"reason"`
+	Actor     string `json:"actor"`
+	CreatedAt string `json:"created_at"`
+}
+
+func toStateChangeView(c *storage.TaskStateChange) stateChangeView {
+	return stateChangeView{c.ID, c.TaskID, int(c.FromState), int(c.ToState), c.Reason, c.Actor, c.CreatedAt.Format(time.RFC3339)}
+}
+
+type apiKeyView struct {
+	ID         int      `json:"id"`
+	Name       string   `json:"name"`
+	Prefix     string   `json:"prefix"`
+	Scopes     []string `json:"scopes"`
+	CreatedAt  string   `json:"created_at"`
+	LastUsedAt string   `json:"last_used_at"`
+	RevokedAt  string   `json:"revoked_at"`
+}
+
+func toAPIKeyView(k *storage.APIKey) apiKeyView {
+	v := apiKeyView{k.ID, k.Name, k.Prefix, k.Scopes, k.CreatedAt.Format(time.RFC3339), "", ""}
+	if !k.LastUsedAt.IsZero() {
+		v.LastUsedAt = k.LastUsedAt.Format(time.RFC3339)
+	}
+	if !k.RevokedAt.IsZero() {
+		v.RevokedAt = k.RevokedAt.Format(time.RFC3339)
+	}
+	return v
+}
+
+// output prints val as JSON or as table with given header and rows
+func output(val interface{}, header []string, rows [][]interface{}) error {
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(val)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = fmt.Sprint(cell)
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	return w.Flush()
+}
+
+var userHeader = []string{"ID", "LOGIN", "EMAIL", "ADMIN", "DISABLED", "2FA", "BALANCE", "FROZEN", "VERSION"}
+
+func userRow(v userView) []interface{} {
+	return []interface{}{v.ID, v.Login, v.Email, v.IsAdmin, v.Disabled, v.TwoFactor, v.Balance, v.FrozenAmount, v.Version}
+}
+
+func userList(args []string) error {
+	fs := flag.NewFlagSet("user-list", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	users, err := storage.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	views := make([]userView, 0, len(users))
+	var rows [][]interface{}
+	for _, u := range users {
+		v := toUserView(u)
+		views = append(views, v)
+		rows = append(rows, userRow(v))
+	}
+	return output(views, userHeader, rows)
+}
+
+func userShow(args []string) error {
+	fs := flag.NewFlagSet("user-show", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	if err := parseFlags(fs, args, "login"); err != nil {
+		return err
+	}
+	u, err := storage.GetUserByName(ctx, *login)
+	if err != nil {
+		return err
+	}
+	v := toUserView(u)
+	return output(v, userHeader, [][]interface{}{userRow(v)})
+}
+
+func userCreate(args []string) error {
+	fs := flag.NewFlagSet("user-create", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	password := fs.String("password", "", "user password")
+	email := fs.String("email", "", "user email")
+	isAdmin := fs.Bool("admin", false, "grant admin privileges")
+	if err := parseFlags(fs, args, "login", "password"); err != nil {
+		return err
+	}
+	id, err := storage.CreateNewUser(ctx, *isAdmin, *login, passwordHash(*password), *email)
+	if err != nil {
+		return err
+	}
+	if u, err := storage.GetUserByID(ctx, id); err == nil {
+		record("user.create", audit.Change{Target: audit.UserTarget(id), After: audit.UserSnapshot(u)})
+	}
+	return userShow([]string{"-login", *login})
+}
+
+// modifyUser loads user by login, applies change and saves it
+func modifyUser(name string, args []string, change func(u *storage.User, fs *flag.FlagSet), define func(fs *flag.FlagSet), required ...string) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	if define != nil {
+		define(fs)
+	}
+	if err := parseFlags(fs, args, append([]string{"login"}, required...)...); err != nil {
+		return err
+	}
+	u, err := storage.GetUserByName(ctx, *login)
+	if err != nil {
+		return err
+	}
+	before := audit.UserSnapshot(u)
+	change(u, fs)
+	if err := storage.UpdateUser(ctx, u); err != nil {
+		return err
+	}
+	record(strings.Replace(name, "-", ".", 1), audit.Change{Target: audit.UserTarget(u.ID), Before: before, After: audit.UserSnapshot(u)})
+	v := toUserView(u)
+	return output(v, userHeader, [][]interface{}{userRow(v)})
+}
+
+func userDisable(args []string) error {
+	return modifyUser("user-disable", args, func(u *storage.User, fs *flag.FlagSet) { u.Disabled = true }, nil)
+}
+
+func userEnable(args []string) error {
+	return modifyUser("user-enable", args, func(u *storage.User, fs *flag.FlagSet) { u.Disabled = false }, nil)
+}
+
+func userVerifyEmail(args []string) error {
+	return modifyUser("user-verify-email", args, func(u *storage.User, fs *flag.FlagSet) { u.EmailVerified = true }, nil)
+}
+
+func userPassword(args []string) error {
+	var password *string
+	return modifyUser("user-password", args,
+		func(u *storage.User, fs *flag.FlagSet) { u.PasswordHash = passwordHash(*password) },
+		func(fs *flag.FlagSet) { password = fs.String("password", "", "new password") },
+		"password")
+}
+
+func userAdmin(args []string) error {
+	var revoke *bool
+	return modifyUser("user-admin", args,
+		func(u *storage.User, fs *flag.FlagSet) { u.IsAdmin = !*revoke },
+		func(fs *flag.FlagSet) {
+			revoke = fs.Bool("revoke", false, "revoke admin privileges instead of granting")
+		})
+}
+
+// userTwoFactorReset turns second factor off and drops recovery codes,
+// user may enroll again on next login
+func userTwoFactorReset(args []string) error {
+	fs := flag.NewFlagSet("user-2fa-reset", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	if err := parseFlags(fs, args, "login"); err != nil {
+		return err
+	}
+	u, err := storage.GetUserByName(ctx, *login)
+	if err != nil {
+		return err
+	}
+	before := audit.UserSnapshot(u)
+	u.TOTPSecret, u.TOTPEnabled, u.TOTPLastStep = "", false, 0
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackTransaction(tx)
+	if err := storage.UpdateUserTx(tx, u); err != nil {
+		return err
+	}
+	if err := storage.ReplaceRecoveryCodesTx(tx, u.ID, nil); err != nil {
+		return err
+	}
+	if err := storage.CommitTransaction(tx); err != nil {
+		return err
+	}
+	record("user.2fa_reset", audit.Change{Target: audit.UserTarget(u.ID), Before: before, After: audit.UserSnapshot(u)})
+	v := toUserView(u)
+	return output(v, userHeader, [][]interface{}{userRow(v)})
+}
+
+var taskHeader = []string{"ID", "TITLE", "CUSTOMER", "EXECUTOR", "STATE", "COST", "BEGIN", "END", "VERSION"}
+
+func taskRow(v taskView) []interface{} {
+	return []interface{}{v.ID, v.Title, v.CustomerID, v.ExecutionerID, v.State, v.Cost, v.BeginTime, v.EndTime, v.Version}
+}
+
+func taskList(args []string) error {
+	fs := flag.NewFlagSet("task-list", flag.ExitOnError)
+	state := fs.Int("state", -1, "show only tasks in this state")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var states []storage.State
+	if *state >= 0 {
+		states = append(states, storage.State(*state))
+	}
+	tasks, err := storage.GetTasks(ctx, states...)
+	if err != nil {
+		return err
+	}
+	views := make([]taskView, 0, len(tasks))
+	var rows [][]interface{}
+	for _, t := range tasks {
+		v := toTaskView(t, false)
+		views = append(views, v)
+		rows = append(rows, taskRow(v))
+	}
+	return output(views, taskHeader, rows)
+}
+
+func taskShow(args []string) error {
+	fs := flag.NewFlagSet("task-show", flag.ExitOnError)
+	id := fs.Int("id", 0, "task id")
+	if err := parseFlags(fs, args, "id"); err != nil {
+		return err
+	}
+	t, err := storage.GetTaskByID(ctx, *id)
+	if err != nil {
+		return err
+	}
+	changes, err := storage.GetTaskStateChanges(ctx, *id)
+	if err != nil {
+		return err
+	}
+	v := toTaskView(t, true)
+	if *jsonOutput {
+		changeViews := make([]stateChangeView, 0, len(changes))
+		for _, c := range changes {
+			changeViews = append(changeViews, toStateChangeView(c))
+		}
+		return output(struct {
+			taskView
+			StateChanges []stateChangeView `json:"state_changes"`
+		}{v, changeViews}, nil, nil)
+	}
+	if err := output(v, taskHeader, [][]interface{}{taskRow(v)}); err != nil {
+		return err
+	}
+	fmt.Printf("\nPROBLEM:\n%s\n\nSOLUTION:\n%s\n\n", t.Problem, t.Solution)
+	var rows [][]interface{}
+	for _, c := range changes {
+		rows = append(rows, []interface{}{c.ID, c.FromState, c.ToState, c.Reason, c.Actor, c.CreatedAt.Format(time.RFC3339)})
+	}
+	return output(nil, []string{"CHANGE", "FROM", "TO", "REASON", "ACTOR", "AT"}, rows)
+}
+
+func taskState(args []string) error {
+	fs := flag.NewFlagSet("task-state", flag.ExitOnError)
+	id := fs.Int("id", 0, "task id")
+	state := fs.Int("state", 0, "new state: 0 free, 1 executing, 2 paused, 3 completed, 4 accepted, 5 closed, 6 disputed")
+	reason := fs.String("reason", "", "why state is forced")
+	if err := parseFlags(fs, args, "id", "state", "reason"); err != nil {
+		return err
+	}
+	if *state < int(storage.StateFree) || *state > int(storage.StateDisputed) {
+		return fmt.Errorf("task-state: unknown state %d", *state)
+	}
+	if strings.TrimSpace(*reason) == "" {
+		return errors.New("task-state: reason can't be empty")
+	}
+	t, err := storage.GetTaskByID(ctx, *id)
+	if err != nil {
+		return err
+	}
+	change, err := storage.ForceTaskState(ctx, *id, storage.State(*state), *reason, *actor)
+	if err != nil {
+		return err
+	}
+	before := audit.TaskSnapshot(t)
+	t.State = change.ToState
+	record("task.force_state", audit.Change{Target: audit.TaskTarget(t.ID), Before: before, After: audit.TaskSnapshot(t)})
+	v := toStateChangeView(change)
+	return output(v, []string{"CHANGE", "TASK", "FROM", "TO", "REASON", "ACTOR", "AT"},
+		[][]interface{}{{v.ID, v.TaskID, v.FromState, v.ToState, v.Reason, v.Actor, v.CreatedAt}})
+}
+
+var movementHeader = []string{"MOVEMENT", "USER", "AMOUNT", "REASON", "ACTOR", "AT"}
+
+func movementRow(v movementView) []interface{} {
+	return []interface{}{v.ID, v.UserID, v.Amount, v.Reason, v.Actor, v.CreatedAt}
+}
+
+func balanceAdjust(args []string) error {
+	fs := flag.NewFlagSet("balance-adjust", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	amount := fs.Float64("amount", 0, "amount to add, negative to withdraw")
+	reason := fs.String("reason", "", "why balance is adjusted")
+	if err := parseFlags(fs, args, "login", "amount", "reason"); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*reason) == "" {
+		return errors.New("balance-adjust: reason can't be empty")
+	}
+	u, err := storage.GetUserByName(ctx, *login)
+	if err != nil {
+		return err
+	}
+	movement, err := storage.AdjustBalance(ctx, u.ID, currency.MoneyCtr(*amount), *reason, *actor)
+	if err != nil {
+		return err
+	}
+	if after, err := storage.GetUserByID(ctx, u.ID); err == nil {
+		record("user.balance_adjust", audit.Change{Target: audit.UserTarget(u.ID), Before: audit.UserSnapshot(u), After: audit.UserSnapshot(after)})
+	}
+	v := toMovementView(movement)
+	return output(v, movementHeader, [][]interface{}{movementRow(v)})
+}
+
+func balanceHistory(args []string) error {
+	fs := flag.NewFlagSet("balance-history", flag.ExitOnError)
+	login := fs.String("login", "", "user login, all users if empty")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var userID int
+	if *login != "" {
+		u, err := storage.GetUserByName(ctx, *login)
+		if err != nil {
+			return err
+		}
+		userID = u.ID
+	}
+	movements, err := storage.GetBalanceMovements(ctx, userID)
+	if err != nil {
+		return err
+	}
+	views := make([]movementView, 0, len(movements))
+	var rows [][]interface{}
+	for _, m := range movements {
+		v := toMovementView(m)
+		views = append(views, v)
+		rows = append(rows, movementRow(v))
+	}
+	return output(views, movementHeader, rows)
+}
+
+var apiKeyHeader = []string{"ID", "NAME", "PREFIX", "SCOPES", "CREATED", "LAST USED", "REVOKED"}
+
+func apiKeyRow(v apiKeyView) []interface{} {
+	return []interface{}{v.ID, v.Name, v.Prefix, strings.Join(v.Scopes, ","), v.CreatedAt, v.LastUsedAt, v.RevokedAt}
+}
+
+func apiKeyList(args []string) error {
+	fs := flag.NewFlagSet("apikey-list", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	if err := parseFlags(fs, args, "login"); err != nil {
+		return err
+	}
+	u, err := storage.GetUserByName(ctx, *login)
+	if err != nil {
+		return err
+	}
+	keys, err := storage.GetAPIKeys(ctx, u.ID)
+	if err != nil {
+		return err
+	}
+	views := make([]apiKeyView, 0, len(keys))
+	var rows [][]interface{}
+	for _, k := range keys {
+		v := toAPIKeyView(k)
+		views = append(views, v)
+		rows = append(rows, apiKeyRow(v))
+	}
+	return output(views, apiKeyHeader, rows)
+}
+
+func apiKeyRevoke(args []string) error {
+	fs := flag.NewFlagSet("apikey-revoke", flag.ExitOnError)
+	login := fs.String("login", "", "user login")
+	id := fs.Int("id", 0, "api key ID")
+	if err := parseFlags(fs, args, "login", "id"); err != nil {
+		return err
+	}
+	u, err := storage.GetUserByName(ctx, *login)
+	if err != nil {
+		return err
+	}
+	if err := storage.RevokeAPIKey(ctx, u.ID, *id); err != nil {
+		return err
+	}
+	record("apikey.revoke", audit.Change{
+		Target: fmt.Sprintf("apikey:%d", *id),
+		Before: map[string]interface{}{"revoked": false},
+		After:  map[string]interface{}{"revoked": true}})
+	return apiKeyList([]string{"-login", *login})
+}
+
+// export writes JSON dump without password hashes
+func export(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "", "output file, stdout if empty")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	var dump struct {
+		ExportedAt       string            `json:"exported_at"`
+		Users            []userView        `json:"users"`
+		Tasks            []taskView        `json:"tasks"`
+		BalanceMovements []movementView    `json:"balance_movements"`
+		TaskStateChanges []stateChangeView `json:"task_state_changes"`
+	}
+	dump.ExportedAt = time.Now().Format(time.RFC3339)
+	users, err := storage.GetUsers(ctx)
+	if err != nil {
+		return err
+	}
+	for _, u := range users {
+		dump.Users = append(dump.Users, toUserView(u))
+	}
+	tasks, err := storage.GetTasks(ctx)
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		dump.Tasks = append(dump.Tasks, toTaskView(t, true))
+	}
+	movements, err := storage.GetBalanceMovements(ctx, 0)
+	if err != nil {
+		return err
+	}
+	for _, m := range movements {
+		dump.BalanceMovements = append(dump.BalanceMovements, toMovementView(m))
+	}
+	changes, err := storage.GetTaskStateChanges(ctx, 0)
+	if err != nil {
+		return err
+	}
+	for _, c := range changes {
+		dump.TaskStateChanges = append(dump.TaskStateChanges, toStateChangeView(c))
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+func auditVerify(args []string) error {
+	fs := flag.NewFlagSet("audit-verify", flag.ExitOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	checked, brokenAt, err := audit.Verify(ctx)
+	if err != nil {
+		return err
+	}
+	v := struct {
+		Valid    bool `json:"valid"`
+		Checked  int  `json:"checked"`
+		BrokenAt int  `json:"broken_at"`
+	}{brokenAt == 0, checked, brokenAt}
+	if err := output(v, []string{"VALID", "CHECKED", "BROKEN AT"}, [][]interface{}{{v.Valid, v.Checked, v.BrokenAt}}); err != nil {
+		return err
+	}
+	if !v.Valid {
+		return fmt.Errorf("audit-verify: chain is broken at record %d", brokenAt)
+	}
+	return nil
+}
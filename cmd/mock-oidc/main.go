@@ -0,0 +1,42 @@
+// mock-oidc is OpenID Connect identity provider for development and manual
+// testing of single sign-on. It logs in everybody without asking: the
+// identity comes from flags and may be overridden per login by query
+// parameters sub, login, email and groups of the authorization URL.
+//
+// Usage:
+//
+//	mock-oidc [-addr :9000] [-issuer http://localhost:9000] [-sub 1] [-login staff] [-email staff@example.com] [-groups freelance-admins]
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"strings"
+
+	"../../sso/mockoidc"
+)
+
+var (
+	addr     = flag.String("addr", ":9000", "listen address")
+	issuer   = flag.String("issuer", "http://localhost:9000", "issuer URL, must be the URL the provider is reachable at")
+	clientID = flag.String("client-id", "freelance_stock", "accepted client ID")
+	sub      = flag.String("sub", "1", "subject of logged in identity")
+	login    = flag.String("login", "staff", "preferred_username claim")
+	email    = flag.String("email", "staff@example.com", "email claim, always verified")
+	groups   = flag.String("groups", "", "comma separated groups claim")
+)
+
+func main() {
+	flag.Parse()
+	identity := mockoidc.Identity{Sub: *sub, Login: *login, Email: *email}
+	if *groups != "" {
+		identity.Groups = strings.Split(*groups, ",")
+	}
+	server, err := mockoidc.New(*issuer, *clientID, identity)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("mock OIDC provider %s listening on %s", *issuer, *addr)
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"./apidoc"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// routes served outside of the API, they are not in the spec
+var undocumentedRoutes = []string{
+	"GET /metrics",
+	"GET /healthz",
+	"GET /readyz",
+	"GET /api/v1/docs",
+	"GET /api/v1/docs/*",
+}
+
+type specSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*specSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	Items                *specSchema            `json:"items"`
+	AllOf                []*specSchema          `json:"allOf"`
+	Enum                 []json.RawMessage      `json:"enum"`
+	Nullable             bool                   `json:"nullable"`
+	AdditionalProperties json.RawMessage        `json:"additionalProperties"`
+}
+
+type specResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema *specSchema `json:"schema"`
+	} `json:"content"`
+}
+
+type specOperation struct {
+	Responses map[string]*specResponse `json:"responses"`
+}
+
+type spec struct {
+	// path items also have parameters, operations are decoded by operation
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Schemas   map[string]*specSchema   `json:"schemas"`
+		Responses map[string]*specResponse `json:"responses"`
+	} `json:"components"`
+}
+
+func loadSpec(t *testing.T) *spec {
+	var s spec
+	if err := json.Unmarshal(apidoc.Spec, &s); err != nil {
+		t.Fatalf("can't parse apidoc/openapi.json: %v", err)
+	}
+	return &s
+}
+
+// testServer serves routes without middleware touching storage, JSON bodies
+// and API keys are handled as in newServer
+func testServer() *echo.Echo {
+	e := echo.New()
+	e.Use(jsonFormMiddleware)
+	e.Use(apiKeyMiddleware)
+	addRoutes(e)
+	return e
+}
+
+var pathParam = regexp.MustCompile(`:([a-z_]+)`)
+
+// specPath converts echo route path to OpenAPI path
+func specPath(path string) string {
+	return pathParam.ReplaceAllString(path, "{$1}")
+}
+
+func TestRoutesMatchSpec(t *testing.T) {
+	s := loadSpec(t)
+	served := map[string]bool{}
+	for _, r := range testServer().Routes() {
+		route := r.Method + " " + specPath(r.Path)
+		if !contains(undocumentedRoutes, route) {
+			served[route] = true
+		}
+	}
+	documented := map[string]bool{}
+	for path, ops := range s.Paths {
+		for method := range ops {
+			switch method {
+			case "get", "post", "put", "patch", "delete":
+				documented[strings.ToUpper(method)+" "+path] = true
+			}
+		}
+	}
+	var missing, stale []string
+	for route := range served {
+		if !documented[route] {
+			missing = append(missing, route)
+		}
+	}
+	for route := range documented {
+		if !served[route] {
+			stale = append(stale, route)
+		}
+	}
+	sort.Strings(missing)
+	sort.Strings(stale)
+	for _, route := range missing {
+		t.Errorf("route %s is not in apidoc/openapi.json", route)
+	}
+	for _, route := range stale {
+		t.Errorf("apidoc/openapi.json documents %s which is not served", route)
+	}
+}
+
+// checkSchema reports where value doesn't match schema. Objects may have
+// only properties listed in schema, so new fields of answers must be
+// documented too
+func checkSchema(s *spec, schema *specSchema, value interface{}, at string) []string {
+	if schema.Ref != "" {
+		return checkSchema(s, s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")], value, at)
+	}
+	if len(schema.AllOf) > 0 {
+		merged := &specSchema{Type: "object", Properties: map[string]*specSchema{}}
+		for _, part := range schema.AllOf {
+			for part.Ref != "" {
+				part = s.Components.Schemas[strings.TrimPrefix(part.Ref, "#/components/schemas/")]
+			}
+			for name, prop := range part.Properties {
+				merged.Properties[name] = prop
+			}
+			merged.Required = append(merged.Required, part.Required...)
+		}
+		return checkSchema(s, merged, value, at)
+	}
+	if value == nil {
+		if schema.Nullable {
+			return nil
+		}
+		return []string{at + ": is null"}
+	}
+	if len(schema.Enum) > 0 {
+		raw, _ := json.Marshal(value)
+		found := false
+		for _, e := range schema.Enum {
+			found = found || bytes.Equal(bytes.TrimSpace(e), raw)
+		}
+		if !found {
+			return []string{fmt.Sprintf("%s: %s is not in enum", at, raw)}
+		}
+	}
+	var problems []string
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return []string{at + ": is not object"}
+		}
+		for _, name := range schema.Required {
+			if _, ok := obj[name]; !ok {
+				problems = append(problems, at+"."+name+": is required")
+			}
+		}
+		for name, val := range obj {
+			prop, ok := schema.Properties[name]
+			if !ok {
+				if len(schema.AdditionalProperties) == 0 || string(schema.AdditionalProperties) == "false" {
+					problems = append(problems, at+"."+name+": is not documented")
+				}
+				continue
+			}
+			problems = append(problems, checkSchema(s, prop, val, at+"."+name)...)
+		}
+	case "array":
+		arr, ok := value.([]interface{})
+		if !ok {
+			return []string{at + ": is not array"}
+		}
+		for i, item := range arr {
+			problems = append(problems, checkSchema(s, schema.Items, item, fmt.Sprintf("%s[%d]", at, i))...)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			problems = append(problems, at+": is not string")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			problems = append(problems, at+": is not boolean")
+		}
+	case "integer":
+		if n, ok := value.(json.Number); !ok || strings.ContainsAny(n.String(), ".eE") {
+			problems = append(problems, at+": is not integer")
+		}
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			problems = append(problems, at+": is not number")
+		}
+	}
+	return problems
+}
+
+func checkJSON(t *testing.T, s *spec, schema *specSchema, body []byte) {
+	t.Helper()
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("answer %q is not JSON: %v", body, err)
+	}
+	for _, problem := range checkSchema(s, schema, value, "answer") {
+		t.Error(problem)
+	}
+}
+
+// responseOf returns documented response of operation for status
+func responseOf(s *spec, path, method string, status int) *specResponse {
+	raw, ok := s.Paths[path][strings.ToLower(method)]
+	if !ok {
+		return nil
+	}
+	var op specOperation
+	if err := json.Unmarshal(raw, &op); err != nil {
+		return nil
+	}
+	resp := op.Responses[fmt.Sprint(status)]
+	if resp == nil {
+		resp = op.Responses["default"]
+	}
+	if resp != nil && resp.Ref != "" {
+		resp = s.Components.Responses[strings.TrimPrefix(resp.Ref, "#/components/responses/")]
+	}
+	return resp
+}
+
+// Answers given before storage is touched: validation errors and missing
+// authorization
+func TestResponsesMatchSpec(t *testing.T) {
+	s := loadSpec(t)
+	e := testServer()
+	tests := []struct {
+		method string
+		path   string // OpenAPI path the request is routed to
+		target string
+		body   string
+		status int
+	}{
+		{"POST", "/api/v1/login", "/api/v1/login", `{}`, http.StatusUnprocessableEntity},
+		{"POST", "/api/v1/register", "/api/v1/register", `{"user_name": "nurbek", "password": "short", "email": "x"}`, http.StatusUnprocessableEntity},
+		{"POST", "/api/v1/password/reset", "/api/v1/password/reset", `{"token": "t"}`, http.StatusUnprocessableEntity},
+		{"POST", "/api/v1/tasks", "/api/v1/tasks", `{"title": "logo", "cost": -1}`, http.StatusUnauthorized},
+		{"GET", "/api/v1/tasks", "/api/v1/tasks?limit=0", "", http.StatusUnprocessableEntity},
+		{"GET", "/api/v1/tasks", "/api/v1/tasks", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/tasks/recommended", "/api/v1/tasks/recommended?limit=101", "", http.StatusUnprocessableEntity},
+		{"GET", "/api/v1/tasks/{task_id}", "/api/v1/tasks/1", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/categories", "/api/v1/categories", `{}`, http.StatusUnprocessableEntity},
+		{"GET", "/api/v1/users/{slug}", "/api/v1/users/nurbek", "", http.StatusUnauthorized},
+		{"POST", "/api/v1/users/{slug}/webhooks", "/api/v1/users/nurbek/webhooks", `{"url": "ftp://x", "events": "task.created"}`, http.StatusUnprocessableEntity},
+		{"POST", "/api/v1/tasks/{task_id}/reviews", "/api/v1/tasks/1/reviews", `{"rating": 6}`, http.StatusUnprocessableEntity},
+		{"GET", "/api/v1/audit", "/api/v1/audit?limit=1001", "", http.StatusUnauthorized},
+		{"GET", "/api/v1/openapi.json", "/api/v1/openapi.json", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body.String())
+			}
+			resp := responseOf(s, tt.path, tt.method, rec.Code)
+			if resp == nil {
+				t.Fatalf("status %d is not documented", rec.Code)
+			}
+			media, ok := resp.Content["application/json"]
+			if !ok {
+				if rec.Body.Len() > 0 {
+					t.Errorf("documented without body, got %q", rec.Body.String())
+				}
+				return
+			}
+			if media.Schema != nil && tt.path != "/api/v1/openapi.json" {
+				checkJSON(t, s, media.Schema, rec.Body.Bytes())
+			}
+		})
+	}
+}
+
+// Views are what handlers answer with, samples have every optional field set
+func TestViewsMatchSchemas(t *testing.T) {
+	s := loadSpec(t)
+	now := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	customer := &storage.User{ID: 1, UserName: "customer"}
+	task := &storage.Task{ID: 5, Title: "logo", CustomerID: 1, ExecutionerID: 2, State: storage.StateCompleted, Cost: storage.Task{}.Cost,
+		CategoryID: 3, Tags: []string{"design"}, Problem: "draw", Solution: "done", Version: 4}
+	task.Cost.SetVal(9.5)
+	c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+	tests := []struct {
+		schema string
+		view   interface{}
+	}{
+		{"Task", toTaskView(c, customer, task)},
+		{"Task", toTaskView(c, &storage.User{ID: 2}, task)},
+		{"Category", categoryView{ID: 3, ParentID: 1, Name: "Logos", Path: "Design / Logos"}},
+		{"APIKey", toAPIKeyView(&storage.APIKey{ID: 1, Name: "ci", Prefix: "fsk_1a2b3c4d", Scopes: []string{scopeRead}, CreatedAt: now, LastUsedAt: now, RevokedAt: now})},
+		{"Attachment", toAttachmentView(&storage.Attachment{ID: 1, Kind: storage.AttachmentProblem, FileName: "a.png", ContentType: "image/png", Size: 10, SHA256: "ab", UploaderID: 1, CreatedAt: now})},
+		{"TaskDispute", toTaskDisputeView(&storage.TaskDispute{ID: 1, OpenedBy: 1, Reason: "r", OpenedAt: now, ResolvedBy: 3,
+			Resolution: storage.ResolutionAccept, ResolutionReason: "ok", ResolvedAt: now})},
+		{"Lockout", lockoutView{Name: "login:nurbek", Failures: 5, LastFailure: "2024-03-01 10:00:00", LockedUntil: "2024-03-01 10:01:00", Locked: true}},
+		{"TaskMessage", toTaskMessageView(&storage.TaskMessage{ID: 2, ReplyTo: 1, AuthorID: 1, Author: "customer", Body: "", CreatedAt: now, EditedAt: now,
+			DeletedAt: now, DeletedBy: 3, DeleteReason: "spam"})},
+		{"Notification", toNotificationView(&storage.Notification{ID: 1, Kind: storage.NotificationTaskAccepted, TaskID: 5, Message: "m", CreatedAt: now, ReadAt: now})},
+		{"NotificationPreference", notificationPreferenceView{Kind: storage.NotificationTaskAccepted, Channel: "email", Enabled: true}},
+		{"PortfolioLink", portfolioLinkView{ID: 1, Title: "site", URL: "https://example.com"}},
+		{"TaskReview", taskReviewView{ID: 1, TaskID: 5, AuthorID: 1, Author: "customer", TargetID: 2, Rating: 5, Body: "good",
+			CreatedAt: "2024-03-01 10:00:00", Hidden: true, HideReason: "abuse"}},
+		{"Reputation", reputationView{Score: 4.5, Average: 4, Ratings: 2}},
+		{"Identity", identityView{ID: 1, Issuer: "https://idp", Subject: "s", Email: "n@example.com", CreatedAt: "2024-03-01 10:00:00", LastLoginAt: "2024-03-01 10:00:00"}},
+		{"Webhook", toWebhookView(&storage.Webhook{ID: 1, URL: "https://example.com/hook", Events: []string{"task.created"}, CreatedAt: now})},
+		{"WebhookDelivery", toWebhookDeliveryView(&storage.WebhookDelivery{ID: 1, EventID: 2, Status: storage.DeliveryPending, Attempts: 1,
+			NextAttemptAt: now, LastStatus: 500, LastError: "e", CreatedAt: now, DeliveredAt: now})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			if s.Components.Schemas[tt.schema] == nil {
+				t.Fatalf("schema %s is not in spec", tt.schema)
+			}
+			body, err := json.Marshal(tt.view)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkJSON(t, s, &specSchema{Ref: "#/components/schemas/" + tt.schema}, body)
+		})
+	}
+}
+
+func TestSpecRequestsMatchDTOs(t *testing.T) {
+	s := loadSpec(t)
+	tests := []struct {
+		schema string
+		dto    interface{}
+	}{
+		{"LoginRequest", loginRequest{}},
+		{"RegisterRequest", registerRequest{}},
+		{"UserCreateRequest", userCreateRequest{}},
+		{"UserUpdateRequest", userUpdateRequest{}},
+		{"TaskCreateRequest", taskCreateRequest{}},
+		{"TaskUpdateRequest", taskUpdateRequest{}},
+		{"CategoryCreateRequest", categoryCreateRequest{}},
+		{"TaskReviewRequest", taskReviewRequest{}},
+		{"WebhookCreateRequest", webhookCreateRequest{}},
+		{"APIKeyCreateRequest", apiKeyCreateRequest{}},
+		{"ProfileUpdateRequest", profileUpdateRequest{}},
+		{"PortfolioLinkRequest", portfolioLinkRequest{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.schema, func(t *testing.T) {
+			schema := s.Components.Schemas[tt.schema]
+			if schema == nil {
+				t.Fatalf("schema %s is not in spec", tt.schema)
+			}
+			fields := formFields(tt.dto)
+			for name, required := range fields {
+				if schema.Properties[name] == nil {
+					t.Errorf("field %s is not documented", name)
+				}
+				if required && !contains(schema.Required, name) {
+					t.Errorf("field %s is required but not documented so", name)
+				}
+			}
+			for name := range schema.Properties {
+				if _, ok := fields[name]; !ok {
+					t.Errorf("documented field %s is not read", name)
+				}
+			}
+		})
+	}
+}
+
+// formFields returns form names of dto fields and if they are required
+func formFields(dto interface{}) map[string]bool {
+	fields := map[string]bool{}
+	errs, _ := validate.Bind(context.Background(), func(name string) (string, bool) {
+		fields[name] = false
+		return "", false
+	}, reflect.New(reflect.TypeOf(dto)).Interface())
+	for _, e := range errs {
+		if e.Message == "is required" {
+			fields[e.Field] = true
+		}
+	}
+	return fields
+}
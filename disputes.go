@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"./audit"
+	"./metrics"
+	"./storage"
+	"./validate"
+	"./webhooks"
+	"github.com/labstack/echo"
+)
+
+type taskDisputeView struct {
+	ID               int    `json:"id"`
+	OpenedBy         int    `json:"opened_by"`
+	Reason           string `json:"reason"`
+	OpenedAt         string `json:"opened_at"`
+	ResolvedBy       int    `json:"resolved_by,omitempty"`
+	Resolution       string `json:"resolution,omitempty"`
+	ResolutionReason string `json:"resolution_reason,omitempty"`
+	ResolvedAt       string `json:"resolved_at,omitempty"`
+}
+
+func toTaskDisputeView(d *storage.TaskDispute) taskDisputeView {
+	v := taskDisputeView{
+		ID:               d.ID,
+		OpenedBy:         d.OpenedBy,
+		Reason:           d.Reason,
+		OpenedAt:         d.OpenedAt.Format(validate.TimeLayout),
+		ResolvedBy:       d.ResolvedBy,
+		Resolution:       d.Resolution,
+		ResolutionReason: d.ResolutionReason}
+	if !d.ResolvedAt.IsZero() {
+		v.ResolvedAt = d.ResolvedAt.Format(validate.TimeLayout)
+	}
+	return v
+}
+
+// taskDisputesHandlerGet lists disputes of task, oldest first. Customer,
+// executor or admin
+func taskDisputesHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	if t.CustomerID != u.ID && t.ExecutionerID != u.ID && !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "only customer, executor of task and admins can see its disputes", "error_code": 3}`))
+	}
+	disputes, err := storage.GetTaskDisputes(c.Request().Context(), t.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]taskDisputeView, 0, len(disputes))
+	for _, d := range disputes {
+		views = append(views, toTaskDisputeView(d))
+	}
+	answer, _ := json.Marshal(struct {
+		Disputes  []taskDisputeView `json:"disputes"`
+		ErrorCode int               `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// taskDisputeResolveHandler decides open dispute of task: accept pays
+// executor as if customer accepted the solution, rework returns task to
+// executor. Admin only
+func taskDisputeResolveHandler(c echo.Context) error {
+	var req disputeResolveRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to resolve disputes", "error_code": 125}`))
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	if !ifMatch(c, t.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	ctx := c.Request().Context()
+	d, err := storage.GetOpenTaskDispute(ctx, t.ID)
+	if errors.Is(err, storage.ErrNotFound) || err == nil && t.State != storage.StateDisputed {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "task has no open dispute", "error_code": 220}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.SetAction(c, "task.dispute.resolve")
+	before := audit.TaskSnapshot(t)
+	d.ResolvedBy = u.ID
+	d.Resolution = req.Resolution
+	d.ResolutionReason = req.Reason
+	d.ResolvedAt = time.Now().Truncate(time.Second)
+
+	var users []*storage.User
+	var usersBefore []map[string]interface{}
+	var message string
+	if req.Resolution == storage.ResolutionAccept {
+		customer, err := storage.GetUserByID(ctx, t.CustomerID)
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		executioner, err := storage.GetUserByID(ctx, t.ExecutionerID)
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		users = []*storage.User{customer, executioner}
+		usersBefore = []map[string]interface{}{audit.UserSnapshot(customer), audit.UserSnapshot(executioner)}
+		releasePayment(customer, executioner, t.Cost)
+		t.State = storage.StateAccepted
+		t.AcceptTime = time.Now()
+		message = fmt.Sprintf("Dispute of task %q is resolved, the solution is accepted and %.2f is paid: %s", t.Title, t.Cost.GetVal(), quote(req.Reason))
+	} else {
+		t.State = storage.StateExecuting
+		message = fmt.Sprintf("Dispute of task %q is resolved, the solution goes back to rework: %s", t.Title, quote(req.Reason))
+	}
+	notes := []*storage.Notification{
+		taskNotification(t.CustomerID, storage.NotificationDisputeResolved, t, message),
+		taskNotification(t.ExecutionerID, storage.NotificationDisputeResolved, t, message)}
+	err = updateInTransaction(ctx, []*storage.Task{t}, users, webhooks.TaskDisputeResolved, notes, func(tx *storage.Tx) error {
+		return storage.ResolveTaskDisputeTx(tx, d)
+	})
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+	for i, user := range users {
+		audit.AddChange(c, audit.UserTarget(user.ID), usersBefore[i], audit.UserSnapshot(user))
+	}
+	if req.Resolution == storage.ResolutionAccept {
+		metrics.MoneyMoved.WithLabelValues("paid").Add(t.Cost.GetVal())
+	}
+	answer := fmt.Sprintf(`{"error_message": "dispute resolved", "error_code": 0, "state": %d}`, t.State)
+	return c.JSONBlob(http.StatusOK, []byte(answer))
+}
@@ -1,404 +1,1370 @@
-package main
-
-import (
-	"crypto/md5"
-	"net/http"
-	"strconv"
-	"time"
-
-	"./currency"
-	"./storage"
-	"github.com/labstack/echo"
-	"github.com/labstack/echo/middleware"
-
-	"fmt"
-)
-
-func main() {
-	// Echo instance
-	e := echo.New()
-
-	// Middleware
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-
-	// Routes
-	e.POST("/api/v1/login", loginHandler)
-	e.GET("/api/v1/users/:slug", usersHandlerGet)
-	e.POST("/api/v1/users", usersHandlerCreate)
-	e.PUT("/api/v1/users/:slug", usersHandlerUpdate)
-	e.DELETE("/api/v1/users/:slug", usersHandlerDelete)
-
-	e.GET("/api/v1/tasks/:task_id", tasksHandlerGet)
-	e.GET("/api/v1/tasks", tasksHandlerGet)
-	e.POST("/api/v1/tasks", tasksHandlerCreate)
-	e.PUT("/api/v1/tasks/:task_id", tasksHandlerUpdate)
-	e.DELETE("/api/v1/tasks/:task_id", tasksHandlerDelete)
-
-	e.POST("/api/v1/tasks/:task_id/:command", taskCommandHandler)
-
-	// Start server
-	e.Logger.Fatal(e.Start(":8000"))
-
-}
-
-func loginHandler(c echo.Context) error {
-	username := c.FormValue("login")
-	password := c.FormValue("password")
-
-	_, token, errorCode := storage.Login(username, password)
-	var answer string
-	var status = http.StatusUnauthorized
-	switch errorCode {
-	case 0:
-		answer = fmt.Sprintf(`{"token": "%s", "errror_message": "OK", "error_code": 0}`, token)
-		status = http.StatusOK
-	case 1:
-		answer = `{"errror_message": "username and password doesn't match", "error_code": 1}`
-	case 2:
-		answer = `{"errror_message": "user does not registred", "error_code": 2}`
-	default:
-		answer = `{"errror_message": "unknown error", "error_code": 127}`
-	}
-	return c.JSON(status, answer)
-}
-
-func usersHandlerGet(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	userName := c.Param("slug")
-	if u.UserName == userName || u.IsAdmin {
-		answer := fmt.Sprintf(`{"login": "%s", "admin": %t, "email": "%s", "balance": %f, "error_code": 0}`, u.UserName, u.IsAdmin, u.Email, u.Balance.GetVal())
-		return c.JSON(http.StatusOK, answer)
-	}
-	return c.JSON(http.StatusNotModified, `{"error_message": "insufficient permission view user data", "error_code": 3}`)
-}
-
-func usersHandlerCreate(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	if u.IsAdmin {
-		isAdmin, err := strconv.ParseBool(c.FormValue("is_admin"))
-		if err != nil {
-			return c.JSON(http.StatusNotModified, `{"error_message": "is_admin param must be true or false", "error_code": 127}`)
-		}
-		userName := c.FormValue("user_name")
-		passwordHash := fmt.Sprintf("%x", md5.Sum([]byte(c.FormValue("password"))))
-		email := c.FormValue("email")
-
-		id, created := storage.CreateNewUser(isAdmin, userName, passwordHash, email)
-		if created {
-			answer := fmt.Sprintf(`{"id": "%d", "error_message": "new user created", "error_code": 0}`, id)
-			return c.JSON(http.StatusCreated, answer)
-		}
-		return c.JSON(http.StatusNotModified, `{"error_message": "user not created", "error_code": 127}`)
-	}
-	return c.JSON(http.StatusNotModified, `{"error_message": "insufficient permission to create new user", "error_code": 3}`)
-}
-
-func usersHandlerUpdate(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	var isAdmin bool
-	userName := c.Param("slug")
-	editingUser, isUserPresent := storage.GetUserByName(userName)
-	if !isUserPresent {
-		return c.JSON(http.StatusNotFound, `{"error_message": "user not found", "error_code": 123}`)
-	}
-	if u.IsAdmin {
-		if c.FormValue("is_admin") == "" {
-			isAdmin = editingUser.IsAdmin
-		} else if isAdminParam, err := strconv.ParseBool(c.FormValue("is_admin")); err != nil {
-			return c.JSON(http.StatusNotModified, `{"error_message": "is_admin param must be true or false", "error_code": 127}`)
-		} else {
-			isAdmin = isAdminParam
-		}
-	}
-	if u.UserName == userName || u.IsAdmin {
-		editingUser.IsAdmin = isAdmin
-		if password := c.FormValue("password"); password != "" {
-			editingUser.PasswordHash = fmt.Sprintf("%x", md5.Sum([]byte(password)))
-		}
-		if email := c.FormValue("email"); email != "" {
-			editingUser.Email = email
-		}
-		if balanceStr := c.FormValue("balance"); balanceStr != "" {
-			balance, err := strconv.ParseFloat(balanceStr, 64)
-			if err != nil {
-				return c.JSON(http.StatusNotModified, `{"error_message": "balance param must be in float number format", "error_code": 127}`)
-			}
-			editingUser.Balance.SetVal(balance)
-		}
-		if frozenStr := c.FormValue("frozen_amount"); frozenStr != "" {
-			frozenAmount, err := strconv.ParseFloat(frozenStr, 64)
-			if err != nil {
-				return c.JSON(http.StatusNotModified, `{"error_message": "frozen_amount param must be in float number format", "error_code": 127}`)
-			}
-			editingUser.FrozenAmount.SetVal(frozenAmount)
-		}
-		storage.UpdateUser(editingUser)
-		return c.JSON(http.StatusOK, `{"error_message": "user updated", "error_code": 0}`)
-	}
-	return c.JSON(http.StatusNotModified, `{"error_message": "insufficient permission to create new user", "error_code": 3}`)
-}
-
-func usersHandlerDelete(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	if !u.IsAdmin {
-		return c.JSON(http.StatusOK, `{"error_message": "insufficient privileges to delete user", "error_code": 125}`)
-	}
-	userName := c.Param("slug")
-	editingUser, isUserPresent := storage.GetUserByName(userName)
-	if !isUserPresent {
-		return c.JSON(http.StatusNotFound, `{"error_message": "user not found", "error_code": 122}`)
-	}
-	if u.UserName == editingUser.UserName {
-		return c.JSON(http.StatusNotModified, `{"error_message": "user can't delete himself", "error_code": 125}`)
-	}
-	if storage.DeleteUser(editingUser.ID) {
-		return c.JSON(http.StatusOK, `{"error_message": "user deleted", "error_code": 0}`)
-	}
-	return c.JSON(http.StatusNotModified, `{"error_message": "user not deleted", "error_code": 127}`)
-}
-
-func tasksHandlerGet(c echo.Context) error {
-	/*u*/ _, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	if c.Param("task_id") == "" {
-		//return all tasks exept closed ones
-	}
-	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, `{"error_message": "task_id must be integer type", "error_code": 10}`)
-	}
-	task, isTaskPresent := storage.GetTaskByID(int(taskID))
-	if !isTaskPresent {
-		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
-		return c.JSON(http.StatusNotFound, answer)
-	}
-	answer := fmt.Sprintf(`{"id": %d, "title": "%s", "customer_id": %d, "executioner_id": %d, "state": %d, "cost": %f}`,
-		task.ID,
-		task.Title,
-		task.CustomerID,
-		task.ExecutionerID,
-		task.State,
-		task.Cost.GetVal())
-	return c.JSON(http.StatusOK, answer)
-}
-
-func tasksHandlerCreate(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	title := c.FormValue("title")
-	cost, err := strconv.ParseFloat(c.FormValue("cost"), 64)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, `{"error_message": "parameter cost must be in float number format", "error_code": 20}`)
-	}
-	problem := c.FormValue("problem")
-	taskID, _ := storage.CreateNewTask(u.ID, title, currency.MoneyCtr(cost), problem)
-	answer := fmt.Sprintf(`{"error_message": "task with id=%d has been created", "error_code": 0}`, taskID)
-	return c.JSON(http.StatusBadRequest, answer)
-}
-
-func tasksHandlerUpdate(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, `{"error_message": "task_id must be integer type", "error_code": 10}`)
-	}
-	t, isTaskPresent := storage.GetTaskByID(int(taskID))
-	if !isTaskPresent {
-		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
-		return c.JSON(http.StatusNotFound, answer)
-	}
-	if u.IsAdmin {
-		// full control
-		if customerID := c.FormValue("customer_id"); customerID != "" {
-			cID, _ := strconv.ParseInt(customerID, 10, 64)
-			t.CustomerID = int(cID)
-		}
-		if executionerID := c.FormValue("executor_id"); executionerID != "" {
-			eID, _ := strconv.ParseInt(executionerID, 10, 64)
-			t.ExecutionerID = int(eID)
-		}
-		if title := c.FormValue("title"); title != "" {
-			t.Title = title
-		}
-		if stateStr := c.FormValue("state"); stateStr != "" {
-			state, _ := strconv.ParseInt(stateStr, 10, 64)
-			t.ExecutionerID = int(state)
-		}
-		if costStr := c.FormValue("cost"); costStr != "" {
-			cost, err := strconv.ParseFloat(costStr, 64)
-			if err != nil {
-				return c.JSON(http.StatusNotModified, `{"error_message": "cost param must be in float number format", "error_code": 127}`)
-			}
-			t.Cost.SetVal(cost)
-		}
-		if problem := c.FormValue("problem"); problem != "" {
-			t.Problem = problem
-		}
-		if solution := c.FormValue("solution"); solution != "" {
-			t.Solution = solution
-		}
-		if beginTimeStr := c.FormValue("begin_time"); beginTimeStr != "" {
-			t.BeginTime, err = time.Parse("2006-01-02 15:04:05", beginTimeStr)
-			if err != nil {
-				return c.JSON(http.StatusNotModified, `{"error_message": "begin_time must be like 2006-01-02 15:04:05", "error_code": 120}`)
-			}
-		}
-		if endTimeStr := c.FormValue("end_time"); endTimeStr != "" {
-			t.EndTime, err = time.Parse("2006-01-02 15:04:05", endTimeStr)
-			if err != nil {
-				return c.JSON(http.StatusNotModified, `{"error_message": "end_time must be like 2006-01-02 15:04:05", "error_code": 121}`)
-			}
-		}
-	} // if u.IsAdmin
-	if u.ID == t.CustomerID {
-		// partial control
-		if title := c.FormValue("title"); title != "" {
-			t.Title = title
-		}
-		if t.State == storage.StateFree {
-			if costStr := c.FormValue("cost"); costStr != "" {
-				cost, err := strconv.ParseFloat(costStr, 64)
-				if err != nil {
-					return c.JSON(http.StatusNotModified, `{"error_message": "cost param must be in float number format", "error_code": 127}`)
-				}
-				t.Cost.SetVal(cost)
-			}
-			if problem := c.FormValue("problem"); problem != "" {
-				t.Problem = problem
-			}
-		}
-	} // u.ID == t.CustomerID
-	storage.UpdateTask(t)
-	answer := fmt.Sprintf(`{"error_message": "task with id=%d has been updated", "error_code": 0}`, t.ID)
-	return c.JSON(http.StatusOK, answer)
-}
-
-func tasksHandlerDelete(c echo.Context) error {
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, `{"error_message": "task_id must be integer type", "error_code": 10}`)
-	}
-	t, isTaskPresent := storage.GetTaskByID(int(taskID))
-	if !isTaskPresent {
-		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
-		return c.JSON(http.StatusNotFound, answer)
-	}
-	if !u.IsAdmin || u.ID != t.CustomerID {
-		return c.JSON(http.StatusNotModified, `{"error_message": "insufficient privileges to delete task", "error_code": 125}`)
-	}
-	if t.State != storage.StateFree && !u.IsAdmin {
-		return c.JSON(http.StatusNotModified, `{"error_message": "only tasks with status free(0) can be deleted", "error_code": 115}`)
-	}
-	if storage.DeleteTask(int(taskID)) {
-		return c.JSON(http.StatusOK, `{"error_message": "task deleted", "error_code": 0}`)
-	}
-	return c.JSON(http.StatusNotModified, `{"error_message": "task not deleted", "error_code": 64}`)
-}
-
-func taskCommandHandler(c echo.Context) error {
-	// allowed commands: acquire, finish, accept, close
-	u, isAuthorized := storage.Auth(c.Request())
-	if !isAuthorized {
-		return c.String(http.StatusUnauthorized, "")
-	}
-	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
-	if err != nil {
-		return c.JSON(http.StatusBadRequest, `{"error_message": "task_id must be integer type", "error_code": 10}`)
-	}
-	t, isTaskPresent := storage.GetTaskByID(int(taskID))
-	if !isTaskPresent {
-		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
-		return c.JSON(http.StatusNotFound, answer)
-	}
-
-	command := c.Param("command")
-
-	switch command {
-	case "acquire":
-		if t.State != storage.StateFree {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not in free status", "error_code": 32}`)
-		}
-		activeAmount := u.Balance
-		activeAmount.Sub(u.FrozenAmount)
-		if t.Cost.IsGreaterThan(activeAmount) {
-			return c.JSON(http.StatusNotModified, `{"error_message": "isufficient amout of money on users account", "error_code": 33}`)
-		}
-		u.FrozenAmount.Add(t.Cost)
-		t.State = storage.StateExecuting
-		t.ExecutionerID = u.ID
-		t.BeginTime = time.Now()
-
-		tx := storage.BeginTransaction()
-		storage.UpdateTask(t)
-		storage.UpdateUser(u)
-		storage.CommitTransaction(tx)
-
-		return c.JSON(http.StatusOK, `{"error_message": "task acquired", "error_code": 0}`)
-	case "finish":
-		if t.ExecutionerID != u.ID {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not acquired previously by user", "error_code": 34}`)
-		}
-		if t.State != storage.StateExecuting {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not in executing status", "error_code": 35}`)
-		}
-		t.State = storage.StateCompleted
-		t.Solution = c.FormValue("solution")
-		t.EndTime = time.Now()
-		storage.UpdateTask(t)
-		return c.JSON(http.StatusOK, `{"error_message": "task finished", "error_code": 0}`)
-	case "accept":
-		if t.CustomerID != u.ID {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not created by this user", "error_code": 36}`)
-		}
-		if t.State != storage.StateCompleted {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not in completed status", "error_code": 37}`)
-		}
-		t.State = storage.StateAccepted
-		executioner, _ := storage.GetUserByID(t.ExecutionerID)
-		executioner.Balance.Add(t.Cost)
-		u.Balance.Sub(t.Cost)
-		u.FrozenAmount.Sub(t.Cost)
-
-		tx := storage.BeginTransaction()
-		storage.UpdateTask(t)
-		storage.UpdateUser(u)
-		storage.UpdateUser(executioner)
-		storage.CommitTransaction(tx)
-
-		return c.JSON(http.StatusOK, `{"error_message": "task accepted", "error_code": 0}`)
-	case "close":
-		if t.CustomerID != u.ID {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not created by this user", "error_code": 46}`)
-		}
-		if t.State != storage.StateFree {
-			return c.JSON(http.StatusNotModified, `{"error_message": "task is not in free status", "error_code": 47}`)
-		}
-		t.State = storage.StateClosed
-		return c.JSON(http.StatusOK, `{"error_message": "task successfully closed", "error_code": 0}`)
-	}
-	return c.JSON(http.StatusBadRequest, `{"error_message": "unexeptable command", "error_code": 66}`)
-}
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"./apidoc"
+	"./audit"
+	"./currency"
+	"./logging"
+	"./mailer"
+	"./metrics"
+	"./notify"
+	"./ratelimit"
+	"./storage"
+	"./tracing"
+	"./validate"
+	"./webhooks"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	swaggerFiles "github.com/swaggo/files"
+
+	"fmt"
+)
+
+// shutdownTimeout : how long in-flight requests are drained on shutdown
+const shutdownTimeout = 30 * time.Second
+
+func main() {
+	os.Exit(run())
+}
+
+// run starts server and blocks until SIGINT or SIGTERM, returns exit code
+func run() int {
+	// LOG_LEVEL is one of debug, info, warn, error
+	if err := logging.Setup(os.Stdout, os.Getenv("LOG_LEVEL")); err != nil {
+		fmt.Fprintln(os.Stderr, "LOG_LEVEL:", err)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := tracing.Setup(ctx)
+	if err != nil {
+		slog.Error("can't set up tracing", "err", err)
+		return 2
+	}
+	defer shutdownTracing(context.Background())
+
+	// DATABASE_DSN is go-sql-driver/mysql DSN, connection is retried until database is up
+	dsn := os.Getenv("DATABASE_DSN")
+	if dsn == "" {
+		dsn = storage.DefaultDSN
+	}
+	if err := storage.Open(ctx, dsn); err != nil {
+		slog.Error("can't connect to database", "err", err)
+		return 1
+	}
+	defer storage.Close()
+
+	// RATE_LIMIT_STORE is memory (default) or db when servers share limits
+	switch store := os.Getenv("RATE_LIMIT_STORE"); store {
+	case "", "memory":
+		loginLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore())
+	case "db":
+		loginLimiter = ratelimit.NewLimiter(ratelimit.DBStore{})
+	default:
+		slog.Error("unknown RATE_LIMIT_STORE", "store", store)
+		return 2
+	}
+
+	// TRUSTED_PROXIES are comma separated networks of reverse proxies,
+	// client address is taken from their X-Forwarded-For
+	proxies, err := parseProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		slog.Error("bad TRUSTED_PROXIES", "err", err)
+		return 2
+	}
+	trustedProxies = proxies
+
+	// ADMIN_2FA_REQUIRED=false lets admins log in without second factor
+	if policy := os.Getenv("ADMIN_2FA_REQUIRED"); policy != "" {
+		required, err := strconv.ParseBool(policy)
+		if err != nil {
+			slog.Error("bad ADMIN_2FA_REQUIRED", "value", policy)
+			return 2
+		}
+		adminTwoFactorRequired = required
+	}
+
+	// MAILER is log (default), file (MAIL_DIR, ./mail by default) or smtp
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "freelance_stock@localhost"
+	}
+	switch kind := os.Getenv("MAILER"); kind {
+	case "", "log":
+		mail = mailer.Log{}
+	case "file":
+		dir := os.Getenv("MAIL_DIR")
+		if dir == "" {
+			dir = "mail"
+		}
+		mail = mailer.File{Dir: dir, From: from}
+	case "smtp":
+		mail = mailer.SMTP{
+			Addr:     os.Getenv("SMTP_ADDR"),
+			From:     from,
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD")}
+	default:
+		slog.Error("unknown MAILER", "mailer", kind)
+		return 2
+	}
+	// PUBLIC_URL is address of the site in emailed links
+	if url := os.Getenv("PUBLIC_URL"); url != "" {
+		publicURL = strings.TrimSuffix(url, "/")
+	}
+	notifier = notify.NewNotifier(notify.Email{Mailer: mail, URL: publicURL})
+	// WEBHOOK_ALLOW_PRIVATE=true lets webhooks reach private networks, e.g. in development
+	allowPrivate := false
+	if allow := os.Getenv("WEBHOOK_ALLOW_PRIVATE"); allow != "" {
+		val, err := strconv.ParseBool(allow)
+		if err != nil {
+			slog.Error("bad WEBHOOK_ALLOW_PRIVATE", "value", allow)
+			return 2
+		}
+		allowPrivate = val
+	}
+	// BLOB_STORE is fs (BLOB_DIR, ./blobs by default) or s3, see README
+	if err := setupBlobStore(); err != nil {
+		slog.Error("can't set up blob store", "err", err)
+		return 2
+	}
+	// OIDC_ISSUER enables single sign-on, see README
+	if err := setupSSO(ctx); err != nil {
+		slog.Error("can't set up single sign-on", "err", err)
+		return 1
+	}
+
+	e := newServer()
+
+	var background sync.WaitGroup
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		storage.RunSessionExpirer(ctx)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		webhooks.NewDispatcher(allowPrivate).Run(ctx, 2*time.Second)
+	}()
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		notifier.Run(ctx)
+	}()
+
+	// Start server
+	exitCode := 0
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start(":8000")
+	}()
+	select {
+	case err := <-serverErr:
+		slog.Error("server stopped", "err", err)
+		exitCode = 1
+		stop()
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	}
+
+	// readiness fails while in-flight requests are drained
+	shuttingDown.Store(true)
+	// streams never end by themselves, clients reconnect to other servers
+	streamHub.Close()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		slog.Error("can't drain requests", "err", err)
+		exitCode = 1
+	}
+	background.Wait()
+	return exitCode
+}
+
+// newServer creates echo instance with middleware and routes
+func newServer() *echo.Echo {
+	// Echo instance
+	e := echo.New()
+
+	// Middleware
+	e.Pre(clientIPMiddleware)
+	e.Use(middleware.RequestID())
+	e.Use(tracing.Middleware)
+	e.Use(logging.Middleware)
+	e.Use(metrics.Middleware)
+	e.Use(audit.Middleware)
+	e.Use(logging.Recover)
+	e.Use(jsonFormMiddleware)
+	e.Use(apiKeyMiddleware)
+
+	addRoutes(e)
+	return e
+}
+
+// addRoutes registers handlers. Routes must match apidoc/openapi.json,
+// contract_test.go checks it
+func addRoutes(e *echo.Echo) {
+	e.POST("/api/v1/login", loginHandler)
+	e.POST("/api/v1/login/2fa", loginSecondFactorHandler)
+	e.POST("/api/v1/login/2fa/enroll", loginEnrollHandler)
+	e.GET("/api/v1/sso/login", ssoLoginHandler)
+	e.GET("/api/v1/sso/callback", ssoCallbackHandler)
+	e.POST("/api/v1/register", registerHandler)
+	e.POST("/api/v1/email/verify", verifyEmailHandler)
+	e.POST("/api/v1/email/verify/resend", resendVerificationHandler)
+	e.POST("/api/v1/password/forgot", forgotPasswordHandler)
+	e.POST("/api/v1/password/reset", resetPasswordHandler)
+	e.GET("/api/v1/users/:slug", usersHandlerGet)
+	e.POST("/api/v1/users", usersHandlerCreate)
+	e.PUT("/api/v1/users/:slug", usersHandlerUpdate)
+	e.PATCH("/api/v1/users/:slug", usersHandlerPatch)
+	e.DELETE("/api/v1/users/:slug", usersHandlerDelete)
+	e.POST("/api/v1/users/:slug/2fa/enroll", usersTwoFactorEnrollHandler)
+	e.POST("/api/v1/users/:slug/2fa/verify", usersTwoFactorVerifyHandler)
+	e.POST("/api/v1/users/:slug/2fa/recovery-codes", usersTwoFactorRecoveryCodesHandler)
+	e.DELETE("/api/v1/users/:slug/2fa", usersTwoFactorDeleteHandler)
+	e.GET("/api/v1/users/:slug/api-keys", apiKeysHandlerGet)
+	e.POST("/api/v1/users/:slug/api-keys", apiKeysHandlerCreate)
+	e.DELETE("/api/v1/users/:slug/api-keys/:key_id", apiKeysHandlerDelete)
+	e.POST("/api/v1/users/:slug/sso/link", ssoLinkHandler)
+	e.GET("/api/v1/users/:slug/identities", identitiesHandlerGet)
+	e.DELETE("/api/v1/users/:slug/identities/:identity_id", identitiesHandlerDelete)
+	e.GET("/api/v1/users/:slug/webhooks", webhooksHandlerGet)
+	e.POST("/api/v1/users/:slug/webhooks", webhooksHandlerCreate)
+	e.DELETE("/api/v1/users/:slug/webhooks/:webhook_id", webhooksHandlerDelete)
+	e.GET("/api/v1/users/:slug/webhooks/:webhook_id/deliveries", webhookDeliveriesHandlerGet)
+	e.POST("/api/v1/users/:slug/webhooks/:webhook_id/deliveries/:delivery_id/redeliver", webhookRedeliverHandler)
+	e.GET("/api/v1/users/:slug/notifications", notificationsHandlerGet)
+	e.POST("/api/v1/users/:slug/notifications/read", notificationsReadAllHandler)
+	e.POST("/api/v1/users/:slug/notifications/:notification_id/read", notificationReadHandler)
+	e.GET("/api/v1/users/:slug/notification-preferences", notificationPreferencesHandlerGet)
+	e.PUT("/api/v1/users/:slug/notification-preferences", notificationPreferencesHandlerUpdate)
+	e.GET("/api/v1/users/:slug/messages/unread", unreadMessagesHandlerGet)
+	e.GET("/api/v1/users/:slug/reviews", userReviewsHandlerGet)
+	e.PUT("/api/v1/users/:slug/profile", profileHandlerUpdate)
+	e.POST("/api/v1/users/:slug/portfolio", portfolioHandlerCreate)
+	e.DELETE("/api/v1/users/:slug/portfolio/:link_id", portfolioHandlerDelete)
+
+	e.GET("/api/v1/tasks/:task_id", tasksHandlerGet)
+	e.GET("/api/v1/tasks", tasksHandlerList)
+	e.GET("/api/v1/tasks/recommended", recommendedTasksHandlerGet)
+	e.GET("/api/v1/categories", categoriesHandlerGet)
+	e.POST("/api/v1/categories", categoriesHandlerCreate)
+	e.DELETE("/api/v1/categories/:category_id", categoriesHandlerDelete)
+	e.GET("/api/v1/stream", streamHandler)
+	e.POST("/api/v1/tasks", tasksHandlerCreate)
+	e.PUT("/api/v1/tasks/:task_id", tasksHandlerUpdate)
+	e.PATCH("/api/v1/tasks/:task_id", tasksHandlerPatch)
+	e.DELETE("/api/v1/tasks/:task_id", tasksHandlerDelete)
+
+	e.GET("/api/v1/tasks/:task_id/attachments", attachmentsHandlerGet)
+	e.POST("/api/v1/tasks/:task_id/attachments", attachmentsHandlerCreate)
+	e.GET("/api/v1/tasks/:task_id/attachments/:attachment_id", attachmentHandlerDownload)
+	e.DELETE("/api/v1/tasks/:task_id/attachments/:attachment_id", attachmentHandlerDelete)
+	e.GET("/api/v1/tasks/:task_id/messages", taskMessagesHandlerGet)
+	e.POST("/api/v1/tasks/:task_id/messages", taskMessagesHandlerCreate)
+	e.POST("/api/v1/tasks/:task_id/messages/read", taskMessagesReadHandler)
+	e.POST("/api/v1/tasks/:task_id/messages/lock", taskMessagesLockHandler)
+	e.DELETE("/api/v1/tasks/:task_id/messages/lock", taskMessagesUnlockHandler)
+	e.PUT("/api/v1/tasks/:task_id/messages/:message_id", taskMessageHandlerUpdate)
+	e.DELETE("/api/v1/tasks/:task_id/messages/:message_id", taskMessageHandlerDelete)
+
+	e.GET("/api/v1/tasks/:task_id/disputes", taskDisputesHandlerGet)
+	e.POST("/api/v1/tasks/:task_id/dispute/resolve", taskDisputeResolveHandler)
+
+	e.GET("/api/v1/tasks/:task_id/reviews", taskReviewsHandlerGet)
+	e.POST("/api/v1/tasks/:task_id/reviews", taskReviewsHandlerCreate)
+	e.POST("/api/v1/tasks/:task_id/reviews/:review_id/hide", taskReviewHideHandler)
+	e.DELETE("/api/v1/tasks/:task_id/reviews/:review_id/hide", taskReviewShowHandler)
+
+	e.POST("/api/v1/tasks/:task_id/:command", taskCommandHandler)
+
+	e.GET("/api/v1/audit", auditHandlerGet)
+	e.GET("/api/v1/audit/verify", auditHandlerVerify)
+
+	e.GET("/api/v1/lockouts", lockoutsHandlerGet)
+	e.DELETE("/api/v1/lockouts/:name", lockoutsHandlerDelete)
+
+	e.GET("/metrics", echo.WrapHandler(metrics.Handler()))
+	e.GET("/healthz", healthHandler)
+	e.GET("/readyz", readyHandler)
+
+	e.GET("/api/v1/openapi.json", openAPIHandler)
+	e.GET("/api/v1/docs", docsHandler)
+	e.GET("/api/v1/docs/*", echo.WrapHandler(http.StripPrefix("/api/v1/docs", http.FileServer(swaggerFiles.HTTP))))
+}
+
+func openAPIHandler(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, apidoc.Spec)
+}
+
+func docsHandler(c echo.Context) error {
+	return c.HTMLBlob(http.StatusOK, apidoc.Index)
+}
+
+func loginHandler(c echo.Context) error {
+	var req loginRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+
+	audit.SetAction(c, "user.login")
+	audit.SetActor(c, req.Login)
+	ctx := c.Request().Context()
+	account := accountLockoutName(req.Login)
+	if ok, err := allowLoginAttempt(c, account); !ok {
+		return err
+	}
+
+	user, err := storage.Authenticate(ctx, req.Login, req.Password)
+	var answer string
+	var status = http.StatusUnauthorized
+	switch {
+	case err == nil:
+		if answer = secondFactorChallenge(user); answer != "" {
+			break
+		}
+		if err := loginLimiter.Reset(ctx, account); err != nil {
+			slog.WarnContext(ctx, "can't reset login failures", "err", err)
+		}
+		answer = fmt.Sprintf(`{"token": "%s", "errror_message": "OK", "error_code": 0}`, storage.StartSession(user))
+		status = http.StatusOK
+	case errors.Is(err, storage.ErrWrongPassword), errors.Is(err, storage.ErrNotFound):
+		// the same answer for unknown user and wrong password, so logins can't be enumerated
+		if _, err := loginLimiter.Fail(ctx, account); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		metrics.LoginRejected.WithLabelValues("bad_credentials").Inc()
+		answer = `{"errror_message": "username and password doesn't match", "error_code": 1}`
+	case errors.Is(err, storage.ErrUserDisabled):
+		answer = `{"errror_message": "user is disabled", "error_code": 4}`
+	case errors.Is(err, storage.ErrEmailNotVerified):
+		answer = `{"errror_message": "email is not verified", "error_code": 10}`
+	default:
+		return storageErrorAnswer(c, err)
+	}
+	return c.JSONBlob(status, []byte(answer))
+}
+
+// usersHandlerGet returns public profile of user, with balance and
+// account settings to the user and admins
+func usersHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	userName := c.Param("slug")
+	viewedUser, err := storage.GetUserByName(c.Request().Context(), userName)
+	if errors.Is(err, storage.ErrNotFound) || err == nil && viewedUser.Disabled && !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 123}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	profile, err := profileOf(c, viewedUser)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if u.UserName != userName && !isAdmin(c, u) {
+		answer, _ := json.Marshal(struct {
+			userProfileView
+			ErrorCode int `json:"error_code"`
+		}{profile, 0})
+		return c.JSONBlob(http.StatusOK, answer)
+	}
+	c.Response().Header().Set("ETag", etag(viewedUser.Version))
+	answer, _ := json.Marshal(struct {
+		userProfileView
+		Admin         bool    `json:"admin"`
+		Email         string  `json:"email"`
+		EmailVerified bool    `json:"email_verified"`
+		Balance       float64 `json:"balance"`
+		FrozenAmount  float64 `json:"frozen_amount"`
+		TwoFactor     bool    `json:"two_factor"`
+		Version       int     `json:"version"`
+		ErrorCode     int     `json:"error_code"`
+	}{profile, viewedUser.IsAdmin, viewedUser.Email, viewedUser.EmailVerified, viewedUser.Balance.GetVal(), viewedUser.FrozenAmount.GetVal(),
+		viewedUser.TOTPEnabled, viewedUser.Version, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+func usersHandlerCreate(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if isAdmin(c, u) {
+		var req userCreateRequest
+		if ok, err := bindRequest(c, &req); !ok {
+			return err
+		}
+		passwordHash := fmt.Sprintf("%x", md5.Sum([]byte(req.Password)))
+
+		audit.SetAction(c, "user.create")
+		id, err := storage.CreateNewUser(c.Request().Context(), req.IsAdmin, req.UserName, passwordHash, req.Email)
+		if errors.Is(err, storage.ErrDuplicate) {
+			return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "user with such user_name already exists", "error_code": 124}`))
+		}
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.UserTarget(id), nil, audit.UserSnapshot(&storage.User{
+			ID:           id,
+			IsAdmin:      req.IsAdmin,
+			UserName:     req.UserName,
+			PasswordHash: passwordHash,
+			Email:        req.Email}))
+		answer := fmt.Sprintf(`{"id": "%d", "error_message": "new user created", "error_code": 0}`, id)
+		return c.JSONBlob(http.StatusCreated, []byte(answer))
+	}
+	return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "insufficient permission to create new user", "error_code": 3}`))
+}
+
+func usersHandlerUpdate(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	userName := c.Param("slug")
+	editingUser, err := storage.GetUserByName(c.Request().Context(), userName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 123}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !ifMatch(c, editingUser.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	audit.SetAction(c, "user.update")
+	if u.UserName == userName || isAdmin(c, u) {
+		before, balanceBefore := audit.UserSnapshot(editingUser), editingUser.Balance
+		var req userUpdateRequest
+		errs, err := validate.Bind(c.Request().Context(), formSource(c), &req)
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		if !isAdmin(c, u) {
+			for name, isSet := range map[string]bool{"is_admin": req.IsAdmin != nil, "balance": req.Balance != nil, "frozen_amount": req.FrozenAmount != nil} {
+				if isSet {
+					errs.Add(name, "insufficient permission to change field")
+				}
+			}
+		}
+		if len(errs) > 0 {
+			return validationErrorAnswer(c, errs)
+		}
+		verify := updateUser(editingUser, req, vouchesEmail(c, u, editingUser))
+		notes := balanceNotifications(editingUser, balanceBefore, u)
+		ctx := c.Request().Context()
+		if err := updateInTransaction(ctx, nil, []*storage.User{editingUser}, "", notes); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		if verify {
+			sendUserToken(ctx, editingUser, storage.TokenVerifyEmail)
+		}
+		audit.AddChange(c, audit.UserTarget(editingUser.ID), before, audit.UserSnapshot(editingUser))
+		return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "user updated", "error_code": 0}`))
+	}
+	return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "insufficient permission to create new user", "error_code": 3}`))
+}
+
+// usersHandlerPatch applies JSON Merge Patch to user, null clears email
+func usersHandlerPatch(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	userName := c.Param("slug")
+	if u.UserName != userName && !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient permission to edit user", "error_code": 3}`))
+	}
+	editingUser, err := storage.GetUserByName(c.Request().Context(), userName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 123}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !ifMatch(c, editingUser.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	audit.SetAction(c, "user.patch")
+	before, balanceBefore := audit.UserSnapshot(editingUser), editingUser.Balance
+	patch, err := readMergePatch(c)
+	if patch == nil {
+		return err
+	}
+
+	ctx := c.Request().Context()
+	errs, verify, err := patchUser(ctx, editingUser, patch, isAdmin(c, u), vouchesEmail(c, u, editingUser))
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if len(errs) > 0 {
+		return validationErrorAnswer(c, errs)
+	}
+
+	notes := balanceNotifications(editingUser, balanceBefore, u)
+	if err := updateInTransaction(ctx, nil, []*storage.User{editingUser}, "", notes); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if verify {
+		sendUserToken(ctx, editingUser, storage.TokenVerifyEmail)
+	}
+	audit.AddChange(c, audit.UserTarget(editingUser.ID), before, audit.UserSnapshot(editingUser))
+	c.Response().Header().Set("ETag", etag(editingUser.Version))
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "user updated", "error_code": 0}`))
+}
+
+// vouchesEmail tells if email set by u to editingUser needs no
+// verification: admins vouch for addresses they give to other users
+func vouchesEmail(c echo.Context, u, editingUser *storage.User) bool {
+	return isAdmin(c, u) && u.ID != editingUser.ID
+}
+
+// setEmail changes email of user. Changed address has to be verified
+// before the user logs in again, unless it is vouched for or cleared.
+// Returns if verification link is to be sent
+func setEmail(u *storage.User, email string, vouched bool) bool {
+	if email == u.Email {
+		return false
+	}
+	u.Email = email
+	if vouched || email == "" {
+		return false
+	}
+	u.EmailVerified = false
+	return true
+}
+
+// updateUser applies validated PUT request to user. Returns if
+// verification link is to be sent to changed email
+func updateUser(u *storage.User, req userUpdateRequest, vouched bool) bool {
+	if req.IsAdmin != nil {
+		u.IsAdmin = *req.IsAdmin
+	}
+	if req.Password != nil {
+		u.PasswordHash = fmt.Sprintf("%x", md5.Sum([]byte(*req.Password)))
+	}
+	if req.Balance != nil {
+		u.Balance.SetVal(*req.Balance)
+	}
+	if req.FrozenAmount != nil {
+		u.FrozenAmount.SetVal(*req.FrozenAmount)
+	}
+	return req.Email != nil && setEmail(u, *req.Email, vouched)
+}
+
+// patchUser applies merge patch to user, privileges and money only for
+// admin. Returns if verification link is to be sent to changed email
+func patchUser(ctx context.Context, u *storage.User, patch mergePatch, admin, vouched bool) (validate.Errors, bool, error) {
+	allowed := []string{"email", "password"}
+	if admin {
+		allowed = append(allowed, "is_admin", "balance", "frozen_amount")
+	}
+	var errs validate.Errors
+	patch.checkFields(&errs, []string{"email", "password", "is_admin", "balance", "frozen_amount"}, allowed)
+	email := u.Email
+	patch.setString(&errs, "email", &email, true)
+	var password string
+	patch.setString(&errs, "password", &password, false)
+	if _, ok := patch["password"]; ok && password == "" {
+		errs.Add("password", "can't be empty")
+	}
+	patch.setBool(&errs, "is_admin", &u.IsAdmin)
+	patch.setMoney(&errs, "balance", &u.Balance)
+	patch.setMoney(&errs, "frozen_amount", &u.FrozenAmount)
+	balance, frozenAmount := u.Balance.GetVal(), u.FrozenAmount.GetVal()
+	req := userUpdateRequest{Balance: &balance, FrozenAmount: &frozenAmount}
+	// null clears email, only given address is checked
+	if email != "" {
+		req.Email = &email
+	}
+	if password != "" {
+		req.Password = &password
+	}
+	errs, err := patch.checkRules(ctx, errs, req)
+	if err != nil || len(errs) > 0 {
+		return errs, false, err
+	}
+	if password != "" {
+		u.PasswordHash = fmt.Sprintf("%x", md5.Sum([]byte(password)))
+	}
+	return nil, setEmail(u, email, vouched), nil
+}
+
+func usersHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "insufficient privileges to delete user", "error_code": 125}`))
+	}
+	userName := c.Param("slug")
+	editingUser, err := storage.GetUserByName(c.Request().Context(), userName)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 122}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if u.UserName == editingUser.UserName {
+		return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "user can't delete himself", "error_code": 125}`))
+	}
+	if !ifMatch(c, editingUser.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	audit.SetAction(c, "user.delete")
+	err = storage.DeleteUser(c.Request().Context(), editingUser.ID, editingUser.Version)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 122}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(editingUser.ID), audit.UserSnapshot(editingUser), nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "user deleted", "error_code": 0}`))
+}
+
+type taskView struct {
+	ID              int      `json:"id"`
+	Title           string   `json:"title"`
+	CustomerID      int      `json:"customer_id"`
+	ExecutionerID   int      `json:"executioner_id"`
+	State           int      `json:"state"`
+	Cost            float64  `json:"cost"`
+	CategoryID      int      `json:"category_id"`
+	Tags            []string `json:"tags"`
+	Version         int      `json:"version"`
+	Problem         string   `json:"problem"`
+	Solution        *string  `json:"solution,omitempty"`
+	SolutionPreview string   `json:"solution_preview,omitempty"`
+	SolutionSize    int      `json:"solution_size,omitempty"`
+	SolutionSHA256  string   `json:"solution_sha256,omitempty"`
+}
+
+// canSeeSolution tells if user may get solution of task: executor and admins
+// always, customer after accepting it. Others never see it
+func canSeeSolution(c echo.Context, u *storage.User, t *storage.Task) bool {
+	if isAdmin(c, u) || t.ExecutionerID == u.ID {
+		return true
+	}
+	return t.CustomerID == u.ID && t.State == storage.StateAccepted
+}
+
+// toTaskListView shows task in lists. Solution is never there, only its
+// preview and size, it is got with the task itself
+func toTaskListView(t *storage.Task) taskView {
+	v := taskView{
+		ID:            t.ID,
+		Title:         t.Title,
+		CustomerID:    t.CustomerID,
+		ExecutionerID: t.ExecutionerID,
+		State:         int(t.State),
+		Cost:          t.Cost.GetVal(),
+		CategoryID:    t.CategoryID,
+		Tags:          t.Tags,
+		Version:       t.Version,
+		Problem:       t.Problem}
+	if v.Tags == nil {
+		v.Tags = []string{}
+	}
+	if t.Solution != "" {
+		v.SolutionPreview = t.SolutionPreview
+		v.SolutionSize = len(t.Solution)
+	}
+	return v
+}
+
+// toTaskView shows solution to those canSeeSolution allows. Others see its
+// preview and size, customer also its checksum to compare with the
+// solution they will get after accepting it. Checksum of short solution
+// is easy to reverse, so nobody else gets it
+func toTaskView(c echo.Context, u *storage.User, t *storage.Task) taskView {
+	v := toTaskListView(t)
+	switch {
+	case canSeeSolution(c, u, t):
+		v.Solution = &t.Solution
+		v.SolutionPreview, v.SolutionSize = "", 0
+	case t.CustomerID == u.ID && t.Solution != "":
+		sum := sha256.Sum256([]byte(t.Solution))
+		v.SolutionSHA256 = hex.EncodeToString(sum[:])
+	}
+	return v
+}
+
+func tasksHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
+	if err != nil {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "task_id must be integer type", "error_code": 10}`))
+	}
+	logging.SetTaskID(c, int(taskID))
+	task, err := storage.GetTaskByID(c.Request().Context(), int(taskID))
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	c.Response().Header().Set("ETag", etag(task.Version))
+	answer, _ := json.Marshal(toTaskView(c, u, task))
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+func tasksHandlerCreate(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	var req taskCreateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "task.create")
+	tx, err := storage.BeginTransaction(c.Request().Context())
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	defer storage.RollbackTransaction(tx)
+	taskID, err := storage.CreateNewTaskTx(tx, u.ID, req.Title, currency.MoneyCtr(req.Cost), req.CategoryID, req.Problem)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	t := &storage.Task{
+		ID:         taskID,
+		CustomerID: u.ID,
+		Title:      req.Title,
+		State:      storage.StateFree,
+		Cost:       currency.MoneyCtr(req.Cost),
+		CategoryID: req.CategoryID,
+		Tags:       parseTags(req.Tags),
+		Problem:    req.Problem}
+	if err := storage.SetTaskTagsTx(tx, taskID, t.Tags); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	event := newTaskEvent(webhooks.TaskCreated, t)
+	if err := storage.AddWebhookEventTx(tx, event); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if err := storage.CommitTransaction(tx); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	publishTaskEvent(event, t)
+	audit.AddChange(c, audit.TaskTarget(taskID), nil, audit.TaskSnapshot(t))
+	logging.SetTaskID(c, taskID)
+	metrics.TasksCreated.Inc()
+	answer := fmt.Sprintf(`{"error_message": "task with id=%d has been created", "error_code": 0}`, taskID)
+	return c.JSONBlob(http.StatusCreated, []byte(answer))
+}
+
+func tasksHandlerUpdate(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
+	if err != nil {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "task_id must be integer type", "error_code": 10}`))
+	}
+	logging.SetTaskID(c, int(taskID))
+	t, err := storage.GetTaskByID(c.Request().Context(), int(taskID))
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !isAdmin(c, u) && u.ID != t.CustomerID {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to edit task", "error_code": 125}`))
+	}
+	if !ifMatch(c, t.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	audit.SetAction(c, "task.update")
+	before := audit.TaskSnapshot(t)
+	var req taskUpdateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	if isAdmin(c, u) {
+		// full control
+		if req.CustomerID != nil {
+			t.CustomerID = *req.CustomerID
+		}
+		if req.ExecutionerID != nil {
+			t.ExecutionerID = *req.ExecutionerID
+		}
+		if req.Title != nil {
+			t.Title = *req.Title
+		}
+		if req.State != nil {
+			t.State = storage.State(*req.State)
+		}
+		if req.Cost != nil {
+			t.Cost.SetVal(*req.Cost)
+		}
+		if req.CategoryID != nil {
+			t.CategoryID = *req.CategoryID
+		}
+		if req.Tags != nil {
+			t.Tags = parseTags(*req.Tags)
+		}
+		if req.Problem != nil {
+			t.Problem = *req.Problem
+		}
+		if req.Solution != nil {
+			t.Solution = *req.Solution
+		}
+		if req.BeginTime != nil {
+			t.BeginTime = *req.BeginTime
+		}
+		if req.EndTime != nil {
+			t.EndTime = *req.EndTime
+		}
+	} // if isAdmin(c, u)
+	if u.ID == t.CustomerID {
+		// partial control
+		if req.Title != nil {
+			t.Title = *req.Title
+		}
+		if req.CategoryID != nil {
+			t.CategoryID = *req.CategoryID
+		}
+		if req.Tags != nil {
+			t.Tags = parseTags(*req.Tags)
+		}
+		if t.State == storage.StateFree {
+			if req.Cost != nil {
+				t.Cost.SetVal(*req.Cost)
+			}
+			if req.Problem != nil {
+				t.Problem = *req.Problem
+			}
+		}
+	} // u.ID == t.CustomerID
+	if err := saveTask(c.Request().Context(), t, req.Tags != nil); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+	answer := fmt.Sprintf(`{"error_message": "task with id=%d has been updated", "error_code": 0}`, t.ID)
+	return c.JSONBlob(http.StatusOK, []byte(answer))
+}
+
+// tasksHandlerPatch applies JSON Merge Patch to task. Admin can change any
+// field, customer can change title, and cost and problem while task is free
+func tasksHandlerPatch(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
+	if err != nil {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "task_id must be integer type", "error_code": 10}`))
+	}
+	logging.SetTaskID(c, int(taskID))
+	t, err := storage.GetTaskByID(c.Request().Context(), int(taskID))
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !isAdmin(c, u) && u.ID != t.CustomerID {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to edit task", "error_code": 125}`))
+	}
+	if !ifMatch(c, t.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	audit.SetAction(c, "task.patch")
+	before := audit.TaskSnapshot(t)
+	patch, err := readMergePatch(c)
+	if patch == nil {
+		return err
+	}
+
+	known := []string{"title", "cost", "category_id", "tags", "problem", "customer_id", "executor_id", "state", "solution", "begin_time", "end_time"}
+	var allowed []string
+	switch {
+	case isAdmin(c, u):
+		allowed = known
+	case t.State == storage.StateFree:
+		allowed = []string{"title", "cost", "category_id", "tags", "problem"}
+	default:
+		allowed = []string{"title", "category_id", "tags"}
+	}
+	var errs validate.Errors
+	patch.checkFields(&errs, known, allowed)
+	patch.setString(&errs, "title", &t.Title, false)
+	patch.setMoney(&errs, "cost", &t.Cost)
+	patch.setInt(&errs, "category_id", &t.CategoryID)
+	tags := strings.Join(t.Tags, ",")
+	patch.setString(&errs, "tags", &tags, true)
+	t.Tags = parseTags(tags)
+	patch.setString(&errs, "problem", &t.Problem, true)
+	patch.setInt(&errs, "customer_id", &t.CustomerID)
+	patch.setInt(&errs, "executor_id", &t.ExecutionerID)
+	state := int(t.State)
+	patch.setInt(&errs, "state", &state)
+	t.State = storage.State(state)
+	patch.setString(&errs, "solution", &t.Solution, true)
+	patch.setTime(&errs, "begin_time", &t.BeginTime)
+	patch.setTime(&errs, "end_time", &t.EndTime)
+	cost := t.Cost.GetVal()
+	errs, err = patch.checkRules(c.Request().Context(), errs, taskUpdateRequest{
+		CustomerID:    &t.CustomerID,
+		ExecutionerID: &t.ExecutionerID,
+		Title:         &t.Title,
+		State:         &state,
+		Cost:          &cost,
+		CategoryID:    &t.CategoryID,
+		Tags:          &tags,
+		Problem:       &t.Problem,
+		Solution:      &t.Solution})
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if len(errs) > 0 {
+		return validationErrorAnswer(c, errs)
+	}
+
+	_, tagsChanged := patch["tags"]
+	if err := saveTask(c.Request().Context(), t, tagsChanged); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+	c.Response().Header().Set("ETag", etag(t.Version))
+	answer := fmt.Sprintf(`{"error_message": "task with id=%d has been updated", "error_code": 0}`, t.ID)
+	return c.JSONBlob(http.StatusOK, []byte(answer))
+}
+
+func tasksHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
+	if err != nil {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "task_id must be integer type", "error_code": 10}`))
+	}
+	logging.SetTaskID(c, int(taskID))
+	t, err := storage.GetTaskByID(c.Request().Context(), int(taskID))
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !isAdmin(c, u) && u.ID != t.CustomerID {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to delete task", "error_code": 125}`))
+	}
+	if t.State != storage.StateFree && !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "only tasks with status free(0) can be deleted", "error_code": 115}`))
+	}
+	if !ifMatch(c, t.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	audit.SetAction(c, "task.delete")
+	err = storage.DeleteTask(c.Request().Context(), t.ID, t.Version)
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.TaskTarget(t.ID), audit.TaskSnapshot(t), nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "task deleted", "error_code": 0}`))
+}
+
+func taskCommandHandler(c echo.Context) error {
+	// allowed commands: acquire, finish, accept, dispute, close
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	taskID, err := strconv.ParseInt(c.Param("task_id"), 10, 64)
+	if err != nil {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "task_id must be integer type", "error_code": 10}`))
+	}
+	logging.SetTaskID(c, int(taskID))
+	t, err := storage.GetTaskByID(c.Request().Context(), int(taskID))
+	if errors.Is(err, storage.ErrNotFound) {
+		answer := fmt.Sprintf(`{"error_message": "task with id=%d not found in database", "error_code": 11}`, taskID)
+		return c.JSONBlob(http.StatusNotFound, []byte(answer))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !ifMatch(c, t.Version) {
+		return preconditionFailedAnswer(c)
+	}
+
+	command := c.Param("command")
+	audit.SetAction(c, "task."+command)
+	before := audit.TaskSnapshot(t)
+
+	switch command {
+	case "acquire":
+		if t.State != storage.StateFree {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not in free status", "error_code": 32}`))
+		}
+		activeAmount := u.Balance
+		activeAmount.Sub(u.FrozenAmount)
+		if t.Cost.IsGreaterThan(activeAmount) {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "isufficient amout of money on users account", "error_code": 33}`))
+		}
+		userBefore := audit.UserSnapshot(u)
+		u.FrozenAmount.Add(t.Cost)
+		t.State = storage.StateExecuting
+		t.ExecutionerID = u.ID
+		t.BeginTime = time.Now()
+
+		note := taskNotification(t.CustomerID, storage.NotificationTaskAcquired, t, fmt.Sprintf("Task %q is acquired by %s", t.Title, u.UserName))
+		if err := updateInTransaction(c.Request().Context(), []*storage.Task{t}, []*storage.User{u}, webhooks.TaskAcquired, []*storage.Notification{note}); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+		audit.AddChange(c, audit.UserTarget(u.ID), userBefore, audit.UserSnapshot(u))
+		metrics.TaskCommands.WithLabelValues(command).Inc()
+		metrics.MoneyMoved.WithLabelValues("frozen").Add(t.Cost.GetVal())
+
+		return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "task acquired", "error_code": 0}`))
+	case "finish":
+		if t.ExecutionerID != u.ID {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not acquired previously by user", "error_code": 34}`))
+		}
+		if t.State != storage.StateExecuting {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not in executing status", "error_code": 35}`))
+		}
+		var req taskFinishRequest
+		if ok, err := bindRequest(c, &req); !ok {
+			return err
+		}
+		t.State = storage.StateCompleted
+		t.Solution = req.Solution
+		t.SolutionPreview = req.Preview
+		t.EndTime = time.Now()
+		note := taskNotification(t.CustomerID, storage.NotificationTaskFinished, t, fmt.Sprintf("Task %q is finished by %s, check the preview and accept it to get the solution", t.Title, u.UserName))
+		if err := updateInTransaction(c.Request().Context(), []*storage.Task{t}, nil, webhooks.TaskFinished, []*storage.Notification{note}); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+		metrics.TaskCommands.WithLabelValues(command).Inc()
+		return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "task finished", "error_code": 0}`))
+	case "accept":
+		if t.CustomerID != u.ID {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not created by this user", "error_code": 36}`))
+		}
+		if t.State != storage.StateCompleted {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not in completed status", "error_code": 37}`))
+		}
+		t.State = storage.StateAccepted
+		t.AcceptTime = time.Now()
+		executioner, err := storage.GetUserByID(c.Request().Context(), t.ExecutionerID)
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		userBefore, executionerBefore := audit.UserSnapshot(u), audit.UserSnapshot(executioner)
+		releasePayment(u, executioner, t.Cost)
+
+		note := taskNotification(executioner.ID, storage.NotificationTaskAccepted, t, fmt.Sprintf("Task %q is accepted, %.2f is paid to your balance", t.Title, t.Cost.GetVal()))
+		if err := updateInTransaction(c.Request().Context(), []*storage.Task{t}, []*storage.User{u, executioner}, webhooks.TaskAccepted, []*storage.Notification{note}); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+		audit.AddChange(c, audit.UserTarget(u.ID), userBefore, audit.UserSnapshot(u))
+		audit.AddChange(c, audit.UserTarget(executioner.ID), executionerBefore, audit.UserSnapshot(executioner))
+		metrics.TaskCommands.WithLabelValues(command).Inc()
+		metrics.MoneyMoved.WithLabelValues("paid").Add(t.Cost.GetVal())
+
+		return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "task accepted", "error_code": 0}`))
+	case "dispute":
+		if t.CustomerID != u.ID {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not created by this user", "error_code": 48}`))
+		}
+		if t.State != storage.StateCompleted {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not in completed status", "error_code": 49}`))
+		}
+		var req taskDisputeRequest
+		if ok, err := bindRequest(c, &req); !ok {
+			return err
+		}
+		t.State = storage.StateDisputed
+		d := &storage.TaskDispute{TaskID: t.ID, OpenedBy: u.ID, Reason: req.Reason, OpenedAt: time.Now().Truncate(time.Second)}
+		note := taskNotification(t.ExecutionerID, storage.NotificationTaskDisputed, t, fmt.Sprintf("Solution of task %q is disputed by customer, admin will decide: %s", t.Title, quote(req.Reason)))
+		err := updateInTransaction(c.Request().Context(), []*storage.Task{t}, nil, webhooks.TaskDisputed, []*storage.Notification{note}, func(tx *storage.Tx) error {
+			return storage.CreateTaskDisputeTx(tx, d)
+		})
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+		metrics.TaskCommands.WithLabelValues(command).Inc()
+		answer := fmt.Sprintf(`{"error_message": "task disputed", "error_code": 0, "dispute_id": %d}`, d.ID)
+		return c.JSONBlob(http.StatusOK, []byte(answer))
+	case "close":
+		if t.CustomerID != u.ID {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not created by this user", "error_code": 46}`))
+		}
+		if t.State != storage.StateFree {
+			return c.JSONBlob(http.StatusNotModified, []byte(`{"error_message": "task is not in free status", "error_code": 47}`))
+		}
+		t.State = storage.StateClosed
+		if err := updateInTransaction(c.Request().Context(), []*storage.Task{t}, nil, webhooks.TaskClosed, nil); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.TaskTarget(t.ID), before, audit.TaskSnapshot(t))
+		metrics.TaskCommands.WithLabelValues(command).Inc()
+		return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "task successfully closed", "error_code": 0}`))
+	}
+	return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "unexeptable command", "error_code": 66}`))
+}
+
+// auditHandlerGet returns audit records, newest first. Admin only
+func auditHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to view audit log", "error_code": 125}`))
+	}
+	var req auditQueryRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	filter := storage.AuditFilter{Actor: req.Actor, Target: req.Target, Limit: 100}
+	if req.From != nil {
+		filter.From = *req.From
+	}
+	if req.To != nil {
+		filter.To = *req.To
+	}
+	if req.Limit != nil {
+		filter.Limit = *req.Limit
+	}
+	records, err := storage.GetAuditRecords(c.Request().Context(), filter)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	type auditRecordView struct {
+		ID        int             `json:"id"`
+		CreatedAt string          `json:"created_at"`
+		ActorID   int             `json:"actor_id"`
+		ActorName string          `json:"actor_name"`
+		Action    string          `json:"action"`
+		Targets   []string        `json:"targets"`
+		Diff      json.RawMessage `json:"diff"`
+		IP        string          `json:"ip"`
+		RequestID string          `json:"request_id"`
+		Status    int             `json:"status"`
+		Hash      string          `json:"hash"`
+	}
+	views := make([]auditRecordView, 0, len(records))
+	for _, rec := range records {
+		views = append(views, auditRecordView{
+			ID:        rec.ID,
+			CreatedAt: rec.CreatedAt.Format(validate.TimeLayout),
+			ActorID:   rec.ActorID,
+			ActorName: rec.ActorName,
+			Action:    rec.Action,
+			Targets:   rec.Targets,
+			Diff:      json.RawMessage(rec.Diff),
+			IP:        rec.IP,
+			RequestID: rec.RequestID,
+			Status:    rec.Status,
+			Hash:      rec.Hash})
+	}
+	answer, _ := json.Marshal(struct {
+		Records   []auditRecordView `json:"records"`
+		ErrorCode int               `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// auditHandlerVerify checks hash chain of the whole audit log. Admin only
+func auditHandlerVerify(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to view audit log", "error_code": 125}`))
+	}
+	checked, brokenAt, err := audit.Verify(c.Request().Context())
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	answer := fmt.Sprintf(`{"valid": %t, "checked": %d, "broken_at": %d, "error_code": 0}`, brokenAt == 0, checked, brokenAt)
+	return c.JSONBlob(http.StatusOK, []byte(answer))
+}
+
+// authorize returns session user, remembers it as actor of request
+// and adds its ID to request log fields. On failure writes answer, 401 or
+// storage error, and returns nil
+func authorize(c echo.Context) (*storage.User, error) {
+	u, isAuthorized := c.Get(contextAPIKeyUser).(*storage.User)
+	if !isAuthorized {
+		var err error
+		if u, isAuthorized, err = storage.Auth(c.Request()); err != nil {
+			return nil, storageErrorAnswer(c, err)
+		}
+	}
+	if !isAuthorized {
+		return nil, c.String(http.StatusUnauthorized, "")
+	}
+	audit.SetUser(c, u)
+	logging.SetUserID(c, u.ID)
+	return u, nil
+}
+
+// updateInTransaction saves tasks and users, rolling back on first error.
+// Webhook event of type event about every saved task is put into outbox
+// in the same transaction and published to stream after commit. So are
+// notes, which are queued for delivery out of the app after commit.
+// also are run in the transaction to save records going with the change
+func updateInTransaction(ctx context.Context, tasks []*storage.Task, users []*storage.User, event string, notes []*storage.Notification, also ...func(*storage.Tx) error) error {
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	events := make([]*storage.WebhookEvent, 0, len(tasks))
+	for _, t := range tasks {
+		if err := storage.UpdateTaskTx(tx, t); err != nil {
+			storage.RollbackTransaction(tx)
+			return err
+		}
+		e := newTaskEvent(event, t)
+		if err := storage.AddWebhookEventTx(tx, e); err != nil {
+			storage.RollbackTransaction(tx)
+			return err
+		}
+		events = append(events, e)
+	}
+	for _, u := range users {
+		if err := storage.UpdateUserTx(tx, u); err != nil {
+			storage.RollbackTransaction(tx)
+			return err
+		}
+	}
+	for _, n := range notes {
+		if err := storage.AddNotificationTx(tx, n); err != nil {
+			storage.RollbackTransaction(tx)
+			return err
+		}
+	}
+	for _, f := range also {
+		if err := f(tx); err != nil {
+			storage.RollbackTransaction(tx)
+			return err
+		}
+	}
+	if err := storage.CommitTransaction(tx); err != nil {
+		return err
+	}
+	for i, e := range events {
+		publishTaskEvent(e, tasks[i])
+	}
+	notifier.Enqueue(notes...)
+	return nil
+}
+
+// saveTask saves task edited by PUT or PATCH, with its tags if they changed
+func saveTask(ctx context.Context, t *storage.Task, tagsChanged bool) error {
+	if !tagsChanged {
+		return storage.UpdateTask(ctx, t)
+	}
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackTransaction(tx)
+	if err := storage.UpdateTaskTx(tx, t); err != nil {
+		return err
+	}
+	if err := storage.SetTaskTagsTx(tx, t.ID, t.Tags); err != nil {
+		return err
+	}
+	return storage.CommitTransaction(tx)
+}
+
+// releasePayment moves cost of task from customer to executor
+func releasePayment(customer, executor *storage.User, cost currency.Money) {
+	executor.Balance.Add(cost)
+	customer.Balance.Sub(cost)
+	customer.FrozenAmount.Sub(cost)
+}
+
+// storageErrorAnswer maps storage error kinds to http status and error code,
+// trace_id of answer finds the request in logs and traces
+func storageErrorAnswer(c echo.Context, err error) error {
+	status, code, msg := http.StatusInternalServerError, 127, "internal error"
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		status, code, msg = http.StatusNotFound, 104, "not found"
+	case errors.Is(err, storage.ErrDuplicate):
+		status, code, msg = http.StatusConflict, 105, "already exists"
+	case errors.Is(err, storage.ErrConflict):
+		status, code, msg = http.StatusConflict, 109, "modified concurrently, try again"
+	case errors.Is(err, storage.ErrUnavailable):
+		status, code, msg = http.StatusServiceUnavailable, 110, "storage unavailable"
+	}
+	if status >= http.StatusInternalServerError {
+		slog.ErrorContext(c.Request().Context(), "request failed", "err", err)
+	}
+	answer := fmt.Sprintf(`{"error_message": "%s", "error_code": %d, "trace_id": "%s"}`, msg, code, tracing.TraceID(c.Request().Context()))
+	return c.JSONBlob(status, []byte(answer))
+}
+
+// etag formats entity version as ETag header value
+func etag(version int) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// ifMatch checks If-Match request header against current entity version,
+// absent header matches anything
+func ifMatch(c echo.Context, version int) bool {
+	header := c.Request().Header.Get("If-Match")
+	if header == "" || header == "*" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+func preconditionFailedAnswer(c echo.Context) error {
+	return c.JSONBlob(http.StatusPreconditionFailed, []byte(`{"error_message": "entity has been modified, ETag doesn't match If-Match", "error_code": 108}`))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"./storage"
+	"github.com/labstack/echo"
+)
+
+func TestSolutionVisibility(t *testing.T) {
+	const customer, executor, stranger = 1, 2, 3
+	tests := []struct {
+		name    string
+		user    storage.User
+		state   storage.State
+		noAdmin bool
+		want    bool
+	}{
+		{"executor", storage.User{ID: executor}, storage.StateCompleted, false, true},
+		{"admin", storage.User{ID: stranger, IsAdmin: true}, storage.StateCompleted, false, true},
+		{"admin via key without admin scope", storage.User{ID: stranger, IsAdmin: true}, storage.StateCompleted, true, false},
+		{"customer before accepting", storage.User{ID: customer}, storage.StateCompleted, false, false},
+		{"customer after accepting", storage.User{ID: customer}, storage.StateAccepted, false, true},
+		{"stranger", storage.User{ID: stranger}, storage.StateCompleted, false, false},
+		{"stranger after accepting", storage.User{ID: stranger}, storage.StateAccepted, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+			if tt.noAdmin {
+				c.Set(contextAPIKeyNoAdmin, true)
+			}
+			task := &storage.Task{ID: 5, CustomerID: customer, ExecutionerID: executor, State: tt.state, Solution: "done"}
+			if got := canSeeSolution(c, &tt.user, task); got != tt.want {
+				t.Errorf("canSeeSolution %v, want %v", got, tt.want)
+			}
+			if got := toTaskView(c, &tt.user, task).Solution != nil; got != tt.want {
+				t.Errorf("solution in view %v, want %v", got, tt.want)
+			}
+			if v := toTaskListView(task); v.Solution != nil || v.SolutionSize != len("done") || v.SolutionSHA256 != "" {
+				t.Errorf("list view must have solution preview and size only, got %+v", v)
+			}
+			wantSum := !tt.want && tt.user.ID == customer
+			if got := toTaskView(c, &tt.user, task).SolutionSHA256 != ""; got != wantSum {
+				t.Errorf("solution checksum in view %v, want %v", got, wantSum)
+			}
+			solution := &storage.Attachment{Kind: storage.AttachmentSolution}
+			if got := canDownload(c, &tt.user, task, solution); got != tt.want {
+				t.Errorf("canDownload %v, want %v", got, tt.want)
+			}
+			if !canDownload(c, &tt.user, task, &storage.Attachment{Kind: storage.AttachmentProblem}) {
+				t.Error("problem files must be downloadable by everyone")
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"./storage"
+	"github.com/labstack/echo"
+)
+
+// readyTimeout : how long readiness check waits for database
+const readyTimeout = 2 * time.Second
+
+// shuttingDown is set when server stops accepting new requests
+var shuttingDown atomic.Bool
+
+// healthHandler tells that process is alive, it doesn't touch database
+func healthHandler(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, []byte(`{"status": "ok"}`))
+}
+
+// readyHandler tells whether server can serve requests: it isn't shutting
+// down, database answers and its schema is migrated to storage.SchemaVersion
+func readyHandler(c echo.Context) error {
+	if shuttingDown.Load() {
+		return c.JSONBlob(http.StatusServiceUnavailable, []byte(`{"status": "shutting down"}`))
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readyTimeout)
+	defer cancel()
+	if err := storage.Ping(ctx); err != nil {
+		slog.WarnContext(ctx, "readiness: database unavailable", "err", err)
+		return c.JSONBlob(http.StatusServiceUnavailable, []byte(`{"status": "database unavailable"}`))
+	}
+	version, err := storage.MigrationVersion(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "readiness: can't read schema version", "err", err)
+		return c.JSONBlob(http.StatusServiceUnavailable, []byte(`{"status": "schema version unknown"}`))
+	}
+	status, code := "ok", http.StatusOK
+	if version < storage.SchemaVersion {
+		status, code = "migrations pending", http.StatusServiceUnavailable
+	}
+	answer := fmt.Sprintf(`{"status": "%s", "schema_version": %d, "expected_schema_version": %d}`, status, version, storage.SchemaVersion)
+	return c.JSONBlob(code, []byte(answer))
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./audit"
+	"./metrics"
+	"./ratelimit"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// loginLimiter limits login attempts by IP and account, set up in run
+var loginLimiter *ratelimit.Limiter
+
+// accountLockoutName names login in limiter, logins are case insensitive.
+// Unknown logins are limited too, so lockout doesn't reveal which exist
+func accountLockoutName(login string) string {
+	return "login:" + strings.ToLower(login)
+}
+
+// allowIPAttempt checks IP rate limit shared by login and other requests
+// without session, which may guess passwords or tokens. On rejection
+// writes answer and returns false
+func allowIPAttempt(c echo.Context) (ok bool, err error) {
+	allowed, retryAfter, err := loginLimiter.Allow(c.Request().Context(), "ip:"+clientIP(c.Request()), loginLimiter.IP)
+	if err != nil {
+		return false, storageErrorAnswer(c, err)
+	}
+	if !allowed {
+		return false, tooManyAttemptsAnswer(c, "rate_limited", retryAfter)
+	}
+	return true, nil
+}
+
+// allowLoginAttempt checks IP and account rate limits and account lockout,
+// on rejection writes answer and returns false
+func allowLoginAttempt(c echo.Context, account string) (ok bool, err error) {
+	if ok, err := allowIPAttempt(c); !ok {
+		return false, err
+	}
+	ctx := c.Request().Context()
+	allowed, retryAfter, err := loginLimiter.Allow(ctx, account, loginLimiter.Account)
+	if err != nil {
+		return false, storageErrorAnswer(c, err)
+	}
+	if !allowed {
+		return false, tooManyAttemptsAnswer(c, "rate_limited", retryAfter)
+	}
+	lockedFor, err := loginLimiter.Locked(ctx, account)
+	if err != nil {
+		return false, storageErrorAnswer(c, err)
+	}
+	if lockedFor > 0 {
+		return false, tooManyAttemptsAnswer(c, "locked_out", lockedFor)
+	}
+	return true, nil
+}
+
+// tooManyAttemptsAnswer is the same for rate limit and lockout
+func tooManyAttemptsAnswer(c echo.Context, reason string, retryAfter time.Duration) error {
+	metrics.LoginRejected.WithLabelValues(reason).Inc()
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	c.Response().Header().Set("Retry-After", strconv.Itoa(seconds))
+	answer := []byte(`{"errror_message": "too many login attempts, try again later", "error_code": 5, "retry_after": ` + strconv.Itoa(seconds) + `}`)
+	return c.JSONBlob(http.StatusTooManyRequests, answer)
+}
+
+type lockoutView struct {
+	Name        string `json:"name"`
+	Failures    int    `json:"failures"`
+	LastFailure string `json:"last_failure"`
+	LockedUntil string `json:"locked_until"`
+	Locked      bool   `json:"locked"`
+}
+
+// lockoutsHandlerGet lists accounts with failed login attempts. Admin only
+func lockoutsHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to view lockouts", "error_code": 125}`))
+	}
+	lockouts, err := loginLimiter.Store.Lockouts(c.Request().Context())
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]lockoutView, 0, len(lockouts))
+	for _, l := range lockouts {
+		views = append(views, lockoutView{
+			Name:        l.Name,
+			Failures:    l.Failures,
+			LastFailure: l.LastFailure.Format(validate.TimeLayout),
+			LockedUntil: l.LockedUntil.Format(validate.TimeLayout),
+			Locked:      l.LockedUntil.After(time.Now())})
+	}
+	answer, _ := json.Marshal(struct {
+		Lockouts  []lockoutView `json:"lockouts"`
+		ErrorCode int           `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// lockoutsHandlerDelete clears failed attempts and lockout of account. Admin only
+func lockoutsHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to clear lockouts", "error_code": 125}`))
+	}
+	ctx := c.Request().Context()
+	name := c.Param("name")
+	lockout, err := loginLimiter.Store.GetLockout(ctx, name)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if lockout.Failures == 0 {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "lockout not found", "error_code": 104}`))
+	}
+	audit.SetAction(c, "lockout.clear")
+	if err := loginLimiter.Reset(ctx, name); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "lockout:"+name, map[string]interface{}{
+		"failures":     lockout.Failures,
+		"locked_until": lockout.LockedUntil.Format(validate.TimeLayout)}, nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "lockout cleared", "error_code": 0}`))
+}
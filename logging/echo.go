@@ -0,0 +1,86 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Middleware puts request ID into request context and writes access log
+// record after request is served. Request ID is taken from X-Request-ID
+// set by middleware.RequestID, so it must be used after it
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		id := c.Response().Header().Get(echo.HeaderXRequestID)
+		if id == "" {
+			id = req.Header.Get(echo.HeaderXRequestID)
+		}
+		c.SetRequest(req.WithContext(WithRequestID(req.Context(), id)))
+
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			c.Error(err)
+		}
+		status := c.Response().Status
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		attrs := []slog.Attr{
+			slog.String("method", req.Method),
+			slog.String("path", req.URL.Path),
+			slog.String("route", c.Path()),
+			slog.Int("status", status),
+			slog.Duration("latency", time.Since(start)),
+			slog.String("ip", c.RealIP()),
+			slog.Int64("bytes_out", c.Response().Size)}
+		if req.URL.RawQuery != "" {
+			attrs = append(attrs, slog.String("query", redactQuery(req.URL.Query())))
+		}
+		if err != nil {
+			attrs = append(attrs, slog.Any("err", err))
+		}
+		slog.LogAttrs(c.Request().Context(), level, "request", attrs...)
+		return err
+	}
+}
+
+// Recover turns panic of handler into 500 error and logs it with stack
+// and request fields
+func Recover(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				slog.ErrorContext(c.Request().Context(), "panic", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+				err = echo.NewHTTPError(http.StatusInternalServerError)
+			}
+		}()
+		return next(c)
+	}
+}
+
+// SetUserID adds user ID to request context, so it is logged with request
+func SetUserID(c echo.Context, id int) {
+	c.SetRequest(c.Request().WithContext(WithUserID(c.Request().Context(), id)))
+}
+
+// SetTaskID adds task ID to request context, so it is logged with request
+func SetTaskID(c echo.Context, id int) {
+	c.SetRequest(c.Request().WithContext(WithTaskID(c.Request().Context(), id)))
+}
+
+func redactQuery(query url.Values) string {
+	for key := range query {
+		if IsSensitive(key) {
+			query[key] = []string{Redacted}
+		}
+	}
+	return query.Encode()
+}
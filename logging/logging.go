@@ -0,0 +1,126 @@
+// Package logging sets up structured JSON logging. Request ID, user ID and
+// task ID put into context.Context, and trace ID of its span, are added to
+// every record logged with that context, values of sensitive fields are redacted
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Redacted replaces values of sensitive fields
+const Redacted = "[REDACTED]"
+
+// sensitive key parts, matched case insensitive, so "password_hash",
+// "new_password" and "X-Auth-Token" are redacted too
+var sensitive = []string{"password", "token", "secret", "authorization", "cookie"}
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	userIDKey
+	taskIDKey
+)
+
+// ParseLevel parses one of debug, info, warn, error, empty string is info
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	if level == "" {
+		return slog.LevelInfo, nil
+	}
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+// New returns JSON logger writing records of level and above to w
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redact})
+	return slog.New(contextHandler{handler})
+}
+
+// Setup makes logger returned by New default one, level is parsed by ParseLevel
+func Setup(w io.Writer, level string) error {
+	l, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(New(w, l))
+	return nil
+}
+
+// IsSensitive tells whether value of field with key must not be logged
+func IsSensitive(key string) bool {
+	key = strings.ToLower(key)
+	for _, part := range sensitive {
+		if strings.Contains(key, part) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if IsSensitive(a.Key) {
+		return slog.String(a.Key, Redacted)
+	}
+	return a
+}
+
+// contextHandler adds request fields from context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if ctx != nil {
+		if id, ok := ctx.Value(requestIDKey).(string); ok {
+			r.AddAttrs(slog.String("request_id", id))
+		}
+		if id, ok := ctx.Value(userIDKey).(int); ok {
+			r.AddAttrs(slog.Int("user_id", id))
+		}
+		if id, ok := ctx.Value(taskIDKey).(int); ok {
+			r.AddAttrs(slog.Int("task_id", id))
+		}
+		if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+			r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// WithRequestID returns context carrying request ID
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns request ID from context, empty string if there is none
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithUserID returns context carrying ID of authorized user
+func WithUserID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, userIDKey, id)
+}
+
+// WithTaskID returns context carrying ID of task request works with
+func WithTaskID(ctx context.Context, id int) context.Context {
+	return context.WithValue(ctx, taskIDKey, id)
+}
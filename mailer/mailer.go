@@ -0,0 +1,107 @@
+// Package mailer sends templated email messages. SMTP delivers them for
+// real, File and Log keep them locally for development
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Message : email to be sent
+type Message struct {
+	To      string
+	Subject string
+	Body    string // plain text
+}
+
+// Mailer sends messages
+type Mailer interface {
+	Send(ctx context.Context, m Message) error
+}
+
+//go:embed templates/*.tmpl
+var templateFiles embed.FS
+
+var templates = template.Must(template.ParseFS(templateFiles, "templates/*.tmpl"))
+
+// Render builds message to address from template name, e.g. "verify_email".
+// The first line of template output is subject, the rest is body
+func Render(name, to string, data interface{}) (Message, error) {
+	var out bytes.Buffer
+	if err := templates.ExecuteTemplate(&out, name+".tmpl", data); err != nil {
+		return Message{}, err
+	}
+	subject, body, _ := strings.Cut(out.String(), "\n")
+	return Message{To: to, Subject: strings.TrimSpace(subject), Body: strings.TrimLeft(body, "\n")}, nil
+}
+
+// headerLines : line breaks which would start new header or body
+var headerLines = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ")
+
+// format returns message in RFC 5322 format. Header values come from users,
+// so line breaks are removed from them
+func format(from string, m Message) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", headerLines.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", headerLines.Replace(m.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", headerLines.Replace(m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(m.Body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// SMTP sends messages through SMTP server, with PLAIN auth if Username is set
+type SMTP struct {
+	Addr     string // host:port
+	From     string
+	Username string
+	Password string
+}
+
+// Send implements Mailer
+func (s SMTP) Send(ctx context.Context, m Message) error {
+	var auth smtp.Auth
+	if s.Username != "" {
+		host, _, _ := net.SplitHostPort(s.Addr)
+		auth = smtp.PlainAuth("", s.Username, s.Password, host)
+	}
+	return smtp.SendMail(s.Addr, auth, s.From, []string{m.To}, format(s.From, m))
+}
+
+// File writes every message into its own .eml file in Dir
+type File struct {
+	Dir  string
+	From string
+}
+
+// Send implements Mailer
+func (f File) Send(ctx context.Context, m Message) error {
+	if err := os.MkdirAll(f.Dir, 0o755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().Format("20060102-150405.000000"), strings.NewReplacer("@", "_at_", "/", "_").Replace(m.To))
+	slog.InfoContext(ctx, "mail written", "to", m.To, "subject", m.Subject, "file", name)
+	return os.WriteFile(filepath.Join(f.Dir, name), format(f.From, m), 0o644)
+}
+
+// Log writes messages into log, links in their bodies are logged too,
+// so it is for development only
+type Log struct{}
+
+// Send implements Mailer
+func (Log) Send(ctx context.Context, m Message) error {
+	slog.InfoContext(ctx, "mail", "to", m.To, "subject", m.Subject, "body", m.Body)
+	return nil
+}
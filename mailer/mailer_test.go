@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFormatKeepsHeaderValuesOnTheirLines(t *testing.T) {
+	msg := string(format("app@example.com", Message{
+		To:      "user@example.com\r\nBcc: victim@example.com",
+		Subject: "Hi\nBcc: victim@example.com\r\rX-Spam: no",
+		Body:    "line one\nline two"}))
+	header, body, ok := strings.Cut(msg, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("no header end in %q", msg)
+	}
+	for _, line := range strings.Split(header, "\r\n") {
+		name, _, _ := strings.Cut(line, ":")
+		switch name {
+		case "From", "To", "Subject", "Date", "MIME-Version", "Content-Type":
+		default:
+			t.Errorf("injected header line %q", line)
+		}
+	}
+	if !strings.Contains(header, "Subject: Hi Bcc: victim@example.com  X-Spam: no\r\n") {
+		t.Errorf("subject is lost in %q", header)
+	}
+	if body != "line one\r\nline two" {
+		t.Errorf("body %q", body)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"./audit"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// messageEditWindow : how long after posting author may edit or delete message
+const messageEditWindow = 15 * time.Minute
+
+// messagesShown : how many messages are listed by default
+const messagesShown = 100
+
+// messageQuoted : how many characters of message are quoted in notification
+const messageQuoted = 100
+
+type taskMessageView struct {
+	ID           int    `json:"id"`
+	ReplyTo      int    `json:"reply_to,omitempty"`
+	AuthorID     int    `json:"author_id"`
+	Author       string `json:"author"`
+	Body         string `json:"body"`
+	CreatedAt    string `json:"created_at"`
+	EditedAt     string `json:"edited_at,omitempty"`
+	Deleted      bool   `json:"deleted"`
+	Moderated    bool   `json:"moderated"`
+	DeleteReason string `json:"delete_reason,omitempty"`
+}
+
+func toTaskMessageView(m *storage.TaskMessage) taskMessageView {
+	v := taskMessageView{
+		ID:        m.ID,
+		ReplyTo:   m.ReplyTo,
+		AuthorID:  m.AuthorID,
+		Author:    m.Author,
+		Body:      m.Body,
+		CreatedAt: m.CreatedAt.Format(validate.TimeLayout),
+		Deleted:   !m.DeletedAt.IsZero()}
+	if !m.EditedAt.IsZero() {
+		v.EditedAt = m.EditedAt.Format(validate.TimeLayout)
+	}
+	if v.Deleted && m.DeletedBy != m.AuthorID {
+		v.Moderated = true
+		v.DeleteReason = m.DeleteReason
+	}
+	return v
+}
+
+// taskOfParticipant returns task in path if user is its customer, executor
+// or admin. On failure writes answer and returns nil
+func taskOfParticipant(c echo.Context, u *storage.User) (*storage.Task, error) {
+	t, err := taskOf(c)
+	if t == nil {
+		return nil, err
+	}
+	if t.CustomerID != u.ID && t.ExecutionerID != u.ID && !isAdmin(c, u) {
+		return nil, c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "only customer, executor of task and admins can see its messages", "error_code": 200}`))
+	}
+	return t, nil
+}
+
+// taskMessageOf returns message in path of task. On failure writes answer
+// and returns nil
+func taskMessageOf(c echo.Context, t *storage.Task) (*storage.TaskMessage, error) {
+	messageID, err := strconv.Atoi(c.Param("message_id"))
+	var m *storage.TaskMessage
+	if err == nil {
+		m, err = storage.GetTaskMessage(c.Request().Context(), t.ID, messageID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return nil, c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "message not found", "error_code": 201}`))
+	}
+	return m, nil
+}
+
+// taskMessageLock returns lock of task thread, nil if thread is open
+func taskMessageLock(c echo.Context, taskID int) (*storage.TaskMessageLock, error) {
+	l, err := storage.GetTaskMessageLock(c.Request().Context(), taskID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, nil
+	}
+	return l, err
+}
+
+// quote returns the beginning of message text for notification
+func quote(text string) string {
+	runes := []rune(text)
+	if len(runes) <= messageQuoted {
+		return text
+	}
+	return string(runes[:messageQuoted]) + "..."
+}
+
+// taskMessagesHandlerGet lists messages of task, oldest first, with number
+// of messages user hasn't read. Customer, executor or admin
+func taskMessagesHandlerGet(c echo.Context) error {
+	var req taskMessagesQueryRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	afterID, limit := 0, messagesShown
+	if req.AfterID != nil {
+		afterID = *req.AfterID
+	}
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	ctx := c.Request().Context()
+	messages, err := storage.GetTaskMessages(ctx, t.ID, afterID, limit)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	unread, err := storage.CountUnreadTaskMessages(ctx, t.ID, u.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	lock, err := taskMessageLock(c, t.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]taskMessageView, 0, len(messages))
+	for _, m := range messages {
+		views = append(views, toTaskMessageView(m))
+	}
+	answer := struct {
+		Messages   []taskMessageView `json:"messages"`
+		Unread     int               `json:"unread"`
+		Locked     bool              `json:"locked"`
+		LockReason string            `json:"lock_reason,omitempty"`
+		ErrorCode  int               `json:"error_code"`
+	}{Messages: views, Unread: unread}
+	if lock != nil {
+		answer.Locked, answer.LockReason = true, lock.Reason
+	}
+	body, _ := json.Marshal(answer)
+	return c.JSONBlob(http.StatusOK, body)
+}
+
+// allowThreadChange tells if user may post, edit or delete messages of
+// task: thread is open or user is admin. Otherwise writes answer
+func allowThreadChange(c echo.Context, u *storage.User, t *storage.Task) (bool, error) {
+	if isAdmin(c, u) {
+		return true, nil
+	}
+	lock, err := taskMessageLock(c, t.ID)
+	if err != nil {
+		return false, storageErrorAnswer(c, err)
+	}
+	if lock != nil {
+		answer, _ := json.Marshal(struct {
+			ErrorMessage string `json:"error_message"`
+			ErrorCode    int    `json:"error_code"`
+		}{"messages of task are locked by admin: " + lock.Reason, 203})
+		return false, c.JSONBlob(http.StatusConflict, answer)
+	}
+	return true, nil
+}
+
+// taskMessagesHandlerCreate posts message to task and notifies the other
+// participants. Customer, executor or admin, only admins post to locked thread
+func taskMessagesHandlerCreate(c echo.Context) error {
+	var req taskMessageRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	audit.SetAction(c, "task.message.create")
+	ctx := c.Request().Context()
+	if ok, err := allowThreadChange(c, u, t); !ok {
+		return err
+	}
+	m := &storage.TaskMessage{
+		TaskID:    t.ID,
+		AuthorID:  u.ID,
+		Author:    u.UserName,
+		Body:      req.Body,
+		CreatedAt: time.Now().Truncate(time.Second)}
+	if req.ReplyTo != nil {
+		if _, err := storage.GetTaskMessage(ctx, t.ID, *req.ReplyTo); err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "reply_to is not a message of this task", "error_code": 204}`))
+			}
+			return storageErrorAnswer(c, err)
+		}
+		m.ReplyTo = *req.ReplyTo
+	}
+	var notes []*storage.Notification
+	for _, userID := range []int{t.CustomerID, t.ExecutionerID} {
+		if userID != 0 && userID != u.ID {
+			notes = append(notes, taskNotification(userID, storage.NotificationTaskMessage, t,
+				fmt.Sprintf("%s wrote about task %q: %s", u.UserName, t.Title, quote(m.Body))))
+		}
+	}
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if err := storage.CreateTaskMessageTx(tx, m); err != nil {
+		storage.RollbackTransaction(tx)
+		return storageErrorAnswer(c, err)
+	}
+	for _, n := range notes {
+		if err := storage.AddNotificationTx(tx, n); err != nil {
+			storage.RollbackTransaction(tx)
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if err := storage.CommitTransaction(tx); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	notifier.Enqueue(notes...)
+	audit.AddChange(c, "task_message:"+strconv.Itoa(m.ID), nil, map[string]interface{}{"task_id": t.ID, "reply_to": m.ReplyTo, "body": m.Body})
+	answer, _ := json.Marshal(struct {
+		taskMessageView
+		ErrorCode int `json:"error_code"`
+	}{toTaskMessageView(m), 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+// taskMessageHandlerUpdate changes text of message. Author only, within
+// messageEditWindow after posting and while thread isn't locked
+func taskMessageHandlerUpdate(c echo.Context) error {
+	var req taskMessageUpdateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	m, err := taskMessageOf(c, t)
+	if m == nil {
+		return err
+	}
+	audit.SetAction(c, "task.message.update")
+	if m.AuthorID != u.ID {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "only author can edit message", "error_code": 205}`))
+	}
+	if ok, err := allowThreadChange(c, u, t); !ok {
+		return err
+	}
+	if !m.DeletedAt.IsZero() || time.Since(m.CreatedAt) > messageEditWindow {
+		answer := fmt.Sprintf(`{"error_message": "message can be edited only within %d minutes after posting", "error_code": 202}`, int(messageEditWindow.Minutes()))
+		return c.JSONBlob(http.StatusConflict, []byte(answer))
+	}
+	before := map[string]interface{}{"body": m.Body}
+	m.Body = req.Body
+	m.EditedAt = time.Now().Truncate(time.Second)
+	if err := storage.UpdateTaskMessage(c.Request().Context(), m); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "task_message:"+strconv.Itoa(m.ID), before, map[string]interface{}{"body": m.Body})
+	answer, _ := json.Marshal(struct {
+		taskMessageView
+		ErrorCode int `json:"error_code"`
+	}{toTaskMessageView(m), 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// taskMessageHandlerDelete removes text of message. Author within
+// messageEditWindow after posting while thread isn't locked, admins any
+// time giving reason
+func taskMessageHandlerDelete(c echo.Context) error {
+	var req taskMessageDeleteRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	m, err := taskMessageOf(c, t)
+	if m == nil {
+		return err
+	}
+	audit.SetAction(c, "task.message.delete")
+	if !m.DeletedAt.IsZero() {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "message not found", "error_code": 201}`))
+	}
+	if !isAdmin(c, u) {
+		if m.AuthorID != u.ID {
+			return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "only author or admin can delete message", "error_code": 205}`))
+		}
+		if time.Since(m.CreatedAt) > messageEditWindow {
+			answer := fmt.Sprintf(`{"error_message": "message can be deleted only within %d minutes after posting", "error_code": 202}`, int(messageEditWindow.Minutes()))
+			return c.JSONBlob(http.StatusConflict, []byte(answer))
+		}
+		if ok, err := allowThreadChange(c, u, t); !ok {
+			return err
+		}
+	}
+	before := map[string]interface{}{"body": m.Body}
+	m.DeletedAt = time.Now().Truncate(time.Second)
+	m.DeletedBy = u.ID
+	m.DeleteReason = req.Reason
+	if err := storage.DeleteTaskMessage(c.Request().Context(), m); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "task_message:"+strconv.Itoa(m.ID), before, map[string]interface{}{"deleted_by": u.ID, "delete_reason": m.DeleteReason})
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "message deleted", "error_code": 0}`))
+}
+
+// taskMessagesReadHandler marks all messages of task read by user.
+// Customer, executor or admin
+func taskMessagesReadHandler(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	if err := storage.MarkTaskMessagesRead(c.Request().Context(), t.ID, u.ID); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "messages marked read", "error_code": 0}`))
+}
+
+// taskMessagesLockHandler closes thread of task for new messages of
+// customer and executor. Admin only
+func taskMessagesLockHandler(c echo.Context) error {
+	var req taskMessagesLockRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to lock messages", "error_code": 125}`))
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	audit.SetAction(c, "task.message.lock")
+	err = storage.LockTaskMessages(c.Request().Context(), &storage.TaskMessageLock{
+		TaskID:    t.ID,
+		ActorID:   u.ID,
+		Reason:    req.Reason,
+		CreatedAt: time.Now().Truncate(time.Second)})
+	if errors.Is(err, storage.ErrDuplicate) {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "messages of task are locked already", "error_code": 206}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.TaskTarget(t.ID), map[string]interface{}{"messages_locked": false}, map[string]interface{}{"messages_locked": true, "lock_reason": req.Reason})
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "messages locked", "error_code": 0}`))
+}
+
+// taskMessagesUnlockHandler opens thread of task again. Admin only
+func taskMessagesUnlockHandler(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to unlock messages", "error_code": 125}`))
+	}
+	t, err := taskOfParticipant(c, u)
+	if t == nil {
+		return err
+	}
+	audit.SetAction(c, "task.message.unlock")
+	err = storage.UnlockTaskMessages(c.Request().Context(), t.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "messages of task aren't locked", "error_code": 207}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.TaskTarget(t.ID), map[string]interface{}{"messages_locked": true}, map[string]interface{}{"messages_locked": false})
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "messages unlocked", "error_code": 0}`))
+}
+
+// unreadMessagesHandlerGet returns numbers of unread messages in tasks of
+// user. User or admin
+func unreadMessagesHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "messages")
+	if owner == nil {
+		return err
+	}
+	unread, err := storage.GetUnreadTaskMessages(c.Request().Context(), owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	type taskUnread struct {
+		TaskID int `json:"task_id"`
+		Unread int `json:"unread"`
+	}
+	tasks, total := make([]taskUnread, 0, len(unread)), 0
+	for _, n := range unread {
+		tasks = append(tasks, taskUnread{n.TaskID, n.Count})
+		total += n.Count
+	}
+	answer, _ := json.Marshal(struct {
+		Tasks     []taskUnread `json:"tasks"`
+		Total     int          `json:"total"`
+		ErrorCode int          `json:"error_code"`
+	}{tasks, total, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
@@ -0,0 +1,127 @@
+// Package metrics defines Prometheus metrics of API and business events.
+// Storage metrics are defined in storage package, all of them are
+// registered in default registry and served by Handler
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "freelance_stock"
+
+var requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: namespace,
+	Subsystem: "http",
+	Name:      "request_duration_seconds",
+	Help:      "Duration of HTTP requests by method, route and status.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"method", "route", "status"})
+
+// TaskCommands counts successful task commands by command name
+var TaskCommands = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "task_commands_total",
+	Help:      "Successful task commands by command.",
+}, []string{"command"})
+
+// TasksCreated counts created tasks
+var TasksCreated = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "tasks_created_total",
+	Help:      "Created tasks.",
+})
+
+// MoneyMoved sums money moved by task commands: "frozen" on acquire,
+// "paid" from customer to executor on accept
+var MoneyMoved = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "money_moved_total",
+	Help:      "Money moved by task commands by kind of movement.",
+}, []string{"kind"})
+
+// LoginRejected counts rejected logins by reason: "rate_limited",
+// "locked_out", "bad_credentials" or "sso_failed"
+var LoginRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "login_rejected_total",
+	Help:      "Rejected login attempts by reason.",
+}, []string{"reason"})
+
+// MailsSent counts sent emails by template and result: "ok" or "error"
+var MailsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "mails_sent_total",
+	Help:      "Sent emails by template and result.",
+}, []string{"template", "result"})
+
+// WebhookAttempts counts webhook delivery attempts by result: "delivered",
+// "retry" or "failed" when no attempts are left
+var WebhookAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "webhook_attempts_total",
+	Help:      "Webhook delivery attempts by result.",
+}, []string{"result"})
+
+// StreamClients : clients connected to event stream
+var StreamClients = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: namespace,
+	Name:      "stream_clients",
+	Help:      "Clients connected to event stream.",
+})
+
+// StreamDropped counts stream clients dropped for not keeping up with events
+var StreamDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "stream_dropped_total",
+	Help:      "Stream clients dropped for being slow.",
+})
+
+// NotificationsDelivered counts notifications sent out of the app by
+// channel, e.g. "email", and result: "ok" or "error"
+var NotificationsDelivered = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "notifications_delivered_total",
+	Help:      "Notifications sent through channels by channel and result.",
+}, []string{"channel", "result"})
+
+// NotificationsDropped counts notifications not sent through channels
+// because delivery queue was full. They stay in inbox anyway
+var NotificationsDropped = promauto.NewCounter(prometheus.CounterOpts{
+	Namespace: namespace,
+	Name:      "notifications_dropped_total",
+	Help:      "Notifications not sent through channels for full queue.",
+})
+
+// Handler serves metrics in Prometheus text format
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// Middleware observes duration of every request. Route is the registered
+// path pattern, e.g. /api/v1/tasks/:task_id, so label values are bounded
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			status = http.StatusInternalServerError
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				status = httpErr.Code
+			}
+		}
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		requestDuration.WithLabelValues(c.Request().Method, route, strconv.Itoa(status)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
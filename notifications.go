@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./audit"
+	"./currency"
+	"./notify"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// notificationsShown : how many latest notifications are listed by default
+const notificationsShown = 50
+
+// notifier sends notifications through channels out of the app, set up in run
+var notifier = notify.NewNotifier()
+
+type notificationView struct {
+	ID        int    `json:"id"`
+	Kind      string `json:"kind"`
+	TaskID    int    `json:"task_id,omitempty"`
+	Message   string `json:"message"`
+	CreatedAt string `json:"created_at"`
+	ReadAt    string `json:"read_at,omitempty"`
+}
+
+type notificationPreferenceView struct {
+	Kind    string `json:"kind"`
+	Channel string `json:"channel"`
+	Enabled bool   `json:"enabled"`
+}
+
+func toNotificationView(n *storage.Notification) notificationView {
+	v := notificationView{
+		ID:        n.ID,
+		Kind:      n.Kind,
+		TaskID:    n.TaskID,
+		Message:   n.Message,
+		CreatedAt: n.CreatedAt.Format(validate.TimeLayout)}
+	if !n.ReadAt.IsZero() {
+		v.ReadAt = n.ReadAt.Format(validate.TimeLayout)
+	}
+	return v
+}
+
+// taskNotification returns notification of user about task
+func taskNotification(userID int, kind string, t *storage.Task, message string) *storage.Notification {
+	return &storage.Notification{
+		UserID:    userID,
+		Kind:      kind,
+		TaskID:    t.ID,
+		Message:   message,
+		CreatedAt: time.Now().Truncate(time.Second)}
+}
+
+// balanceNotifications returns notification of user whose balance actor
+// changed from before, none if balance is the same
+func balanceNotifications(u *storage.User, before currency.Money, actor *storage.User) []*storage.Notification {
+	if u.Balance.GetVal() == before.GetVal() {
+		return nil
+	}
+	return []*storage.Notification{{
+		UserID:    u.ID,
+		Kind:      storage.NotificationBalanceChanged,
+		Message:   fmt.Sprintf("Your balance is changed from %.2f to %.2f by %s", before.GetVal(), u.Balance.GetVal(), actor.UserName),
+		CreatedAt: time.Now().Truncate(time.Second)}}
+}
+
+// notificationsHandlerGet lists latest notifications of user, newest first,
+// with number of unread ones. User or admin
+func notificationsHandlerGet(c echo.Context) error {
+	var req notificationsQueryRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "notifications")
+	if owner == nil {
+		return err
+	}
+	limit := notificationsShown
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	ctx := c.Request().Context()
+	notifications, err := storage.GetNotifications(ctx, owner.ID, req.Unread != nil && *req.Unread, limit)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	unread, err := storage.CountUnreadNotifications(ctx, owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]notificationView, 0, len(notifications))
+	for _, n := range notifications {
+		views = append(views, toNotificationView(n))
+	}
+	answer, _ := json.Marshal(struct {
+		Notifications []notificationView `json:"notifications"`
+		Unread        int                `json:"unread"`
+		ErrorCode     int                `json:"error_code"`
+	}{views, unread, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// notificationReadHandler marks notification read. User or admin
+func notificationReadHandler(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "notifications")
+	if owner == nil {
+		return err
+	}
+	audit.SetAction(c, "notification.read")
+	notificationID, err := strconv.Atoi(c.Param("notification_id"))
+	if err == nil {
+		err = storage.MarkNotificationRead(c.Request().Context(), owner.ID, notificationID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "notification not found", "error_code": 190}`))
+	}
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "notification marked read", "error_code": 0}`))
+}
+
+// notificationsReadAllHandler marks all notifications of user read. User or admin
+func notificationsReadAllHandler(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "notifications")
+	if owner == nil {
+		return err
+	}
+	audit.SetAction(c, "notification.read_all")
+	n, err := storage.MarkAllNotificationsRead(c.Request().Context(), owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	answer := fmt.Sprintf(`{"marked": %d, "error_message": "notifications marked read", "error_code": 0}`, n)
+	return c.JSONBlob(http.StatusOK, []byte(answer))
+}
+
+// notificationPreferencesAnswer writes preferences of user for every
+// channel and kind, defaults included
+func notificationPreferencesAnswer(c echo.Context, userID int) error {
+	prefs, err := storage.GetNotificationPreferences(c.Request().Context(), userID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := []notificationPreferenceView{}
+	for _, channel := range notifier.Channels() {
+		for _, kind := range storage.NotificationKinds {
+			views = append(views, notificationPreferenceView{kind, channel, notify.Enabled(prefs, channel, kind)})
+		}
+	}
+	answer, _ := json.Marshal(struct {
+		Preferences []notificationPreferenceView `json:"preferences"`
+		ErrorCode   int                          `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// notificationPreferencesHandlerGet tells which notification kinds user
+// gets through every channel. User or admin
+func notificationPreferencesHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "notifications")
+	if owner == nil {
+		return err
+	}
+	return notificationPreferencesAnswer(c, owner.ID)
+}
+
+// notificationPreferencesHandlerUpdate sets kinds sent through channel,
+// other kinds are turned off in it. User or admin
+func notificationPreferencesHandlerUpdate(c echo.Context) error {
+	var req notificationPreferencesRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "notifications")
+	if owner == nil {
+		return err
+	}
+	if !hasScope(notifier.Channels(), req.Channel) {
+		answer := fmt.Sprintf(`{"error_message": "unknown channel, known are: %s", "error_code": 191}`, strings.Join(notifier.Channels(), ", "))
+		return c.JSONBlob(http.StatusBadRequest, []byte(answer))
+	}
+	audit.SetAction(c, "notification.preferences")
+	enabled := strings.Split(req.Kinds, ",")
+	prefs := make([]*storage.NotificationPreference, 0, len(storage.NotificationKinds))
+	for _, kind := range storage.NotificationKinds {
+		prefs = append(prefs, &storage.NotificationPreference{Kind: kind, Channel: req.Channel, Enabled: hasScope(enabled, kind)})
+	}
+	if err := storage.SetNotificationPreferences(c.Request().Context(), owner.ID, prefs); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(owner.ID), nil, map[string]interface{}{"notification_channel": req.Channel, "notification_kinds": req.Kinds})
+	return notificationPreferencesAnswer(c, owner.ID)
+}
@@ -0,0 +1,188 @@
+// Package notify sends notifications of inbox out of the app through
+// pluggable channels, e.g. email, by preferences of users. Notifications
+// are saved before they are queued, so a lost delivery loses no message
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"../mailer"
+	"../metrics"
+	"../storage"
+)
+
+// queueSize : notifications waiting for delivery before new ones are dropped
+const queueSize = 256
+
+// ErrNoAddress is returned by channel which can't reach the user, e.g. who
+// has no verified email
+var ErrNoAddress = errors.New("user has no address in channel")
+
+// Channel delivers notifications out of the app
+type Channel interface {
+	// Name identifies channel in preferences, e.g. "email"
+	Name() string
+	Deliver(ctx context.Context, u *storage.User, n *storage.Notification) error
+}
+
+// defaults : kinds sent through channel unless user turned them off
+var defaults = map[string][]string{
+	"email": {storage.NotificationTaskFinished, storage.NotificationTaskAccepted, storage.NotificationTaskDisputed, storage.NotificationDisputeResolved,
+		storage.NotificationBalanceChanged},
+}
+
+// Enabled tells if notifications of kind go through channel by preferences
+// of user, kinds without preference keep defaults
+func Enabled(prefs []*storage.NotificationPreference, channel, kind string) bool {
+	for _, p := range prefs {
+		if p.Channel == channel && p.Kind == kind {
+			return p.Enabled
+		}
+	}
+	for _, k := range defaults[channel] {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// subjects : email subjects by notification kind. Message may contain text
+// of users, e.g. dispute reason, so it goes to body only
+var subjects = map[string]string{
+	storage.NotificationTaskAcquired:    "Your task is taken on freelance stock",
+	storage.NotificationTaskFinished:    "Your task is finished on freelance stock",
+	storage.NotificationTaskAccepted:    "Your solution is accepted on freelance stock",
+	storage.NotificationTaskMessage:     "New message in task on freelance stock",
+	storage.NotificationTaskDisputed:    "Your solution is disputed on freelance stock",
+	storage.NotificationDisputeResolved: "Dispute is resolved on freelance stock",
+	storage.NotificationBalanceChanged:  "Your balance changed on freelance stock",
+}
+
+// subjectOf returns email subject of notification kind
+func subjectOf(kind string) string {
+	if subject, ok := subjects[kind]; ok {
+		return subject
+	}
+	return "Notification on freelance stock"
+}
+
+// Email sends notifications to verified email of user
+type Email struct {
+	Mailer mailer.Mailer
+	URL    string // address of the site in links
+}
+
+// Name implements Channel
+func (Email) Name() string {
+	return "email"
+}
+
+// Deliver implements Channel
+func (e Email) Deliver(ctx context.Context, u *storage.User, n *storage.Notification) error {
+	if u.Email == "" || !u.EmailVerified {
+		return ErrNoAddress
+	}
+	link := e.URL + "/notifications"
+	if n.TaskID != 0 {
+		link = fmt.Sprintf("%s/tasks/%d", e.URL, n.TaskID)
+	}
+	msg, err := mailer.Render("notification", u.Email, struct {
+		Subject string
+		Login   string
+		Message string
+		Link    string
+	}{subjectOf(n.Kind), u.UserName, n.Message, link})
+	if err == nil {
+		err = e.Mailer.Send(ctx, msg)
+	}
+	if err != nil {
+		metrics.MailsSent.WithLabelValues("notification", "error").Inc()
+		return err
+	}
+	metrics.MailsSent.WithLabelValues("notification", "ok").Inc()
+	return nil
+}
+
+// Notifier delivers saved notifications through channels in background
+type Notifier struct {
+	channels []Channel
+	queue    chan *storage.Notification
+}
+
+// NewNotifier returns notifier delivering through channels
+func NewNotifier(channels ...Channel) *Notifier {
+	return &Notifier{channels: channels, queue: make(chan *storage.Notification, queueSize)}
+}
+
+// Channels returns names of channels of notifier
+func (n *Notifier) Channels() []string {
+	names := make([]string, 0, len(n.channels))
+	for _, ch := range n.channels {
+		names = append(names, ch.Name())
+	}
+	return names
+}
+
+// Enqueue queues notifications for delivery. Never blocks: when queue is
+// full notification is only kept in inbox
+func (n *Notifier) Enqueue(notes ...*storage.Notification) {
+	for _, note := range notes {
+		select {
+		case n.queue <- note:
+		default:
+			metrics.NotificationsDropped.Inc()
+			slog.Warn("notification queue is full", "notification_id", note.ID, "kind", note.Kind)
+		}
+	}
+}
+
+// Run delivers queued notifications until ctx is done
+func (n *Notifier) Run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case note := <-n.queue:
+			n.deliver(ctx, note)
+		}
+	}
+}
+
+// deliver sends notification through channels user has it enabled in
+func (n *Notifier) deliver(ctx context.Context, note *storage.Notification) {
+	if len(n.channels) == 0 {
+		return
+	}
+	u, err := storage.GetUserByID(ctx, note.UserID)
+	if err != nil {
+		slog.WarnContext(ctx, "can't get user of notification", "notification_id", note.ID, "err", err)
+		return
+	}
+	if u.Disabled {
+		return
+	}
+	prefs, err := storage.GetNotificationPreferences(ctx, u.ID)
+	if err != nil {
+		slog.WarnContext(ctx, "can't get notification preferences", "user_id", u.ID, "err", err)
+		return
+	}
+	for _, ch := range n.channels {
+		if !Enabled(prefs, ch.Name(), note.Kind) {
+			continue
+		}
+		err := ch.Deliver(ctx, u, note)
+		result := "ok"
+		switch {
+		case errors.Is(err, ErrNoAddress):
+			continue
+		case err != nil:
+			result = "error"
+			slog.WarnContext(ctx, "can't deliver notification", "notification_id", note.ID, "channel", ch.Name(), "err", err)
+		}
+		metrics.NotificationsDelivered.WithLabelValues(ch.Name(), result).Inc()
+	}
+}
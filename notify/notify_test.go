@@ -0,0 +1,45 @@
+package notify
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"../mailer"
+	"../storage"
+)
+
+// sentMail keeps sent messages
+type sentMail []mailer.Message
+
+func (s *sentMail) Send(ctx context.Context, m mailer.Message) error {
+	*s = append(*s, m)
+	return nil
+}
+
+func TestEmailSubjectIsFixedByKind(t *testing.T) {
+	var sent sentMail
+	e := Email{Mailer: &sent, URL: "https://example.com"}
+	u := &storage.User{UserName: "alice", Email: "alice@example.com", EmailVerified: true}
+	message := "Task disputed: urgent\r\nBcc: victim@example.com"
+	kinds := []string{storage.NotificationTaskDisputed, "unknown.kind"}
+	for _, kind := range kinds {
+		if err := e.Deliver(context.Background(), u, &storage.Notification{Kind: kind, TaskID: 7, Message: message}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sent) != len(kinds) {
+		t.Fatalf("sent %d messages, want %d", len(sent), len(kinds))
+	}
+	for i, want := range []string{subjects[storage.NotificationTaskDisputed], "Notification on freelance stock"} {
+		if sent[i].Subject != want {
+			t.Errorf("subject %q, want %q", sent[i].Subject, want)
+		}
+		if !strings.Contains(sent[i].Body, message) || !strings.Contains(sent[i].Body, "https://example.com/tasks/7") {
+			t.Errorf("body %q lacks message or link", sent[i].Body)
+		}
+	}
+	if err := e.Deliver(context.Background(), &storage.User{Email: "bob@example.com"}, &storage.Notification{}); err != ErrNoAddress {
+		t.Errorf("unverified email: %v, want ErrNoAddress", err)
+	}
+}
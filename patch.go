@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"time"
+
+	"./currency"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// maxJSONBodySize : JSON request bodies are read into memory whole, so they
+// are limited. Text columns hold at most 64 KiB, escaping may double it
+const maxJSONBodySize = 256 << 10
+
+// jsonTooLargeAnswer answers body over maxJSONBodySize
+func jsonTooLargeAnswer(c echo.Context) error {
+	answer := fmt.Sprintf(`{"error_message": "body may have at most %d bytes", "error_code": 133}`, maxJSONBodySize)
+	return c.JSONBlob(http.StatusRequestEntityTooLarge, []byte(answer))
+}
+
+// validationErrorAnswer writes all field errors at once
+func validationErrorAnswer(c echo.Context, errs validate.Errors) error {
+	sort.SliceStable(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	answer, _ := json.Marshal(struct {
+		ErrorMessage string          `json:"error_message"`
+		ErrorCode    int             `json:"error_code"`
+		Fields       validate.Errors `json:"fields"`
+	}{"validation failed", 130, errs})
+	return c.JSONBlob(http.StatusUnprocessableEntity, []byte(string(answer)))
+}
+
+// mergePatch : top level members of JSON Merge Patch document (RFC 7396).
+// Our resources are flat, so nested objects are not merged
+type mergePatch map[string]json.RawMessage
+
+// readMergePatch decodes request body sent as application/merge-patch+json
+// or application/json
+func readMergePatch(c echo.Context) (mergePatch, error) {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if mediaType != "application/merge-patch+json" && mediaType != echo.MIMEApplicationJSON {
+		return nil, c.JSONBlob(http.StatusUnsupportedMediaType, []byte(`{"error_message": "content type must be application/merge-patch+json", "error_code": 131}`))
+	}
+	var patch mergePatch
+	body := http.MaxBytesReader(c.Response(), c.Request().Body, maxJSONBodySize)
+	err := json.NewDecoder(body).Decode(&patch)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return nil, jsonTooLargeAnswer(c)
+	}
+	if err != nil || patch == nil {
+		return nil, c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "body must be JSON object", "error_code": 132}`))
+	}
+	return patch, nil
+}
+
+// checkFields reports unknown members and members current user can't change
+func (p mergePatch) checkFields(errs *validate.Errors, known, allowed []string) {
+	for name := range p {
+		switch {
+		case !contains(known, name):
+			errs.Add(name, "unknown field")
+		case !contains(allowed, name):
+			errs.Add(name, "insufficient permission to change field")
+		}
+	}
+}
+
+// checkRules validates patched values with request DTO rules, reporting
+// only fields present in patch which have no errors yet
+func (p mergePatch) checkRules(ctx context.Context, errs validate.Errors, dto interface{}) (validate.Errors, error) {
+	var present []string
+	for name := range p {
+		if !hasFieldError(errs, name) {
+			present = append(present, name)
+		}
+	}
+	dtoErrs, err := validate.Struct(ctx, dto)
+	if err != nil {
+		return nil, err
+	}
+	return append(errs, dtoErrs.Only(present)...), nil
+}
+
+func hasFieldError(errs validate.Errors, field string) bool {
+	for _, e := range errs {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func (p mergePatch) isNull(name string) bool {
+	return string(p[name]) == "null"
+}
+
+// setString sets dst if member is present, null clears it when nullable
+func (p mergePatch) setString(errs *validate.Errors, name string, dst *string, nullable bool) {
+	raw, ok := p[name]
+	if !ok {
+		return
+	}
+	if p.isNull(name) {
+		if !nullable {
+			errs.Add(name, "can't be null")
+			return
+		}
+		*dst = ""
+		return
+	}
+	if err := json.Unmarshal(raw, dst); err != nil {
+		errs.Add(name, "must be string")
+	}
+}
+
+func (p mergePatch) setBool(errs *validate.Errors, name string, dst *bool) {
+	raw, ok := p[name]
+	if !ok {
+		return
+	}
+	if p.isNull(name) || json.Unmarshal(raw, dst) != nil {
+		errs.Add(name, "must be true or false")
+	}
+}
+
+func (p mergePatch) setInt(errs *validate.Errors, name string, dst *int) {
+	raw, ok := p[name]
+	if !ok {
+		return
+	}
+	if p.isNull(name) || json.Unmarshal(raw, dst) != nil {
+		errs.Add(name, "must be integer")
+	}
+}
+
+func (p mergePatch) setMoney(errs *validate.Errors, name string, dst *currency.Money) {
+	raw, ok := p[name]
+	if !ok {
+		return
+	}
+	var val float64
+	if p.isNull(name) || json.Unmarshal(raw, &val) != nil {
+		errs.Add(name, "must be in float number format")
+		return
+	}
+	dst.SetVal(val)
+}
+
+// setTime sets dst from validate.TimeLayout string, null resets it
+func (p mergePatch) setTime(errs *validate.Errors, name string, dst *time.Time) {
+	raw, ok := p[name]
+	if !ok {
+		return
+	}
+	if p.isNull(name) {
+		*dst = time.Time{}
+		return
+	}
+	var str string
+	if err := json.Unmarshal(raw, &str); err != nil {
+		errs.Add(name, "must be like "+validate.TimeLayout)
+		return
+	}
+	t, err := time.Parse(validate.TimeLayout, str)
+	if err != nil {
+		errs.Add(name, "must be like "+validate.TimeLayout)
+		return
+	}
+	*dst = t
+}
+
+func contains(list []string, val string) bool {
+	for _, item := range list {
+		if item == val {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFormMiddleware lets POST and PUT handlers reading c.FormValue accept
+// flat JSON object bodies as well as url encoded and multipart forms
+func jsonFormMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		r := c.Request()
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get(echo.HeaderContentType))
+		if (r.Method != http.MethodPost && r.Method != http.MethodPut) || mediaType != echo.MIMEApplicationJSON {
+			return next(c)
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Response(), r.Body, maxJSONBodySize))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return jsonTooLargeAnswer(c)
+		}
+		if err != nil {
+			return err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var fields map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&fields); err != nil {
+			return c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "body must be JSON object", "error_code": 132}`))
+		}
+		form := r.URL.Query()
+		for name, val := range fields {
+			switch v := val.(type) {
+			case nil:
+				form.Set(name, "")
+			case string:
+				form.Set(name, v)
+			case json.Number, bool:
+				form.Set(name, fmt.Sprint(v))
+			default:
+				// name comes from client, json.Marshal escapes it
+				answer, _ := json.Marshal(struct {
+					ErrorMessage string `json:"error_message"`
+					ErrorCode    int    `json:"error_code"`
+				}{fmt.Sprintf("field %s must be string, number or boolean", name), 132})
+				return c.JSONBlob(http.StatusBadRequest, answer)
+			}
+		}
+		r.Form = form
+		r.PostForm = form
+		return next(c)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestJSONFormMiddleware(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		status  int
+		form    map[string]string
+		message string
+		code    int
+	}{
+		{"flat object", `{"title": "logo", "cost": 9.5, "urgent": true, "note": null}`, http.StatusOK,
+			map[string]string{"title": "logo", "cost": "9.5", "urgent": "true", "note": ""}, "", 0},
+		{"not object", `[1]`, http.StatusBadRequest, nil, "body must be JSON object", 132},
+		{"nested object", `{"tags": ["go"]}`, http.StatusBadRequest, nil, "field tags must be string, number or boolean", 132},
+		{"field name is escaped", `{"a\"b\\c</script>\n": {}}`, http.StatusBadRequest, nil, "field a\"b\\c</script>\n must be string, number or boolean", 132},
+		{"too large", `{"problem": "` + strings.Repeat("x", maxJSONBodySize) + `"}`, http.StatusRequestEntityTooLarge, nil,
+			fmt.Sprintf("body may have at most %d bytes", maxJSONBodySize), 133},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			var form map[string]string
+			err := jsonFormMiddleware(func(c echo.Context) error {
+				form = map[string]string{}
+				for name := range tt.form {
+					form[name] = c.FormValue(name)
+				}
+				return c.NoContent(http.StatusOK)
+			})(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d", rec.Code, tt.status)
+			}
+			for name, want := range tt.form {
+				if form[name] != want {
+					t.Errorf("field %s is %q, want %q", name, form[name], want)
+				}
+			}
+			if tt.message == "" {
+				return
+			}
+			var answer struct {
+				ErrorMessage string `json:"error_message"`
+				ErrorCode    int    `json:"error_code"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+				t.Fatalf("answer %q is not JSON: %v", rec.Body.String(), err)
+			}
+			if answer.ErrorMessage != tt.message || answer.ErrorCode != tt.code {
+				t.Errorf("got %+v, want message %q and code %d", answer, tt.message, tt.code)
+			}
+		})
+	}
+}
+
+func TestReadMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"object", `{"title": "logo"}`, http.StatusOK},
+		{"not object", `null`, http.StatusBadRequest},
+		{"too large", `{"problem": "` + strings.Repeat("x", maxJSONBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, "application/merge-patch+json")
+			rec := httptest.NewRecorder()
+			patch, err := readMergePatch(echo.New().NewContext(req, rec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.status == http.StatusOK {
+				if patch == nil || rec.Body.Len() != 0 {
+					t.Errorf("patch %v rejected: %s", patch, rec.Body)
+				}
+				return
+			}
+			if patch != nil || rec.Code != tt.status {
+				t.Errorf("patch %v answered %d, want %d", patch, rec.Code, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"./audit"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// maxSkills : how many skills user may list on profile
+const maxSkills = 20
+
+// maxPortfolioLinks : how many links user may have in portfolio
+const maxPortfolioLinks = 10
+
+type portfolioLinkView struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// userProfileView : what everybody may know about user
+type userProfileView struct {
+	Login          string              `json:"login"`
+	Bio            string              `json:"bio"`
+	Skills         []string            `json:"skills"`
+	Portfolio      []portfolioLinkView `json:"portfolio"`
+	TasksPosted    int                 `json:"tasks_posted"`
+	TasksCompleted int                 `json:"tasks_completed"`
+	AcceptanceRate float64             `json:"acceptance_rate"`
+	Reputation     reputationView      `json:"reputation"`
+	MemberSince    string              `json:"member_since"`
+}
+
+// profileOf collects public profile of user
+func profileOf(c echo.Context, user *storage.User) (userProfileView, error) {
+	ctx := c.Request().Context()
+	skills, err := storage.GetUserSkills(ctx, user.ID)
+	if err != nil {
+		return userProfileView{}, err
+	}
+	links, err := storage.GetPortfolioLinks(ctx, user.ID)
+	if err != nil {
+		return userProfileView{}, err
+	}
+	stats, err := storage.GetUserStats(ctx, user.ID)
+	if err != nil {
+		return userProfileView{}, err
+	}
+	rep, err := reputationOf(c, user.ID)
+	if err != nil {
+		return userProfileView{}, err
+	}
+	portfolio := make([]portfolioLinkView, 0, len(links))
+	for _, l := range links {
+		portfolio = append(portfolio, portfolioLinkView{l.ID, l.Title, l.URL})
+	}
+	v := userProfileView{
+		Login:          user.UserName,
+		Bio:            user.Bio,
+		Skills:         skills,
+		Portfolio:      portfolio,
+		TasksPosted:    stats.TasksPosted,
+		TasksCompleted: stats.TasksCompleted,
+		Reputation:     rep,
+		MemberSince:    user.CreatedAt.Format(validate.TimeLayout)}
+	if stats.TasksSubmitted > 0 {
+		v.AcceptanceRate = math.Round(float64(stats.TasksCompleted)/float64(stats.TasksSubmitted)*100) / 100
+	}
+	return v, nil
+}
+
+// parseTags splits comma separated tags of tasks or skills of users, which
+// are matched against each other, trimmed, lower cased and sorted without
+// duplicates
+func parseTags(str string) []string {
+	skills := []string{}
+	for _, skill := range strings.Split(str, ",") {
+		skill = strings.ToLower(strings.TrimSpace(skill))
+		if skill != "" && !hasScope(skills, skill) {
+			skills = append(skills, skill)
+		}
+	}
+	sort.Strings(skills)
+	return skills
+}
+
+// profileHandlerUpdate replaces bio and skills of user. User or admin
+func profileHandlerUpdate(c echo.Context) error {
+	var req profileUpdateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "profile")
+	if owner == nil {
+		return err
+	}
+	if !ifMatch(c, owner.Version) {
+		return preconditionFailedAnswer(c)
+	}
+	ctx := c.Request().Context()
+	skillsBefore, err := storage.GetUserSkills(ctx, owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.SetAction(c, "user.profile.update")
+	before := map[string]interface{}{"bio": owner.Bio, "skills": strings.Join(skillsBefore, ",")}
+	skills := parseTags(req.Skills)
+	owner.Bio = req.Bio
+	err = updateInTransaction(ctx, nil, []*storage.User{owner}, "", nil, func(tx *storage.Tx) error {
+		return storage.SetUserSkillsTx(tx, owner.ID, skills)
+	})
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(owner.ID), before, map[string]interface{}{"bio": owner.Bio, "skills": strings.Join(skills, ",")})
+	c.Response().Header().Set("ETag", etag(owner.Version))
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "profile updated", "error_code": 0}`))
+}
+
+// portfolioHandlerCreate adds link to portfolio of user. User or admin
+func portfolioHandlerCreate(c echo.Context) error {
+	var req portfolioLinkRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "portfolio")
+	if owner == nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	links, err := storage.GetPortfolioLinks(ctx, owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if len(links) >= maxPortfolioLinks {
+		answer := fmt.Sprintf(`{"error_message": "portfolio has %d links already", "error_code": 241}`, maxPortfolioLinks)
+		return c.JSONBlob(http.StatusConflict, []byte(answer))
+	}
+	audit.SetAction(c, "user.portfolio.create")
+	l := &storage.PortfolioLink{UserID: owner.ID, Title: req.Title, URL: req.URL}
+	if err := storage.CreatePortfolioLink(ctx, l); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "portfolio_link:"+strconv.Itoa(l.ID), nil, map[string]interface{}{"user_id": owner.ID, "title": l.Title, "url": l.URL})
+	answer, _ := json.Marshal(struct {
+		portfolioLinkView
+		ErrorMessage string `json:"error_message"`
+		ErrorCode    int    `json:"error_code"`
+	}{portfolioLinkView{l.ID, l.Title, l.URL}, "link added", 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+// portfolioHandlerDelete removes link from portfolio of user. User or admin
+func portfolioHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "portfolio")
+	if owner == nil {
+		return err
+	}
+	linkID, err := strconv.Atoi(c.Param("link_id"))
+	if err == nil {
+		audit.SetAction(c, "user.portfolio.delete")
+		err = storage.DeletePortfolioLink(c.Request().Context(), owner.ID, linkID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "portfolio link not found", "error_code": 240}`))
+	}
+	audit.AddChange(c, "portfolio_link:"+strconv.Itoa(linkID), map[string]interface{}{"user_id": owner.ID}, nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "link deleted", "error_code": 0}`))
+}
@@ -0,0 +1,138 @@
+// Package ratelimit limits login attempts with token buckets and locks
+// accounts out progressively after repeated failures. State is kept in
+// a Store: MemoryStore for single server, DBStore when several servers
+// share one database
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"../storage"
+)
+
+// Store keeps buckets and lockouts. Update functions must apply update
+// atomically, update may be called more than once
+type Store interface {
+	UpdateBucket(ctx context.Context, name string, update func(b *storage.RateBucket)) (*storage.RateBucket, error)
+	GetLockout(ctx context.Context, name string) (*storage.Lockout, error)
+	UpdateLockout(ctx context.Context, name string, update func(l *storage.Lockout)) (*storage.Lockout, error)
+	Lockouts(ctx context.Context) ([]*storage.Lockout, error)
+	DeleteLockout(ctx context.Context, name string) error
+}
+
+// pruner is Store keeping lockouts in memory, it drops lockouts whose
+// failures are forgotten and lock is over
+type pruner interface {
+	pruneLockouts(forgotten, now time.Time)
+}
+
+// Limit : token bucket refilled by Rate tokens per second up to Burst
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// PerMinute returns limit of n attempts per minute with burst n
+func PerMinute(n int) Limit {
+	return Limit{Rate: float64(n) / 60, Burst: n}
+}
+
+// Limiter : login rate limits and lockout policy. Account is locked for
+// LockoutBase after LockoutThreshold failures in a row, lock doubles with
+// every next failure up to LockoutMax. Failures older than FailureReset
+// are forgotten
+type Limiter struct {
+	Store            Store
+	IP               Limit
+	Account          Limit
+	LockoutThreshold int
+	LockoutBase      time.Duration
+	LockoutMax       time.Duration
+	FailureReset     time.Duration
+	now              func() time.Time
+}
+
+// NewLimiter returns limiter with default policy: 20 attempts per minute
+// from IP, 5 per minute for account, lockout after 5 failures from 1 minute to 1 hour
+func NewLimiter(store Store) *Limiter {
+	return &Limiter{
+		Store:            store,
+		IP:               PerMinute(20),
+		Account:          PerMinute(5),
+		LockoutThreshold: 5,
+		LockoutBase:      time.Minute,
+		LockoutMax:       time.Hour,
+		FailureReset:     24 * time.Hour,
+		now:              time.Now}
+}
+
+// Allow takes token from bucket of name. If there is none, returns
+// false and time until next token
+func (l *Limiter) Allow(ctx context.Context, name string, limit Limit) (ok bool, retryAfter time.Duration, err error) {
+	var allowed bool
+	bucket, err := l.Store.UpdateBucket(ctx, name, func(b *storage.RateBucket) {
+		now := l.now()
+		tokens := float64(limit.Burst)
+		if !b.Updated.IsZero() {
+			tokens = math.Min(tokens, b.Tokens+now.Sub(b.Updated).Seconds()*limit.Rate)
+		}
+		allowed = tokens >= 1
+		if allowed {
+			tokens--
+		}
+		b.Tokens, b.Updated = tokens, now
+	})
+	if err != nil || allowed {
+		return allowed, 0, err
+	}
+	return false, time.Duration((1 - bucket.Tokens) / limit.Rate * float64(time.Second)), nil
+}
+
+// Locked returns time left until lockout of name ends, 0 if it isn't locked
+func (l *Limiter) Locked(ctx context.Context, name string) (time.Duration, error) {
+	lockout, err := l.Store.GetLockout(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	if left := lockout.LockedUntil.Sub(l.now()); left > 0 {
+		return left, nil
+	}
+	return 0, nil
+}
+
+// Fail records failed attempt of name and locks it out if failures
+// reached threshold
+func (l *Limiter) Fail(ctx context.Context, name string) (*storage.Lockout, error) {
+	now := l.now()
+	if p, ok := l.Store.(pruner); ok {
+		p.pruneLockouts(now.Add(-l.FailureReset), now)
+	}
+	return l.Store.UpdateLockout(ctx, name, func(lockout *storage.Lockout) {
+		if now.Sub(lockout.LastFailure) > l.FailureReset {
+			lockout.Failures = 0
+		}
+		lockout.Failures++
+		lockout.LastFailure = now
+		if lockout.Failures >= l.LockoutThreshold {
+			lockout.LockedUntil = now.Add(l.lockoutDuration(lockout.Failures))
+		}
+	})
+}
+
+func (l *Limiter) lockoutDuration(failures int) time.Duration {
+	d := l.LockoutBase
+	for i := l.LockoutThreshold; i < failures && d < l.LockoutMax; i++ {
+		d *= 2
+	}
+	if d > l.LockoutMax {
+		d = l.LockoutMax
+	}
+	return d
+}
+
+// Reset forgets failures of name, e.g. after successful login
+func (l *Limiter) Reset(ctx context.Context, name string) error {
+	return l.Store.DeleteLockout(ctx, name)
+}
@@ -0,0 +1,139 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// clock : time of tests, advanced by hand
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func testLimiter() (*Limiter, *MemoryStore, *clock) {
+	store := NewMemoryStore()
+	l := NewLimiter(store)
+	c := &clock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	l.now = c.now
+	return l, store, c
+}
+
+func TestAllowRefillsBucket(t *testing.T) {
+	type attempt struct {
+		after      time.Duration // since previous attempt
+		ok         bool
+		retryAfter time.Duration
+	}
+	tests := []struct {
+		name     string
+		limit    Limit
+		attempts []attempt
+	}{
+		{"burst then empty", Limit{Rate: 1, Burst: 2}, []attempt{
+			{0, true, 0}, {0, true, 0}, {0, false, time.Second}}},
+		{"refill by rate", Limit{Rate: 1, Burst: 2}, []attempt{
+			{0, true, 0}, {0, true, 0}, {500 * time.Millisecond, false, 500 * time.Millisecond}, {500 * time.Millisecond, true, 0}}},
+		{"refill up to burst only", Limit{Rate: 1, Burst: 2}, []attempt{
+			{0, true, 0}, {time.Hour, true, 0}, {0, true, 0}, {0, false, time.Second}}},
+		{"per minute", PerMinute(5), []attempt{
+			{0, true, 0}, {0, true, 0}, {0, true, 0}, {0, true, 0}, {0, true, 0}, {0, false, 12 * time.Second},
+			{12 * time.Second, true, 0}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, _, c := testLimiter()
+			for i, a := range tt.attempts {
+				c.t = c.t.Add(a.after)
+				ok, retryAfter, err := l.Allow(context.Background(), "ip:1", tt.limit)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != a.ok || (retryAfter-a.retryAfter).Abs() > time.Millisecond {
+					t.Errorf("attempt %d: %v retry after %v, want %v %v", i, ok, retryAfter, a.ok, a.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestLockoutDuration(t *testing.T) {
+	l, _, _ := testLimiter()
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{5, time.Minute},
+		{6, 2 * time.Minute},
+		{7, 4 * time.Minute},
+		{11, time.Hour}, // 64 minutes capped
+		{100, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := l.lockoutDuration(tt.failures); got != tt.want {
+			t.Errorf("%d failures lock for %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestFailLocksOut(t *testing.T) {
+	ctx := context.Background()
+	l, _, c := testLimiter()
+	for i := 1; i < l.LockoutThreshold; i++ {
+		lockout, err := l.Fail(ctx, "login:a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lockout.Failures != i || !lockout.LockedUntil.IsZero() {
+			t.Fatalf("failure %d: %+v", i, lockout)
+		}
+	}
+	if lockout, _ := l.Fail(ctx, "login:a"); !lockout.LockedUntil.Equal(c.t.Add(time.Minute)) {
+		t.Fatalf("threshold failure locks until %v, want minute", lockout.LockedUntil)
+	}
+	c.t = c.t.Add(20 * time.Second)
+	if left, _ := l.Locked(ctx, "login:a"); left != 40*time.Second {
+		t.Errorf("locked for %v, want 40s", left)
+	}
+	c.t = c.t.Add(time.Minute)
+	if left, _ := l.Locked(ctx, "login:a"); left != 0 {
+		t.Errorf("lock is over, but locked for %v", left)
+	}
+	if lockout, _ := l.Fail(ctx, "login:a"); !lockout.LockedUntil.Equal(c.t.Add(2 * time.Minute)) {
+		t.Errorf("next failure locks until %v, want 2 minutes", lockout.LockedUntil)
+	}
+
+	c.t = c.t.Add(l.FailureReset + time.Second)
+	if lockout, _ := l.Fail(ctx, "login:a"); lockout.Failures != 1 {
+		t.Errorf("failures older than FailureReset are counted: %+v", lockout)
+	}
+	if err := l.Reset(ctx, "login:a"); err != nil {
+		t.Fatal(err)
+	}
+	if lockout, _ := l.Fail(ctx, "login:a"); lockout.Failures != 1 {
+		t.Errorf("reset keeps failures: %+v", lockout)
+	}
+}
+
+func TestMemoryStorePrunesLockouts(t *testing.T) {
+	ctx := context.Background()
+	l, store, c := testLimiter()
+	l.FailureReset, l.LockoutBase, l.LockoutMax = time.Hour, 2*time.Hour, 2*time.Hour
+	l.Fail(ctx, "login:forgotten")
+	for i := 0; i < l.LockoutThreshold; i++ {
+		l.Fail(ctx, "login:locked")
+	}
+	c.t = c.t.Add(90 * time.Minute)
+	l.Fail(ctx, "login:recent")
+	for store.failures%pruneEvery != 0 {
+		l.Fail(ctx, "login:recent")
+	}
+	lockouts, _ := store.Lockouts(ctx)
+	var names []string
+	for _, lockout := range lockouts {
+		names = append(names, lockout.Name)
+	}
+	if len(names) != 2 || names[0] != "login:recent" || names[1] != "login:locked" {
+		t.Errorf("lockouts %v, want forgotten failures pruned and lock kept", names)
+	}
+}
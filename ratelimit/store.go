@@ -0,0 +1,134 @@
+package ratelimit
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"../storage"
+)
+
+const (
+	// buckets not updated for bucketTTL are full again and dropped from memory
+	bucketTTL = time.Hour
+	// lockouts are pruned once per pruneEvery failures
+	pruneEvery = 1024
+)
+
+// MemoryStore keeps state in process memory, it is lost on restart
+type MemoryStore struct {
+	mu       sync.Mutex
+	buckets  map[string]storage.RateBucket
+	lockouts map[string]storage.Lockout
+	updates  int
+	failures int
+}
+
+// NewMemoryStore returns empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets:  make(map[string]storage.RateBucket),
+		lockouts: make(map[string]storage.Lockout)}
+}
+
+func (s *MemoryStore) UpdateBucket(ctx context.Context, name string, update func(b *storage.RateBucket)) (*storage.RateBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.updates++
+	if s.updates%1024 == 0 {
+		for key, b := range s.buckets {
+			if time.Since(b.Updated) > bucketTTL {
+				delete(s.buckets, key)
+			}
+		}
+	}
+	b, ok := s.buckets[name]
+	if !ok {
+		b = storage.RateBucket{Name: name}
+	}
+	update(&b)
+	s.buckets[name] = b
+	return &b, nil
+}
+
+func (s *MemoryStore) GetLockout(ctx context.Context, name string) (*storage.Lockout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.lockouts[name]
+	if !ok {
+		l = storage.Lockout{Name: name}
+	}
+	return &l, nil
+}
+
+func (s *MemoryStore) UpdateLockout(ctx context.Context, name string, update func(l *storage.Lockout)) (*storage.Lockout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.lockouts[name]
+	if !ok {
+		l = storage.Lockout{Name: name}
+	}
+	update(&l)
+	s.lockouts[name] = l
+	return &l, nil
+}
+
+// pruneLockouts drops lockouts with last failure before forgotten which
+// aren't locked at now, once per pruneEvery calls
+func (s *MemoryStore) pruneLockouts(forgotten, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures++
+	if s.failures%pruneEvery != 0 {
+		return
+	}
+	for key, l := range s.lockouts {
+		if l.LastFailure.Before(forgotten) && !l.LockedUntil.After(now) {
+			delete(s.lockouts, key)
+		}
+	}
+}
+
+func (s *MemoryStore) Lockouts(ctx context.Context) ([]*storage.Lockout, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lockouts := make([]*storage.Lockout, 0, len(s.lockouts))
+	for _, l := range s.lockouts {
+		l := l
+		lockouts = append(lockouts, &l)
+	}
+	sort.Slice(lockouts, func(i, j int) bool { return lockouts[i].LastFailure.After(lockouts[j].LastFailure) })
+	return lockouts, nil
+}
+
+func (s *MemoryStore) DeleteLockout(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.lockouts, name)
+	return nil
+}
+
+// DBStore keeps state in rate_limit_buckets and login_lockouts tables,
+// so limits are shared by all servers
+type DBStore struct{}
+
+func (DBStore) UpdateBucket(ctx context.Context, name string, update func(b *storage.RateBucket)) (*storage.RateBucket, error) {
+	return storage.UpdateRateBucket(ctx, name, update)
+}
+
+func (DBStore) GetLockout(ctx context.Context, name string) (*storage.Lockout, error) {
+	return storage.GetLockout(ctx, name)
+}
+
+func (DBStore) UpdateLockout(ctx context.Context, name string, update func(l *storage.Lockout)) (*storage.Lockout, error) {
+	return storage.UpdateLockout(ctx, name, update)
+}
+
+func (DBStore) Lockouts(ctx context.Context) ([]*storage.Lockout, error) {
+	return storage.GetLockouts(ctx)
+}
+
+func (DBStore) DeleteLockout(ctx context.Context, name string) error {
+	return storage.DeleteLockout(ctx, name)
+}
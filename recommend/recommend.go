@@ -0,0 +1,93 @@
+// Package recommend ranks free tasks for executor by how well their
+// categories and tags match skills of executor and tasks they have done
+package recommend
+
+import (
+	"sort"
+	"strings"
+
+	"../storage"
+)
+
+// Weights of matches: skill is what executor says they can do, history is
+// what they have been paid for. History counts up to maxHistory tasks
+const (
+	skillTag      = 3
+	skillCategory = 2
+	maxHistory    = 3
+)
+
+// Profile : what is known about executor
+type Profile struct {
+	Skills  []string
+	History *storage.TaskHistory
+}
+
+// Match : task with its score and why it matches, e.g. "skill:go",
+// "history:go" or "history:category:Design"
+type Match struct {
+	Task    *storage.Task
+	Score   int
+	Reasons []string
+}
+
+// Rank returns up to limit tasks matching profile, best first, newer first
+// among equal. categories are all categories, parents of task category
+// match too
+func Rank(tasks []*storage.Task, p Profile, categories []*storage.Category, limit int) []Match {
+	byID := make(map[int]*storage.Category, len(categories))
+	for _, c := range categories {
+		byID[c.ID] = c
+	}
+	skills := make(map[string]bool, len(p.Skills))
+	for _, s := range p.Skills {
+		skills[s] = true
+	}
+	matches := []Match{}
+	for _, t := range tasks {
+		m := Match{Task: t}
+		for _, tag := range t.Tags {
+			if skills[tag] {
+				m.Score += skillTag
+				m.Reasons = append(m.Reasons, "skill:"+tag)
+			}
+			if n := p.History.Tags[tag]; n > 0 {
+				m.Score += capped(n)
+				m.Reasons = append(m.Reasons, "history:"+tag)
+			}
+		}
+		// guard against cycles, categories are edited by hand
+		seen := map[int]bool{}
+		for c := byID[t.CategoryID]; c != nil && !seen[c.ID]; c = byID[c.ParentID] {
+			seen[c.ID] = true
+			if name := strings.ToLower(c.Name); skills[name] {
+				m.Score += skillCategory
+				m.Reasons = append(m.Reasons, "skill:"+name)
+			}
+			if n := p.History.Categories[c.ID]; n > 0 {
+				m.Score += capped(n)
+				m.Reasons = append(m.Reasons, "history:category:"+c.Name)
+			}
+		}
+		if m.Score > 0 {
+			matches = append(matches, m)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].Score != matches[j].Score {
+			return matches[i].Score > matches[j].Score
+		}
+		return matches[i].Task.ID > matches[j].Task.ID
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return matches
+}
+
+func capped(n int) int {
+	if n > maxHistory {
+		return maxHistory
+	}
+	return n
+}
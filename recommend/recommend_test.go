@@ -0,0 +1,82 @@
+package recommend
+
+import (
+	"reflect"
+	"testing"
+
+	"../storage"
+)
+
+func TestRank(t *testing.T) {
+	categories := []*storage.Category{
+		{ID: 1, Name: "Development"},
+		{ID: 2, ParentID: 1, Name: "Backend"},
+		{ID: 3, ParentID: 2, Name: "Go"},
+		// cycle made by hand
+		{ID: 4, ParentID: 5, Name: "Design"},
+		{ID: 5, ParentID: 4, Name: "Art"},
+	}
+	noHistory := &storage.TaskHistory{}
+	tests := []struct {
+		name    string
+		task    *storage.Task
+		profile Profile
+		score   int // 0 when task doesn't match
+		reasons []string
+	}{
+		{"skill tag", &storage.Task{Tags: []string{"go", "sql"}},
+			Profile{Skills: []string{"go"}, History: noHistory}, 3, []string{"skill:go"}},
+		{"no match", &storage.Task{Tags: []string{"sql"}, CategoryID: 3},
+			Profile{Skills: []string{"design"}, History: noHistory}, 0, nil},
+		{"own category", &storage.Task{CategoryID: 3},
+			Profile{Skills: []string{"go"}, History: noHistory}, 2, []string{"skill:go"}},
+		{"parent categories", &storage.Task{CategoryID: 3},
+			Profile{Skills: []string{"development", "backend"}, History: noHistory}, 4, []string{"skill:backend", "skill:development"}},
+		{"history of parent category", &storage.Task{CategoryID: 3},
+			Profile{History: &storage.TaskHistory{Categories: map[int]int{1: 2}}}, 2, []string{"history:category:Development"}},
+		{"history capped", &storage.Task{Tags: []string{"go", "sql"}},
+			Profile{History: &storage.TaskHistory{Tags: map[string]int{"go": 10, "sql": 1}}}, 4, []string{"history:go", "history:sql"}},
+		{"category history capped", &storage.Task{CategoryID: 2},
+			Profile{History: &storage.TaskHistory{Categories: map[int]int{2: 7}}}, 3, []string{"history:category:Backend"}},
+		{"category cycle", &storage.Task{CategoryID: 4},
+			Profile{Skills: []string{"design", "art"}, History: &storage.TaskHistory{Categories: map[int]int{5: 1}}}, 5,
+			[]string{"skill:design", "skill:art", "history:category:Art"}},
+		{"unknown category", &storage.Task{CategoryID: 99},
+			Profile{Skills: []string{"go"}, History: noHistory}, 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			matches := Rank([]*storage.Task{tt.task}, tt.profile, categories, 10)
+			if tt.score == 0 {
+				if len(matches) != 0 {
+					t.Errorf("matches %+v, want none", matches)
+				}
+				return
+			}
+			if len(matches) != 1 {
+				t.Fatalf("matches %+v, want one", matches)
+			}
+			if m := matches[0]; m.Score != tt.score || !reflect.DeepEqual(m.Reasons, tt.reasons) {
+				t.Errorf("score %d reasons %q, want %d %q", m.Score, m.Reasons, tt.score, tt.reasons)
+			}
+		})
+	}
+}
+
+func TestRankOrder(t *testing.T) {
+	tasks := []*storage.Task{
+		{ID: 1, Tags: []string{"go"}},
+		{ID: 2, Tags: []string{"go", "sql"}},
+		{ID: 3, Tags: []string{"php"}},
+		{ID: 4, Tags: []string{"sql"}},
+		{ID: 5, Tags: []string{"go"}},
+	}
+	p := Profile{Skills: []string{"go", "sql"}, History: &storage.TaskHistory{}}
+	var ids []int
+	for _, m := range Rank(tasks, p, nil, 3) {
+		ids = append(ids, m.Task.ID)
+	}
+	if want := []int{2, 5, 4}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("ranked %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"./audit"
+	"./mailer"
+	"./metrics"
+	"./storage"
+	"github.com/labstack/echo"
+)
+
+const (
+	verifyEmailTTL   = 24 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+// mail sends verification and password reset links, set up in run
+var mail mailer.Mailer = mailer.Log{}
+
+// publicURL : address of the site used in emailed links, set up in run
+var publicURL = "http://localhost:8000"
+
+// hashUserToken returns stored form of emailed token
+func hashUserToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sendUserToken saves new token of purpose and emails link with it to
+// user. Failures are logged only, user can ask for another link
+func sendUserToken(ctx context.Context, u *storage.User, purpose storage.TokenPurpose) {
+	name, page, ttl := "verify_email", "/verify-email", verifyEmailTTL
+	if purpose == storage.TokenResetPassword {
+		name, page, ttl = "reset_password", "/reset-password", resetPasswordTTL
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		slog.ErrorContext(ctx, "can't generate token", "err", err)
+		return
+	}
+	token := hex.EncodeToString(b)
+	now := time.Now().Truncate(time.Second)
+	t := &storage.UserToken{
+		Hash:      hashUserToken(token),
+		UserID:    u.ID,
+		Purpose:   purpose,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl)}
+	if err := storage.CreateUserToken(ctx, t); err != nil {
+		slog.ErrorContext(ctx, "can't save token", "err", err)
+		return
+	}
+	msg, err := mailer.Render(name, u.Email, struct {
+		Login   string
+		Link    string
+		Expires string
+	}{u.UserName, publicURL + page + "?token=" + token, t.ExpiresAt.Format("2006-01-02 15:04 MST")})
+	if err == nil {
+		err = mail.Send(ctx, msg)
+	}
+	if err != nil {
+		metrics.MailsSent.WithLabelValues(name, "error").Inc()
+		slog.ErrorContext(ctx, "can't send mail", "template", name, "err", err)
+		return
+	}
+	metrics.MailsSent.WithLabelValues(name, "ok").Inc()
+}
+
+// useUserToken uses up token of purpose and saves user changed by change
+// in one transaction. On failure writes answer and returns nil
+func useUserToken(c echo.Context, purpose storage.TokenPurpose, token string, change func(u *storage.User)) (*storage.User, error) {
+	ctx := c.Request().Context()
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	defer storage.RollbackTransaction(tx)
+	t, err := storage.UseUserTokenTx(tx, purpose, hashUserToken(token))
+	if errors.Is(err, storage.ErrNotFound) {
+		return nil, c.JSONBlob(http.StatusBadRequest, []byte(`{"error_message": "token is invalid, used or expired", "error_code": 150}`))
+	}
+	if err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	u, err := storage.GetUserByID(ctx, t.UserID)
+	if err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	audit.SetActor(c, u.UserName)
+	before := audit.UserSnapshot(u)
+	change(u)
+	if err := storage.UpdateUserTx(tx, u); err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	if err := storage.CommitTransaction(tx); err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(u.ID), before, audit.UserSnapshot(u))
+	return u, nil
+}
+
+// registerHandler creates user who can log in after following link
+// emailed to verify address
+func registerHandler(c echo.Context) error {
+	var req registerRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.register")
+	audit.SetActor(c, req.UserName)
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	ctx := c.Request().Context()
+	passwordHash := fmt.Sprintf("%x", md5.Sum([]byte(req.Password)))
+	id, err := storage.RegisterUser(ctx, req.UserName, passwordHash, req.Email)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "user with such user_name already exists", "error_code": 124}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	u := &storage.User{ID: id, UserName: req.UserName, PasswordHash: passwordHash, Email: req.Email}
+	audit.AddChange(c, audit.UserTarget(id), nil, audit.UserSnapshot(u))
+	sendUserToken(ctx, u, storage.TokenVerifyEmail)
+	answer := fmt.Sprintf(`{"id": "%d", "error_message": "user registered, follow the link sent to email to log in", "error_code": 0}`, id)
+	return c.JSONBlob(http.StatusCreated, []byte(answer))
+}
+
+// verifyEmailHandler marks email of token owner verified, so the user can log in
+func verifyEmailHandler(c echo.Context) error {
+	var req tokenRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.verify_email")
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	u, err := useUserToken(c, storage.TokenVerifyEmail, req.Token, func(u *storage.User) { u.EmailVerified = true })
+	if u == nil {
+		return err
+	}
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "email verified", "error_code": 0}`))
+}
+
+// resendVerificationHandler emails new verification links to unverified
+// users with email. Answer is the same whether there are such users or not
+func resendVerificationHandler(c echo.Context) error {
+	var req emailRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.resend_verification")
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	ctx := c.Request().Context()
+	users, err := storage.GetUsersByEmail(ctx, req.Email)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	for _, u := range users {
+		if !u.EmailVerified && !u.Disabled {
+			sendUserToken(ctx, u, storage.TokenVerifyEmail)
+		}
+	}
+	return c.JSONBlob(http.StatusAccepted, []byte(`{"error_message": "if there is unverified user with this email, verification link is sent to it", "error_code": 0}`))
+}
+
+// forgotPasswordHandler emails password reset links to users with verified
+// email. Answer is the same whether there are such users or not
+func forgotPasswordHandler(c echo.Context) error {
+	var req emailRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.forgot_password")
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	ctx := c.Request().Context()
+	users, err := storage.GetUsersByEmail(ctx, req.Email)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	for _, u := range users {
+		if u.EmailVerified && !u.Disabled {
+			sendUserToken(ctx, u, storage.TokenResetPassword)
+		}
+	}
+	return c.JSONBlob(http.StatusAccepted, []byte(`{"error_message": "if there is user with this email, password reset link is sent to it", "error_code": 0}`))
+}
+
+// resetPasswordHandler sets new password of token owner and ends the
+// user's sessions
+func resetPasswordHandler(c echo.Context) error {
+	var req passwordResetRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.reset_password")
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	passwordHash := fmt.Sprintf("%x", md5.Sum([]byte(req.Password)))
+	u, err := useUserToken(c, storage.TokenResetPassword, req.Token, func(u *storage.User) { u.PasswordHash = passwordHash })
+	if u == nil {
+		return err
+	}
+	storage.EndSessions(u.ID)
+	ctx := c.Request().Context()
+	if err := loginLimiter.Reset(ctx, accountLockoutName(u.UserName)); err != nil {
+		slog.WarnContext(ctx, "can't reset login failures", "err", err)
+	}
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "password changed, log in with new password", "error_code": 0}`))
+}
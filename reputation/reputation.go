@@ -0,0 +1,52 @@
+// Package reputation aggregates ratings of user into a score. Ratings of
+// expensive tasks weigh more, old ratings fade out with HalfLife
+package reputation
+
+import (
+	"math"
+	"time"
+
+	"../storage"
+)
+
+// HalfLife : age at which rating weighs half as much as a fresh one
+const HalfLife = 180 * 24 * time.Hour
+
+// MinCost : cost ratings of cheaper and free tasks are weighted as
+const MinCost = 0.01
+
+// Reputation : weighted and plain mean ratings from 1 to 5, 0 when user
+// has no ratings
+type Reputation struct {
+	Score   float64
+	Average float64
+	Ratings int
+}
+
+// Weight returns weight of rating at time now
+func Weight(r *storage.Rating, now time.Time) float64 {
+	age := now.Sub(r.CreatedAt)
+	if age < 0 {
+		age = 0
+	}
+	return math.Max(r.Cost.GetVal(), MinCost) * math.Pow(0.5, float64(age)/float64(HalfLife))
+}
+
+// Of returns weighted and plain mean of ratings rounded to hundredths
+func Of(ratings []*storage.Rating, now time.Time) Reputation {
+	var sum, weights, total float64
+	for _, r := range ratings {
+		w := Weight(r, now)
+		sum += w * float64(r.Value)
+		weights += w
+		total += float64(r.Value)
+	}
+	rep := Reputation{Ratings: len(ratings)}
+	if weights > 0 {
+		rep.Score = math.Round(sum/weights*100) / 100
+	}
+	if len(ratings) > 0 {
+		rep.Average = math.Round(total/float64(len(ratings))*100) / 100
+	}
+	return rep
+}
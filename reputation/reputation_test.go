@@ -0,0 +1,57 @@
+package reputation
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"../currency"
+	"../storage"
+)
+
+var now = time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func rating(value int, cost float64, age time.Duration) *storage.Rating {
+	return &storage.Rating{Value: value, Cost: currency.MoneyCtr(cost), CreatedAt: now.Add(-age)}
+}
+
+func TestWeight(t *testing.T) {
+	tests := []struct {
+		name   string
+		rating *storage.Rating
+		want   float64
+	}{
+		{"fresh", rating(5, 10, 0), 10},
+		{"half life old", rating(5, 10, HalfLife), 5},
+		{"two half lives old", rating(5, 10, 2*HalfLife), 2.5},
+		{"from future", rating(5, 10, -time.Hour), 10},
+		{"free task", rating(5, 0, 0), MinCost},
+		{"cheaper than MinCost", rating(5, 0.001, 0), MinCost},
+	}
+	for _, tt := range tests {
+		if got := Weight(tt.rating, now); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: weight %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		ratings []*storage.Rating
+		want    Reputation
+	}{
+		{"no ratings", nil, Reputation{}},
+		{"empty ratings", []*storage.Rating{}, Reputation{}},
+		{"one rating", []*storage.Rating{rating(4, 10, 0)}, Reputation{4, 4, 1}},
+		{"old rating weighs half", []*storage.Rating{rating(5, 10, 0), rating(1, 10, HalfLife)}, Reputation{3.67, 3, 2}},
+		{"expensive task weighs more", []*storage.Rating{rating(5, 30, 0), rating(1, 10, 0)}, Reputation{4, 3, 2}},
+		{"free tasks weigh MinCost", []*storage.Rating{rating(5, 0, 0), rating(2, 0, 0)}, Reputation{3.5, 3.5, 2}},
+		{"free task barely counts", []*storage.Rating{rating(5, 100, 0), rating(1, 0, 0)}, Reputation{5, 3, 2}},
+	}
+	for _, tt := range tests {
+		if got := Of(tt.ratings, now); got != tt.want {
+			t.Errorf("%s: %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"./storage"
+	"./validate"
+	"./webhooks"
+	"github.com/labstack/echo"
+)
+
+// Request DTOs. Lengths follow sql/users.sql and sql/tasks.sql columns,
+// pointer fields are optional and stay nil when value is absent or empty.
+// Money columns are decimal(25,12), amounts are kept at most 10^12 leaving
+// room for balances to grow
+
+type loginRequest struct {
+	Login    string `form:"login" validate:"required,maxlen=45"`
+	Password string `form:"password" validate:"required"`
+}
+
+type userCreateRequest struct {
+	IsAdmin  bool   `form:"is_admin" validate:"required"`
+	UserName string `form:"user_name" validate:"required,maxlen=45"`
+	Password string `form:"password" validate:"required"`
+	Email    string `form:"email" validate:"maxlen=45,email"`
+}
+
+type registerRequest struct {
+	UserName string `form:"user_name" validate:"required,maxlen=45"`
+	Password string `form:"password" validate:"required,minlen=8"`
+	Email    string `form:"email" validate:"required,maxlen=45,email"`
+}
+
+type emailRequest struct {
+	Email string `form:"email" validate:"required,maxlen=45,email"`
+}
+
+type tokenRequest struct {
+	Token string `form:"token" validate:"required,maxlen=64"`
+}
+
+type passwordResetRequest struct {
+	Token    string `form:"token" validate:"required,maxlen=64"`
+	Password string `form:"password" validate:"required,minlen=8"`
+}
+
+type userUpdateRequest struct {
+	IsAdmin      *bool    `form:"is_admin"`
+	Password     *string  `form:"password" validate:"minlen=8"`
+	Email        *string  `form:"email" validate:"maxlen=45,email"`
+	Balance      *float64 `form:"balance" validate:"min=0,max=1000000000000"`
+	FrozenAmount *float64 `form:"frozen_amount" validate:"min=0,max=1000000000000"`
+}
+
+type taskCreateRequest struct {
+	Title      string  `form:"title" validate:"required,maxlen=45"`
+	Cost       float64 `form:"cost" validate:"required,min=0,max=1000000000000"`
+	CategoryID int     `form:"category_id" validate:"min=0,category"`
+	Tags       string  `form:"tags" validate:"tags"` // comma separated
+	Problem    string  `form:"problem" validate:"maxbytes=65535"`
+}
+
+type taskUpdateRequest struct {
+	CustomerID    *int       `form:"customer_id" validate:"user"`
+	ExecutionerID *int       `form:"executor_id" validate:"min=0,user"`
+	Title         *string    `form:"title" validate:"maxlen=45"`
+	State         *int       `form:"state" validate:"min=0,max=6"`
+	Cost          *float64   `form:"cost" validate:"min=0,max=1000000000000"`
+	CategoryID    *int       `form:"category_id" validate:"min=0,category"`
+	Tags          *string    `form:"tags" validate:"tags"` // comma separated, PATCH clears them
+	Problem       *string    `form:"problem" validate:"maxbytes=65535"`
+	Solution      *string    `form:"solution" validate:"maxbytes=65535"`
+	BeginTime     *time.Time `form:"begin_time"`
+	EndTime       *time.Time `form:"end_time"`
+}
+
+type tasksQueryRequest struct {
+	State      *int    `form:"state" validate:"min=0,max=6"` // all but closed by default
+	CategoryID *int    `form:"category_id" validate:"min=1"` // with subcategories
+	Tags       *string `form:"tags" validate:"tags"`         // tasks with all of them
+	BeforeID   *int    `form:"before_id" validate:"min=1"`
+	Limit      *int    `form:"limit" validate:"min=1,max=200"`
+}
+
+type recommendedTasksQueryRequest struct {
+	Limit *int `form:"limit" validate:"min=1,max=100"`
+}
+
+type categoryCreateRequest struct {
+	Name     string `form:"name" validate:"required,maxlen=45"`
+	ParentID int    `form:"parent_id" validate:"min=0,category"`
+}
+
+type taskFinishRequest struct {
+	Solution string `form:"solution" validate:"maxbytes=65535"`
+	Preview  string `form:"preview" validate:"maxlen=500"` // shown to customer until solution is accepted
+}
+
+type taskDisputeRequest struct {
+	Reason string `form:"reason" validate:"required,maxlen=1000"`
+}
+
+type disputeResolveRequest struct {
+	Resolution string `form:"resolution" validate:"required,resolution"`
+	Reason     string `form:"reason" validate:"required,maxlen=1000"`
+}
+
+type loginSecondFactorRequest struct {
+	Challenge string `form:"challenge" validate:"required,maxlen=64"`
+	Code      string `form:"code" validate:"required,maxlen=32"`
+}
+
+type loginEnrollRequest struct {
+	Challenge string `form:"challenge" validate:"required,maxlen=64"`
+}
+
+type twoFactorCodeRequest struct {
+	Code string `form:"code" validate:"required,maxlen=32"`
+}
+
+// code is not needed when admin resets two-factor authentication of other user
+type twoFactorDisableRequest struct {
+	Code string `form:"code" validate:"maxlen=32"`
+}
+
+type apiKeyCreateRequest struct {
+	Name   string `form:"name" validate:"required,maxlen=64"`
+	Scopes string `form:"scopes" validate:"required,scopes"` // comma separated
+}
+
+type webhookCreateRequest struct {
+	URL    string `form:"url" validate:"required,maxlen=255,url"`
+	Events string `form:"events" validate:"required,events"` // comma separated
+}
+
+type streamRequest struct {
+	Events  *string  `form:"events" validate:"events"` // comma separated, all by default
+	Mine    *bool    `form:"mine"`
+	MinCost *float64 `form:"min_cost" validate:"min=0"`
+}
+
+type notificationsQueryRequest struct {
+	Unread *bool `form:"unread"`
+	Limit  *int  `form:"limit" validate:"min=1,max=200"`
+}
+
+type notificationPreferencesRequest struct {
+	Channel string `form:"channel" validate:"required,maxlen=16"`
+	Kinds   string `form:"kinds" validate:"kinds"` // comma separated kinds sent through channel, empty for none
+}
+
+type taskMessagesQueryRequest struct {
+	AfterID *int `form:"after_id" validate:"min=0"`
+	Limit   *int `form:"limit" validate:"min=1,max=500"`
+}
+
+type taskMessageRequest struct {
+	Body    string `form:"body" validate:"required,maxlen=4000"`
+	ReplyTo *int   `form:"reply_to" validate:"min=1"`
+}
+
+type taskMessageUpdateRequest struct {
+	Body string `form:"body" validate:"required,maxlen=4000"`
+}
+
+type taskMessageDeleteRequest struct {
+	Reason string `form:"reason" validate:"maxlen=255"`
+}
+
+type taskMessagesLockRequest struct {
+	Reason string `form:"reason" validate:"required,maxlen=255"`
+}
+
+type taskReviewRequest struct {
+	Rating int    `form:"rating" validate:"required,min=1,max=5"`
+	Body   string `form:"body" validate:"maxlen=2000"`
+}
+
+type taskReviewHideRequest struct {
+	Reason string `form:"reason" validate:"required,maxlen=255"`
+}
+
+type reviewsQueryRequest struct {
+	Limit *int `form:"limit" validate:"min=1,max=200"`
+}
+
+type profileUpdateRequest struct {
+	Bio    string `form:"bio" validate:"maxlen=1000"`
+	Skills string `form:"skills" validate:"skills"` // comma separated, empty for none
+}
+
+type portfolioLinkRequest struct {
+	Title string `form:"title" validate:"required,maxlen=100"`
+	URL   string `form:"url" validate:"required,maxlen=255,url"`
+}
+
+type attachmentCreateRequest struct {
+	Kind   string `form:"kind" validate:"required,attachment_kind"`
+	SHA256 string `form:"sha256" validate:"maxlen=64"` // hex checksum to verify upload, optional
+}
+
+type auditQueryRequest struct {
+	Actor  string     `form:"actor" validate:"maxlen=45"`
+	Target string     `form:"target" validate:"maxlen=64"`
+	From   *time.Time `form:"from"`
+	To     *time.Time `form:"to"`
+	Limit  *int       `form:"limit" validate:"min=1,max=1000"`
+}
+
+// lookups of user and category rules
+var (
+	lookupUser     = storage.GetUserByID
+	lookupCategory = storage.GetCategory
+)
+
+func init() {
+	// user: referenced user exists, 0 means no user
+	validate.RegisterLookupRule("user", func(ctx context.Context, value interface{}, param string) (string, error) {
+		id, _ := value.(int)
+		if id == 0 {
+			return "", nil
+		}
+		_, err := lookupUser(ctx, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return "must be id of existing user", nil
+		}
+		return "", err
+	})
+	// category: referenced category exists, 0 means no category
+	validate.RegisterLookupRule("category", func(ctx context.Context, value interface{}, param string) (string, error) {
+		id, _ := value.(int)
+		if id == 0 {
+			return "", nil
+		}
+		_, err := lookupCategory(ctx, id)
+		if errors.Is(err, storage.ErrNotFound) {
+			return "must be id of existing category", nil
+		}
+		return "", err
+	})
+	// tags: comma separated tags of task
+	validate.RegisterRule("tags", func(value interface{}, param string) string {
+		str, _ := value.(string)
+		tags := parseTags(str)
+		if len(tags) > maxTaskTags {
+			return fmt.Sprintf("must have at most %d tags", maxTaskTags)
+		}
+		for _, tag := range tags {
+			if utf8.RuneCountInString(tag) > 45 {
+				return "must have tags of at most 45 characters"
+			}
+		}
+		return ""
+	})
+	// scopes: comma separated API key scopes
+	validate.RegisterRule("scopes", func(value interface{}, param string) string {
+		str, _ := value.(string)
+		for _, scope := range strings.Split(str, ",") {
+			if !hasScope(apiKeyScopes, scope) {
+				return "must be comma separated list of " + strings.Join(apiKeyScopes, ", ")
+			}
+		}
+		return ""
+	})
+	// events: comma separated webhook event types
+	validate.RegisterRule("events", func(value interface{}, param string) string {
+		str, _ := value.(string)
+		for _, event := range strings.Split(str, ",") {
+			if !hasScope(webhooks.Events, event) {
+				return "must be comma separated list of " + strings.Join(webhooks.Events, ", ")
+			}
+		}
+		return ""
+	})
+	// resolution: how admin resolves dispute
+	validate.RegisterRule("resolution", func(value interface{}, param string) string {
+		if str, _ := value.(string); str != storage.ResolutionAccept && str != storage.ResolutionRework {
+			return "must be " + storage.ResolutionAccept + " or " + storage.ResolutionRework
+		}
+		return ""
+	})
+	// attachment_kind: problem or solution
+	validate.RegisterRule("attachment_kind", func(value interface{}, param string) string {
+		if str, _ := value.(string); str != storage.AttachmentProblem && str != storage.AttachmentSolution {
+			return "must be " + storage.AttachmentProblem + " or " + storage.AttachmentSolution
+		}
+		return ""
+	})
+	// skills: comma separated skills of user
+	validate.RegisterRule("skills", func(value interface{}, param string) string {
+		str, _ := value.(string)
+		skills := parseTags(str)
+		if len(skills) > maxSkills {
+			return fmt.Sprintf("must have at most %d skills", maxSkills)
+		}
+		for _, skill := range skills {
+			if utf8.RuneCountInString(skill) > 45 {
+				return "must have skills of at most 45 characters"
+			}
+		}
+		return ""
+	})
+	// kinds: comma separated notification kinds
+	validate.RegisterRule("kinds", func(value interface{}, param string) string {
+		str, _ := value.(string)
+		for _, kind := range strings.Split(str, ",") {
+			if !hasScope(storage.NotificationKinds, kind) {
+				return "must be comma separated list of " + strings.Join(storage.NotificationKinds, ", ")
+			}
+		}
+		return ""
+	})
+}
+
+// formSource reads request values for validate.Bind
+func formSource(c echo.Context) validate.Source {
+	return func(name string) (string, bool) {
+		val := c.FormValue(name)
+		_, ok := c.Request().Form[name]
+		return val, ok
+	}
+}
+
+// bindRequest fills and validates dto, on failure writes validation error
+// answer, or storage error answer if rule lookup failed, and returns false
+func bindRequest(c echo.Context, dto interface{}) (ok bool, err error) {
+	errs, err := validate.Bind(c.Request().Context(), formSource(c), dto)
+	if err != nil {
+		return false, storageErrorAnswer(c, err)
+	}
+	if len(errs) > 0 {
+		return false, validationErrorAnswer(c, errs)
+	}
+	return true, nil
+}
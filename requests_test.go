@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"./storage"
+	"./validate"
+	"./webhooks"
+)
+
+// existing user and category have ID 1, ID 2 is missing, lookup of ID 3
+// fails as if database were down. Lookups end with request context
+func stubLookups(t *testing.T) {
+	userOf, categoryOf := lookupUser, lookupCategory
+	t.Cleanup(func() { lookupUser, lookupCategory = userOf, categoryOf })
+	lookupUser = func(ctx context.Context, id int) (*storage.User, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		switch id {
+		case 1:
+			return &storage.User{ID: 1}, nil
+		case 3:
+			return nil, storage.ErrUnavailable
+		}
+		return nil, storage.ErrNotFound
+	}
+	lookupCategory = func(ctx context.Context, id int) (*storage.Category, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		switch id {
+		case 1:
+			return &storage.Category{ID: 1, Name: "Design"}, nil
+		case 3:
+			return nil, storage.ErrUnavailable
+		}
+		return nil, storage.ErrNotFound
+	}
+}
+
+func formOf(values map[string]string) validate.Source {
+	return func(name string) (string, bool) {
+		val, ok := values[name]
+		return val, ok
+	}
+}
+
+func fieldErrors(errs validate.Errors) []string {
+	retVal := []string{}
+	for _, e := range errs {
+		retVal = append(retVal, e.Field+": "+e.Message)
+	}
+	return retVal
+}
+
+func list(n int, prefix string) string {
+	items := []string{}
+	for i := 0; i < n; i++ {
+		items = append(items, fmt.Sprintf("%s%d", prefix, i))
+	}
+	return strings.Join(items, ",")
+}
+
+type form map[string]string
+
+func TestRequests(t *testing.T) {
+	stubLookups(t)
+	long := func(n int) string { return strings.Repeat("a", n) }
+	tests := []struct {
+		name   string
+		dto    interface{}
+		values form
+		errs   []string
+	}{
+		{"login ok", &loginRequest{}, form{"login": "nurbek", "password": "x"}, nil},
+		{"login missing", &loginRequest{}, form{}, []string{"login: is required", "password: is required"}},
+		{"login too long", &loginRequest{}, form{"login": long(46), "password": "x"}, []string{"login: must be at most 45 characters long"}},
+
+		{"user create ok", &userCreateRequest{}, form{"is_admin": "false", "user_name": "nurbek", "password": "x", "email": "n@example.com"}, nil},
+		{"user create missing", &userCreateRequest{}, form{}, []string{"is_admin: is required", "user_name: is required", "password: is required"}},
+		{"user create bad", &userCreateRequest{}, form{"is_admin": "yes", "user_name": long(46), "password": "x", "email": "nurbek"},
+			[]string{"is_admin: must be true or false", "user_name: must be at most 45 characters long", "email: must be valid email address"}},
+
+		{"register ok", &registerRequest{}, form{"user_name": "nurbek", "password": "password123", "email": "n@example.com"}, nil},
+		{"register short password", &registerRequest{}, form{"user_name": "nurbek", "password": "1234567", "email": "n@example.com"},
+			[]string{"password: must be at least 8 characters long"}},
+		{"register missing email", &registerRequest{}, form{"user_name": "nurbek", "password": "password123"}, []string{"email: is required"}},
+		{"register long email", &registerRequest{}, form{"user_name": "nurbek", "password": "password123", "email": long(40) + "@b.com"},
+			[]string{"email: must be at most 45 characters long"}},
+
+		{"email ok", &emailRequest{}, form{"email": "n@example.com"}, nil},
+		{"email bad", &emailRequest{}, form{"email": "n@"}, []string{"email: must be valid email address"}},
+		{"token ok", &tokenRequest{}, form{"token": long(64)}, nil},
+		{"token too long", &tokenRequest{}, form{"token": long(65)}, []string{"token: must be at most 64 characters long"}},
+		{"password reset ok", &passwordResetRequest{}, form{"token": "t", "password": "password123"}, nil},
+		{"password reset bad", &passwordResetRequest{}, form{"password": "short"}, []string{"token: is required", "password: must be at least 8 characters long"}},
+
+		{"user update empty", &userUpdateRequest{}, form{}, nil},
+		{"user update ok", &userUpdateRequest{}, form{"is_admin": "true", "password": "password123", "email": "n@example.com", "balance": "1000000000000", "frozen_amount": "0"}, nil},
+		{"user update bad", &userUpdateRequest{}, form{"is_admin": "1x", "email": "x", "balance": "-1", "frozen_amount": "1000000000000.5"},
+			[]string{"is_admin: must be true or false", "email: must be valid email address", "balance: must be at least 0", "frozen_amount: must be at most 1000000000000"}},
+		{"user update short password", &userUpdateRequest{}, form{"password": "1234567"}, []string{"password: must be at least 8 characters long"}},
+		{"user update money format", &userUpdateRequest{}, form{"balance": "ten"}, []string{"balance: must be in float number format"}},
+
+		{"task create ok", &taskCreateRequest{}, form{"title": "logo", "cost": "9.5", "category_id": "1", "tags": "Go, mysql", "problem": "draw"}, nil},
+		{"task create no category", &taskCreateRequest{}, form{"title": "logo", "cost": "10", "category_id": "0"}, nil},
+		{"task create missing", &taskCreateRequest{}, form{}, []string{"title: is required", "cost: is required"}},
+		{"task create bad", &taskCreateRequest{}, form{"title": long(46), "cost": "1000000000001", "category_id": "2", "tags": list(11, "t"), "problem": long(65536)},
+			[]string{"title: must be at most 45 characters long", "cost: must be at most 1000000000000", "category_id: must be id of existing category",
+				"tags: must have at most 10 tags", "problem: must be at most 65535 bytes long"}},
+		{"task create negative", &taskCreateRequest{}, form{"title": "logo", "cost": "-1", "category_id": "-1", "tags": long(46)},
+			[]string{"cost: must be at least 0", "category_id: must be at least 0", "tags: must have tags of at most 45 characters"}},
+		{"task create duplicate tags count once", &taskCreateRequest{}, form{"title": "logo", "cost": "1", "tags": list(10, "t") + ",T1, t2"}, nil},
+
+		{"task update empty", &taskUpdateRequest{}, form{}, nil},
+		{"task update ok", &taskUpdateRequest{}, form{"customer_id": "1", "executor_id": "0", "title": "logo", "state": "6", "cost": "1",
+			"category_id": "1", "tags": "go", "problem": "p", "solution": "s", "begin_time": "2024-03-01 10:00:00", "end_time": "2024-03-02 10:00:00"}, nil},
+		{"task update bad", &taskUpdateRequest{}, form{"customer_id": "2", "executor_id": "-1", "state": "7", "cost": "-0.5", "category_id": "2",
+			"solution": long(65536), "begin_time": "yesterday"},
+			[]string{"begin_time: must be like 2006-01-02 15:04:05", "customer_id: must be id of existing user", "executor_id: must be at least 0",
+				"state: must be at most 6", "cost: must be at least 0", "category_id: must be id of existing category", "solution: must be at most 65535 bytes long"}},
+		{"task update not integer", &taskUpdateRequest{}, form{"customer_id": "one", "state": "1.5"},
+			[]string{"customer_id: must be integer", "state: must be integer"}},
+
+		{"tasks query empty", &tasksQueryRequest{}, form{}, nil},
+		{"tasks query ok", &tasksQueryRequest{}, form{"state": "0", "category_id": "2", "tags": "go", "before_id": "100", "limit": "200"}, nil},
+		{"tasks query bad", &tasksQueryRequest{}, form{"state": "-1", "category_id": "0", "tags": list(11, "t"), "before_id": "0", "limit": "201"},
+			[]string{"state: must be at least 0", "category_id: must be at least 1", "tags: must have at most 10 tags", "before_id: must be at least 1", "limit: must be at most 200"}},
+		{"recommended ok", &recommendedTasksQueryRequest{}, form{"limit": "100"}, nil},
+		{"recommended bad", &recommendedTasksQueryRequest{}, form{"limit": "0"}, []string{"limit: must be at least 1"}},
+
+		{"category create ok", &categoryCreateRequest{}, form{"name": "Logos", "parent_id": "1"}, nil},
+		{"category create top level", &categoryCreateRequest{}, form{"name": "Design"}, nil},
+		{"category create bad", &categoryCreateRequest{}, form{"name": long(46), "parent_id": "2"},
+			[]string{"name: must be at most 45 characters long", "parent_id: must be id of existing category"}},
+		{"category create missing", &categoryCreateRequest{}, form{"parent_id": "-1"}, []string{"name: is required", "parent_id: must be at least 0"}},
+
+		{"finish ok", &taskFinishRequest{}, form{"solution": "s", "preview": long(500)}, nil},
+		{"finish bad", &taskFinishRequest{}, form{"solution": long(65536), "preview": long(501)},
+			[]string{"solution: must be at most 65535 bytes long", "preview: must be at most 500 characters long"}},
+		{"dispute ok", &taskDisputeRequest{}, form{"reason": "not done"}, nil},
+		{"dispute bad", &taskDisputeRequest{}, form{"reason": long(1001)}, []string{"reason: must be at most 1000 characters long"}},
+		{"dispute missing", &taskDisputeRequest{}, form{}, []string{"reason: is required"}},
+		{"resolve accept", &disputeResolveRequest{}, form{"resolution": storage.ResolutionAccept, "reason": "done"}, nil},
+		{"resolve rework", &disputeResolveRequest{}, form{"resolution": storage.ResolutionRework, "reason": "not done"}, nil},
+		{"resolve bad", &disputeResolveRequest{}, form{"resolution": "refund", "reason": long(1001)},
+			[]string{"resolution: must be accept or rework", "reason: must be at most 1000 characters long"}},
+
+		{"second factor ok", &loginSecondFactorRequest{}, form{"challenge": "c", "code": "123456"}, nil},
+		{"second factor bad", &loginSecondFactorRequest{}, form{"challenge": long(65), "code": long(33)},
+			[]string{"challenge: must be at most 64 characters long", "code: must be at most 32 characters long"}},
+		{"enroll ok", &loginEnrollRequest{}, form{"challenge": "c"}, nil},
+		{"enroll missing", &loginEnrollRequest{}, form{}, []string{"challenge: is required"}},
+		{"2fa code ok", &twoFactorCodeRequest{}, form{"code": "123456"}, nil},
+		{"2fa code missing", &twoFactorCodeRequest{}, form{}, []string{"code: is required"}},
+		{"2fa disable without code", &twoFactorDisableRequest{}, form{}, nil},
+		{"2fa disable bad", &twoFactorDisableRequest{}, form{"code": long(33)}, []string{"code: must be at most 32 characters long"}},
+
+		{"api key ok", &apiKeyCreateRequest{}, form{"name": "ci", "scopes": "read,tasks:write,admin"}, nil},
+		{"api key bad", &apiKeyCreateRequest{}, form{"name": long(65), "scopes": "read,write"},
+			[]string{"name: must be at most 64 characters long", "scopes: must be comma separated list of " + strings.Join(apiKeyScopes, ", ")}},
+		{"api key missing", &apiKeyCreateRequest{}, form{}, []string{"name: is required", "scopes: is required"}},
+		{"webhook ok", &webhookCreateRequest{}, form{"url": "https://example.com/hook", "events": strings.Join(webhooks.Events, ",")}, nil},
+		{"webhook bad", &webhookCreateRequest{}, form{"url": "ftp://example.com", "events": "task.created,task.deleted"},
+			[]string{"url: must be http or https URL", "events: must be comma separated list of " + strings.Join(webhooks.Events, ", ")}},
+		{"webhook long url", &webhookCreateRequest{}, form{"url": "https://example.com/" + long(236), "events": "task.created"},
+			[]string{"url: must be at most 255 characters long"}},
+		{"stream ok", &streamRequest{}, form{"events": "task.created", "mine": "true", "min_cost": "0"}, nil},
+		{"stream bad", &streamRequest{}, form{"events": "created", "mine": "maybe", "min_cost": "-1"},
+			[]string{"mine: must be true or false", "events: must be comma separated list of " + strings.Join(webhooks.Events, ", "), "min_cost: must be at least 0"}},
+
+		{"notifications ok", &notificationsQueryRequest{}, form{"unread": "true", "limit": "200"}, nil},
+		{"notifications bad", &notificationsQueryRequest{}, form{"unread": "x", "limit": "201"}, []string{"unread: must be true or false", "limit: must be at most 200"}},
+		{"preferences ok", &notificationPreferencesRequest{}, form{"channel": "email", "kinds": strings.Join(storage.NotificationKinds, ",")}, nil},
+		{"preferences none", &notificationPreferencesRequest{}, form{"channel": "email", "kinds": ""}, nil},
+		{"preferences bad", &notificationPreferencesRequest{}, form{"channel": long(17), "kinds": "spam"},
+			[]string{"channel: must be at most 16 characters long", "kinds: must be comma separated list of " + strings.Join(storage.NotificationKinds, ", ")}},
+
+		{"messages query ok", &taskMessagesQueryRequest{}, form{"after_id": "0", "limit": "500"}, nil},
+		{"messages query bad", &taskMessagesQueryRequest{}, form{"after_id": "-1", "limit": "501"}, []string{"after_id: must be at least 0", "limit: must be at most 500"}},
+		{"message ok", &taskMessageRequest{}, form{"body": "hi", "reply_to": "1"}, nil},
+		{"message bad", &taskMessageRequest{}, form{"body": long(4001), "reply_to": "0"},
+			[]string{"body: must be at most 4000 characters long", "reply_to: must be at least 1"}},
+		{"message update ok", &taskMessageUpdateRequest{}, form{"body": "hi"}, nil},
+		{"message update missing", &taskMessageUpdateRequest{}, form{"body": ""}, []string{"body: is required"}},
+		{"message delete ok", &taskMessageDeleteRequest{}, form{}, nil},
+		{"message delete bad", &taskMessageDeleteRequest{}, form{"reason": long(256)}, []string{"reason: must be at most 255 characters long"}},
+		{"messages lock ok", &taskMessagesLockRequest{}, form{"reason": "spam"}, nil},
+		{"messages lock missing", &taskMessagesLockRequest{}, form{}, []string{"reason: is required"}},
+
+		{"review ok", &taskReviewRequest{}, form{"rating": "5", "body": "good"}, nil},
+		{"review bad", &taskReviewRequest{}, form{"rating": "0", "body": long(2001)},
+			[]string{"rating: must be at least 1", "body: must be at most 2000 characters long"}},
+		{"review too high", &taskReviewRequest{}, form{"rating": "6"}, []string{"rating: must be at most 5"}},
+		{"review missing", &taskReviewRequest{}, form{}, []string{"rating: is required"}},
+		{"review hide ok", &taskReviewHideRequest{}, form{"reason": "abuse"}, nil},
+		{"review hide bad", &taskReviewHideRequest{}, form{"reason": long(256)}, []string{"reason: must be at most 255 characters long"}},
+		{"reviews query ok", &reviewsQueryRequest{}, form{"limit": "1"}, nil},
+		{"reviews query bad", &reviewsQueryRequest{}, form{"limit": "201"}, []string{"limit: must be at most 200"}},
+
+		{"profile ok", &profileUpdateRequest{}, form{"bio": long(1000), "skills": list(20, "s")}, nil},
+		{"profile bad", &profileUpdateRequest{}, form{"bio": long(1001), "skills": list(21, "s")},
+			[]string{"bio: must be at most 1000 characters long", "skills: must have at most 20 skills"}},
+		{"profile long skill", &profileUpdateRequest{}, form{"skills": "go," + long(46)}, []string{"skills: must have skills of at most 45 characters"}},
+		{"portfolio ok", &portfolioLinkRequest{}, form{"title": "site", "url": "https://example.com"}, nil},
+		{"portfolio bad", &portfolioLinkRequest{}, form{"title": long(101), "url": "example.com"},
+			[]string{"title: must be at most 100 characters long", "url: must be http or https URL"}},
+		{"portfolio missing", &portfolioLinkRequest{}, form{}, []string{"title: is required", "url: is required"}},
+		{"attachment ok", &attachmentCreateRequest{}, form{"kind": storage.AttachmentProblem, "sha256": long(64)}, nil},
+		{"attachment solution", &attachmentCreateRequest{}, form{"kind": storage.AttachmentSolution}, nil},
+		{"attachment bad", &attachmentCreateRequest{}, form{"kind": "photo", "sha256": long(65)},
+			[]string{"kind: must be problem or solution", "sha256: must be at most 64 characters long"}},
+
+		{"audit query ok", &auditQueryRequest{}, form{"actor": "nurbek", "target": "task:1", "from": "2024-03-01 00:00:00", "to": "2024-03-02 00:00:00", "limit": "1000"}, nil},
+		{"audit query bad", &auditQueryRequest{}, form{"actor": long(46), "target": long(65), "from": "2024-03-01", "limit": "1001"},
+			[]string{"from: must be like 2006-01-02 15:04:05", "actor: must be at most 45 characters long", "target: must be at most 64 characters long", "limit: must be at most 1000"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, err := validate.Bind(context.Background(), formOf(tt.values), tt.dto)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			want := tt.errs
+			if want == nil {
+				want = []string{}
+			}
+			if got := fieldErrors(errs); !reflect.DeepEqual(got, want) {
+				t.Errorf("errors %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestRequestLookupFailures(t *testing.T) {
+	stubLookups(t)
+	tests := []struct {
+		name   string
+		dto    interface{}
+		values form
+	}{
+		{"customer", &taskUpdateRequest{}, form{"customer_id": "3"}},
+		{"executor", &taskUpdateRequest{}, form{"executor_id": "3"}},
+		{"task category", &taskCreateRequest{}, form{"title": "logo", "cost": "1", "category_id": "3"}},
+		{"parent category", &categoryCreateRequest{}, form{"name": "Logos", "parent_id": "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := validate.Bind(context.Background(), formOf(tt.values), tt.dto); err != storage.ErrUnavailable {
+				t.Errorf("error %v, want %v", err, storage.ErrUnavailable)
+			}
+			// lookups of request gone away are cancelled with it
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			values := form{}
+			for name, val := range tt.values {
+				if val == "3" {
+					val = "1"
+				}
+				values[name] = val
+			}
+			if _, err := validate.Bind(ctx, formOf(values), tt.dto); err != context.Canceled {
+				t.Errorf("error of cancelled request %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"./audit"
+	"./reputation"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// reviewWindow : how long after acceptance participants may review each other
+const reviewWindow = 14 * 24 * time.Hour
+
+// reviewsShown : how many reviews about user are listed by default
+const reviewsShown = 50
+
+type taskReviewView struct {
+	ID         int    `json:"id"`
+	TaskID     int    `json:"task_id"`
+	AuthorID   int    `json:"author_id"`
+	Author     string `json:"author"`
+	TargetID   int    `json:"target_id"`
+	Rating     int    `json:"rating"`
+	Body       string `json:"body"`
+	CreatedAt  string `json:"created_at"`
+	Hidden     bool   `json:"hidden,omitempty"`
+	HideReason string `json:"hide_reason,omitempty"`
+}
+
+func toTaskReviewView(r *storage.TaskReview) taskReviewView {
+	return taskReviewView{
+		ID:         r.ID,
+		TaskID:     r.TaskID,
+		AuthorID:   r.AuthorID,
+		Author:     r.Author,
+		TargetID:   r.TargetID,
+		Rating:     r.Rating,
+		Body:       r.Body,
+		CreatedAt:  r.CreatedAt.Format(validate.TimeLayout),
+		Hidden:     !r.HiddenAt.IsZero(),
+		HideReason: r.HideReason}
+}
+
+type reputationView struct {
+	Score   float64 `json:"score"`
+	Average float64 `json:"average"`
+	Ratings int     `json:"ratings"`
+}
+
+// reputationOf returns reputation of user by visible ratings
+func reputationOf(c echo.Context, userID int) (reputationView, error) {
+	ratings, err := storage.GetRatings(c.Request().Context(), userID)
+	if err != nil {
+		return reputationView{}, err
+	}
+	rep := reputation.Of(ratings, time.Now())
+	return reputationView{rep.Score, rep.Average, rep.Ratings}, nil
+}
+
+// visibleReviews drops reviews hidden by admins unless user is admin
+func visibleReviews(c echo.Context, u *storage.User, reviews []*storage.TaskReview) []taskReviewView {
+	views := make([]taskReviewView, 0, len(reviews))
+	for _, r := range reviews {
+		if isAdmin(c, u) || r.HiddenAt.IsZero() {
+			views = append(views, toTaskReviewView(r))
+		}
+	}
+	return views
+}
+
+// taskReviewOf returns review in path of task. On failure writes answer
+// and returns nil
+func taskReviewOf(c echo.Context, t *storage.Task) (*storage.TaskReview, error) {
+	reviewID, err := strconv.Atoi(c.Param("review_id"))
+	var r *storage.TaskReview
+	if err == nil {
+		r, err = storage.GetTaskReview(c.Request().Context(), t.ID, reviewID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return nil, c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "review not found", "error_code": 234}`))
+	}
+	return r, nil
+}
+
+// taskReviewsHandlerGet lists reviews of task, oldest first
+func taskReviewsHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	reviews, err := storage.GetTaskReviews(c.Request().Context(), t.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	answer, _ := json.Marshal(struct {
+		Reviews   []taskReviewView `json:"reviews"`
+		ErrorCode int              `json:"error_code"`
+	}{visibleReviews(c, u, reviews), 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// taskReviewsHandlerCreate rates the other participant of accepted task:
+// customer rates executor and executor rates customer, once per task and
+// within reviewWindow after acceptance
+func taskReviewsHandlerCreate(c echo.Context) error {
+	var req taskReviewRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	targetID, ok := reviewTarget(u, t)
+	if !ok {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "only customer and executor of task review each other", "error_code": 230}`))
+	}
+	// customer executing own task would rate themself up
+	if targetID == u.ID {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "users don't review themselves", "error_code": 237}`))
+	}
+	if t.State != storage.StateAccepted {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "task is not in accepted status", "error_code": 231}`))
+	}
+	if time.Since(t.AcceptTime) > reviewWindow {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "reviews are left within 14 days after acceptance", "error_code": 232}`))
+	}
+	audit.SetAction(c, "task.review.create")
+	r := &storage.TaskReview{
+		TaskID:    t.ID,
+		AuthorID:  u.ID,
+		Author:    u.UserName,
+		TargetID:  targetID,
+		Rating:    req.Rating,
+		Body:      req.Body,
+		CreatedAt: time.Now().Truncate(time.Second)}
+	err = storage.CreateTaskReview(c.Request().Context(), r)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "task is reviewed by user already", "error_code": 233}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "task_review:"+strconv.Itoa(r.ID), nil, map[string]interface{}{"task_id": t.ID, "target_id": targetID, "rating": r.Rating, "body": r.Body})
+	answer, _ := json.Marshal(struct {
+		taskReviewView
+		ErrorMessage string `json:"error_message"`
+		ErrorCode    int    `json:"error_code"`
+	}{toTaskReviewView(r), "review created", 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+// reviewTarget returns participant of task reviewed by user, false when
+// user is not participant of task
+func reviewTarget(u *storage.User, t *storage.Task) (int, bool) {
+	switch u.ID {
+	case t.CustomerID:
+		return t.ExecutionerID, true
+	case t.ExecutionerID:
+		return t.CustomerID, true
+	}
+	return 0, false
+}
+
+// taskReviewHideHandler hides abusive review from users and reputation. Admin only
+func taskReviewHideHandler(c echo.Context) error {
+	var req taskReviewHideRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to hide reviews", "error_code": 125}`))
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	r, err := taskReviewOf(c, t)
+	if r == nil {
+		return err
+	}
+	if !r.HiddenAt.IsZero() {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "review is hidden already", "error_code": 235}`))
+	}
+	audit.SetAction(c, "task.review.hide")
+	r.HiddenAt = time.Now().Truncate(time.Second)
+	r.HiddenBy = u.ID
+	r.HideReason = req.Reason
+	if err := storage.HideTaskReview(c.Request().Context(), r); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "task_review:"+strconv.Itoa(r.ID), map[string]interface{}{"hidden": false}, map[string]interface{}{"hidden": true, "hide_reason": r.HideReason})
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "review hidden", "error_code": 0}`))
+}
+
+// taskReviewShowHandler shows hidden review again. Admin only
+func taskReviewShowHandler(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if !isAdmin(c, u) {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient privileges to show reviews", "error_code": 125}`))
+	}
+	t, err := taskOf(c)
+	if t == nil {
+		return err
+	}
+	r, err := taskReviewOf(c, t)
+	if r == nil {
+		return err
+	}
+	if r.HiddenAt.IsZero() {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "review is not hidden", "error_code": 236}`))
+	}
+	audit.SetAction(c, "task.review.show")
+	if err := storage.ShowTaskReview(c.Request().Context(), r.ID); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "task_review:"+strconv.Itoa(r.ID), map[string]interface{}{"hidden": true, "hide_reason": r.HideReason}, map[string]interface{}{"hidden": false})
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "review shown", "error_code": 0}`))
+}
+
+// userReviewsHandlerGet lists reviews about user, newest first, with
+// reputation of user
+func userReviewsHandlerGet(c echo.Context) error {
+	var req reviewsQueryRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	ctx := c.Request().Context()
+	target, err := storage.GetUserByName(ctx, c.Param("slug"))
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 123}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	limit := reviewsShown
+	if req.Limit != nil {
+		limit = *req.Limit
+	}
+	reviews, err := storage.GetUserReviews(ctx, target.ID, limit)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	rep, err := reputationOf(c, target.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	answer, _ := json.Marshal(struct {
+		Reviews    []taskReviewView `json:"reviews"`
+		Reputation reputationView   `json:"reputation"`
+		ErrorCode  int              `json:"error_code"`
+	}{visibleReviews(c, u, reviews), rep, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	"./storage"
+)
+
+func TestReviewTarget(t *testing.T) {
+	const customer, executor, stranger = 1, 2, 3
+	tests := []struct {
+		name     string
+		user     int
+		task     storage.Task
+		target   int
+		ok       bool
+		selfRate bool
+	}{
+		{"customer rates executor", customer, storage.Task{CustomerID: customer, ExecutionerID: executor}, executor, true, false},
+		{"executor rates customer", executor, storage.Task{CustomerID: customer, ExecutionerID: executor}, customer, true, false},
+		{"stranger", stranger, storage.Task{CustomerID: customer, ExecutionerID: executor}, 0, false, false},
+		{"customer executed own task", customer, storage.Task{CustomerID: customer, ExecutionerID: customer}, customer, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, ok := reviewTarget(&storage.User{ID: tt.user}, &tt.task)
+			if target != tt.target || ok != tt.ok {
+				t.Errorf("reviewTarget %d %v, want %d %v", target, ok, tt.target, tt.ok)
+			}
+			if self := ok && target == tt.user; self != tt.selfRate {
+				t.Errorf("review of themself %v, want %v", self, tt.selfRate)
+			}
+		})
+	}
+}
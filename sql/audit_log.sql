@@ -0,0 +1,19 @@
+CREATE TABLE `audit_log` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `created_at` datetime NOT NULL,
+  `actor_id` int(11) NOT NULL DEFAULT '0',
+  `actor_name` varchar(45) NOT NULL DEFAULT '',
+  `action` varchar(64) NOT NULL,
+  `targets` varchar(255) NOT NULL DEFAULT '',
+  `diff` text NOT NULL,
+  `ip` varchar(45) NOT NULL DEFAULT '',
+  `request_id` varchar(64) NOT NULL DEFAULT '',
+  `status` smallint(6) NOT NULL DEFAULT '0',
+  `prev_hash` char(64) NOT NULL DEFAULT '',
+  `hash` char(64) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `actor_name_idx` (`actor_name`),
+  KEY `created_at_idx` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TRIGGER `audit_log_no_update` BEFORE UPDATE ON `audit_log` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only';
+CREATE TRIGGER `audit_log_no_delete` BEFORE DELETE ON `audit_log` FOR EACH ROW SIGNAL SQLSTATE '45000' SET MESSAGE_TEXT = 'audit_log is append-only';
@@ -1,2 +1,2 @@
-# create admin user login:admin password:password123 
-INSERT INTO users (is_admin, user_name, password_hash, email) VALUES(1, 'admin', '482c811da5d5b4bc6d497ffa98491e38', 'admin@mail.com')
\ No newline at end of file
+# create admin user login:admin password:password123 
+INSERT INTO users (is_admin, user_name, password_hash, email, email_verified) VALUES(1, 'admin', '482c811da5d5b4bc6d497ffa98491e38', 'admin@mail.com', 1)
\ No newline at end of file
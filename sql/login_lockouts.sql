@@ -0,0 +1,7 @@
+CREATE TABLE `login_lockouts` (
+  `name` varchar(128) NOT NULL,
+  `failures` int(11) NOT NULL,
+  `last_failure` datetime NOT NULL,
+  `locked_until` datetime NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
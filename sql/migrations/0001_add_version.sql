@@ -0,0 +1,3 @@
+# optimistic locking: version is incremented on every update
+ALTER TABLE `tasks` ADD COLUMN `version` int(11) NOT NULL DEFAULT '0' AFTER `end_time`;
+ALTER TABLE `users` ADD COLUMN `version` int(11) NOT NULL DEFAULT '0' AFTER `frozen_amount`;
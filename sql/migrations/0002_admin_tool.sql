@@ -0,0 +1,23 @@
+# users can be disabled by admin tool, balance and forced state changes are recorded
+ALTER TABLE `users` ADD COLUMN `disabled` tinyint(4) NOT NULL DEFAULT '0' AFTER `frozen_amount`;
+CREATE TABLE `balance_movements` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `amount` decimal(13,12) NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `actor` varchar(45) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id_idx` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `task_state_changes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `from_status` tinyint(4) NOT NULL,
+  `to_status` tinyint(4) NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `actor` varchar(45) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `task_id_idx` (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,8 @@
+# applied migrations are recorded, /readyz compares the latest one with version server expects.
+# every next migration ends with INSERT INTO `schema_migrations` (`version`) VALUES (<its number>);
+CREATE TABLE `schema_migrations` (
+  `version` int(11) NOT NULL,
+  `applied_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  PRIMARY KEY (`version`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (1), (2), (3), (4);
@@ -0,0 +1,15 @@
+# login rate limiting and lockouts, used when RATE_LIMIT_STORE=db
+CREATE TABLE `rate_limit_buckets` (
+  `name` varchar(128) NOT NULL,
+  `tokens` double NOT NULL,
+  `updated_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `login_lockouts` (
+  `name` varchar(128) NOT NULL,
+  `failures` int(11) NOT NULL,
+  `last_failure` datetime NOT NULL,
+  `locked_until` datetime NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (5);
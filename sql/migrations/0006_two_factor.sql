@@ -0,0 +1,13 @@
+# TOTP second factor of users and their single use recovery codes
+ALTER TABLE `users` ADD COLUMN `totp_secret` varchar(64) NOT NULL DEFAULT '' AFTER `version`;
+ALTER TABLE `users` ADD COLUMN `totp_enabled` tinyint(4) NOT NULL DEFAULT '0' AFTER `totp_secret`;
+ALTER TABLE `users` ADD COLUMN `totp_last_step` bigint(20) NOT NULL DEFAULT '0' AFTER `totp_enabled`;
+CREATE TABLE `recovery_codes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `code_hash` char(64) NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id_code_hash` (`user_id`, `code_hash`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (6);
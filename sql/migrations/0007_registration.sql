@@ -0,0 +1,15 @@
+# self-service registration: users verify email before login, emailed
+# verification and password reset tokens. Existing users are trusted
+ALTER TABLE `users` ADD COLUMN `email_verified` tinyint(4) NOT NULL DEFAULT '0' AFTER `totp_last_step`;
+UPDATE `users` SET `email_verified` = 1;
+CREATE TABLE `user_tokens` (
+  `token_hash` char(64) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `purpose` varchar(16) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `expires_at` datetime NOT NULL,
+  `used_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`token_hash`),
+  KEY `user_id_purpose` (`user_id`, `purpose`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (7);
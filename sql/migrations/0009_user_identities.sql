@@ -0,0 +1,14 @@
+# identities of users at OIDC identity provider for single sign-on
+CREATE TABLE `user_identities` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `issuer` varchar(255) NOT NULL,
+  `subject` varchar(255) NOT NULL,
+  `email` varchar(255) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  `last_login_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `issuer_subject_UNIQUE` (`issuer`,`subject`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (9);
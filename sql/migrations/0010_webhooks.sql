@@ -0,0 +1,40 @@
+# webhooks of users, outbox of task events and their deliveries
+CREATE TABLE `webhooks` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  `secret` varchar(80) NOT NULL,
+  `events` varchar(255) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `webhook_events` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `event_type` varchar(32) NOT NULL,
+  `task_id` int(11) NOT NULL,
+  `customer_id` int(11) NOT NULL,
+  `executor_id` int(11) NOT NULL,
+  `public` tinyint(1) NOT NULL DEFAULT '0',
+  `payload` text NOT NULL,
+  `created_at` datetime NOT NULL,
+  `dispatched_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `dispatched_at` (`dispatched_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `webhook_deliveries` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `webhook_id` int(11) NOT NULL,
+  `event_id` int(11) NOT NULL,
+  `status` varchar(16) NOT NULL,
+  `attempts` int(11) NOT NULL DEFAULT '0',
+  `next_attempt_at` datetime NOT NULL,
+  `last_status` int(11) NOT NULL DEFAULT '0',
+  `last_error` text NOT NULL,
+  `created_at` datetime NOT NULL,
+  `delivered_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `webhook_id` (`webhook_id`),
+  KEY `status_next_attempt_at` (`status`,`next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (10);
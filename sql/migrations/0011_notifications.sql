@@ -0,0 +1,20 @@
+# inbox of users and which notification kinds they get by email
+CREATE TABLE `notifications` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `kind` varchar(32) NOT NULL,
+  `task_id` int(11) NOT NULL DEFAULT '0',
+  `message` varchar(512) NOT NULL,
+  `created_at` datetime NOT NULL,
+  `read_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id_read_at` (`user_id`,`read_at`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `notification_preferences` (
+  `user_id` int(11) NOT NULL,
+  `kind` varchar(32) NOT NULL,
+  `channel` varchar(16) NOT NULL,
+  `enabled` tinyint(1) NOT NULL,
+  PRIMARY KEY (`user_id`,`kind`,`channel`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (11);
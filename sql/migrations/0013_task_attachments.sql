@@ -0,0 +1,16 @@
+# files attached to problems and solutions of tasks, contents are in blob store
+CREATE TABLE `task_attachments` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `uploader_id` int(11) NOT NULL,
+  `kind` varchar(16) NOT NULL,
+  `file_name` varchar(255) NOT NULL,
+  `content_type` varchar(100) NOT NULL,
+  `size` bigint(20) NOT NULL,
+  `sha256` char(64) NOT NULL,
+  `blob_key` varchar(255) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `task_id` (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (13);
@@ -0,0 +1,19 @@
+# ratings and reviews task participants leave each other after acceptance
+ALTER TABLE `tasks` ADD COLUMN `accept_time` datetime DEFAULT '0001-01-01 00:00:00' AFTER `end_time`;
+UPDATE `tasks` SET `accept_time`=`end_time` WHERE `status`=4;
+CREATE TABLE `task_reviews` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `author_id` int(11) NOT NULL,
+  `target_id` int(11) NOT NULL,
+  `rating` tinyint(4) NOT NULL,
+  `body` varchar(2000) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  `hidden_at` datetime DEFAULT NULL,
+  `hidden_by` int(11) NOT NULL DEFAULT '0',
+  `hide_reason` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `task_author` (`task_id`, `author_id`),
+  KEY `target_id` (`target_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (15);
@@ -0,0 +1,17 @@
+# public profiles: bio, skills and portfolio links of users. Users existing before the migration are members since it
+ALTER TABLE `users` ADD COLUMN `bio` varchar(1000) NOT NULL DEFAULT '', ADD COLUMN `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP;
+CREATE TABLE `user_skills` (
+  `user_id` int(11) NOT NULL,
+  `skill` varchar(45) NOT NULL,
+  PRIMARY KEY (`user_id`, `skill`),
+  KEY `skill` (`skill`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `user_portfolio_links` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `user_id` int(11) NOT NULL,
+  `title` varchar(100) NOT NULL,
+  `url` varchar(255) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `user_id` (`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (16);
@@ -0,0 +1,16 @@
+# hierarchical categories and free tags of tasks
+CREATE TABLE `categories` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `parent_id` int(11) NOT NULL DEFAULT '0',
+  `name` varchar(45) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `parent_name` (`parent_id`, `name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+ALTER TABLE `tasks` ADD COLUMN `category_id` int(11) NOT NULL DEFAULT '0' AFTER `cost`, ADD KEY `category_id` (`category_id`);
+CREATE TABLE `task_tags` (
+  `task_id` int(11) NOT NULL,
+  `tag` varchar(45) NOT NULL,
+  PRIMARY KEY (`task_id`, `tag`),
+  KEY `tag` (`tag`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+INSERT INTO `schema_migrations` (`version`) VALUES (17);
@@ -0,0 +1,5 @@
+# money columns were decimal(13,12), which keeps values below 10 only
+ALTER TABLE `tasks` MODIFY `cost` decimal(25,12) NOT NULL DEFAULT '0.000000000000';
+ALTER TABLE `users` MODIFY `balance` decimal(25,12) NOT NULL DEFAULT '0.000000000000', MODIFY `frozen_amount` decimal(25,12) NOT NULL DEFAULT '0.000000000000';
+ALTER TABLE `balance_movements` MODIFY `amount` decimal(25,12) NOT NULL;
+INSERT INTO `schema_migrations` (`version`) VALUES (18);
@@ -0,0 +1,6 @@
+CREATE TABLE `rate_limit_buckets` (
+  `name` varchar(128) NOT NULL,
+  `tokens` double NOT NULL,
+  `updated_at` datetime(6) NOT NULL,
+  PRIMARY KEY (`name`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,13 @@
+CREATE TABLE `task_disputes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `opened_by` int(11) NOT NULL,
+  `reason` varchar(1000) NOT NULL,
+  `opened_at` datetime NOT NULL,
+  `resolved_by` int(11) NOT NULL DEFAULT '0',
+  `resolution` varchar(16) NOT NULL DEFAULT '',
+  `resolution_reason` varchar(1000) NOT NULL DEFAULT '',
+  `resolved_at` datetime DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `task_id` (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,27 @@
+CREATE TABLE `task_messages` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `author_id` int(11) NOT NULL,
+  `reply_to` int(11) NOT NULL DEFAULT '0',
+  `body` text NOT NULL,
+  `created_at` datetime NOT NULL,
+  `edited_at` datetime DEFAULT NULL,
+  `deleted_at` datetime DEFAULT NULL,
+  `deleted_by` int(11) NOT NULL DEFAULT '0',
+  `delete_reason` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  KEY `task_id` (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `task_message_reads` (
+  `task_id` int(11) NOT NULL,
+  `user_id` int(11) NOT NULL,
+  `last_read_id` int(11) NOT NULL,
+  PRIMARY KEY (`task_id`,`user_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
+CREATE TABLE `task_message_locks` (
+  `task_id` int(11) NOT NULL,
+  `actor_id` int(11) NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,15 @@
+CREATE TABLE `task_reviews` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `author_id` int(11) NOT NULL,
+  `target_id` int(11) NOT NULL,
+  `rating` tinyint(4) NOT NULL,
+  `body` varchar(2000) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL,
+  `hidden_at` datetime DEFAULT NULL,
+  `hidden_by` int(11) NOT NULL DEFAULT '0',
+  `hide_reason` varchar(255) NOT NULL DEFAULT '',
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `task_author` (`task_id`, `author_id`),
+  KEY `target_id` (`target_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -0,0 +1,11 @@
+CREATE TABLE `task_state_changes` (
+  `id` int(11) NOT NULL AUTO_INCREMENT,
+  `task_id` int(11) NOT NULL,
+  `from_status` tinyint(4) NOT NULL,
+  `to_status` tinyint(4) NOT NULL,
+  `reason` varchar(255) NOT NULL,
+  `actor` varchar(45) NOT NULL,
+  `created_at` datetime NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `task_id_idx` (`task_id`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -4,11 +4,16 @@ CREATE TABLE `tasks` (
   `executor_id` int(11) DEFAULT NULL,
   `title` varchar(45) DEFAULT NULL,
   `status` tinyint(4) NOT NULL DEFAULT '0',
-  `cost` decimal(13,12) NOT NULL DEFAULT '0.000000000000',
+  `cost` decimal(25,12) NOT NULL DEFAULT '0.000000000000',
+  `category_id` int(11) NOT NULL DEFAULT '0',
   `problem` blob,
   `solution` blob,
+  `solution_preview` varchar(500) NOT NULL DEFAULT '',
   `begin_time` datetime DEFAULT '0001-01-01 00:00:00',
   `end_time` datetime DEFAULT '0001-01-01 00:00:00',
+  `accept_time` datetime DEFAULT '0001-01-01 00:00:00',
+  `version` int(11) NOT NULL DEFAULT '0',
   PRIMARY KEY (`id`),
-  UNIQUE KEY `id_UNIQUE` (`id`)
+  UNIQUE KEY `id_UNIQUE` (`id`),
+  KEY `category_id` (`category_id`)
 ) ENGINE=InnoDB AUTO_INCREMENT=12 DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
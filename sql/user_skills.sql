@@ -0,0 +1,6 @@
+CREATE TABLE `user_skills` (
+  `user_id` int(11) NOT NULL,
+  `skill` varchar(45) NOT NULL,
+  PRIMARY KEY (`user_id`, `skill`),
+  KEY `skill` (`skill`)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_0900_ai_ci;
@@ -4,8 +4,16 @@ CREATE TABLE `users` (
   `user_name` varchar(45) NOT NULL,
   `password_hash` varchar(45) NOT NULL,
   `email` varchar(45) DEFAULT NULL,
-  `balance` decimal(13,12) NOT NULL DEFAULT '0.000000000000',
-  `frozen_amount` decimal(13,12) NOT NULL DEFAULT '0.000000000000',
+  `balance` decimal(25,12) NOT NULL DEFAULT '0.000000000000',
+  `frozen_amount` decimal(25,12) NOT NULL DEFAULT '0.000000000000',
+  `disabled` tinyint(4) NOT NULL DEFAULT '0',
+  `version` int(11) NOT NULL DEFAULT '0',
+  `totp_secret` varchar(64) NOT NULL DEFAULT '',
+  `totp_enabled` tinyint(4) NOT NULL DEFAULT '0',
+  `totp_last_step` bigint(20) NOT NULL DEFAULT '0',
+  `email_verified` tinyint(4) NOT NULL DEFAULT '0',
+  `bio` varchar(1000) NOT NULL DEFAULT '',
+  `created_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP,
   PRIMARY KEY (`id`),
   UNIQUE KEY `id_UNIQUE` (`id`),
   UNIQUE KEY `user_name_UNIQUE` (`user_name`)
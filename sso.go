@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"./audit"
+	"./metrics"
+	"./sso"
+	"./storage"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// ssoProvider : OIDC identity provider, nil when single sign-on is off. Set up in run
+var ssoProvider *sso.Provider
+
+// ssoProvision : unknown identities get new users, otherwise they have to
+// be linked to existing users first. Set up in run
+var ssoProvision = true
+
+// ssoBrowserCookie : cookie with secret of browser that started login at
+// identity provider, the login is finished by this browser only
+const ssoBrowserCookie = "sso_browser"
+
+// storage used by single sign-on login, replaced in tests
+var (
+	ssoGetIdentity    = storage.GetUserIdentity
+	ssoGetUser        = storage.GetUserByID
+	ssoLinkIdentity   = storage.LinkUserIdentity
+	ssoUnlinkIdentity = storage.UnlinkUserIdentity
+	ssoTouchIdentity  = storage.TouchUserIdentity
+	ssoUpdateUser     = storage.UpdateUser
+	ssoCreateUser     = storage.CreateNewUser
+	ssoRegisterUser   = storage.RegisterUser
+)
+
+// loginNameChars : characters left in login names made of IdP claims
+var loginNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+type identityView struct {
+	ID          int    `json:"id"`
+	Issuer      string `json:"issuer"`
+	Subject     string `json:"subject"`
+	Email       string `json:"email"`
+	CreatedAt   string `json:"created_at"`
+	LastLoginAt string `json:"last_login_at"`
+}
+
+// setupSSO configures identity provider from OIDC_* variables, single
+// sign-on stays off without OIDC_ISSUER
+func setupSSO(ctx context.Context) error {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	cfg := sso.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("OIDC_REDIRECT_URL"),
+		GroupsClaim:  os.Getenv("OIDC_GROUPS_CLAIM")}
+	if cfg.ClientID == "" {
+		return errors.New("OIDC_CLIENT_ID is required")
+	}
+	if cfg.RedirectURL == "" {
+		cfg.RedirectURL = publicURL + "/api/v1/sso/callback"
+	}
+	for _, g := range strings.Split(os.Getenv("OIDC_ADMIN_GROUPS"), ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			cfg.AdminGroups = append(cfg.AdminGroups, g)
+		}
+	}
+	if provision := os.Getenv("OIDC_PROVISION"); provision != "" {
+		val, err := strconv.ParseBool(provision)
+		if err != nil {
+			return fmt.Errorf("bad OIDC_PROVISION %q", provision)
+		}
+		ssoProvision = val
+	}
+	provider, err := sso.New(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	ssoProvider = provider
+	slog.Info("single sign-on enabled", "issuer", issuer, "provision", ssoProvision, "admin_groups", cfg.AdminGroups)
+	return nil
+}
+
+func ssoDisabledAnswer(c echo.Context) error {
+	return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "single sign-on is not configured", "error_code": 170}`))
+}
+
+// ssoLoginHandler sends user to identity provider to log in
+func ssoLoginHandler(c echo.Context) error {
+	if ssoProvider == nil {
+		return ssoDisabledAnswer(c)
+	}
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	url, err := ssoStart(c, sso.Pending{})
+	if url == "" {
+		return err
+	}
+	return c.Redirect(http.StatusFound, url)
+}
+
+// ssoStart binds login at identity provider to the browser with cookie
+// and returns identity provider page to send user to. On failure writes
+// answer and returns empty URL
+func ssoStart(c echo.Context, start sso.Pending) (string, error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	start.Browser = hex.EncodeToString(b)
+	url, err := ssoProvider.AuthURL(start)
+	if errors.Is(err, sso.ErrTooManyPending) {
+		c.Response().Header().Set("Retry-After", "60")
+		return "", c.JSONBlob(http.StatusServiceUnavailable, []byte(`{"error_message": "too many logins in progress, try later", "error_code": 179}`))
+	}
+	if err != nil {
+		return "", storageErrorAnswer(c, err)
+	}
+	c.SetCookie(ssoCookie(start.Browser, 600))
+	return url, nil
+}
+
+// ssoCookie returns browser cookie, negative maxAge deletes it
+func ssoCookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     ssoBrowserCookie,
+		Value:    value,
+		Path:     "/api/v1/sso/callback",
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(publicURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode}
+}
+
+// ssoLinkHandler answers identity provider URL, logging in there links
+// the identity to the user. Only the user links identities
+func ssoLinkHandler(c echo.Context) error {
+	if ssoProvider == nil {
+		return ssoDisabledAnswer(c)
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	if c.Param("slug") != u.UserName {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "identities are linked by their user only", "error_code": 3}`))
+	}
+	// linking is finished in browser by the session that started it,
+	// API key has no session to check
+	if _, isKey := c.Get(contextAPIKeyUser).(*storage.User); isKey {
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "identities are linked in session only", "error_code": 177}`))
+	}
+	audit.SetAction(c, "user.sso_link_start")
+	session := strings.TrimPrefix(c.Request().Header.Get("Authorization"), "Bearer ")
+	url, err := ssoStart(c, sso.Pending{LinkTo: u.ID, Session: session})
+	if url == "" {
+		return err
+	}
+	answer, _ := json.Marshal(struct {
+		URL       string `json:"url"`
+		ErrorCode int    `json:"error_code"`
+	}{url, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// ssoCallbackHandler finishes login at identity provider. Identity linked
+// to user logs the user in, unknown identity gets new user. When admin
+// groups are configured admin privileges follow them on every login.
+// Second factor is asked as on password login
+func ssoCallbackHandler(c echo.Context) error {
+	if ssoProvider == nil {
+		return ssoDisabledAnswer(c)
+	}
+	audit.SetAction(c, "user.login_sso")
+	if ok, err := allowIPAttempt(c); !ok {
+		return err
+	}
+	ctx := c.Request().Context()
+	if reason := c.QueryParam("error"); reason != "" {
+		slog.InfoContext(ctx, "identity provider refused login", "error", reason, "description", c.QueryParam("error_description"))
+		metrics.LoginRejected.WithLabelValues("sso_failed").Inc()
+		return c.JSONBlob(http.StatusUnauthorized, []byte(`{"errror_message": "identity provider login failed", "error_code": 172}`))
+	}
+	var browser string
+	if cookie, err := c.Cookie(ssoBrowserCookie); err == nil {
+		browser = cookie.Value
+	}
+	c.SetCookie(ssoCookie("", -1))
+	identity, pending, err := ssoProvider.Exchange(ctx, c.QueryParam("state"), browser, c.QueryParam("code"))
+	if errors.Is(err, sso.ErrUnknownState) {
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"errror_message": "login is unknown or expired, start again", "error_code": 171}`))
+	}
+	if errors.Is(err, sso.ErrOtherBrowser) {
+		metrics.LoginRejected.WithLabelValues("sso_failed").Inc()
+		return c.JSONBlob(http.StatusBadRequest, []byte(`{"errror_message": "login is started by other browser, start again", "error_code": 176}`))
+	}
+	if err != nil {
+		slog.WarnContext(ctx, "identity provider login failed", "err", err)
+		metrics.LoginRejected.WithLabelValues("sso_failed").Inc()
+		return c.JSONBlob(http.StatusUnauthorized, []byte(`{"errror_message": "identity provider login failed", "error_code": 172}`))
+	}
+	if pending.LinkTo != 0 {
+		return ssoLink(c, identity, pending)
+	}
+
+	linked, err := ssoGetIdentity(ctx, identity.Issuer, identity.Subject)
+	var u *storage.User
+	if err == nil {
+		u, err = ssoGetUser(ctx, linked.UserID)
+		if errors.Is(err, storage.ErrNotFound) {
+			// user was deleted, the identity is seen as new one
+			if err := ssoUnlinkIdentity(ctx, linked.UserID, linked.ID); err != nil {
+				return storageErrorAnswer(c, err)
+			}
+		} else if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+	} else if !errors.Is(err, storage.ErrNotFound) {
+		return storageErrorAnswer(c, err)
+	}
+	if u == nil {
+		if u, err = ssoUserOf(c, identity); u == nil {
+			return err
+		}
+		linked = newUserIdentity(u, identity)
+		if err := ssoLinkIdentity(ctx, linked); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, identityTarget(linked.ID), nil, identitySnapshot(linked))
+	}
+	audit.SetActor(c, u.UserName)
+	if u.Disabled {
+		return c.JSONBlob(http.StatusUnauthorized, []byte(`{"errror_message": "user is disabled", "error_code": 4}`))
+	}
+	if ssoProvider.MapsAdmin() && u.IsAdmin != ssoProvider.IsAdmin(identity) {
+		before := audit.UserSnapshot(u)
+		u.IsAdmin = !u.IsAdmin
+		if err := ssoUpdateUser(ctx, u); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.UserTarget(u.ID), before, audit.UserSnapshot(u))
+	}
+	if err := ssoTouchIdentity(ctx, linked.ID, identity.Email); err != nil {
+		slog.WarnContext(ctx, "can't record identity login", "err", err)
+	}
+	if answer := secondFactorChallenge(u); answer != "" {
+		return c.JSONBlob(http.StatusUnauthorized, []byte(answer))
+	}
+	answer := fmt.Sprintf(`{"token": "%s", "errror_message": "OK", "error_code": 0}`, storage.StartSession(u))
+	return c.JSONBlob(http.StatusOK, []byte(answer))
+}
+
+// ssoLink links identity to user who started linking, the user has to be
+// still logged in with the same session
+func ssoLink(c echo.Context, identity *sso.Identity, pending *sso.Pending) error {
+	audit.SetAction(c, "user.sso_link")
+	if id, ok := storage.SessionUserID(pending.Session); !ok || id != pending.LinkTo {
+		return c.JSONBlob(http.StatusUnauthorized, []byte(`{"error_message": "session that started linking has ended", "error_code": 178}`))
+	}
+	ctx := c.Request().Context()
+	u, err := ssoGetUser(ctx, pending.LinkTo)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.SetUser(c, u)
+	linked := newUserIdentity(u, identity)
+	err = ssoLinkIdentity(ctx, linked)
+	if errors.Is(err, storage.ErrDuplicate) {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "identity is linked to user already", "error_code": 173}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, identityTarget(linked.ID), nil, identitySnapshot(linked))
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "identity linked", "error_code": 0}`))
+}
+
+// ssoUserOf returns new user for identity seen first time. Identities are
+// never linked to existing users by email: anyone may set any email on
+// their account, so such link would give the account of one person to
+// another. Existing users link identities themselves with ssoLinkHandler.
+// On failure writes answer and returns nil
+func ssoUserOf(c echo.Context, identity *sso.Identity) (*storage.User, error) {
+	if !ssoProvision {
+		return nil, c.JSONBlob(http.StatusForbidden, []byte(`{"errror_message": "identity is not linked to any user", "error_code": 174}`))
+	}
+	return ssoProvisionUser(c, identity)
+}
+
+// ssoProvisionUser creates user for identity. Login is made of preferred
+// username or email and gets number suffix when taken. The user has no
+// password and logs in with identity provider only until password is reset
+func ssoProvisionUser(c echo.Context, identity *sso.Identity) (*storage.User, error) {
+	ctx := c.Request().Context()
+	base := identity.PreferredUsername
+	if base == "" {
+		base, _, _ = strings.Cut(identity.Email, "@")
+	}
+	base = strings.Trim(loginNameChars.ReplaceAllString(base, "_"), "_")
+	if base == "" {
+		base = "user"
+	}
+	if len(base) > 40 {
+		base = base[:40]
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, storageErrorAnswer(c, err)
+	}
+	// md5 hex never matches "!" prefixed hash, so password login is impossible
+	passwordHash := "!" + hex.EncodeToString(b)
+	for n := 1; n <= 100; n++ {
+		name := base
+		if n > 1 {
+			name = base + strconv.Itoa(n)
+		}
+		var id int
+		var err error
+		if identity.EmailVerified {
+			id, err = ssoCreateUser(ctx, false, name, passwordHash, identity.Email)
+		} else {
+			// email not verified by identity provider mustn't get password reset links
+			id, err = ssoRegisterUser(ctx, name, passwordHash, identity.Email)
+		}
+		if errors.Is(err, storage.ErrDuplicate) {
+			continue
+		}
+		if err != nil {
+			return nil, storageErrorAnswer(c, err)
+		}
+		u, err := ssoGetUser(ctx, id)
+		if err != nil {
+			return nil, storageErrorAnswer(c, err)
+		}
+		audit.SetAction(c, "user.provision_sso")
+		audit.AddChange(c, audit.UserTarget(id), nil, audit.UserSnapshot(u))
+		return u, nil
+	}
+	return nil, c.JSONBlob(http.StatusConflict, []byte(`{"errror_message": "can't choose free login for identity", "error_code": 124}`))
+}
+
+func newUserIdentity(u *storage.User, identity *sso.Identity) *storage.UserIdentity {
+	now := time.Now().Truncate(time.Second)
+	return &storage.UserIdentity{
+		UserID:      u.ID,
+		Issuer:      identity.Issuer,
+		Subject:     identity.Subject,
+		Email:       identity.Email,
+		CreatedAt:   now,
+		LastLoginAt: now}
+}
+
+func identityTarget(identityID int) string {
+	return "identity:" + strconv.Itoa(identityID)
+}
+
+func identitySnapshot(i *storage.UserIdentity) map[string]interface{} {
+	return map[string]interface{}{
+		"user_id": i.UserID,
+		"issuer":  i.Issuer,
+		"subject": i.Subject,
+		"email":   i.Email}
+}
+
+// identitiesHandlerGet lists identities linked to user. User or admin
+func identitiesHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "identities")
+	if owner == nil {
+		return err
+	}
+	identities, err := storage.GetUserIdentities(c.Request().Context(), owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]identityView, 0, len(identities))
+	for _, i := range identities {
+		views = append(views, identityView{
+			ID:          i.ID,
+			Issuer:      i.Issuer,
+			Subject:     i.Subject,
+			Email:       i.Email,
+			CreatedAt:   i.CreatedAt.Format(validate.TimeLayout),
+			LastLoginAt: i.LastLoginAt.Format(validate.TimeLayout)})
+	}
+	answer, _ := json.Marshal(struct {
+		Identities []identityView `json:"identities"`
+		ErrorCode  int            `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// identitiesHandlerDelete unlinks identity from user. User or admin
+func identitiesHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "identities")
+	if owner == nil {
+		return err
+	}
+	audit.SetAction(c, "user.sso_unlink")
+	identityID, err := strconv.Atoi(c.Param("identity_id"))
+	if err == nil {
+		err = storage.UnlinkUserIdentity(c.Request().Context(), owner.ID, identityID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "identity not found", "error_code": 175}`))
+	}
+	audit.AddChange(c, identityTarget(identityID), map[string]interface{}{"user_id": owner.ID}, nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "identity unlinked", "error_code": 0}`))
+}
@@ -0,0 +1,195 @@
+// Package mockoidc is OpenID Connect identity provider for development and
+// tests of single sign-on. It logs in everybody without asking: the
+// identity is Server.Identity and may be overridden per login by query
+// parameters sub, login, email and groups of the authorization URL
+package mockoidc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jose "github.com/go-jose/go-jose/v3"
+)
+
+// Identity : logged in identity
+type Identity struct {
+	Sub    string
+	Login  string // preferred_username and name claims
+	Email  string // always verified
+	Groups []string
+}
+
+// Server : identity provider, serves discovery, authorization, token and
+// keys endpoints
+type Server struct {
+	Issuer   string // URL the provider is reachable at
+	ClientID string // accepted client ID
+	Identity Identity
+	// Claims are added to every ID token over the others, e.g. wrong nonce
+	Claims map[string]interface{}
+	Logf   func(format string, args ...interface{}) // log.Printf by default
+
+	key    *rsa.PrivateKey
+	signer jose.Signer
+	mux    *http.ServeMux
+
+	lock   sync.Mutex
+	grants map[string]*grant // key is authorization code
+}
+
+// grant : issued authorization code waiting for token request
+type grant struct {
+	challenge   string
+	redirectURI string
+	claims      map[string]interface{}
+	created     time.Time
+}
+
+// New returns provider with fresh signing key
+func New(issuer, clientID string, identity Identity) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jose.JSONWebKey{Key: key, KeyID: "mock"}},
+		(&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{Issuer: issuer, ClientID: clientID, Identity: identity, Logf: log.Printf,
+		key: key, signer: signer, mux: http.NewServeMux(), grants: map[string]*grant{}}
+	s.mux.HandleFunc("/.well-known/openid-configuration", s.discovery)
+	s.mux.HandleFunc("/authorize", s.authorize)
+	s.mux.HandleFunc("/token", s.token)
+	s.mux.HandleFunc("/jwks", s.jwks)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(val)
+}
+
+func (s *Server) discovery(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.Issuer,
+		"authorization_endpoint":                s.Issuer + "/authorize",
+		"token_endpoint":                        s.Issuer + "/token",
+		"jwks_uri":                              s.Issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+	})
+}
+
+// query returns query parameter or default value
+func query(q url.Values, name, def string) string {
+	if val := q.Get(name); val != "" {
+		return val
+	}
+	return def
+}
+
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("response_type") != "code" || q.Get("client_id") != s.ClientID || q.Get("redirect_uri") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge") == "" || q.Get("code_challenge_method") != "S256" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	claims := map[string]interface{}{
+		"sub":                query(q, "sub", s.Identity.Sub),
+		"preferred_username": query(q, "login", s.Identity.Login),
+		"name":               query(q, "login", s.Identity.Login),
+		"email":              query(q, "email", s.Identity.Email),
+		"email_verified":     true,
+		"nonce":              q.Get("nonce"),
+	}
+	if g := query(q, "groups", strings.Join(s.Identity.Groups, ",")); g != "" {
+		claims["groups"] = strings.Split(g, ",")
+	}
+	b := make([]byte, 16)
+	rand.Read(b)
+	code := hex.EncodeToString(b)
+	s.lock.Lock()
+	s.grants[code] = &grant{challenge: q.Get("code_challenge"), redirectURI: q.Get("redirect_uri"), claims: claims, created: time.Now()}
+	s.lock.Unlock()
+
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirect.Query()
+	params.Set("code", code)
+	params.Set("state", q.Get("state"))
+	redirect.RawQuery = params.Encode()
+	s.Logf("logged in %s, redirecting to %s", claims["sub"], redirect.Host+redirect.Path)
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (s *Server) token(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.Form.Get("grant_type") != "authorization_code" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+	code := r.Form.Get("code")
+	s.lock.Lock()
+	g, ok := s.grants[code]
+	delete(s.grants, code)
+	s.lock.Unlock()
+	if !ok || time.Since(g.created) > time.Minute || g.redirectURI != r.Form.Get("redirect_uri") {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant", "error_description": "PKCE verification failed"})
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{"iss": s.Issuer, "aud": s.ClientID, "iat": now.Unix(), "exp": now.Add(5 * time.Minute).Unix()}
+	for name, val := range g.claims {
+		claims[name] = val
+	}
+	for name, val := range s.Claims {
+		claims[name] = val
+	}
+	payload, _ := json.Marshal(claims)
+	jws, err := s.signer.Sign(payload)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+	idToken, _ := jws.CompactSerialize()
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": code,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     idToken,
+	})
+}
+
+func (s *Server) jwks(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{{Key: &s.key.PublicKey, KeyID: "mock", Algorithm: "RS256", Use: "sig"}}})
+}
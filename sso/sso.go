@@ -0,0 +1,197 @@
+// Package sso logs users in with OpenID Connect identity provider using
+// authorization code flow with PKCE. It verifies ID tokens and maps their
+// claims to Identity, users are looked up and provisioned by main
+package sso
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+const (
+	// pendingTTL : how long user has to log in at identity provider
+	pendingTTL = 10 * time.Minute
+	// maxPending : logins in progress at once, each anonymous request
+	// starts one, so they are limited to keep memory bounded
+	maxPending = 10000
+)
+
+var (
+	// ErrUnknownState returned by Exchange for unknown or expired state
+	ErrUnknownState = errors.New("unknown or expired login state")
+	// ErrOtherBrowser returned by Exchange when login is finished by
+	// browser other than the one that started it
+	ErrOtherBrowser = errors.New("login is started by other browser")
+	// ErrTooManyPending returned by AuthURL when too many logins are in
+	// progress
+	ErrTooManyPending = errors.New("too many logins in progress")
+)
+
+// Config : identity provider client settings
+type Config struct {
+	Issuer       string // e.g. https://idp.example.com/realms/staff
+	ClientID     string
+	ClientSecret string // empty for public client, PKCE protects the code
+	RedirectURL  string // our /api/v1/sso/callback
+	GroupsClaim  string // claim with group names, "groups" by default
+	AdminGroups  []string
+}
+
+// Identity : user as identity provider knows the user
+type Identity struct {
+	Issuer            string
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	Groups            []string
+}
+
+// Pending : login started at identity provider and not finished yet
+type Pending struct {
+	Browser  string // secret kept by browser that started login, e.g. in cookie
+	LinkTo   int    // ID of user the identity is linked to, 0 for login
+	Session  string // session of LinkTo user that started linking
+	Verifier string // PKCE code verifier
+	Nonce    string
+	Created  time.Time
+}
+
+// Provider : configured identity provider
+type Provider struct {
+	cfg      Config
+	oauth    oauth2.Config
+	verifier *oidc.IDTokenVerifier
+
+	lock    sync.Mutex
+	pending map[string]*Pending // key is state
+}
+
+// New discovers identity provider endpoints by issuer
+func New(ctx context.Context, cfg Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+	if cfg.GroupsClaim == "" {
+		cfg.GroupsClaim = "groups"
+	}
+	return &Provider{
+		cfg: cfg,
+		oauth: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"}},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+		pending:  make(map[string]*Pending)}, nil
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// AuthURL starts login described by start and returns identity provider
+// page to send user to. Browser must be set, the login is finished only
+// by the same browser. Returns ErrTooManyPending when maxPending logins
+// are in progress
+func (p *Provider) AuthURL(start Pending) (string, error) {
+	state := randomString()
+	pending := start
+	pending.Verifier, pending.Nonce, pending.Created = oauth2.GenerateVerifier(), randomString(), time.Now()
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for key, old := range p.pending {
+		if time.Since(old.Created) > pendingTTL {
+			delete(p.pending, key)
+		}
+	}
+	if len(p.pending) >= maxPending {
+		return "", ErrTooManyPending
+	}
+	p.pending[state] = &pending
+	return p.oauth.AuthCodeURL(state, oauth2.S256ChallengeOption(pending.Verifier), oidc.Nonce(pending.Nonce)), nil
+}
+
+// Exchange finishes login of state started by browser: exchanges code for
+// tokens and verifies ID token. Every state is used once, so login state
+// sent to other browser is lost for it
+func (p *Provider) Exchange(ctx context.Context, state, browser, code string) (*Identity, *Pending, error) {
+	p.lock.Lock()
+	pending, ok := p.pending[state]
+	delete(p.pending, state)
+	p.lock.Unlock()
+	if !ok || time.Since(pending.Created) > pendingTTL {
+		return nil, nil, ErrUnknownState
+	}
+	if pending.Browser == "" || subtle.ConstantTimeCompare([]byte(pending.Browser), []byte(browser)) != 1 {
+		return nil, nil, ErrOtherBrowser
+	}
+	token, err := p.oauth.Exchange(ctx, code, oauth2.VerifierOption(pending.Verifier))
+	if err != nil {
+		return nil, nil, fmt.Errorf("code exchange: %w", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, nil, errors.New("no id_token in token response")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("id token: %w", err)
+	}
+	if idToken.Nonce != pending.Nonce {
+		return nil, nil, errors.New("id token: nonce mismatch")
+	}
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, nil, fmt.Errorf("id token claims: %w", err)
+	}
+	identity := &Identity{Issuer: idToken.Issuer, Subject: idToken.Subject}
+	identity.Email, _ = claims["email"].(string)
+	identity.EmailVerified, _ = claims["email_verified"].(bool)
+	identity.Name, _ = claims["name"].(string)
+	identity.PreferredUsername, _ = claims["preferred_username"].(string)
+	switch groups := claims[p.cfg.GroupsClaim].(type) {
+	case []interface{}:
+		for _, g := range groups {
+			if name, ok := g.(string); ok {
+				identity.Groups = append(identity.Groups, name)
+			}
+		}
+	case string:
+		identity.Groups = strings.Fields(groups)
+	}
+	return identity, pending, nil
+}
+
+// MapsAdmin tells whether admin privileges follow identity provider
+// groups, it is so when admin groups are configured
+func (p *Provider) MapsAdmin() bool {
+	return len(p.cfg.AdminGroups) > 0
+}
+
+// IsAdmin tells whether identity is in one of admin groups
+func (p *Provider) IsAdmin(identity *Identity) bool {
+	for _, g := range identity.Groups {
+		for _, admin := range p.cfg.AdminGroups {
+			if g == admin {
+				return true
+			}
+		}
+	}
+	return false
+}
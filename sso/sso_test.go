@@ -0,0 +1,134 @@
+package sso
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"./mockoidc"
+)
+
+// testProvider returns provider configured with mock identity provider
+func testProvider(t *testing.T) (*Provider, *mockoidc.Server) {
+	t.Helper()
+	idp, err := mockoidc.New("", "freelance_stock", mockoidc.Identity{Sub: "42", Login: "staff", Email: "staff@example.com", Groups: []string{"staff", "admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Logf = t.Logf
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+	p, err := New(context.Background(), Config{Issuer: srv.URL, ClientID: "freelance_stock",
+		RedirectURL: "http://app.test/api/v1/sso/callback", AdminGroups: []string{"admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, idp
+}
+
+// authorize logs in at identity provider page and returns state and code
+// it redirects back with
+func authorize(t *testing.T, authURL string) (state, code string) {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("identity provider answered %d", resp.StatusCode)
+	}
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return back.Query().Get("state"), back.Query().Get("code")
+}
+
+func TestLogin(t *testing.T) {
+	p, _ := testProvider(t)
+	authURL, err := p.AuthURL(Pending{Browser: "b1", LinkTo: 7, Session: "s1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, code := authorize(t, authURL)
+	identity, pending, err := p.Exchange(context.Background(), state, "b1", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Identity{Issuer: p.cfg.Issuer, Subject: "42", Email: "staff@example.com", EmailVerified: true,
+		Name: "staff", PreferredUsername: "staff", Groups: []string{"staff", "admins"}}
+	if !reflect.DeepEqual(identity, want) {
+		t.Errorf("identity %+v, want %+v", identity, want)
+	}
+	if pending.LinkTo != 7 || pending.Session != "s1" {
+		t.Errorf("pending %+v lost start of login", pending)
+	}
+	if !p.MapsAdmin() || !p.IsAdmin(identity) {
+		t.Error("identity in admin group must be admin")
+	}
+	if _, _, err := p.Exchange(context.Background(), state, "b1", code); !errors.Is(err, ErrUnknownState) {
+		t.Errorf("second use of state: %v, want ErrUnknownState", err)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		browser string
+		state   string // replaces state of login when set
+		claims  map[string]interface{}
+		want    error // nil for any error
+	}{
+		{"unknown state", "b1", "forged", nil, ErrUnknownState},
+		{"other browser", "b2", "", nil, ErrOtherBrowser},
+		{"no browser cookie", "", "", nil, ErrOtherBrowser},
+		{"nonce mismatch", "b1", "", map[string]interface{}{"nonce": "replayed"}, nil},
+		{"other audience", "b1", "", map[string]interface{}{"aud": "other_client"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, idp := testProvider(t)
+			idp.Claims = tt.claims
+			authURL, err := p.AuthURL(Pending{Browser: "b1"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, code := authorize(t, authURL)
+			if tt.state != "" {
+				state = tt.state
+			}
+			identity, _, err := p.Exchange(context.Background(), state, tt.browser, code)
+			if err == nil || identity != nil {
+				t.Fatalf("login accepted: %+v", identity)
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPendingLimit(t *testing.T) {
+	p, _ := testProvider(t)
+	for i := 0; i < maxPending; i++ {
+		if _, err := p.AuthURL(Pending{Browser: "b"}); err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+	}
+	if _, err := p.AuthURL(Pending{Browser: "b"}); !errors.Is(err, ErrTooManyPending) {
+		t.Fatalf("error %v, want ErrTooManyPending", err)
+	}
+	for _, pending := range p.pending {
+		pending.Created = pending.Created.Add(-pendingTTL - 1)
+	}
+	if _, err := p.AuthURL(Pending{Browser: "b"}); err != nil {
+		t.Errorf("expired logins must make room: %v", err)
+	}
+}
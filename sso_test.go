@@ -0,0 +1,378 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"./ratelimit"
+	"./sso"
+	"./sso/mockoidc"
+	"./storage"
+)
+
+// ssoStore : users and identities of single sign-on tests
+type ssoStore struct {
+	users      map[int]*storage.User
+	identities []*storage.UserIdentity
+}
+
+func (s *ssoStore) userNamed(name string) *storage.User {
+	for _, u := range s.users {
+		if u.UserName == name {
+			return u
+		}
+	}
+	return nil
+}
+
+func (s *ssoStore) insertUser(isAdmin bool, name, email string, verified bool) (int, error) {
+	if s.userNamed(name) != nil {
+		return 0, storage.ErrDuplicate
+	}
+	id := len(s.users) + 100
+	s.users[id] = &storage.User{ID: id, IsAdmin: isAdmin, UserName: name, Email: email, EmailVerified: verified}
+	return id, nil
+}
+
+// stubSSO sets up single sign-on with mock identity provider and users
+// of store, identity provider logs in subject 42 as staff
+func stubSSO(t *testing.T, users ...*storage.User) (*ssoStore, *mockoidc.Server) {
+	t.Helper()
+	idp, err := mockoidc.New("", "freelance_stock", mockoidc.Identity{Sub: "42", Login: "staff", Email: "staff@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.Logf = t.Logf
+	srv := httptest.NewServer(idp)
+	t.Cleanup(srv.Close)
+	idp.Issuer = srv.URL
+	provider, err := sso.New(context.Background(), sso.Config{Issuer: srv.URL, ClientID: "freelance_stock",
+		RedirectURL: "http://example.com/api/v1/sso/callback", AdminGroups: []string{"admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &ssoStore{users: map[int]*storage.User{}}
+	for _, u := range users {
+		store.users[u.ID] = u
+	}
+	provision, limiter, getIdentity, getUser := ssoProvision, loginLimiter, ssoGetIdentity, ssoGetUser
+	link, unlink, touch, update, create, register := ssoLinkIdentity, ssoUnlinkIdentity, ssoTouchIdentity, ssoUpdateUser, ssoCreateUser, ssoRegisterUser
+	t.Cleanup(func() {
+		for id := range store.users {
+			storage.EndSessions(id)
+		}
+		ssoProvider, ssoProvision, loginLimiter, ssoGetIdentity, ssoGetUser = nil, provision, limiter, getIdentity, getUser
+		ssoLinkIdentity, ssoUnlinkIdentity, ssoTouchIdentity, ssoUpdateUser, ssoCreateUser, ssoRegisterUser = link, unlink, touch, update, create, register
+	})
+	ssoProvider, ssoProvision = provider, true
+	loginLimiter = ratelimit.NewLimiter(ratelimit.NewMemoryStore())
+	ssoGetIdentity = func(ctx context.Context, issuer, subject string) (*storage.UserIdentity, error) {
+		for _, i := range store.identities {
+			if i.Issuer == issuer && i.Subject == subject {
+				return i, nil
+			}
+		}
+		return nil, storage.ErrNotFound
+	}
+	ssoGetUser = func(ctx context.Context, id int) (*storage.User, error) {
+		if u, ok := store.users[id]; ok {
+			return u, nil
+		}
+		return nil, storage.ErrNotFound
+	}
+	ssoLinkIdentity = func(ctx context.Context, i *storage.UserIdentity) error {
+		if _, err := ssoGetIdentity(ctx, i.Issuer, i.Subject); err == nil {
+			return storage.ErrDuplicate
+		}
+		i.ID = len(store.identities) + 1
+		store.identities = append(store.identities, i)
+		return nil
+	}
+	ssoUnlinkIdentity = func(ctx context.Context, userID, identityID int) error {
+		for n, i := range store.identities {
+			if i.ID == identityID && i.UserID == userID {
+				store.identities = append(store.identities[:n], store.identities[n+1:]...)
+				return nil
+			}
+		}
+		return storage.ErrNotFound
+	}
+	ssoTouchIdentity = func(ctx context.Context, identityID int, email string) error { return nil }
+	ssoUpdateUser = func(ctx context.Context, u *storage.User) error {
+		store.users[u.ID] = u
+		return nil
+	}
+	ssoCreateUser = func(ctx context.Context, isAdmin bool, name, passwordHash, email string) (int, error) {
+		return store.insertUser(isAdmin, name, email, true)
+	}
+	ssoRegisterUser = func(ctx context.Context, name, passwordHash, email string) (int, error) {
+		return store.insertUser(false, name, email, false)
+	}
+	return store, idp
+}
+
+// ssoAnswer : answer of SSO callback
+type ssoAnswer struct {
+	Token     string `json:"token"`
+	ErrorCode int    `json:"error_code"`
+}
+
+// ssoCallback logs in at identity provider page with extra query
+// parameters and returns callback request it redirects back with
+func ssoCallback(t *testing.T, authURL string, extra url.Values) *http.Request {
+	t.Helper()
+	to, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := to.Query()
+	for name := range extra {
+		q.Set(name, extra.Get(name))
+	}
+	to.RawQuery = q.Encode()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(to.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("identity provider answered %d %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	return httptest.NewRequest("GET", back.RequestURI(), nil)
+}
+
+// ssoLogin starts login with /sso/login, logs in at identity provider and
+// finishes login in the same browser
+func ssoLogin(t *testing.T, extra url.Values) (int, ssoAnswer) {
+	t.Helper()
+	e := testServer()
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/sso/login", nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login start answered %d: %s", rec.Code, rec.Body)
+	}
+	req := ssoCallback(t, rec.Header().Get("Location"), extra)
+	for _, cookie := range rec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	var answer ssoAnswer
+	if err := json.Unmarshal(rec.Body.Bytes(), &answer); err != nil {
+		t.Fatalf("answer %s: %v", rec.Body, err)
+	}
+	return rec.Code, answer
+}
+
+func TestSSOLoginProvisionsUser(t *testing.T) {
+	tests := []struct {
+		name   string
+		taken  []string
+		extra  url.Values
+		claims map[string]interface{}
+		want   string
+		verify bool
+	}{
+		{"preferred username", nil, nil, nil, "staff", true},
+		{"taken login gets number", []string{"staff"}, nil, nil, "staff2", true},
+		{"next free number", []string{"staff", "staff2"}, nil, nil, "staff3", true},
+		{"login cleaned of other characters", nil, url.Values{"login": {"Jo Hn!"}}, nil, "Jo_Hn", true},
+		{"email not verified by provider", nil, nil, map[string]interface{}{"email_verified": false}, "staff", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var users []*storage.User
+			for n, name := range tt.taken {
+				users = append(users, &storage.User{ID: n + 1, UserName: name})
+			}
+			store, idp := stubSSO(t, users...)
+			idp.Claims = tt.claims
+			status, answer := ssoLogin(t, tt.extra)
+			if status != http.StatusOK || answer.Token == "" {
+				t.Fatalf("login answered %d %+v", status, answer)
+			}
+			u := store.userNamed(tt.want)
+			if u == nil || u.ID < 100 {
+				t.Fatalf("user %q is not provisioned, users %v", tt.want, store.users)
+			}
+			if u.EmailVerified != tt.verify || u.Email != "staff@example.com" {
+				t.Errorf("provisioned user %+v", u)
+			}
+			if len(store.identities) != 1 || store.identities[0].UserID != u.ID || store.identities[0].Subject != "42" {
+				t.Fatalf("identities %+v, want subject 42 of user %d", store.identities, u.ID)
+			}
+			if id, ok := storage.SessionUserID(answer.Token); !ok || id != u.ID {
+				t.Errorf("token is session of user %d, want %d", id, u.ID)
+			}
+
+			count := len(store.users)
+			if status, again := ssoLogin(t, nil); status != http.StatusOK || again.Token != answer.Token {
+				t.Errorf("second login answered %d %+v, want session of the same user", status, again)
+			}
+			if len(store.users) != count || len(store.identities) != 1 {
+				t.Errorf("second login provisioned again: users %v, identities %+v", store.users, store.identities)
+			}
+		})
+	}
+}
+
+func TestSSOLoginRejects(t *testing.T) {
+	tests := []struct {
+		name      string
+		setup     func(idp *mockoidc.Server)
+		request   func(req *http.Request, cookies []*http.Cookie) *http.Request
+		status    int
+		errorCode int
+	}{
+		{"other browser", nil, func(req *http.Request, cookies []*http.Cookie) *http.Request {
+			req.AddCookie(&http.Cookie{Name: ssoBrowserCookie, Value: "forged"})
+			return req
+		}, http.StatusBadRequest, 176},
+		{"no cookie", nil, func(req *http.Request, cookies []*http.Cookie) *http.Request {
+			return req
+		}, http.StatusBadRequest, 176},
+		{"state mismatch", nil, func(req *http.Request, cookies []*http.Cookie) *http.Request {
+			q := req.URL.Query()
+			q.Set("state", "forged")
+			req = httptest.NewRequest("GET", "/api/v1/sso/callback?"+q.Encode(), nil)
+			req.AddCookie(cookies[0])
+			return req
+		}, http.StatusBadRequest, 171},
+		{"nonce mismatch", func(idp *mockoidc.Server) {
+			idp.Claims = map[string]interface{}{"nonce": "replayed"}
+		}, nil, http.StatusUnauthorized, 172},
+		{"provider refused", nil, func(req *http.Request, cookies []*http.Cookie) *http.Request {
+			req = httptest.NewRequest("GET", "/api/v1/sso/callback?error=access_denied", nil)
+			req.AddCookie(cookies[0])
+			return req
+		}, http.StatusUnauthorized, 172},
+		{"provisioning off", func(idp *mockoidc.Server) {
+			ssoProvision = false
+		}, nil, http.StatusForbidden, 174},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, idp := stubSSO(t)
+			if tt.setup != nil {
+				tt.setup(idp)
+			}
+			e := testServer()
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/sso/login", nil))
+			req := ssoCallback(t, rec.Header().Get("Location"), nil)
+			cookies := rec.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != ssoBrowserCookie || !cookies[0].HttpOnly {
+				t.Fatalf("login start cookies %v", cookies)
+			}
+			if tt.request != nil {
+				req = tt.request(req, cookies)
+			} else {
+				req.AddCookie(cookies[0])
+			}
+			rec = httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+			var answer ssoAnswer
+			json.Unmarshal(rec.Body.Bytes(), &answer)
+			if rec.Code != tt.status || answer.ErrorCode != tt.errorCode {
+				t.Errorf("answered %d %s, want %d with code %d", rec.Code, rec.Body, tt.status, tt.errorCode)
+			}
+			if answer.Token != "" || len(store.users) != 0 || len(store.identities) != 0 {
+				t.Errorf("rejected login left token %q, users %v, identities %+v", answer.Token, store.users, store.identities)
+			}
+		})
+	}
+}
+
+func TestSSOAdminGroups(t *testing.T) {
+	store, _ := stubSSO(t, &storage.User{ID: 1, UserName: "boss", IsAdmin: true})
+	store.identities = []*storage.UserIdentity{{ID: 1, UserID: 1, Subject: "42", Issuer: ssoIssuer(t)}}
+	// admin who left admin group loses privileges
+	if status, answer := ssoLogin(t, nil); status != http.StatusOK || answer.Token == "" {
+		t.Fatalf("login answered %d %+v", status, answer)
+	}
+	if store.users[1].IsAdmin {
+		t.Error("admin privileges must follow groups")
+	}
+	// and gets them back with the group, admins need second factor
+	status, answer := ssoLogin(t, url.Values{"groups": {"admins"}})
+	if !store.users[1].IsAdmin {
+		t.Error("member of admin group must become admin")
+	}
+	if status != http.StatusUnauthorized || answer.ErrorCode != 7 || answer.Token != "" {
+		t.Errorf("admin without second factor answered %d %+v, want enrollment challenge", status, answer)
+	}
+}
+
+// ssoIssuer returns issuer of identity provider set up by stubSSO
+func ssoIssuer(t *testing.T) string {
+	t.Helper()
+	authURL, err := ssoProvider.AuthURL(sso.Pending{Browser: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _ := url.Parse(authURL)
+	return to.Scheme + "://" + to.Host
+}
+
+func TestSSOLink(t *testing.T) {
+	alice := &storage.User{ID: 5, UserName: "alice", EmailVerified: true}
+	bob := &storage.User{ID: 6, UserName: "bob", EmailVerified: true}
+	tests := []struct {
+		name      string
+		session   func() string
+		linked    bool // identity is linked to other user already
+		status    int
+		errorCode int
+	}{
+		{"linked by session that started it", func() string { return storage.StartSession(alice) }, false, http.StatusOK, 0},
+		{"session ended", func() string {
+			token := storage.StartSession(alice)
+			storage.EndSessions(alice.ID)
+			return token
+		}, false, http.StatusUnauthorized, 178},
+		{"session of other user", func() string { return storage.StartSession(bob) }, false, http.StatusUnauthorized, 178},
+		{"identity of other user", func() string { return storage.StartSession(alice) }, true, http.StatusConflict, 173},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, _ := stubSSO(t, alice, bob)
+			t.Cleanup(func() { storage.EndSessions(alice.ID); storage.EndSessions(bob.ID) })
+			if tt.linked {
+				store.identities = []*storage.UserIdentity{{ID: 1, UserID: bob.ID, Subject: "42", Issuer: ssoIssuer(t)}}
+			}
+			authURL, err := ssoProvider.AuthURL(sso.Pending{Browser: "b", LinkTo: alice.ID, Session: tt.session()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := ssoCallback(t, authURL, nil)
+			req.AddCookie(&http.Cookie{Name: ssoBrowserCookie, Value: "b"})
+			rec := httptest.NewRecorder()
+			testServer().ServeHTTP(rec, req)
+			var answer ssoAnswer
+			json.Unmarshal(rec.Body.Bytes(), &answer)
+			if rec.Code != tt.status || answer.ErrorCode != tt.errorCode {
+				t.Fatalf("answered %d %s, want %d with code %d", rec.Code, rec.Body, tt.status, tt.errorCode)
+			}
+			i, err := ssoGetIdentity(context.Background(), ssoIssuer(t), "42")
+			switch {
+			case tt.status == http.StatusOK && (err != nil || i.UserID != alice.ID):
+				t.Errorf("identity %+v, %v: want linked to alice", i, err)
+			case tt.status != http.StatusOK && err == nil && i.UserID == alice.ID:
+				t.Error("rejected linking linked identity to alice")
+			case tt.status != http.StatusOK && !tt.linked && !errors.Is(err, storage.ErrNotFound):
+				t.Errorf("rejected linking left identity %+v", i)
+			}
+			if len(store.users) != 2 {
+				t.Errorf("linking provisioned user: %v", store.users)
+			}
+		})
+	}
+}
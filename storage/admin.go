@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"../currency"
+	"github.com/jmoiron/sqlx"
+)
+
+type dbBalanceMovement struct {
+	ID        int     `db:"id"`
+	UserID    int     `db:"user_id"`
+	Amount    float64 `db:"amount"`
+	Reason    string  `db:"reason"`
+	Actor     string  `db:"actor"`
+	CreatedAt string  `db:"created_at"`
+}
+
+type dbTaskStateChange struct {
+	ID        int    `db:"id"`
+	TaskID    int    `db:"task_id"`
+	FromState int    `db:"from_status"`
+	ToState   int    `db:"to_status"`
+	Reason    string `db:"reason"`
+	Actor     string `db:"actor"`
+	CreatedAt string `db:"created_at"`
+}
+
+// GetUsers returns all users ordered by ID
+func GetUsers(ctx context.Context) ([]*User, error) {
+	ctx, end := startOp(ctx, "GetUsers")
+	defer end()
+	var dbUsers []dbUser
+	if err := sqlx.SelectContext(ctx, conn(), &dbUsers, "SELECT * FROM users ORDER BY id"); err != nil {
+		return nil, wrapError(ctx, "GetUsers", err)
+	}
+	users := make([]*User, 0, len(dbUsers))
+	for i := range dbUsers {
+		users = append(users, dbUserToUser(&dbUsers[i]))
+	}
+	return users, nil
+}
+
+// GetTasks returns tasks in any of given states ordered by ID, all tasks if no states given
+func GetTasks(ctx context.Context, states ...State) ([]*Task, error) {
+	ctx, end := startOp(ctx, "GetTasks")
+	defer end()
+	query, args := "SELECT * FROM tasks ORDER BY id", []interface{}{}
+	if len(states) > 0 {
+		query = "SELECT * FROM tasks WHERE status IN (?" + strings.Repeat(", ?", len(states)-1) + ") ORDER BY id"
+		for _, s := range states {
+			args = append(args, int(s))
+		}
+	}
+	var dbTasks []dbTask
+	if err := sqlx.SelectContext(ctx, conn(), &dbTasks, query, args...); err != nil {
+		return nil, wrapError(ctx, "GetTasks", err)
+	}
+	tasks := make([]*Task, 0, len(dbTasks))
+	for i := range dbTasks {
+		tasks = append(tasks, dbTaskToTask(&dbTasks[i]))
+	}
+	return tasks, nil
+}
+
+// AdjustBalance adds amount (negative to withdraw) to user balance and records
+// the movement with reason and actor in one transaction, which also notifies
+// the user. Returns ErrInsufficientFunds if balance would become less than
+// frozen amount
+func AdjustBalance(ctx context.Context, userID int, amount currency.Money, reason, actor string) (*BalanceMovement, error) {
+	ctx, end := startOp(ctx, "AdjustBalance")
+	defer end()
+	tx, err := BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer RollbackTransaction(tx)
+
+	var dbU dbUser
+	if err := sqlx.GetContext(ctx, tx.conn(), &dbU, "SELECT * FROM users WHERE id=? FOR UPDATE", userID); err != nil {
+		return nil, wrapError(ctx, "AdjustBalance", err)
+	}
+	user := dbUserToUser(&dbU)
+	user.Balance.Add(amount)
+	if user.Balance.IsLessThan(user.FrozenAmount) {
+		return nil, &Error{Op: "AdjustBalance", Kind: ErrInsufficientFunds}
+	}
+	if err := updateUser(ctx, tx.conn(), user); err != nil {
+		return nil, err
+	}
+	movement := BalanceMovement{UserID: userID, Amount: amount, Reason: reason, Actor: actor, CreatedAt: time.Now()}
+	res, err := tx.conn().ExecContext(ctx, "INSERT INTO balance_movements (user_id, amount, reason, actor, created_at) VALUES(?, ?, ?, ?, ?)",
+		movement.UserID,
+		movement.Amount.GetVal(),
+		movement.Reason,
+		movement.Actor,
+		movement.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return nil, wrapError(ctx, "AdjustBalance", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, wrapError(ctx, "AdjustBalance", err)
+	}
+	movement.ID = int(id)
+	err = addNotification(ctx, tx.conn(), &Notification{
+		UserID:    userID,
+		Kind:      NotificationBalanceChanged,
+		Message:   fmt.Sprintf("Your balance is adjusted by %.2f: %s", amount.GetVal(), reason),
+		CreatedAt: movement.CreatedAt.Truncate(time.Second)})
+	if err != nil {
+		return nil, err
+	}
+	return &movement, CommitTransaction(tx)
+}
+
+// GetBalanceMovements returns balance movements of user, all users if userID is 0
+func GetBalanceMovements(ctx context.Context, userID int) ([]*BalanceMovement, error) {
+	ctx, end := startOp(ctx, "GetBalanceMovements")
+	defer end()
+	query, args := "SELECT * FROM balance_movements ORDER BY id", []interface{}{}
+	if userID != 0 {
+		query, args = "SELECT * FROM balance_movements WHERE user_id=? ORDER BY id", []interface{}{userID}
+	}
+	var rows []dbBalanceMovement
+	if err := sqlx.SelectContext(ctx, conn(), &rows, query, args...); err != nil {
+		return nil, wrapError(ctx, "GetBalanceMovements", err)
+	}
+	movements := make([]*BalanceMovement, 0, len(rows))
+	for _, row := range rows {
+		createdAt, _ := time.Parse(timeStringLayout, row.CreatedAt)
+		movements = append(movements, &BalanceMovement{
+			ID:        row.ID,
+			UserID:    row.UserID,
+			Amount:    currency.MoneyCtr(row.Amount),
+			Reason:    row.Reason,
+			Actor:     row.Actor,
+			CreatedAt: createdAt})
+	}
+	return movements, nil
+}
+
+// ForceTaskState moves task to any state bypassing command rules
+// and records the change with reason and actor in one transaction
+func ForceTaskState(ctx context.Context, taskID int, state State, reason, actor string) (*TaskStateChange, error) {
+	ctx, end := startOp(ctx, "ForceTaskState")
+	defer end()
+	tx, err := BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer RollbackTransaction(tx)
+
+	var dbT dbTask
+	if err := sqlx.GetContext(ctx, tx.conn(), &dbT, "SELECT * FROM tasks WHERE id=? FOR UPDATE", taskID); err != nil {
+		return nil, wrapError(ctx, "ForceTaskState", err)
+	}
+	task := dbTaskToTask(&dbT)
+	change := TaskStateChange{TaskID: taskID, FromState: task.State, ToState: state, Reason: reason, Actor: actor, CreatedAt: time.Now()}
+	task.State = state
+	if err := updateTask(ctx, tx.conn(), task); err != nil {
+		return nil, err
+	}
+	res, err := tx.conn().ExecContext(ctx, "INSERT INTO task_state_changes (task_id, from_status, to_status, reason, actor, created_at) VALUES(?, ?, ?, ?, ?, ?)",
+		change.TaskID,
+		int(change.FromState),
+		int(change.ToState),
+		change.Reason,
+		change.Actor,
+		change.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return nil, wrapError(ctx, "ForceTaskState", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return nil, wrapError(ctx, "ForceTaskState", err)
+	}
+	change.ID = int(id)
+	return &change, CommitTransaction(tx)
+}
+
+// GetTaskStateChanges returns forced state changes of task, all tasks if taskID is 0
+func GetTaskStateChanges(ctx context.Context, taskID int) ([]*TaskStateChange, error) {
+	ctx, end := startOp(ctx, "GetTaskStateChanges")
+	defer end()
+	query, args := "SELECT * FROM task_state_changes ORDER BY id", []interface{}{}
+	if taskID != 0 {
+		query, args = "SELECT * FROM task_state_changes WHERE task_id=? ORDER BY id", []interface{}{taskID}
+	}
+	var rows []dbTaskStateChange
+	if err := sqlx.SelectContext(ctx, conn(), &rows, query, args...); err != nil {
+		return nil, wrapError(ctx, "GetTaskStateChanges", err)
+	}
+	changes := make([]*TaskStateChange, 0, len(rows))
+	for _, row := range rows {
+		createdAt, _ := time.Parse(timeStringLayout, row.CreatedAt)
+		changes = append(changes, &TaskStateChange{
+			ID:        row.ID,
+			TaskID:    row.TaskID,
+			FromState: State(row.FromState),
+			ToState:   State(row.ToState),
+			Reason:    row.Reason,
+			Actor:     row.Actor,
+			CreatedAt: createdAt})
+	}
+	return changes, nil
+}
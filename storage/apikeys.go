@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbAPIKey struct {
+	ID         int            `db:"id"`
+	UserID     int            `db:"user_id"`
+	Name       string         `db:"name"`
+	Prefix     string         `db:"prefix"`
+	Hash       string         `db:"key_hash"`
+	Scopes     string         `db:"scopes"`
+	CreatedAt  string         `db:"created_at"`
+	LastUsedAt sql.NullString `db:"last_used_at"`
+	RevokedAt  sql.NullString `db:"revoked_at"`
+}
+
+// apiKeyTouchInterval : last_used_at is updated at most once in it, so
+// every request made with key doesn't write to database
+const apiKeyTouchInterval = time.Minute
+
+func dbAPIKeyToAPIKey(val *dbAPIKey) *APIKey {
+	k := APIKey{
+		ID:        val.ID,
+		UserID:    val.UserID,
+		Name:      val.Name,
+		Prefix:    val.Prefix,
+		Hash:      val.Hash,
+		Scopes:    strings.Split(val.Scopes, ","),
+		CreatedAt: parseLocalTime(timeStringLayout, val.CreatedAt)}
+	if val.LastUsedAt.Valid {
+		k.LastUsedAt = parseLocalTime(timeStringLayout, val.LastUsedAt.String)
+	}
+	if val.RevokedAt.Valid {
+		k.RevokedAt = parseLocalTime(timeStringLayout, val.RevokedAt.String)
+	}
+	return &k
+}
+
+// CreateAPIKey saves new key of user, returns its ID
+func CreateAPIKey(ctx context.Context, k *APIKey) (keyID int, err error) {
+	ctx, end := startOp(ctx, "CreateAPIKey")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO api_keys (user_id, name, prefix, key_hash, scopes, created_at) VALUES(?, ?, ?, ?, ?, ?)",
+		k.UserID,
+		k.Name,
+		k.Prefix,
+		k.Hash,
+		strings.Join(k.Scopes, ","),
+		k.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return 0, wrapError(ctx, "CreateAPIKey", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, wrapError(ctx, "CreateAPIKey", err)
+	}
+	return int(id), nil
+}
+
+// GetAPIKeys returns keys of user including revoked ones, newest first
+func GetAPIKeys(ctx context.Context, userID int) ([]*APIKey, error) {
+	ctx, end := startOp(ctx, "GetAPIKeys")
+	defer end()
+	var rows []dbAPIKey
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM api_keys WHERE user_id=? ORDER BY id DESC", userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetAPIKeys", err)
+	}
+	keys := make([]*APIKey, 0, len(rows))
+	for i := range rows {
+		keys = append(keys, dbAPIKeyToAPIKey(&rows[i]))
+	}
+	return keys, nil
+}
+
+// GetAPIKeyByHash returns active key by hash, ErrNotFound if there is no
+// such key or it is revoked
+func GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	ctx, end := startOp(ctx, "GetAPIKeyByHash")
+	defer end()
+	var row dbAPIKey
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM api_keys WHERE key_hash=? AND revoked_at IS NULL", hash)
+	if err != nil {
+		return nil, wrapError(ctx, "GetAPIKeyByHash", err)
+	}
+	return dbAPIKeyToAPIKey(&row), nil
+}
+
+// TouchAPIKey records use of key, at most once a minute
+func TouchAPIKey(ctx context.Context, keyID int) error {
+	ctx, end := startOp(ctx, "TouchAPIKey")
+	defer end()
+	now := time.Now()
+	_, err := conn().ExecContext(ctx, "UPDATE api_keys SET last_used_at=? WHERE id=? AND (last_used_at IS NULL OR last_used_at<?)",
+		now.Format(timeStringLayout),
+		keyID,
+		now.Add(-apiKeyTouchInterval).Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "TouchAPIKey", err)
+	}
+	return nil
+}
+
+// RevokeAPIKey revokes active key of user. Returns ErrNotFound if user
+// has no such key or it is already revoked
+func RevokeAPIKey(ctx context.Context, userID, keyID int) error {
+	ctx, end := startOp(ctx, "RevokeAPIKey")
+	defer end()
+	res, err := conn().ExecContext(ctx, "UPDATE api_keys SET revoked_at=? WHERE id=? AND user_id=? AND revoked_at IS NULL",
+		time.Now().Format(timeStringLayout),
+		keyID,
+		userID)
+	if err != nil {
+		return wrapError(ctx, "RevokeAPIKey", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "RevokeAPIKey", err)
+	}
+	if n == 0 {
+		return notFound("RevokeAPIKey")
+	}
+	return nil
+}
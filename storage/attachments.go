@@ -0,0 +1,105 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbAttachment struct {
+	ID          int    `db:"id"`
+	TaskID      int    `db:"task_id"`
+	UploaderID  int    `db:"uploader_id"`
+	Kind        string `db:"kind"`
+	FileName    string `db:"file_name"`
+	ContentType string `db:"content_type"`
+	Size        int64  `db:"size"`
+	SHA256      string `db:"sha256"`
+	BlobKey     string `db:"blob_key"`
+	CreatedAt   string `db:"created_at"`
+}
+
+func dbAttachmentToAttachment(val *dbAttachment) *Attachment {
+	return &Attachment{
+		ID:          val.ID,
+		TaskID:      val.TaskID,
+		UploaderID:  val.UploaderID,
+		Kind:        val.Kind,
+		FileName:    val.FileName,
+		ContentType: val.ContentType,
+		Size:        val.Size,
+		SHA256:      val.SHA256,
+		BlobKey:     val.BlobKey,
+		CreatedAt:   parseLocalTime(timeStringLayout, val.CreatedAt)}
+}
+
+// CreateAttachment saves attachment and sets its ID
+func CreateAttachment(ctx context.Context, a *Attachment) error {
+	ctx, end := startOp(ctx, "CreateAttachment")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO task_attachments (task_id, uploader_id, kind, file_name, content_type, size, sha256, blob_key, created_at) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		a.TaskID,
+		a.UploaderID,
+		a.Kind,
+		a.FileName,
+		a.ContentType,
+		a.Size,
+		a.SHA256,
+		a.BlobKey,
+		a.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "CreateAttachment", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreateAttachment", err)
+	}
+	a.ID = int(id)
+	return nil
+}
+
+// GetAttachments returns attachments of task, oldest first
+func GetAttachments(ctx context.Context, taskID int) ([]*Attachment, error) {
+	ctx, end := startOp(ctx, "GetAttachments")
+	defer end()
+	var rows []dbAttachment
+	if err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM task_attachments WHERE task_id=? ORDER BY id", taskID); err != nil {
+		return nil, wrapError(ctx, "GetAttachments", err)
+	}
+	attachments := make([]*Attachment, 0, len(rows))
+	for i := range rows {
+		attachments = append(attachments, dbAttachmentToAttachment(&rows[i]))
+	}
+	return attachments, nil
+}
+
+// GetAttachment returns attachment of task, ErrNotFound if task has no such attachment
+func GetAttachment(ctx context.Context, taskID, attachmentID int) (*Attachment, error) {
+	ctx, end := startOp(ctx, "GetAttachment")
+	defer end()
+	var row dbAttachment
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM task_attachments WHERE id=? AND task_id=?", attachmentID, taskID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetAttachment", err)
+	}
+	return dbAttachmentToAttachment(&row), nil
+}
+
+// DeleteAttachment removes attachment of task, ErrNotFound if task has no
+// such attachment. Its blob is left to the caller
+func DeleteAttachment(ctx context.Context, taskID, attachmentID int) error {
+	ctx, end := startOp(ctx, "DeleteAttachment")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM task_attachments WHERE id=? AND task_id=?", attachmentID, taskID)
+	if err != nil {
+		return wrapError(ctx, "DeleteAttachment", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "DeleteAttachment", err)
+	}
+	if n == 0 {
+		return notFound("DeleteAttachment")
+	}
+	return nil
+}
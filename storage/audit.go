@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbAuditRecord struct {
+	ID        int    `db:"id"`
+	CreatedAt string `db:"created_at"`
+	ActorID   int    `db:"actor_id"`
+	ActorName string `db:"actor_name"`
+	Action    string `db:"action"`
+	Targets   string `db:"targets"`
+	Diff      string `db:"diff"`
+	IP        string `db:"ip"`
+	RequestID string `db:"request_id"`
+	Status    int    `db:"status"`
+	PrevHash  string `db:"prev_hash"`
+	Hash      string `db:"hash"`
+}
+
+// AuditFilter : conditions for GetAuditRecords, zero fields match everything
+type AuditFilter struct {
+	Actor  string // actor name
+	Target string // e.g. "task:5"
+	From   time.Time
+	To     time.Time
+	Limit  int
+}
+
+func dbAuditRecordToAuditRecord(val *dbAuditRecord) *AuditRecord {
+	createdAt, _ := time.Parse(timeStringLayout, val.CreatedAt)
+	return &AuditRecord{
+		ID:        val.ID,
+		CreatedAt: createdAt,
+		ActorID:   val.ActorID,
+		ActorName: val.ActorName,
+		Action:    val.Action,
+		Targets:   splitTargets(val.Targets),
+		Diff:      val.Diff,
+		IP:        val.IP,
+		RequestID: val.RequestID,
+		Status:    val.Status,
+		PrevHash:  val.PrevHash,
+		Hash:      val.Hash}
+}
+
+// targets are stored as ",task:5,user:3," so LIKE '%,task:5,%' finds them
+func joinTargets(targets []string) string {
+	if len(targets) == 0 {
+		return ""
+	}
+	return "," + strings.Join(targets, ",") + ","
+}
+
+func splitTargets(targets string) []string {
+	targets = strings.Trim(targets, ",")
+	if targets == "" {
+		return nil
+	}
+	return strings.Split(targets, ",")
+}
+
+// LastAuditHashTx returns hash of the last audit record, empty string for
+// empty log. The row stays locked until transaction ends, so records are
+// chained one after another
+func LastAuditHashTx(tx *Tx) (string, error) {
+	ctx, end := startOp(tx.ctx, "LastAuditHashTx")
+	defer end()
+	var hash string
+	err := sqlx.GetContext(ctx, tx.conn(), &hash, "SELECT hash FROM audit_log ORDER BY id DESC LIMIT 1 FOR UPDATE")
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", wrapError(ctx, "LastAuditHashTx", err)
+	}
+	return hash, nil
+}
+
+// InsertAuditRecordTx appends record to audit log, sets rec.ID.
+// rec.CreatedAt is truncated to seconds as it is stored
+func InsertAuditRecordTx(tx *Tx, rec *AuditRecord) error {
+	ctx, end := startOp(tx.ctx, "InsertAuditRecordTx")
+	defer end()
+	res, err := tx.conn().ExecContext(ctx, "INSERT INTO audit_log (created_at, actor_id, actor_name, action, targets, diff, ip, request_id, status, prev_hash, hash) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		rec.CreatedAt.Format(timeStringLayout),
+		rec.ActorID,
+		rec.ActorName,
+		rec.Action,
+		joinTargets(rec.Targets),
+		rec.Diff,
+		rec.IP,
+		rec.RequestID,
+		rec.Status,
+		rec.PrevHash,
+		rec.Hash)
+	if err != nil {
+		return wrapError(ctx, "InsertAuditRecordTx", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "InsertAuditRecordTx", err)
+	}
+	rec.ID = int(id)
+	return nil
+}
+
+// GetAuditRecords returns records matching filter, newest first
+func GetAuditRecords(ctx context.Context, f AuditFilter) ([]*AuditRecord, error) {
+	ctx, end := startOp(ctx, "GetAuditRecords")
+	defer end()
+	var where []string
+	var args []interface{}
+	if f.Actor != "" {
+		where = append(where, "actor_name=?")
+		args = append(args, f.Actor)
+	}
+	if f.Target != "" {
+		where = append(where, "targets LIKE ?")
+		args = append(args, "%,"+f.Target+",%")
+	}
+	if !f.From.IsZero() {
+		where = append(where, "created_at>=?")
+		args = append(args, f.From.Format(timeStringLayout))
+	}
+	if !f.To.IsZero() {
+		where = append(where, "created_at<=?")
+		args = append(args, f.To.Format(timeStringLayout))
+	}
+	query := "SELECT * FROM audit_log"
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if f.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, f.Limit)
+	}
+	return selectAuditRecords(ctx, "GetAuditRecords", query, args...)
+}
+
+// GetAuditRecordsAfter returns up to limit records with id greater than
+// afterID in log order, used to walk the whole chain
+func GetAuditRecordsAfter(ctx context.Context, afterID, limit int) ([]*AuditRecord, error) {
+	ctx, end := startOp(ctx, "GetAuditRecordsAfter")
+	defer end()
+	return selectAuditRecords(ctx, "GetAuditRecordsAfter", "SELECT * FROM audit_log WHERE id>? ORDER BY id LIMIT ?", afterID, limit)
+}
+
+func selectAuditRecords(ctx context.Context, op, query string, args ...interface{}) ([]*AuditRecord, error) {
+	var rows []dbAuditRecord
+	if err := sqlx.SelectContext(ctx, conn(), &rows, query, args...); err != nil {
+		return nil, wrapError(ctx, op, err)
+	}
+	records := make([]*AuditRecord, 0, len(rows))
+	for i := range rows {
+		records = append(records, dbAuditRecordToAuditRecord(&rows[i]))
+	}
+	return records, nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"context"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbCategory struct {
+	ID       int    `db:"id"`
+	ParentID int    `db:"parent_id"`
+	Name     string `db:"name"`
+}
+
+// placeholders returns "?, ?, ?" for n values
+func placeholders(n int) string {
+	return "?" + strings.Repeat(", ?", n-1)
+}
+
+// loadTags sets tags of tasks
+func loadTags(ctx context.Context, tasks []*Task) error {
+	if len(tasks) == 0 {
+		return nil
+	}
+	byID := make(map[int]*Task, len(tasks))
+	args := make([]interface{}, 0, len(tasks))
+	for _, t := range tasks {
+		t.Tags = []string{}
+		byID[t.ID] = t
+		args = append(args, t.ID)
+	}
+	var rows []struct {
+		TaskID int    `db:"task_id"`
+		Tag    string `db:"tag"`
+	}
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT task_id, tag FROM task_tags WHERE task_id IN ("+placeholders(len(args))+") ORDER BY tag", args...)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		byID[row.TaskID].Tags = append(byID[row.TaskID].Tags, row.Tag)
+	}
+	return nil
+}
+
+// SetTaskTagsTx replaces tags of task in transaction of task change
+func SetTaskTagsTx(tx *Tx, taskID int, tags []string) error {
+	ctx, end := startOp(tx.ctx, "SetTaskTags")
+	defer end()
+	if _, err := tx.conn().ExecContext(ctx, "DELETE FROM task_tags WHERE task_id=?", taskID); err != nil {
+		return wrapError(ctx, "SetTaskTags", err)
+	}
+	for _, tag := range tags {
+		if _, err := tx.conn().ExecContext(ctx, "INSERT INTO task_tags (task_id, tag) VALUES(?, ?)", taskID, tag); err != nil {
+			return wrapError(ctx, "SetTaskTags", err)
+		}
+	}
+	return nil
+}
+
+// FindTasks returns tasks matching filter with their tags, newest first
+func FindTasks(ctx context.Context, f TaskFilter) ([]*Task, error) {
+	ctx, end := startOp(ctx, "FindTasks")
+	defer end()
+	where, args := []string{"1=1"}, []interface{}{}
+	if len(f.States) > 0 {
+		where = append(where, "status IN ("+placeholders(len(f.States))+")")
+		for _, s := range f.States {
+			args = append(args, int(s))
+		}
+	}
+	if len(f.CategoryIDs) > 0 {
+		where = append(where, "category_id IN ("+placeholders(len(f.CategoryIDs))+")")
+		for _, id := range f.CategoryIDs {
+			args = append(args, id)
+		}
+	}
+	if len(f.Tags) > 0 {
+		where = append(where, "id IN (SELECT task_id FROM task_tags WHERE tag IN ("+placeholders(len(f.Tags))+") GROUP BY task_id HAVING COUNT(*)=?)")
+		for _, tag := range f.Tags {
+			args = append(args, tag)
+		}
+		args = append(args, len(f.Tags))
+	}
+	if f.BeforeID > 0 {
+		where = append(where, "id<?")
+		args = append(args, f.BeforeID)
+	}
+	args = append(args, f.Limit)
+	var rows []dbTask
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM tasks WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, wrapError(ctx, "FindTasks", err)
+	}
+	tasks := make([]*Task, 0, len(rows))
+	for i := range rows {
+		tasks = append(tasks, dbTaskToTask(&rows[i]))
+	}
+	if err := loadTags(ctx, tasks); err != nil {
+		return nil, wrapError(ctx, "FindTasks", err)
+	}
+	return tasks, nil
+}
+
+// GetTaskHistory counts tags and categories of tasks user has executed
+// and got accepted
+func GetTaskHistory(ctx context.Context, userID int) (*TaskHistory, error) {
+	ctx, end := startOp(ctx, "GetTaskHistory")
+	defer end()
+	h := TaskHistory{Tags: map[string]int{}, Categories: map[int]int{}}
+	var tags []struct {
+		Tag   string `db:"tag"`
+		Count int    `db:"count"`
+	}
+	err := sqlx.SelectContext(ctx, conn(), &tags, "SELECT g.tag, COUNT(*) AS count FROM task_tags g JOIN tasks t ON t.id=g.task_id "+
+		"WHERE t.executor_id=? AND t.status=? GROUP BY g.tag", userID, StateAccepted)
+	if err != nil {
+		return nil, wrapError(ctx, "GetTaskHistory", err)
+	}
+	for _, row := range tags {
+		h.Tags[row.Tag] = row.Count
+	}
+	var categories []struct {
+		CategoryID int `db:"category_id"`
+		Count      int `db:"count"`
+	}
+	err = sqlx.SelectContext(ctx, conn(), &categories, "SELECT category_id, COUNT(*) AS count FROM tasks "+
+		"WHERE executor_id=? AND status=? AND category_id<>0 GROUP BY category_id", userID, StateAccepted)
+	if err != nil {
+		return nil, wrapError(ctx, "GetTaskHistory", err)
+	}
+	for _, row := range categories {
+		h.Categories[row.CategoryID] = row.Count
+	}
+	return &h, nil
+}
+
+// GetCategories returns all categories ordered by name
+func GetCategories(ctx context.Context) ([]*Category, error) {
+	ctx, end := startOp(ctx, "GetCategories")
+	defer end()
+	var rows []dbCategory
+	if err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM categories ORDER BY name"); err != nil {
+		return nil, wrapError(ctx, "GetCategories", err)
+	}
+	categories := make([]*Category, 0, len(rows))
+	for _, row := range rows {
+		categories = append(categories, &Category{ID: row.ID, ParentID: row.ParentID, Name: row.Name})
+	}
+	return categories, nil
+}
+
+// GetCategory returns category by ID, ErrNotFound if there is none
+func GetCategory(ctx context.Context, categoryID int) (*Category, error) {
+	ctx, end := startOp(ctx, "GetCategory")
+	defer end()
+	var row dbCategory
+	if err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM categories WHERE id=?", categoryID); err != nil {
+		return nil, wrapError(ctx, "GetCategory", err)
+	}
+	return &Category{ID: row.ID, ParentID: row.ParentID, Name: row.Name}, nil
+}
+
+// CreateCategory saves category and sets its ID, ErrDuplicate if parent
+// has category with the name already
+func CreateCategory(ctx context.Context, cat *Category) error {
+	ctx, end := startOp(ctx, "CreateCategory")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO categories (parent_id, name) VALUES(?, ?)", cat.ParentID, cat.Name)
+	if err != nil {
+		return wrapError(ctx, "CreateCategory", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreateCategory", err)
+	}
+	cat.ID = int(id)
+	return nil
+}
+
+// DeleteCategory deletes category nothing refers to. Returns ErrNotFound if
+// there is no such category and ErrConflict if it has subcategories or tasks
+func DeleteCategory(ctx context.Context, categoryID int) error {
+	ctx, end := startOp(ctx, "DeleteCategory")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM categories WHERE id=? "+
+		"AND NOT EXISTS (SELECT 1 FROM (SELECT id FROM categories WHERE parent_id=?) c) "+
+		"AND NOT EXISTS (SELECT 1 FROM tasks WHERE category_id=?)", categoryID, categoryID, categoryID)
+	if err != nil {
+		return wrapError(ctx, "DeleteCategory", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "DeleteCategory", err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := GetCategory(ctx, categoryID); err != nil {
+		return err
+	}
+	return &Error{Op: "DeleteCategory", Kind: ErrConflict}
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbTaskDispute struct {
+	ID               int            `db:"id"`
+	TaskID           int            `db:"task_id"`
+	OpenedBy         int            `db:"opened_by"`
+	Reason           string         `db:"reason"`
+	OpenedAt         string         `db:"opened_at"`
+	ResolvedBy       int            `db:"resolved_by"`
+	Resolution       string         `db:"resolution"`
+	ResolutionReason string         `db:"resolution_reason"`
+	ResolvedAt       sql.NullString `db:"resolved_at"`
+}
+
+func dbTaskDisputeToTaskDispute(val *dbTaskDispute) *TaskDispute {
+	d := TaskDispute{
+		ID:               val.ID,
+		TaskID:           val.TaskID,
+		OpenedBy:         val.OpenedBy,
+		Reason:           val.Reason,
+		OpenedAt:         parseLocalTime(timeStringLayout, val.OpenedAt),
+		ResolvedBy:       val.ResolvedBy,
+		Resolution:       val.Resolution,
+		ResolutionReason: val.ResolutionReason}
+	if val.ResolvedAt.Valid {
+		d.ResolvedAt = parseLocalTime(timeStringLayout, val.ResolvedAt.String)
+	}
+	return &d
+}
+
+// CreateTaskDisputeTx saves dispute in transaction of task change and sets its ID
+func CreateTaskDisputeTx(tx *Tx, d *TaskDispute) error {
+	ctx, end := startOp(tx.ctx, "CreateTaskDispute")
+	defer end()
+	res, err := tx.conn().ExecContext(ctx, "INSERT INTO task_disputes (task_id, opened_by, reason, opened_at) VALUES(?, ?, ?, ?)",
+		d.TaskID,
+		d.OpenedBy,
+		d.Reason,
+		d.OpenedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "CreateTaskDispute", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreateTaskDispute", err)
+	}
+	d.ID = int(id)
+	return nil
+}
+
+// ResolveTaskDisputeTx saves resolution of open dispute in transaction of
+// task change, ErrConflict if dispute is resolved already
+func ResolveTaskDisputeTx(tx *Tx, d *TaskDispute) error {
+	ctx, end := startOp(tx.ctx, "ResolveTaskDispute")
+	defer end()
+	res, err := tx.conn().ExecContext(ctx, "UPDATE task_disputes SET resolved_by=?, resolution=?, resolution_reason=?, resolved_at=? WHERE id=? AND resolved_at IS NULL",
+		d.ResolvedBy,
+		d.Resolution,
+		d.ResolutionReason,
+		d.ResolvedAt.Format(timeStringLayout),
+		d.ID)
+	if err != nil {
+		return wrapError(ctx, "ResolveTaskDispute", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "ResolveTaskDispute", err)
+	}
+	if n == 0 {
+		return &Error{Op: "ResolveTaskDispute", Kind: ErrConflict}
+	}
+	return nil
+}
+
+// GetTaskDisputes returns disputes of task, oldest first
+func GetTaskDisputes(ctx context.Context, taskID int) ([]*TaskDispute, error) {
+	ctx, end := startOp(ctx, "GetTaskDisputes")
+	defer end()
+	var rows []dbTaskDispute
+	if err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM task_disputes WHERE task_id=? ORDER BY id", taskID); err != nil {
+		return nil, wrapError(ctx, "GetTaskDisputes", err)
+	}
+	disputes := make([]*TaskDispute, 0, len(rows))
+	for i := range rows {
+		disputes = append(disputes, dbTaskDisputeToTaskDispute(&rows[i]))
+	}
+	return disputes, nil
+}
+
+// GetOpenTaskDispute returns unresolved dispute of task, ErrNotFound if there is none
+func GetOpenTaskDispute(ctx context.Context, taskID int) (*TaskDispute, error) {
+	ctx, end := startOp(ctx, "GetOpenTaskDispute")
+	defer end()
+	var row dbTaskDispute
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM task_disputes WHERE task_id=? AND resolved_at IS NULL ORDER BY id DESC LIMIT 1", taskID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetOpenTaskDispute", err)
+	}
+	return dbTaskDisputeToTaskDispute(&row), nil
+}
@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+
+	"github.com/VividCortex/mysqlerr"
+	"github.com/go-sql-driver/mysql"
+)
+
+// Error kinds returned by storage functions. Check them with errors.Is,
+// the concrete error is always an *Error carrying the operation name
+var (
+	ErrNotFound    = errors.New("not found")
+	ErrDuplicate   = errors.New("duplicate entry")
+	ErrConflict    = errors.New("conflict")
+	ErrUnavailable = errors.New("storage unavailable")
+)
+
+// ErrWrongPassword returned by Login when password doesn't match
+var ErrWrongPassword = errors.New("username and password doesn't match")
+
+// ErrUserDisabled returned by Login for disabled user
+var ErrUserDisabled = errors.New("user is disabled")
+
+// ErrEmailNotVerified returned by Login for registered user who didn't verify email yet
+var ErrEmailNotVerified = errors.New("email is not verified")
+
+// ErrInsufficientFunds returned when balance would become less than frozen amount
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// Error : storage error with context
+type Error struct {
+	Op   string // storage function name, e.g. "GetTaskByID"
+	Kind error  // one of ErrNotFound, ErrDuplicate, ErrConflict, ErrUnavailable or nil
+	Err  error  // underlying driver error, may be nil
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.Kind != nil && e.Err != nil:
+		return fmt.Sprintf("storage: %s: %v: %v", e.Op, e.Kind, e.Err)
+	case e.Kind != nil:
+		return fmt.Sprintf("storage: %s: %v", e.Op, e.Kind)
+	}
+	return fmt.Sprintf("storage: %s: %v", e.Op, e.Err)
+}
+
+// Unwrap allows errors.Is to match both the kind and the driver error
+func (e *Error) Unwrap() []error {
+	var errs []error
+	if e.Kind != nil {
+		errs = append(errs, e.Kind)
+	}
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	return errs
+}
+
+// wrapError classifies driver error and wraps it with operation name.
+// Unexpected errors are logged as warnings with request fields from ctx
+func wrapError(ctx context.Context, op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	wrapped := &Error{Op: op, Kind: errorKind(err), Err: err}
+	level := slog.LevelDebug
+	if wrapped.Kind == nil || wrapped.Kind == ErrUnavailable {
+		level = slog.LevelWarn
+	}
+	slog.Log(ctx, level, "storage error", "op", op, "err", wrapped)
+	countError(op, wrapped.Kind)
+	recordError(ctx, wrapped)
+	return wrapped
+}
+
+func errorKind(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, sql.ErrConnDone) {
+		return ErrUnavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return ErrUnavailable
+	}
+	var driverErr *mysql.MySQLError
+	if errors.As(err, &driverErr) {
+		switch driverErr.Number {
+		case mysqlerr.ER_DUP_ENTRY:
+			return ErrDuplicate
+		case mysqlerr.ER_LOCK_DEADLOCK, mysqlerr.ER_LOCK_WAIT_TIMEOUT:
+			return ErrConflict
+		case mysqlerr.ER_CON_COUNT_ERROR, mysqlerr.ER_SERVER_SHUTDOWN:
+			return ErrUnavailable
+		}
+	}
+	return nil
+}
+
+// notFound returns ErrNotFound error for operation
+func notFound(op string) error {
+	countError(op, ErrNotFound)
+	return &Error{Op: op, Kind: ErrNotFound}
+}
@@ -0,0 +1,113 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbUserIdentity struct {
+	ID          int    `db:"id"`
+	UserID      int    `db:"user_id"`
+	Issuer      string `db:"issuer"`
+	Subject     string `db:"subject"`
+	Email       string `db:"email"`
+	CreatedAt   string `db:"created_at"`
+	LastLoginAt string `db:"last_login_at"`
+}
+
+func dbUserIdentityToUserIdentity(val *dbUserIdentity) *UserIdentity {
+	return &UserIdentity{
+		ID:          val.ID,
+		UserID:      val.UserID,
+		Issuer:      val.Issuer,
+		Subject:     val.Subject,
+		Email:       val.Email,
+		CreatedAt:   parseLocalTime(timeStringLayout, val.CreatedAt),
+		LastLoginAt: parseLocalTime(timeStringLayout, val.LastLoginAt)}
+}
+
+// GetUserIdentity returns identity by issuer and subject, ErrNotFound if
+// it is not linked to any user
+func GetUserIdentity(ctx context.Context, issuer, subject string) (*UserIdentity, error) {
+	ctx, end := startOp(ctx, "GetUserIdentity")
+	defer end()
+	var row dbUserIdentity
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM user_identities WHERE issuer=? AND subject=?", issuer, subject)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserIdentity", err)
+	}
+	return dbUserIdentityToUserIdentity(&row), nil
+}
+
+// GetUserIdentities returns identities linked to user
+func GetUserIdentities(ctx context.Context, userID int) ([]*UserIdentity, error) {
+	ctx, end := startOp(ctx, "GetUserIdentities")
+	defer end()
+	var rows []dbUserIdentity
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM user_identities WHERE user_id=? ORDER BY id", userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserIdentities", err)
+	}
+	identities := make([]*UserIdentity, 0, len(rows))
+	for i := range rows {
+		identities = append(identities, dbUserIdentityToUserIdentity(&rows[i]))
+	}
+	return identities, nil
+}
+
+// LinkUserIdentity links identity to user. Returns ErrDuplicate if it is
+// linked already
+func LinkUserIdentity(ctx context.Context, i *UserIdentity) error {
+	ctx, end := startOp(ctx, "LinkUserIdentity")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO user_identities (user_id, issuer, subject, email, created_at, last_login_at) VALUES(?, ?, ?, ?, ?, ?)",
+		i.UserID,
+		i.Issuer,
+		i.Subject,
+		i.Email,
+		i.CreatedAt.Format(timeStringLayout),
+		i.LastLoginAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "LinkUserIdentity", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "LinkUserIdentity", err)
+	}
+	i.ID = int(id)
+	return nil
+}
+
+// TouchUserIdentity records login with identity and its current email
+func TouchUserIdentity(ctx context.Context, identityID int, email string) error {
+	ctx, end := startOp(ctx, "TouchUserIdentity")
+	defer end()
+	_, err := conn().ExecContext(ctx, "UPDATE user_identities SET email=?, last_login_at=? WHERE id=?",
+		email,
+		time.Now().Format(timeStringLayout),
+		identityID)
+	if err != nil {
+		return wrapError(ctx, "TouchUserIdentity", err)
+	}
+	return nil
+}
+
+// UnlinkUserIdentity removes identity of user, ErrNotFound if user has no such identity
+func UnlinkUserIdentity(ctx context.Context, userID, identityID int) error {
+	ctx, end := startOp(ctx, "UnlinkUserIdentity")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM user_identities WHERE id=? AND user_id=?", identityID, userID)
+	if err != nil {
+		return wrapError(ctx, "UnlinkUserIdentity", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "UnlinkUserIdentity", err)
+	}
+	if n == 0 {
+		return notFound("UnlinkUserIdentity")
+	}
+	return nil
+}
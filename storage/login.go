@@ -1,82 +1,236 @@
-package storage
-
-import (
-	"crypto/md5"
-	"crypto/rand"
-	"fmt"
-	"net/http"
-	"strings"
-	"time"
-)
-
-type LoggedInUserStruct struct {
-	User      *User
-	LoginTime time.Time
-}
-
-var loggedInUsers = make(map[string]LoggedInUserStruct) // key is token
-
-func init() {
-	go expireLoggedInUsers()
-}
-
-func expireLoggedInUsers() {
-	for {
-		for key, s := range loggedInUsers {
-			elapsed := time.Now().Sub(s.LoginTime)
-			if elapsed.Minutes() > 30 {
-				delete(loggedInUsers, key)
-			}
-		}
-		time.Sleep(10 * time.Second)
-	}
-}
-
-func loggedInUserLookup(username string) (token string, isLoggedIn bool) {
-	for tok, u := range loggedInUsers {
-		if u.User.UserName == username {
-			u.LoginTime = time.Now()
-			return tok, true
-		}
-	}
-	return "", false
-}
-
-func generateToken() string {
-	b := make([]byte, 16)
-	rand.Read(b)
-	return fmt.Sprintf("%x", b)
-}
-
-func Login(username, password string) (user *User, token string, errCode int) {
-	if tok, isUserLoggedIn := loggedInUserLookup(username); isUserLoggedIn {
-		return loggedInUsers[tok].User, tok, 0
-	}
-	user, isUserPresent := GetUserByName(username)
-	if !isUserPresent {
-		return nil, "", 1 // there is no such user
-	}
-	hash := fmt.Sprintf("%x", md5.Sum([]byte(password)))
-	if hash != user.PasswordHash {
-		return nil, "", 2 // username/password mismatch
-	}
-	token = generateToken()
-	loggedInUsers[token] = LoggedInUserStruct{
-		User:      user,
-		LoginTime: time.Now()}
-	return user, token, 0
-}
-
-func Auth(r *http.Request) (user *User, isAuthorized bool) {
-	var token string
-	authStrings := strings.Split(r.Header.Get("Authorization"), " ")
-	if len(authStrings) == 2 && authStrings[0] == "Bearer" {
-		token = authStrings[1]
-	} else {
-		return nil, false
-	}
-	if userInfo, ok := loggedInUsers[token]; ok {
-		return userInfo.User, true
-	}
-	return nil, false
-}
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type LoggedInUserStruct struct {
+	User      *User
+	LoginTime time.Time
+}
+
+var loggedInUsers = make(map[string]LoggedInUserStruct) // key is token
+var loggedInUsersLock sync.RWMutex
+
+// RunSessionExpirer drops sessions idle for more than 30 minutes and
+// expired login challenges every 10 seconds until ctx is done
+func RunSessionExpirer(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expireLoggedInUsers()
+			expireChallenges()
+		}
+	}
+}
+
+func expireLoggedInUsers() {
+	loggedInUsersLock.Lock()
+	defer loggedInUsersLock.Unlock()
+	for key, s := range loggedInUsers {
+		elapsed := time.Now().Sub(s.LoginTime)
+		if elapsed.Minutes() > 30 {
+			delete(loggedInUsers, key)
+		}
+	}
+}
+
+func loggedInUserLookup(username string) (token string, isLoggedIn bool) {
+	loggedInUsersLock.RLock()
+	defer loggedInUsersLock.RUnlock()
+	for tok, u := range loggedInUsers {
+		if u.User.UserName == username {
+			u.LoginTime = time.Now()
+			return tok, true
+		}
+	}
+	return "", false
+}
+
+func generateToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return fmt.Sprintf("%x", b)
+}
+
+// Authenticate checks credentials. Returns ErrNotFound if there is no
+// such user, ErrWrongPassword on password mismatch, ErrUserDisabled
+// if user is disabled and ErrEmailNotVerified if email is not verified
+func Authenticate(ctx context.Context, username, password string) (*User, error) {
+	user, err := GetUserByName(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	hash := fmt.Sprintf("%x", md5.Sum([]byte(password)))
+	if hash != user.PasswordHash {
+		return nil, ErrWrongPassword
+	}
+	if user.Disabled {
+		return nil, ErrUserDisabled
+	}
+	if !user.EmailVerified {
+		return nil, ErrEmailNotVerified
+	}
+	return user, nil
+}
+
+// StartSession returns session token of authenticated user, existing
+// session is reused
+func StartSession(user *User) (token string) {
+	if tok, isUserLoggedIn := loggedInUserLookup(user.UserName); isUserLoggedIn {
+		return tok
+	}
+	token = generateToken()
+	loggedInUsersLock.Lock()
+	loggedInUsers[token] = LoggedInUserStruct{
+		User:      user,
+		LoginTime: time.Now()}
+	loggedInUsersLock.Unlock()
+	return token
+}
+
+// Login checks credentials like Authenticate and returns session token
+func Login(ctx context.Context, username, password string) (user *User, token string, err error) {
+	user, err = Authenticate(ctx, username, password)
+	if err != nil {
+		return nil, "", err
+	}
+	return user, StartSession(user), nil
+}
+
+// ChallengePurpose : what second login step has to do
+type ChallengePurpose int
+
+const (
+	// ChallengeVerify : user has to enter second factor code
+	ChallengeVerify ChallengePurpose = iota
+	// ChallengeEnroll : user has to enroll second factor before login
+	ChallengeEnroll
+)
+
+const (
+	challengeTTL         = 5 * time.Minute
+	challengeMaxAttempts = 5
+)
+
+// Challenge : password checked, second login step is pending
+type Challenge struct {
+	UserID   int
+	Purpose  ChallengePurpose
+	Created  time.Time
+	Attempts int
+}
+
+var challenges = make(map[string]*Challenge) // key is challenge token
+var challengesLock sync.Mutex
+
+// NewChallenge returns token of second login step of user, it expires
+// in 5 minutes
+func NewChallenge(user *User, purpose ChallengePurpose) string {
+	token := generateToken()
+	challengesLock.Lock()
+	challenges[token] = &Challenge{UserID: user.ID, Purpose: purpose, Created: time.Now()}
+	challengesLock.Unlock()
+	return token
+}
+
+// UseChallenge counts attempt of challenge and returns its copy. Returns
+// false if there is no such challenge, it expired or attempts are exhausted
+func UseChallenge(token string) (Challenge, bool) {
+	challengesLock.Lock()
+	defer challengesLock.Unlock()
+	ch, ok := challenges[token]
+	if !ok {
+		return Challenge{}, false
+	}
+	if time.Since(ch.Created) > challengeTTL || ch.Attempts >= challengeMaxAttempts {
+		delete(challenges, token)
+		return Challenge{}, false
+	}
+	ch.Attempts++
+	return *ch, true
+}
+
+// DeleteChallenge drops challenge once second login step is passed
+func DeleteChallenge(token string) {
+	challengesLock.Lock()
+	delete(challenges, token)
+	challengesLock.Unlock()
+}
+
+func expireChallenges() {
+	challengesLock.Lock()
+	defer challengesLock.Unlock()
+	for key, ch := range challenges {
+		if time.Since(ch.Created) > challengeTTL {
+			delete(challenges, key)
+		}
+	}
+}
+
+// EndSessions logs user out everywhere, e.g. after password reset
+func EndSessions(userID int) {
+	loggedInUsersLock.Lock()
+	defer loggedInUsersLock.Unlock()
+	for key, s := range loggedInUsers {
+		if s.User.ID == userID {
+			delete(loggedInUsers, key)
+		}
+	}
+}
+
+// SessionUserID returns ID of user logged in with session token, false
+// when the session has ended
+func SessionUserID(token string) (int, bool) {
+	loggedInUsersLock.RLock()
+	defer loggedInUsersLock.RUnlock()
+	s, ok := loggedInUsers[token]
+	if !ok {
+		return 0, false
+	}
+	return s.User.ID, true
+}
+
+// Auth returns user of session token in Authorization header. Returns false
+// for missing or unknown token and disabled or deleted user, error when the
+// user can't be reloaded
+func Auth(r *http.Request) (user *User, isAuthorized bool, err error) {
+	var token string
+	authStrings := strings.Split(r.Header.Get("Authorization"), " ")
+	if len(authStrings) == 2 && authStrings[0] == "Bearer" {
+		token = authStrings[1]
+	} else {
+		return nil, false, nil
+	}
+	loggedInUsersLock.RLock()
+	userInfo, ok := loggedInUsers[token]
+	loggedInUsersLock.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	// reload user, so balance and privileges are fresh and disabled
+	// or deleted users lose their sessions
+	user, err = GetUserByID(r.Context(), userInfo.User.ID)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return nil, false, err
+	}
+	if err != nil || user.Disabled {
+		loggedInUsersLock.Lock()
+		delete(loggedInUsers, token)
+		loggedInUsersLock.Unlock()
+		return nil, false, nil
+	}
+	return user, true, nil
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbTaskMessage struct {
+	ID           int            `db:"id"`
+	TaskID       int            `db:"task_id"`
+	AuthorID     int            `db:"author_id"`
+	Author       string         `db:"author"`
+	ReplyTo      int            `db:"reply_to"`
+	Body         string         `db:"body"`
+	CreatedAt    string         `db:"created_at"`
+	EditedAt     sql.NullString `db:"edited_at"`
+	DeletedAt    sql.NullString `db:"deleted_at"`
+	DeletedBy    int            `db:"deleted_by"`
+	DeleteReason string         `db:"delete_reason"`
+}
+
+type dbTaskMessageLock struct {
+	TaskID    int    `db:"task_id"`
+	ActorID   int    `db:"actor_id"`
+	Reason    string `db:"reason"`
+	CreatedAt string `db:"created_at"`
+}
+
+// selectTaskMessages : columns of messages with login of author
+const selectTaskMessages = "SELECT m.*, IFNULL(u.user_name, '') AS author FROM task_messages m LEFT JOIN users u ON u.id=m.author_id "
+
+func dbTaskMessageToTaskMessage(val *dbTaskMessage) *TaskMessage {
+	m := TaskMessage{
+		ID:           val.ID,
+		TaskID:       val.TaskID,
+		AuthorID:     val.AuthorID,
+		Author:       val.Author,
+		ReplyTo:      val.ReplyTo,
+		Body:         val.Body,
+		CreatedAt:    parseLocalTime(timeStringLayout, val.CreatedAt),
+		DeletedBy:    val.DeletedBy,
+		DeleteReason: val.DeleteReason}
+	if val.EditedAt.Valid {
+		m.EditedAt = parseLocalTime(timeStringLayout, val.EditedAt.String)
+	}
+	if val.DeletedAt.Valid {
+		m.DeletedAt = parseLocalTime(timeStringLayout, val.DeletedAt.String)
+	}
+	return &m
+}
+
+// CreateTaskMessageTx saves message in transaction and sets its ID, so
+// notifications about it are saved together with it
+func CreateTaskMessageTx(tx *Tx, m *TaskMessage) error {
+	ctx, end := startOp(tx.ctx, "CreateTaskMessage")
+	defer end()
+	res, err := tx.conn().ExecContext(ctx, "INSERT INTO task_messages (task_id, author_id, reply_to, body, created_at) VALUES(?, ?, ?, ?, ?)",
+		m.TaskID,
+		m.AuthorID,
+		m.ReplyTo,
+		m.Body,
+		m.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "CreateTaskMessage", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreateTaskMessage", err)
+	}
+	m.ID = int(id)
+	return nil
+}
+
+// GetTaskMessages returns up to limit messages of task after message
+// afterID, oldest first. Deleted messages are kept to show thread structure
+func GetTaskMessages(ctx context.Context, taskID, afterID, limit int) ([]*TaskMessage, error) {
+	ctx, end := startOp(ctx, "GetTaskMessages")
+	defer end()
+	var rows []dbTaskMessage
+	err := sqlx.SelectContext(ctx, conn(), &rows, selectTaskMessages+"WHERE m.task_id=? AND m.id>? ORDER BY m.id LIMIT ?", taskID, afterID, limit)
+	if err != nil {
+		return nil, wrapError(ctx, "GetTaskMessages", err)
+	}
+	messages := make([]*TaskMessage, 0, len(rows))
+	for i := range rows {
+		messages = append(messages, dbTaskMessageToTaskMessage(&rows[i]))
+	}
+	return messages, nil
+}
+
+// GetTaskMessage returns message of task, ErrNotFound if task has no such message
+func GetTaskMessage(ctx context.Context, taskID, messageID int) (*TaskMessage, error) {
+	ctx, end := startOp(ctx, "GetTaskMessage")
+	defer end()
+	var row dbTaskMessage
+	err := sqlx.GetContext(ctx, conn(), &row, selectTaskMessages+"WHERE m.id=? AND m.task_id=?", messageID, taskID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetTaskMessage", err)
+	}
+	return dbTaskMessageToTaskMessage(&row), nil
+}
+
+// UpdateTaskMessage saves body and edit time of message
+func UpdateTaskMessage(ctx context.Context, m *TaskMessage) error {
+	ctx, end := startOp(ctx, "UpdateTaskMessage")
+	defer end()
+	_, err := conn().ExecContext(ctx, "UPDATE task_messages SET body=?, edited_at=? WHERE id=?",
+		m.Body, m.EditedAt.Format(timeStringLayout), m.ID)
+	if err != nil {
+		return wrapError(ctx, "UpdateTaskMessage", err)
+	}
+	return nil
+}
+
+// DeleteTaskMessage clears body of message and records who deleted it and
+// why. The message stays, so replies to it keep their place in thread
+func DeleteTaskMessage(ctx context.Context, m *TaskMessage) error {
+	ctx, end := startOp(ctx, "DeleteTaskMessage")
+	defer end()
+	_, err := conn().ExecContext(ctx, "UPDATE task_messages SET body='', deleted_at=?, deleted_by=?, delete_reason=? WHERE id=?",
+		m.DeletedAt.Format(timeStringLayout), m.DeletedBy, m.DeleteReason, m.ID)
+	if err != nil {
+		return wrapError(ctx, "DeleteTaskMessage", err)
+	}
+	m.Body = ""
+	return nil
+}
+
+// MarkTaskMessagesRead marks all current messages of task read by user
+func MarkTaskMessagesRead(ctx context.Context, taskID, userID int) error {
+	ctx, end := startOp(ctx, "MarkTaskMessagesRead")
+	defer end()
+	_, err := conn().ExecContext(ctx, "INSERT INTO task_message_reads (task_id, user_id, last_read_id) "+
+		"SELECT ?, ?, IFNULL(MAX(id), 0) FROM task_messages WHERE task_id=? "+
+		"ON DUPLICATE KEY UPDATE last_read_id=GREATEST(last_read_id, VALUES(last_read_id))",
+		taskID, userID, taskID)
+	if err != nil {
+		return wrapError(ctx, "MarkTaskMessagesRead", err)
+	}
+	return nil
+}
+
+// unreadTaskMessages : messages of others user hasn't read, deleted ones aside
+const unreadTaskMessages = "FROM task_messages m LEFT JOIN task_message_reads r ON r.task_id=m.task_id AND r.user_id=? " +
+	"WHERE m.author_id<>? AND m.deleted_at IS NULL AND m.id>IFNULL(r.last_read_id, 0) "
+
+// CountUnreadTaskMessages returns number of messages of task user hasn't read
+func CountUnreadTaskMessages(ctx context.Context, taskID, userID int) (int, error) {
+	ctx, end := startOp(ctx, "CountUnreadTaskMessages")
+	defer end()
+	var n int
+	err := sqlx.GetContext(ctx, conn(), &n, "SELECT COUNT(*) "+unreadTaskMessages+"AND m.task_id=?", userID, userID, taskID)
+	if err != nil {
+		return 0, wrapError(ctx, "CountUnreadTaskMessages", err)
+	}
+	return n, nil
+}
+
+// GetUnreadTaskMessages returns numbers of unread messages in tasks where
+// user is customer or executor, tasks without unread messages are left out
+func GetUnreadTaskMessages(ctx context.Context, userID int) ([]*UnreadTaskMessages, error) {
+	ctx, end := startOp(ctx, "GetUnreadTaskMessages")
+	defer end()
+	var rows []struct {
+		TaskID int `db:"task_id"`
+		Count  int `db:"count"`
+	}
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT m.task_id, COUNT(*) AS count "+unreadTaskMessages+
+		"AND m.task_id IN (SELECT id FROM tasks WHERE customer_id=? OR executor_id=?) GROUP BY m.task_id ORDER BY m.task_id",
+		userID, userID, userID, userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUnreadTaskMessages", err)
+	}
+	unread := make([]*UnreadTaskMessages, 0, len(rows))
+	for _, r := range rows {
+		unread = append(unread, &UnreadTaskMessages{TaskID: r.TaskID, Count: r.Count})
+	}
+	return unread, nil
+}
+
+// GetTaskMessageLock returns lock of task thread, ErrNotFound if thread is open
+func GetTaskMessageLock(ctx context.Context, taskID int) (*TaskMessageLock, error) {
+	ctx, end := startOp(ctx, "GetTaskMessageLock")
+	defer end()
+	var row dbTaskMessageLock
+	if err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM task_message_locks WHERE task_id=?", taskID); err != nil {
+		return nil, wrapError(ctx, "GetTaskMessageLock", err)
+	}
+	return &TaskMessageLock{
+		TaskID:    row.TaskID,
+		ActorID:   row.ActorID,
+		Reason:    row.Reason,
+		CreatedAt: parseLocalTime(timeStringLayout, row.CreatedAt)}, nil
+}
+
+// LockTaskMessages closes thread of task for new messages, ErrDuplicate if
+// it is locked already
+func LockTaskMessages(ctx context.Context, l *TaskMessageLock) error {
+	ctx, end := startOp(ctx, "LockTaskMessages")
+	defer end()
+	_, err := conn().ExecContext(ctx, "INSERT INTO task_message_locks (task_id, actor_id, reason, created_at) VALUES(?, ?, ?, ?)",
+		l.TaskID, l.ActorID, l.Reason, l.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "LockTaskMessages", err)
+	}
+	return nil
+}
+
+// UnlockTaskMessages opens thread of task again, ErrNotFound if it isn't locked
+func UnlockTaskMessages(ctx context.Context, taskID int) error {
+	ctx, end := startOp(ctx, "UnlockTaskMessages")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM task_message_locks WHERE task_id=?", taskID)
+	if err != nil {
+		return wrapError(ctx, "UnlockTaskMessages", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "UnlockTaskMessages", err)
+	}
+	if n == 0 {
+		return notFound("UnlockTaskMessages")
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"errors"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const metricsNamespace = "freelance_stock"
+
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "storage",
+	Name:      "operation_duration_seconds",
+	Help:      "Duration of storage operations by operation name.",
+	Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+}, []string{"op"})
+
+var operationErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: metricsNamespace,
+	Subsystem: "storage",
+	Name:      "errors_total",
+	Help:      "Storage errors by operation name and kind.",
+}, []string{"op", "kind"})
+
+var _ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	Namespace: metricsNamespace,
+	Name:      "active_sessions",
+	Help:      "Number of logged in sessions.",
+}, func() float64 {
+	loggedInUsersLock.RLock()
+	defer loggedInUsersLock.RUnlock()
+	return float64(len(loggedInUsers))
+})
+
+// registerDBStats exposes connection pool stats of connection
+func registerDBStats() {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(connection.DB, "freelance_stock"))
+}
+
+func countError(op string, kind error) {
+	label := "other"
+	switch {
+	case errors.Is(kind, ErrNotFound):
+		label = "not_found"
+	case errors.Is(kind, ErrDuplicate):
+		label = "duplicate"
+	case errors.Is(kind, ErrConflict):
+		label = "conflict"
+	case errors.Is(kind, ErrUnavailable):
+		label = "unavailable"
+	}
+	operationErrors.WithLabelValues(op, label).Inc()
+}
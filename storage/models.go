@@ -1,44 +1,376 @@
-package storage
-
-import (
-	"time"
-
-	"../currency"
-)
-
-// User : structure for user
-type User struct {
-	ID           int
-	IsAdmin      bool
-	UserName     string
-	PasswordHash string
-	Email        string
-	Balance      currency.Money
-	FrozenAmount currency.Money
-}
-
-// State : state of task
-type State int
-
-const (
-	StateFree      State = 0
-	StateExecuting State = 1
-	StatePaused    State = 2
-	StateCompleted State = 3
-	StateAccepted  State = 4
-	StateClosed    State = 5
-)
-
-// Task : structure for task
-type Task struct {
-	ID            int
-	CustomerID    int
-	ExecutionerID int
-	Title         string
-	State         State
-	Cost          currency.Money
-	Problem       string
-	Solution      string
-	BeginTime     time.Time
-	EndTime       time.Time
-}
+package storage
+
+import (
+	"log/slog"
+	"time"
+
+	"../currency"
+)
+
+// User : structure for user
+type User struct {
+	ID            int
+	IsAdmin       bool
+	UserName      string
+	PasswordHash  string
+	Email         string
+	Balance       currency.Money
+	FrozenAmount  currency.Money
+	Disabled      bool
+	Version       int    // incremented on every update, used for optimistic locking
+	TOTPSecret    string // base32 secret of second factor, set on enrollment
+	TOTPEnabled   bool   // second factor is verified and required on login
+	TOTPLastStep  int64  // time step of the last accepted code, codes are single use
+	EmailVerified bool   // false for registered users until verification link is followed
+	Bio           string
+	CreatedAt     time.Time // member since
+}
+
+// LogValue keeps password hash and balances out of logs
+func (u *User) LogValue() slog.Value {
+	return slog.GroupValue(slog.Int("id", u.ID), slog.String("login", u.UserName), slog.Bool("is_admin", u.IsAdmin))
+}
+
+// State : state of task
+type State int
+
+const (
+	StateFree      State = 0
+	StateExecuting State = 1
+	StatePaused    State = 2
+	StateCompleted State = 3
+	StateAccepted  State = 4
+	StateClosed    State = 5
+	StateDisputed  State = 6 // customer disputes the solution, admin decides
+)
+
+// Task : structure for task
+type Task struct {
+	ID              int
+	CustomerID      int
+	ExecutionerID   int
+	Title           string
+	State           State
+	Cost            currency.Money
+	CategoryID      int      // 0 if task has no category
+	Tags            []string // loaded with task, saved by SetTaskTagsTx
+	Problem         string
+	Solution        string // kept from customer until accepted
+	SolutionPreview string // shown to customer before acceptance
+	BeginTime       time.Time
+	EndTime         time.Time
+	AcceptTime      time.Time // when solution was accepted and paid
+	Version         int       // incremented on every update, used for optimistic locking
+}
+
+// BalanceMovement : audited change of user balance made by admin
+type BalanceMovement struct {
+	ID        int
+	UserID    int
+	Amount    currency.Money
+	Reason    string
+	Actor     string
+	CreatedAt time.Time
+}
+
+// TaskStateChange : task state change forced by admin
+type TaskStateChange struct {
+	ID        int
+	TaskID    int
+	FromState State
+	ToState   State
+	Reason    string
+	Actor     string
+	CreatedAt time.Time
+}
+
+// AuditRecord : entry of append-only audit log. Hash covers all other
+// fields and PrevHash, which is Hash of the previous record
+type AuditRecord struct {
+	ID        int
+	CreatedAt time.Time
+	ActorID   int
+	ActorName string
+	Action    string
+	Targets   []string // changed entities, e.g. "task:5", "user:3"
+	Diff      string   // JSON object: target -> field -> [before, after]
+	IP        string
+	RequestID string
+	Status    int // HTTP status of the request, 0 for actions outside API
+	PrevHash  string
+	Hash      string
+}
+
+// RateBucket : token bucket of rate limiter, zero value is a new bucket
+type RateBucket struct {
+	Name    string // e.g. "ip:10.0.0.1", "login:nurbek"
+	Tokens  float64
+	Updated time.Time
+}
+
+// Lockout : failed login attempts of account, zero value means no failures
+type Lockout struct {
+	Name        string // e.g. "login:nurbek"
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// TokenPurpose : what emailed user token is for
+type TokenPurpose string
+
+const (
+	TokenVerifyEmail   TokenPurpose = "verify_email"
+	TokenResetPassword TokenPurpose = "reset_password"
+)
+
+// UserToken : single use token sent to user by email, only its hash is stored
+type UserToken struct {
+	Hash      string
+	UserID    int
+	Purpose   TokenPurpose
+	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    time.Time // zero if token is not used yet
+}
+
+// APIKey : long-lived key of user for integrations, only hash of the key is stored
+type APIKey struct {
+	ID         int
+	UserID     int
+	Name       string
+	Prefix     string // the first characters of key, shown to tell keys apart
+	Hash       string
+	Scopes     []string // e.g. "read", "tasks:write", "admin"
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero if key was never used
+	RevokedAt  time.Time // zero if key is active
+}
+
+// UserIdentity : account of user at OpenID Connect identity provider
+// linked to the user for single sign-on
+type UserIdentity struct {
+	ID          int
+	UserID      int
+	Issuer      string
+	Subject     string // stable user ID at identity provider
+	Email       string // as of the last login
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+// Webhook : endpoint of user notified about task events
+type Webhook struct {
+	ID        int
+	UserID    int
+	URL       string
+	Secret    string   // HMAC key of payload signatures
+	Events    []string // e.g. "task.created", "task.accepted"
+	CreatedAt time.Time
+}
+
+// WebhookEvent : task event in outbox, saved in the same transaction as
+// the task change and fanned out to webhooks later
+type WebhookEvent struct {
+	ID           int
+	Type         string // e.g. "task.acquired"
+	TaskID       int
+	CustomerID   int
+	ExecutorID   int
+	Public       bool   // sent to all subscribers, not only to participants and admins
+	Payload      string // JSON of task after the change
+	CreatedAt    time.Time
+	DispatchedAt time.Time // zero until deliveries are created
+}
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookDelivery : event to be sent or sent to webhook
+type WebhookDelivery struct {
+	ID            int
+	WebhookID     int
+	EventID       int
+	Status        string // DeliveryPending, DeliveryDelivered or DeliveryFailed
+	Attempts      int
+	NextAttemptAt time.Time
+	LastStatus    int    // HTTP status of the last attempt, 0 if there was no answer
+	LastError     string // error or answer body of the last failed attempt
+	CreatedAt     time.Time
+	DeliveredAt   time.Time // zero until delivered
+}
+
+// WebhookJob : due delivery with everything needed to send it
+type WebhookJob struct {
+	WebhookDelivery
+	URL    string
+	Secret string
+	Event  WebhookEvent
+}
+
+// Notification kinds, task ones are named after the events they are about
+const (
+	NotificationTaskAcquired    = "task.acquired"
+	NotificationTaskFinished    = "task.finished"
+	NotificationTaskAccepted    = "task.accepted"
+	NotificationTaskMessage     = "task.message"
+	NotificationTaskDisputed    = "task.disputed"
+	NotificationDisputeResolved = "task.dispute_resolved"
+	NotificationBalanceChanged  = "balance.changed"
+)
+
+// NotificationKinds : all notification kinds users may set preferences of
+var NotificationKinds = []string{NotificationTaskAcquired, NotificationTaskFinished, NotificationTaskAccepted, NotificationTaskMessage,
+	NotificationTaskDisputed, NotificationDisputeResolved, NotificationBalanceChanged}
+
+// Notification : message in inbox of user
+type Notification struct {
+	ID        int
+	UserID    int
+	Kind      string // e.g. NotificationTaskFinished
+	TaskID    int    // 0 if notification isn't about task
+	Message   string
+	CreatedAt time.Time
+	ReadAt    time.Time // zero while unread
+}
+
+// NotificationPreference : whether notifications of kind are also sent
+// through channel out of the app, e.g. "email"
+type NotificationPreference struct {
+	Kind    string
+	Channel string
+	Enabled bool
+}
+
+// TaskMessage : message of task customer, executor or admin about the task
+type TaskMessage struct {
+	ID           int
+	TaskID       int
+	AuthorID     int
+	Author       string // login of author
+	ReplyTo      int    // ID of message this one answers, 0 if none
+	Body         string // empty once deleted
+	CreatedAt    time.Time
+	EditedAt     time.Time // zero if never edited
+	DeletedAt    time.Time // zero unless deleted
+	DeletedBy    int       // author or admin who deleted message
+	DeleteReason string    // why admin removed message
+}
+
+// TaskMessageLock : thread of task closed for new messages by admin
+type TaskMessageLock struct {
+	TaskID    int
+	ActorID   int
+	Reason    string
+	CreatedAt time.Time
+}
+
+// UnreadTaskMessages : number of messages of task user hasn't read
+type UnreadTaskMessages struct {
+	TaskID int
+	Count  int
+}
+
+// Attachment kinds
+const (
+	AttachmentProblem  = "problem"
+	AttachmentSolution = "solution"
+)
+
+// Attachment : file uploaded to task, its content is in blob store
+type Attachment struct {
+	ID          int
+	TaskID      int
+	UploaderID  int
+	Kind        string // AttachmentProblem or AttachmentSolution
+	FileName    string
+	ContentType string
+	Size        int64
+	SHA256      string // hex checksum of content
+	BlobKey     string
+	CreatedAt   time.Time
+}
+
+// Dispute resolutions
+const (
+	ResolutionAccept = "accept" // executor is paid as if customer accepted
+	ResolutionRework = "rework" // task goes back to executor
+)
+
+// TaskDispute : customer's objection to solution of task, resolved by admin
+type TaskDispute struct {
+	ID               int
+	TaskID           int
+	OpenedBy         int
+	Reason           string
+	OpenedAt         time.Time
+	ResolvedBy       int    // 0 while dispute is open
+	Resolution       string // ResolutionAccept or ResolutionRework, empty while open
+	ResolutionReason string
+	ResolvedAt       time.Time // zero while open
+}
+
+// TaskReview : rating and review one participant of accepted task leaves
+// about the other one
+type TaskReview struct {
+	ID         int
+	TaskID     int
+	AuthorID   int
+	Author     string // login of author
+	TargetID   int
+	Rating     int // 1 to 5
+	Body       string
+	CreatedAt  time.Time
+	HiddenAt   time.Time // zero unless hidden by admin
+	HiddenBy   int
+	HideReason string
+}
+
+// Rating : visible rating of user with what it is weighted by in reputation
+type Rating struct {
+	Value     int
+	Cost      currency.Money // cost of reviewed task
+	CreatedAt time.Time
+}
+
+// PortfolioLink : link to work of user shown on profile
+type PortfolioLink struct {
+	ID     int
+	UserID int
+	Title  string
+	URL    string
+}
+
+// UserStats : task statistics shown on profile of user
+type UserStats struct {
+	TasksPosted    int // tasks created as customer
+	TasksSubmitted int // solutions finished as executor, accepted or not
+	TasksCompleted int // solutions accepted and paid
+}
+
+// Category : kind of tasks, categories form a tree
+type Category struct {
+	ID       int
+	ParentID int // 0 for top level category
+	Name     string
+}
+
+// TaskFilter : which tasks FindTasks returns
+type TaskFilter struct {
+	States      []State  // any state if empty
+	CategoryIDs []int    // any category if empty
+	Tags        []string // tasks with all of them
+	BeforeID    int      // tasks with smaller ID, 0 for the newest
+	Limit       int
+}
+
+// TaskHistory : how many tasks of each tag and category user has done and
+// got paid for
+type TaskHistory struct {
+	Tags       map[string]int
+	Categories map[int]int
+}
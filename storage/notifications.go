@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbNotification struct {
+	ID        int            `db:"id"`
+	UserID    int            `db:"user_id"`
+	Kind      string         `db:"kind"`
+	TaskID    int            `db:"task_id"`
+	Message   string         `db:"message"`
+	CreatedAt string         `db:"created_at"`
+	ReadAt    sql.NullString `db:"read_at"`
+}
+
+type dbNotificationPreference struct {
+	UserID  int    `db:"user_id"`
+	Kind    string `db:"kind"`
+	Channel string `db:"channel"`
+	Enabled bool   `db:"enabled"`
+}
+
+func dbNotificationToNotification(val *dbNotification) *Notification {
+	n := Notification{
+		ID:        val.ID,
+		UserID:    val.UserID,
+		Kind:      val.Kind,
+		TaskID:    val.TaskID,
+		Message:   val.Message,
+		CreatedAt: parseLocalTime(timeStringLayout, val.CreatedAt)}
+	if val.ReadAt.Valid {
+		n.ReadAt = parseLocalTime(timeStringLayout, val.ReadAt.String)
+	}
+	return &n
+}
+
+func addNotification(ctx context.Context, db dbConn, n *Notification) error {
+	res, err := db.ExecContext(ctx, "INSERT INTO notifications (user_id, kind, task_id, message, created_at) VALUES(?, ?, ?, ?, ?)",
+		n.UserID,
+		n.Kind,
+		n.TaskID,
+		n.Message,
+		n.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "AddNotification", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "AddNotification", err)
+	}
+	n.ID = int(id)
+	return nil
+}
+
+// AddNotification puts notification into inbox of its user and sets its ID
+func AddNotification(ctx context.Context, n *Notification) error {
+	ctx, end := startOp(ctx, "AddNotification")
+	defer end()
+	return addNotification(ctx, conn(), n)
+}
+
+// AddNotificationTx puts notification into inbox in transaction of the
+// change it is about, so users aren't told about rolled back changes
+func AddNotificationTx(tx *Tx, n *Notification) error {
+	ctx, end := startOp(tx.ctx, "AddNotification")
+	defer end()
+	return addNotification(ctx, tx.conn(), n)
+}
+
+// GetNotifications returns up to limit latest notifications of user, newest
+// first, only unread ones if unreadOnly is set
+func GetNotifications(ctx context.Context, userID int, unreadOnly bool, limit int) ([]*Notification, error) {
+	ctx, end := startOp(ctx, "GetNotifications")
+	defer end()
+	query := "SELECT * FROM notifications WHERE user_id=? ORDER BY id DESC LIMIT ?"
+	if unreadOnly {
+		query = "SELECT * FROM notifications WHERE user_id=? AND read_at IS NULL ORDER BY id DESC LIMIT ?"
+	}
+	var rows []dbNotification
+	if err := sqlx.SelectContext(ctx, conn(), &rows, query, userID, limit); err != nil {
+		return nil, wrapError(ctx, "GetNotifications", err)
+	}
+	notifications := make([]*Notification, 0, len(rows))
+	for i := range rows {
+		notifications = append(notifications, dbNotificationToNotification(&rows[i]))
+	}
+	return notifications, nil
+}
+
+// CountUnreadNotifications returns number of unread notifications of user
+func CountUnreadNotifications(ctx context.Context, userID int) (int, error) {
+	ctx, end := startOp(ctx, "CountUnreadNotifications")
+	defer end()
+	var n int
+	err := sqlx.GetContext(ctx, conn(), &n, "SELECT COUNT(*) FROM notifications WHERE user_id=? AND read_at IS NULL", userID)
+	if err != nil {
+		return 0, wrapError(ctx, "CountUnreadNotifications", err)
+	}
+	return n, nil
+}
+
+// MarkNotificationRead marks notification of user read, ErrNotFound if user
+// has no such notification. Marking read notification again changes nothing
+func MarkNotificationRead(ctx context.Context, userID, notificationID int) error {
+	ctx, end := startOp(ctx, "MarkNotificationRead")
+	defer end()
+	res, err := conn().ExecContext(ctx, "UPDATE notifications SET read_at=IFNULL(read_at, ?) WHERE id=? AND user_id=?",
+		time.Now().Format(timeStringLayout), notificationID, userID)
+	if err != nil {
+		return wrapError(ctx, "MarkNotificationRead", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "MarkNotificationRead", err)
+	}
+	if n == 0 {
+		return notFound("MarkNotificationRead")
+	}
+	return nil
+}
+
+// MarkAllNotificationsRead marks all notifications of user read, returns
+// number of notifications which were unread
+func MarkAllNotificationsRead(ctx context.Context, userID int) (int, error) {
+	ctx, end := startOp(ctx, "MarkAllNotificationsRead")
+	defer end()
+	res, err := conn().ExecContext(ctx, "UPDATE notifications SET read_at=? WHERE user_id=? AND read_at IS NULL",
+		time.Now().Format(timeStringLayout), userID)
+	if err != nil {
+		return 0, wrapError(ctx, "MarkAllNotificationsRead", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, wrapError(ctx, "MarkAllNotificationsRead", err)
+	}
+	return int(n), nil
+}
+
+// GetNotificationPreferences returns preferences user has set, kinds and
+// channels without preference keep their defaults
+func GetNotificationPreferences(ctx context.Context, userID int) ([]*NotificationPreference, error) {
+	ctx, end := startOp(ctx, "GetNotificationPreferences")
+	defer end()
+	var rows []dbNotificationPreference
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM notification_preferences WHERE user_id=? ORDER BY channel, kind", userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetNotificationPreferences", err)
+	}
+	prefs := make([]*NotificationPreference, 0, len(rows))
+	for _, r := range rows {
+		prefs = append(prefs, &NotificationPreference{Kind: r.Kind, Channel: r.Channel, Enabled: r.Enabled})
+	}
+	return prefs, nil
+}
+
+// SetNotificationPreferences saves preferences of user, replacing ones of
+// the same kind and channel
+func SetNotificationPreferences(ctx context.Context, userID int, prefs []*NotificationPreference) error {
+	ctx, end := startOp(ctx, "SetNotificationPreferences")
+	defer end()
+	tx, err := BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer RollbackTransaction(tx)
+	for _, p := range prefs {
+		_, err := tx.conn().ExecContext(tx.ctx, "INSERT INTO notification_preferences (user_id, kind, channel, enabled) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE enabled=VALUES(enabled)",
+			userID, p.Kind, p.Channel, p.Enabled)
+		if err != nil {
+			return wrapError(ctx, "SetNotificationPreferences", err)
+		}
+	}
+	return CommitTransaction(tx)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbPortfolioLink struct {
+	ID     int    `db:"id"`
+	UserID int    `db:"user_id"`
+	Title  string `db:"title"`
+	URL    string `db:"url"`
+}
+
+// GetUserSkills returns skills of user sorted by name
+func GetUserSkills(ctx context.Context, userID int) ([]string, error) {
+	ctx, end := startOp(ctx, "GetUserSkills")
+	defer end()
+	skills := []string{}
+	if err := sqlx.SelectContext(ctx, conn(), &skills, "SELECT skill FROM user_skills WHERE user_id=? ORDER BY skill", userID); err != nil {
+		return nil, wrapError(ctx, "GetUserSkills", err)
+	}
+	return skills, nil
+}
+
+// SetUserSkillsTx replaces skills of user in transaction of profile change
+func SetUserSkillsTx(tx *Tx, userID int, skills []string) error {
+	ctx, end := startOp(tx.ctx, "SetUserSkills")
+	defer end()
+	if _, err := tx.conn().ExecContext(ctx, "DELETE FROM user_skills WHERE user_id=?", userID); err != nil {
+		return wrapError(ctx, "SetUserSkills", err)
+	}
+	for _, skill := range skills {
+		if _, err := tx.conn().ExecContext(ctx, "INSERT INTO user_skills (user_id, skill) VALUES(?, ?)", userID, skill); err != nil {
+			return wrapError(ctx, "SetUserSkills", err)
+		}
+	}
+	return nil
+}
+
+// GetPortfolioLinks returns portfolio of user in order links were added
+func GetPortfolioLinks(ctx context.Context, userID int) ([]*PortfolioLink, error) {
+	ctx, end := startOp(ctx, "GetPortfolioLinks")
+	defer end()
+	var rows []dbPortfolioLink
+	if err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM user_portfolio_links WHERE user_id=? ORDER BY id", userID); err != nil {
+		return nil, wrapError(ctx, "GetPortfolioLinks", err)
+	}
+	links := make([]*PortfolioLink, 0, len(rows))
+	for _, row := range rows {
+		links = append(links, &PortfolioLink{ID: row.ID, UserID: row.UserID, Title: row.Title, URL: row.URL})
+	}
+	return links, nil
+}
+
+// CreatePortfolioLink saves link and sets its ID
+func CreatePortfolioLink(ctx context.Context, l *PortfolioLink) error {
+	ctx, end := startOp(ctx, "CreatePortfolioLink")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO user_portfolio_links (user_id, title, url) VALUES(?, ?, ?)", l.UserID, l.Title, l.URL)
+	if err != nil {
+		return wrapError(ctx, "CreatePortfolioLink", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreatePortfolioLink", err)
+	}
+	l.ID = int(id)
+	return nil
+}
+
+// DeletePortfolioLink deletes link of user, ErrNotFound if user has no such link
+func DeletePortfolioLink(ctx context.Context, userID, linkID int) error {
+	ctx, end := startOp(ctx, "DeletePortfolioLink")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM user_portfolio_links WHERE id=? AND user_id=?", linkID, userID)
+	if err != nil {
+		return wrapError(ctx, "DeletePortfolioLink", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "DeletePortfolioLink", err)
+	}
+	if n == 0 {
+		return notFound("DeletePortfolioLink")
+	}
+	return nil
+}
+
+// GetUserStats counts tasks of user by their outcome
+func GetUserStats(ctx context.Context, userID int) (*UserStats, error) {
+	ctx, end := startOp(ctx, "GetUserStats")
+	defer end()
+	var stats UserStats
+	err := sqlx.GetContext(ctx, conn(), &stats.TasksPosted, "SELECT COUNT(*) FROM tasks WHERE customer_id=?", userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserStats", err)
+	}
+	var row struct {
+		Submitted int `db:"submitted"`
+		Completed int `db:"completed"`
+	}
+	err = sqlx.GetContext(ctx, conn(), &row, "SELECT COUNT(*) AS submitted, IFNULL(SUM(status=?), 0) AS completed FROM tasks WHERE executor_id=? AND status IN (?, ?, ?)",
+		StateAccepted, userID, StateCompleted, StateAccepted, StateDisputed)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserStats", err)
+	}
+	stats.TasksSubmitted, stats.TasksCompleted = row.Submitted, row.Completed
+	return &stats, nil
+}
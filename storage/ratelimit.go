@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// sub-second precision matters for token buckets
+const preciseTimeLayout = "2006-01-02 15:04:05.000000"
+
+type dbRateBucket struct {
+	Name      string  `db:"name"`
+	Tokens    float64 `db:"tokens"`
+	UpdatedAt string  `db:"updated_at"`
+}
+
+type dbLockout struct {
+	Name        string `db:"name"`
+	Failures    int    `db:"failures"`
+	LastFailure string `db:"last_failure"`
+	LockedUntil string `db:"locked_until"`
+}
+
+// parseLocalTime parses time stored as local wall clock
+func parseLocalTime(layout, value string) time.Time {
+	t, _ := time.ParseInLocation(layout, value, time.Local)
+	return t
+}
+
+func dbLockoutToLockout(val *dbLockout) *Lockout {
+	return &Lockout{
+		Name:        val.Name,
+		Failures:    val.Failures,
+		LastFailure: parseLocalTime(timeStringLayout, val.LastFailure),
+		LockedUntil: parseLocalTime(timeStringLayout, val.LockedUntil)}
+}
+
+// UpdateRateBucket locks bucket, applies update to it and saves it in one
+// transaction. Missing bucket is passed to update as zero value with name set
+func UpdateRateBucket(ctx context.Context, name string, update func(b *RateBucket)) (*RateBucket, error) {
+	ctx, end := startOp(ctx, "UpdateRateBucket")
+	defer end()
+	tx, err := BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer RollbackTransaction(tx)
+
+	bucket := RateBucket{Name: name}
+	var row dbRateBucket
+	err = sqlx.GetContext(tx.ctx, tx.conn(), &row, "SELECT * FROM rate_limit_buckets WHERE name=? FOR UPDATE", name)
+	switch {
+	case err == nil:
+		bucket.Tokens, bucket.Updated = row.Tokens, parseLocalTime(preciseTimeLayout, row.UpdatedAt)
+	case err != sql.ErrNoRows:
+		return nil, wrapError(ctx, "UpdateRateBucket", err)
+	}
+	update(&bucket)
+	_, err = tx.conn().ExecContext(tx.ctx, "INSERT INTO rate_limit_buckets (name, tokens, updated_at) VALUES(?, ?, ?) ON DUPLICATE KEY UPDATE tokens=VALUES(tokens), updated_at=VALUES(updated_at)",
+		name,
+		bucket.Tokens,
+		bucket.Updated.Format(preciseTimeLayout))
+	if err != nil {
+		return nil, wrapError(ctx, "UpdateRateBucket", err)
+	}
+	return &bucket, CommitTransaction(tx)
+}
+
+// GetLockout returns lockout of name, zero value with name set if there is none
+func GetLockout(ctx context.Context, name string) (*Lockout, error) {
+	ctx, end := startOp(ctx, "GetLockout")
+	defer end()
+	var row dbLockout
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM login_lockouts WHERE name=?", name)
+	if err == sql.ErrNoRows {
+		return &Lockout{Name: name}, nil
+	}
+	if err != nil {
+		return nil, wrapError(ctx, "GetLockout", err)
+	}
+	return dbLockoutToLockout(&row), nil
+}
+
+// UpdateLockout locks lockout, applies update to it and saves it in one
+// transaction. Missing lockout is passed to update as zero value with name set
+func UpdateLockout(ctx context.Context, name string, update func(l *Lockout)) (*Lockout, error) {
+	ctx, end := startOp(ctx, "UpdateLockout")
+	defer end()
+	tx, err := BeginTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer RollbackTransaction(tx)
+
+	lockout := &Lockout{Name: name}
+	var row dbLockout
+	err = sqlx.GetContext(tx.ctx, tx.conn(), &row, "SELECT * FROM login_lockouts WHERE name=? FOR UPDATE", name)
+	switch {
+	case err == nil:
+		lockout = dbLockoutToLockout(&row)
+	case err != sql.ErrNoRows:
+		return nil, wrapError(ctx, "UpdateLockout", err)
+	}
+	update(lockout)
+	_, err = tx.conn().ExecContext(tx.ctx, "INSERT INTO login_lockouts (name, failures, last_failure, locked_until) VALUES(?, ?, ?, ?) ON DUPLICATE KEY UPDATE failures=VALUES(failures), last_failure=VALUES(last_failure), locked_until=VALUES(locked_until)",
+		name,
+		lockout.Failures,
+		lockout.LastFailure.Format(timeStringLayout),
+		lockout.LockedUntil.Format(timeStringLayout))
+	if err != nil {
+		return nil, wrapError(ctx, "UpdateLockout", err)
+	}
+	return lockout, CommitTransaction(tx)
+}
+
+// GetLockouts returns all lockouts, most recent failures first
+func GetLockouts(ctx context.Context) ([]*Lockout, error) {
+	ctx, end := startOp(ctx, "GetLockouts")
+	defer end()
+	var rows []dbLockout
+	if err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM login_lockouts ORDER BY last_failure DESC"); err != nil {
+		return nil, wrapError(ctx, "GetLockouts", err)
+	}
+	lockouts := make([]*Lockout, 0, len(rows))
+	for i := range rows {
+		lockouts = append(lockouts, dbLockoutToLockout(&rows[i]))
+	}
+	return lockouts, nil
+}
+
+// DeleteLockout forgets failures of name, missing lockout is not an error
+func DeleteLockout(ctx context.Context, name string) error {
+	ctx, end := startOp(ctx, "DeleteLockout")
+	defer end()
+	_, err := conn().ExecContext(ctx, "DELETE FROM login_lockouts WHERE name=?", name)
+	return wrapError(ctx, "DeleteLockout", err)
+}
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+
+	"../currency"
+	"github.com/jmoiron/sqlx"
+)
+
+type dbTaskReview struct {
+	ID         int            `db:"id"`
+	TaskID     int            `db:"task_id"`
+	AuthorID   int            `db:"author_id"`
+	Author     string         `db:"author"`
+	TargetID   int            `db:"target_id"`
+	Rating     int            `db:"rating"`
+	Body       string         `db:"body"`
+	CreatedAt  string         `db:"created_at"`
+	HiddenAt   sql.NullString `db:"hidden_at"`
+	HiddenBy   int            `db:"hidden_by"`
+	HideReason string         `db:"hide_reason"`
+}
+
+type dbRating struct {
+	Value     int     `db:"rating"`
+	Cost      float64 `db:"cost"`
+	CreatedAt string  `db:"created_at"`
+}
+
+// selectTaskReviews : columns of reviews with login of author
+const selectTaskReviews = "SELECT r.*, IFNULL(u.user_name, '') AS author FROM task_reviews r LEFT JOIN users u ON u.id=r.author_id "
+
+func dbTaskReviewToTaskReview(val *dbTaskReview) *TaskReview {
+	r := TaskReview{
+		ID:         val.ID,
+		TaskID:     val.TaskID,
+		AuthorID:   val.AuthorID,
+		Author:     val.Author,
+		TargetID:   val.TargetID,
+		Rating:     val.Rating,
+		Body:       val.Body,
+		CreatedAt:  parseLocalTime(timeStringLayout, val.CreatedAt),
+		HiddenBy:   val.HiddenBy,
+		HideReason: val.HideReason}
+	if val.HiddenAt.Valid {
+		r.HiddenAt = parseLocalTime(timeStringLayout, val.HiddenAt.String)
+	}
+	return &r
+}
+
+func selectReviews(ctx context.Context, op, where string, args ...interface{}) ([]*TaskReview, error) {
+	ctx, end := startOp(ctx, op)
+	defer end()
+	var rows []dbTaskReview
+	if err := sqlx.SelectContext(ctx, conn(), &rows, selectTaskReviews+where, args...); err != nil {
+		return nil, wrapError(ctx, op, err)
+	}
+	reviews := make([]*TaskReview, 0, len(rows))
+	for i := range rows {
+		reviews = append(reviews, dbTaskReviewToTaskReview(&rows[i]))
+	}
+	return reviews, nil
+}
+
+// CreateTaskReview saves review and sets its ID, ErrDuplicate if author
+// has reviewed the task already
+func CreateTaskReview(ctx context.Context, r *TaskReview) error {
+	ctx, end := startOp(ctx, "CreateTaskReview")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO task_reviews (task_id, author_id, target_id, rating, body, created_at) VALUES(?, ?, ?, ?, ?, ?)",
+		r.TaskID,
+		r.AuthorID,
+		r.TargetID,
+		r.Rating,
+		r.Body,
+		r.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "CreateTaskReview", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreateTaskReview", err)
+	}
+	r.ID = int(id)
+	return nil
+}
+
+// GetTaskReviews returns reviews of task, oldest first
+func GetTaskReviews(ctx context.Context, taskID int) ([]*TaskReview, error) {
+	return selectReviews(ctx, "GetTaskReviews", "WHERE r.task_id=? ORDER BY r.id", taskID)
+}
+
+// GetUserReviews returns up to limit reviews about user, newest first
+func GetUserReviews(ctx context.Context, targetID, limit int) ([]*TaskReview, error) {
+	return selectReviews(ctx, "GetUserReviews", "WHERE r.target_id=? ORDER BY r.id DESC LIMIT ?", targetID, limit)
+}
+
+// GetTaskReview returns review of task, ErrNotFound if task has no such review
+func GetTaskReview(ctx context.Context, taskID, reviewID int) (*TaskReview, error) {
+	ctx, end := startOp(ctx, "GetTaskReview")
+	defer end()
+	var row dbTaskReview
+	err := sqlx.GetContext(ctx, conn(), &row, selectTaskReviews+"WHERE r.id=? AND r.task_id=?", reviewID, taskID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetTaskReview", err)
+	}
+	return dbTaskReviewToTaskReview(&row), nil
+}
+
+// HideTaskReview saves who hid review and why. Hidden review keeps its
+// text for admins but doesn't count in reputation
+func HideTaskReview(ctx context.Context, r *TaskReview) error {
+	ctx, end := startOp(ctx, "HideTaskReview")
+	defer end()
+	_, err := conn().ExecContext(ctx, "UPDATE task_reviews SET hidden_at=?, hidden_by=?, hide_reason=? WHERE id=?",
+		r.HiddenAt.Format(timeStringLayout), r.HiddenBy, r.HideReason, r.ID)
+	if err != nil {
+		return wrapError(ctx, "HideTaskReview", err)
+	}
+	return nil
+}
+
+// ShowTaskReview makes hidden review visible again
+func ShowTaskReview(ctx context.Context, reviewID int) error {
+	ctx, end := startOp(ctx, "ShowTaskReview")
+	defer end()
+	_, err := conn().ExecContext(ctx, "UPDATE task_reviews SET hidden_at=NULL, hidden_by=0, hide_reason='' WHERE id=?", reviewID)
+	if err != nil {
+		return wrapError(ctx, "ShowTaskReview", err)
+	}
+	return nil
+}
+
+// GetRatings returns visible ratings of user with costs of reviewed tasks
+func GetRatings(ctx context.Context, targetID int) ([]*Rating, error) {
+	ctx, end := startOp(ctx, "GetRatings")
+	defer end()
+	var rows []dbRating
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT r.rating, t.cost, r.created_at FROM task_reviews r JOIN tasks t ON t.id=r.task_id "+
+		"WHERE r.target_id=? AND r.hidden_at IS NULL", targetID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetRatings", err)
+	}
+	ratings := make([]*Rating, 0, len(rows))
+	for _, row := range rows {
+		ratings = append(ratings, &Rating{
+			Value:     row.Value,
+			Cost:      currency.MoneyCtr(row.Cost),
+			CreatedAt: parseLocalTime(timeStringLayout, row.CreatedAt)})
+	}
+	return ratings, nil
+}
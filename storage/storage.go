@@ -1,257 +1,522 @@
-package storage
-
-import (
-	"database/sql"
-	"time"
-
-	"../currency"
-	"github.com/VividCortex/mysqlerr"
-	"github.com/go-sql-driver/mysql"
-	"github.com/jmoiron/sqlx"
-)
-
-const timeStringLayout = "2006-01-02 15:04:05"
-
-type dbUser struct {
-	ID           int     `db:"id"`
-	IsAdmin      bool    `db:"is_admin"`
-	UserName     string  `db:"user_name"`
-	PasswordHash string  `db:"password_hash"`
-	Email        string  `db:"email"`
-	Balance      float64 `db:"balance"`
-	FrozenAmount float64 `db:"frozen_amount"`
-}
-
-type dbTask struct {
-	ID            int     `db:"id"`
-	CustomerID    int     `db:"customer_id"`
-	ExecutionerID int     `db:"executor_id"`
-	Title         string  `db:"title"`
-	State         int     `db:"status"`
-	Cost          float64 `db:"cost"`
-	Problem       string  `db:"problem"`
-	Solution      string  `db:"solution"`
-	BeginTime     string  `db:"begin_time"`
-	EndTime       string  `db:"end_time"`
-}
-
-var connection *sqlx.DB
-
-func init() {
-	if connection == nil {
-		conn, err := sqlx.Connect("mysql", "seth:123@tcp(127.0.0.1:3306)/freelance_stock")
-		if err != nil {
-			panic(err)
-		}
-		connection = conn
-	}
-}
-
-func BeginTransaction() *sql.Tx {
-	tx, _ := connection.Begin()
-	return tx
-}
-
-func CommitTransaction(tx *sql.Tx) {
-	tx.Commit()
-}
-
-func dbUserToUser(val *dbUser) *User {
-	retVal := User{
-		ID:           val.ID,
-		IsAdmin:      val.IsAdmin,
-		UserName:     val.UserName,
-		PasswordHash: val.PasswordHash,
-		Email:        val.Email,
-		Balance:      currency.MoneyCtr(val.Balance),
-		FrozenAmount: currency.MoneyCtr(val.FrozenAmount)}
-	return &retVal
-}
-
-func userToDbUser(val *User) dbUser {
-	return dbUser{
-		ID:           val.ID,
-		IsAdmin:      val.IsAdmin,
-		UserName:     val.UserName,
-		PasswordHash: val.PasswordHash,
-		Email:        val.Email,
-		Balance:      val.Balance.GetVal(),
-		FrozenAmount: val.FrozenAmount.GetVal()}
-}
-
-func dbTaskToTask(val *dbTask) *Task {
-	beginTime, _ := time.Parse(timeStringLayout, val.BeginTime)
-	endTime, _ := time.Parse(timeStringLayout, val.EndTime)
-	retVal := Task{
-		ID:            val.ID,
-		CustomerID:    val.CustomerID,
-		ExecutionerID: val.ExecutionerID,
-		Title:         val.Title,
-		State:         State(val.State),
-		Cost:          currency.MoneyCtr(val.Cost),
-		Problem:       val.Problem,
-		Solution:      val.Solution,
-		BeginTime:     beginTime,
-		EndTime:       endTime}
-	return &retVal
-}
-
-func taskToDbTask(val *Task) dbTask {
-	return dbTask{
-		ID:            val.ID,
-		CustomerID:    val.CustomerID,
-		ExecutionerID: val.ExecutionerID,
-		Title:         val.Title,
-		State:         int(val.State),
-		Cost:          val.Cost.GetVal(),
-		Problem:       val.Problem,
-		Solution:      val.Solution,
-		BeginTime:     val.BeginTime.Format(timeStringLayout),
-		EndTime:       val.EndTime.Format(timeStringLayout)}
-}
-
-// GetTaskByID retruns task structure by it's ID
-func GetTaskByID(ID int) (task *Task, isTaskPresent bool) {
-	var dbT dbTask
-	err := connection.Get(&dbT, "SELECT * FROM tasks WHERE id=?", ID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, false
-		}
-		panic(err)
-	}
-	return dbTaskToTask(&dbT), true
-}
-
-/*
-func GetAllTasksNew() (tasks []*task.Task) {
-	var dbT dbTask
-	selectedTasks []*task.Task
-	err := connection.Get(&dbT, "SELECT * FROM tasks WHERE id IN ?, ?, ?, ?",
-		0, 1, 2, 3)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil
-		}
-		panic(err)
-	}
-	return dbTaskToTask(&dbT)
-}*/
-
-func CreateNewTask(customerID int, title string, cost currency.Money, problem string) (taskID int, isTaskCreated bool) {
-	res, err := connection.Exec("INSERT INTO tasks (customer_id, executor_id, title, status, cost, problem, solution) VALUES(?, 0, ?, 0, ?, ?, \"\")",
-		customerID,
-		title,
-		cost.GetVal(),
-		problem)
-	if err != nil {
-		panic(err)
-	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		panic(err)
-	}
-	return int(id), true
-}
-
-func UpdateTask(task *Task) {
-	dbT := taskToDbTask(task)
-	_, err := connection.Exec("UPDATE tasks set customer_id=?, executor_id=?, title=?, status=?, cost=?, problem=?, solution=?, begin_time=?, end_time=? where id=?",
-		dbT.CustomerID,
-		dbT.ExecutionerID,
-		dbT.Title,
-		dbT.State,
-		dbT.Cost,
-		dbT.Problem,
-		dbT.Solution,
-		dbT.BeginTime,
-		dbT.EndTime,
-		dbT.ID)
-	if err != nil {
-		panic(err)
-	}
-}
-
-func DeleteTask(taskID int) (isDeleted bool) {
-	_, err := connection.Exec("DELETE FROM tasks WHERE id=?", taskID)
-	if err != nil {
-		return false
-	}
-	return true
-}
-
-func GetUserByName(userName string) (user *User, isUserPresent bool) {
-	var dbU dbUser
-	err := connection.Get(&dbU, "SELECT * FROM users WHERE user_name=?", userName)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, false
-		}
-		panic(err)
-	}
-	return dbUserToUser(&dbU), true
-}
-
-func GetUserByID(userID int) (user *User, isUserPresent bool) {
-	var dbU dbUser
-	err := connection.Get(&dbU, "SELECT * FROM users WHERE id=?", userID)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, false
-		}
-		panic(err)
-	}
-	return dbUserToUser(&dbU), true
-}
-
-func CreateNewUser(isAdmin bool, userName, passwordHash, email string) (userID int, isUserCreated bool) {
-	res, err := connection.Exec("INSERT INTO users (is_admin, user_name, password_hash, email) VALUES(?, ?, ?, ?)",
-		isAdmin,
-		userName,
-		passwordHash,
-		email)
-	if err != nil {
-		if driverErr, ok := err.(*mysql.MySQLError); ok {
-			if driverErr.Number == mysqlerr.ER_DUP_ENTRY {
-				// in this case we trying to create user with existing user_name
-				return 0, false
-			}
-		}
-		panic(err)
-	}
-	id, err := res.LastInsertId()
-	if err != nil {
-		panic(err)
-	}
-	return int(id), true
-}
-
-func UpdateUser(user *User) (isUpdated bool) {
-	dbU := userToDbUser(user)
-	_, err := connection.Exec("UPDATE users set is_admin=?, user_name=?, password_hash=?, email=?, balance=?, frozen_amount=? WHERE id=?",
-		dbU.IsAdmin,
-		dbU.UserName,
-		dbU.PasswordHash,
-		dbU.Email,
-		dbU.Balance,
-		dbU.FrozenAmount,
-		dbU.ID)
-	if err != nil {
-		if driverErr, ok := err.(*mysql.MySQLError); ok {
-			if driverErr.Number == mysqlerr.ER_DUP_ENTRY {
-				// in this case we trying to update user with other existing user_name
-				return false
-			}
-		}
-		panic(err)
-	}
-	return true
-}
-
-func DeleteUser(userID int) (isDeleted bool) {
-	_, err := connection.Exec("DELETE FROM users WHERE id=?", userID)
-	if err != nil {
-		return false
-	}
-	return true
-}
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	"../currency"
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const timeStringLayout = "2006-01-02 15:04:05"
+
+type dbUser struct {
+	ID            int     `db:"id"`
+	IsAdmin       bool    `db:"is_admin"`
+	UserName      string  `db:"user_name"`
+	PasswordHash  string  `db:"password_hash"`
+	Email         string  `db:"email"`
+	Balance       float64 `db:"balance"`
+	FrozenAmount  float64 `db:"frozen_amount"`
+	Disabled      bool    `db:"disabled"`
+	Version       int     `db:"version"`
+	TOTPSecret    string  `db:"totp_secret"`
+	TOTPEnabled   bool    `db:"totp_enabled"`
+	TOTPLastStep  int64   `db:"totp_last_step"`
+	EmailVerified bool    `db:"email_verified"`
+	Bio           string  `db:"bio"`
+	CreatedAt     string  `db:"created_at"`
+}
+
+type dbTask struct {
+	ID            int     `db:"id"`
+	CustomerID    int     `db:"customer_id"`
+	ExecutionerID int     `db:"executor_id"`
+	Title         string  `db:"title"`
+	State         int     `db:"status"`
+	Cost          float64 `db:"cost"`
+	CategoryID    int     `db:"category_id"`
+	Problem       string  `db:"problem"`
+	Solution      string  `db:"solution"`
+	Preview       string  `db:"solution_preview"`
+	BeginTime     string  `db:"begin_time"`
+	EndTime       string  `db:"end_time"`
+	AcceptTime    string  `db:"accept_time"`
+	Version       int     `db:"version"`
+}
+
+var connection *sqlx.DB
+
+// dbConn is implemented by both *sqlx.DB and *sqlx.Tx
+type dbConn interface {
+	sqlx.ExecerContext
+	sqlx.QueryerContext
+}
+
+// Tx : database transaction, pass it to *Tx storage functions.
+// Statements of transaction run with context given to BeginTransaction
+// and are traced as children of transaction span
+type Tx struct {
+	tx    *sqlx.Tx
+	ctx   context.Context
+	span  trace.Span
+	start time.Time
+}
+
+// DefaultDSN : database used when no other is configured
+const DefaultDSN = "seth:123@tcp(127.0.0.1:3306)/freelance_stock"
+
+// SchemaVersion : latest migration from sql/migrations the code relies on
+const SchemaVersion = 18
+
+const (
+	connectRetryMin = time.Second
+	connectRetryMax = 30 * time.Second
+)
+
+// Open connects to database, retrying with exponential backoff until
+// connection succeeds or ctx is done. Must be called before other
+// storage functions
+func Open(ctx context.Context, dsn string) error {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return &Error{Op: "Open", Err: err}
+	}
+	// clientFoundRows makes UPDATE report matched rows instead of changed ones
+	cfg.ClientFoundRows = true
+	delay := connectRetryMin
+	for attempt := 1; ; attempt++ {
+		conn, err := sqlx.ConnectContext(ctx, "mysql", cfg.FormatDSN())
+		if err == nil {
+			connection = conn
+			registerDBStats()
+			return nil
+		}
+		slog.WarnContext(ctx, "can't connect to database", "attempt", attempt, "retry_in", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return &Error{Op: "Open", Kind: ErrUnavailable, Err: err}
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > connectRetryMax {
+			delay = connectRetryMax
+		}
+	}
+}
+
+// Close closes database connection pool
+func Close() error {
+	return wrapError(context.Background(), "Close", connection.Close())
+}
+
+// Ping checks that database is reachable
+func Ping(ctx context.Context) error {
+	ctx, end := startOp(ctx, "Ping")
+	defer end()
+	return wrapError(ctx, "Ping", connection.PingContext(ctx))
+}
+
+// MigrationVersion returns number of the latest applied migration
+func MigrationVersion(ctx context.Context) (int, error) {
+	ctx, end := startOp(ctx, "MigrationVersion")
+	defer end()
+	var version int
+	if err := sqlx.GetContext(ctx, conn(), &version, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"); err != nil {
+		return 0, wrapError(ctx, "MigrationVersion", err)
+	}
+	return version, nil
+}
+
+// conn returns traced database connection
+func conn() dbConn {
+	return tracedConn{connection}
+}
+
+// conn returns traced connection of transaction
+func (tx *Tx) conn() dbConn {
+	return tracedConn{tx.tx}
+}
+
+// BeginTransaction starts new database transaction, its span lasts until
+// CommitTransaction or RollbackTransaction
+func BeginTransaction(ctx context.Context) (*Tx, error) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "storage.Transaction")
+	tx, err := connection.BeginTxx(ctx, nil)
+	if err != nil {
+		err = wrapError(ctx, "BeginTransaction", err)
+		span.End()
+		return nil, err
+	}
+	return &Tx{tx: tx, ctx: ctx, span: span, start: start}, nil
+}
+
+// CommitTransaction commits transaction started by BeginTransaction
+func CommitTransaction(tx *Tx) error {
+	err := wrapError(tx.ctx, "CommitTransaction", tx.tx.Commit())
+	tx.end("commit")
+	return err
+}
+
+// RollbackTransaction aborts transaction started by BeginTransaction,
+// does nothing if transaction is already committed
+func RollbackTransaction(tx *Tx) error {
+	err := tx.tx.Rollback()
+	if err == sql.ErrTxDone {
+		return nil
+	}
+	err = wrapError(tx.ctx, "RollbackTransaction", err)
+	tx.end("rollback")
+	return err
+}
+
+func (tx *Tx) end(outcome string) {
+	tx.span.SetAttributes(attribute.String("db.transaction.outcome", outcome))
+	tx.span.End()
+	queryDuration.WithLabelValues("Transaction").Observe(time.Since(tx.start).Seconds())
+}
+
+func dbUserToUser(val *dbUser) *User {
+	retVal := User{
+		ID:            val.ID,
+		IsAdmin:       val.IsAdmin,
+		UserName:      val.UserName,
+		PasswordHash:  val.PasswordHash,
+		Email:         val.Email,
+		Balance:       currency.MoneyCtr(val.Balance),
+		FrozenAmount:  currency.MoneyCtr(val.FrozenAmount),
+		Disabled:      val.Disabled,
+		Version:       val.Version,
+		TOTPSecret:    val.TOTPSecret,
+		TOTPEnabled:   val.TOTPEnabled,
+		TOTPLastStep:  val.TOTPLastStep,
+		EmailVerified: val.EmailVerified,
+		Bio:           val.Bio,
+		CreatedAt:     parseLocalTime(timeStringLayout, val.CreatedAt)}
+	return &retVal
+}
+
+func userToDbUser(val *User) dbUser {
+	return dbUser{
+		ID:            val.ID,
+		IsAdmin:       val.IsAdmin,
+		UserName:      val.UserName,
+		PasswordHash:  val.PasswordHash,
+		Email:         val.Email,
+		Balance:       val.Balance.GetVal(),
+		FrozenAmount:  val.FrozenAmount.GetVal(),
+		Disabled:      val.Disabled,
+		Version:       val.Version,
+		TOTPSecret:    val.TOTPSecret,
+		TOTPEnabled:   val.TOTPEnabled,
+		TOTPLastStep:  val.TOTPLastStep,
+		EmailVerified: val.EmailVerified,
+		Bio:           val.Bio}
+}
+
+func dbTaskToTask(val *dbTask) *Task {
+	beginTime, _ := time.Parse(timeStringLayout, val.BeginTime)
+	endTime, _ := time.Parse(timeStringLayout, val.EndTime)
+	acceptTime, _ := time.Parse(timeStringLayout, val.AcceptTime)
+	retVal := Task{
+		ID:              val.ID,
+		CustomerID:      val.CustomerID,
+		ExecutionerID:   val.ExecutionerID,
+		Title:           val.Title,
+		State:           State(val.State),
+		Cost:            currency.MoneyCtr(val.Cost),
+		CategoryID:      val.CategoryID,
+		Problem:         val.Problem,
+		Solution:        val.Solution,
+		SolutionPreview: val.Preview,
+		BeginTime:       beginTime,
+		EndTime:         endTime,
+		AcceptTime:      acceptTime,
+		Version:         val.Version}
+	return &retVal
+}
+
+func taskToDbTask(val *Task) dbTask {
+	return dbTask{
+		ID:            val.ID,
+		CustomerID:    val.CustomerID,
+		ExecutionerID: val.ExecutionerID,
+		Title:         val.Title,
+		State:         int(val.State),
+		Cost:          val.Cost.GetVal(),
+		CategoryID:    val.CategoryID,
+		Problem:       val.Problem,
+		Solution:      val.Solution,
+		Preview:       val.SolutionPreview,
+		BeginTime:     val.BeginTime.Format(timeStringLayout),
+		EndTime:       val.EndTime.Format(timeStringLayout),
+		AcceptTime:    val.AcceptTime.Format(timeStringLayout),
+		Version:       val.Version}
+}
+
+// GetTaskByID retruns task structure by it's ID with its tags
+func GetTaskByID(ctx context.Context, ID int) (*Task, error) {
+	ctx, end := startOp(ctx, "GetTaskByID")
+	defer end()
+	var dbT dbTask
+	err := sqlx.GetContext(ctx, conn(), &dbT, "SELECT * FROM tasks WHERE id=?", ID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetTaskByID", err)
+	}
+	t := dbTaskToTask(&dbT)
+	if err := loadTags(ctx, []*Task{t}); err != nil {
+		return nil, wrapError(ctx, "GetTaskByID", err)
+	}
+	return t, nil
+}
+
+/*
+func GetAllTasksNew() (tasks []*task.Task) {
+	var dbT dbTask
+	selectedTasks []*task.Task
+	err := connection.Get(&dbT, "SELECT * FROM tasks WHERE id IN ?, ?, ?, ?",
+		0, 1, 2, 3)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		panic(err)
+	}
+	return dbTaskToTask(&dbT)
+}*/
+
+// CreateNewTask inserts new free task and returns it's ID, categoryID is 0
+// for task without category
+func CreateNewTask(ctx context.Context, customerID int, title string, cost currency.Money, categoryID int, problem string) (taskID int, err error) {
+	return createTask(ctx, conn(), customerID, title, cost, categoryID, problem)
+}
+
+// CreateNewTaskTx is CreateNewTask inside transaction
+func CreateNewTaskTx(tx *Tx, customerID int, title string, cost currency.Money, categoryID int, problem string) (taskID int, err error) {
+	return createTask(tx.ctx, tx.conn(), customerID, title, cost, categoryID, problem)
+}
+
+func createTask(ctx context.Context, db dbConn, customerID int, title string, cost currency.Money, categoryID int, problem string) (taskID int, err error) {
+	ctx, end := startOp(ctx, "CreateNewTask")
+	defer end()
+	res, err := db.ExecContext(ctx, "INSERT INTO tasks (customer_id, executor_id, title, status, cost, category_id, problem, solution) VALUES(?, 0, ?, 0, ?, ?, ?, \"\")",
+		customerID,
+		title,
+		cost.GetVal(),
+		categoryID,
+		problem)
+	if err != nil {
+		return 0, wrapError(ctx, "CreateNewTask", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, wrapError(ctx, "CreateNewTask", err)
+	}
+	return int(id), nil
+}
+
+// UpdateTask overwrites all task columns if task version is still the same
+// as when it was read. Returns ErrConflict if task was changed meanwhile and
+// ErrNotFound if it doesn't exist. Increments task.Version on success
+func UpdateTask(ctx context.Context, task *Task) error {
+	return updateTask(ctx, conn(), task)
+}
+
+// UpdateTaskTx is UpdateTask inside transaction
+func UpdateTaskTx(tx *Tx, task *Task) error {
+	return updateTask(tx.ctx, tx.conn(), task)
+}
+
+func updateTask(ctx context.Context, db dbConn, task *Task) error {
+	ctx, end := startOp(ctx, "UpdateTask")
+	defer end()
+	dbT := taskToDbTask(task)
+	res, err := db.ExecContext(ctx, "UPDATE tasks set customer_id=?, executor_id=?, title=?, status=?, cost=?, category_id=?, problem=?, solution=?, solution_preview=?, begin_time=?, end_time=?, accept_time=?, version=version+1 where id=? AND version=?",
+		dbT.CustomerID,
+		dbT.ExecutionerID,
+		dbT.Title,
+		dbT.State,
+		dbT.Cost,
+		dbT.CategoryID,
+		dbT.Problem,
+		dbT.Solution,
+		dbT.Preview,
+		dbT.BeginTime,
+		dbT.EndTime,
+		dbT.AcceptTime,
+		dbT.ID,
+		dbT.Version)
+	if err != nil {
+		return wrapError(ctx, "UpdateTask", err)
+	}
+	if err := checkVersion(ctx, db, "UpdateTask", "tasks", dbT.ID, res); err != nil {
+		return err
+	}
+	task.Version++
+	return nil
+}
+
+// DeleteTask deletes task of given version. Returns ErrNotFound if there
+// was no such task and ErrConflict if task was changed meanwhile
+func DeleteTask(ctx context.Context, taskID, version int) error {
+	ctx, end := startOp(ctx, "DeleteTask")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM tasks WHERE id=? AND version=?", taskID, version)
+	if err != nil {
+		return wrapError(ctx, "DeleteTask", err)
+	}
+	return checkVersion(ctx, conn(), "DeleteTask", "tasks", taskID, res)
+}
+
+// GetUserByName returns user by it's login
+func GetUserByName(ctx context.Context, userName string) (*User, error) {
+	ctx, end := startOp(ctx, "GetUserByName")
+	defer end()
+	var dbU dbUser
+	err := sqlx.GetContext(ctx, conn(), &dbU, "SELECT * FROM users WHERE user_name=?", userName)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserByName", err)
+	}
+	return dbUserToUser(&dbU), nil
+}
+
+// GetUserByID returns user by it's ID
+func GetUserByID(ctx context.Context, userID int) (*User, error) {
+	ctx, end := startOp(ctx, "GetUserByID")
+	defer end()
+	var dbU dbUser
+	err := sqlx.GetContext(ctx, conn(), &dbU, "SELECT * FROM users WHERE id=?", userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserByID", err)
+	}
+	return dbUserToUser(&dbU), nil
+}
+
+// CreateNewUser inserts new user, returns ErrDuplicate if user_name is taken.
+// Email of users created by admins is trusted as verified
+func CreateNewUser(ctx context.Context, isAdmin bool, userName, passwordHash, email string) (userID int, err error) {
+	ctx, end := startOp(ctx, "CreateNewUser")
+	defer end()
+	return insertUser(ctx, "CreateNewUser", isAdmin, userName, passwordHash, email, true)
+}
+
+// RegisterUser inserts new user of self-service registration, the user
+// can't log in until email is verified. Returns ErrDuplicate if user_name is taken
+func RegisterUser(ctx context.Context, userName, passwordHash, email string) (userID int, err error) {
+	ctx, end := startOp(ctx, "RegisterUser")
+	defer end()
+	return insertUser(ctx, "RegisterUser", false, userName, passwordHash, email, false)
+}
+
+func insertUser(ctx context.Context, op string, isAdmin bool, userName, passwordHash, email string, emailVerified bool) (userID int, err error) {
+	res, err := conn().ExecContext(ctx, "INSERT INTO users (is_admin, user_name, password_hash, email, email_verified) VALUES(?, ?, ?, ?, ?)",
+		isAdmin,
+		userName,
+		passwordHash,
+		email,
+		emailVerified)
+	if err != nil {
+		return 0, wrapError(ctx, op, err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, wrapError(ctx, op, err)
+	}
+	return int(id), nil
+}
+
+// GetUsersByEmail returns users with email, logins may share it
+func GetUsersByEmail(ctx context.Context, email string) ([]*User, error) {
+	ctx, end := startOp(ctx, "GetUsersByEmail")
+	defer end()
+	var rows []dbUser
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM users WHERE email=? ORDER BY id", email)
+	if err != nil {
+		return nil, wrapError(ctx, "GetUsersByEmail", err)
+	}
+	users := make([]*User, 0, len(rows))
+	for i := range rows {
+		users = append(users, dbUserToUser(&rows[i]))
+	}
+	return users, nil
+}
+
+// UpdateUser overwrites all user columns if user version is still the same
+// as when it was read. Returns ErrDuplicate if new user_name is taken and
+// ErrConflict if user was changed meanwhile. Increments user.Version on success
+func UpdateUser(ctx context.Context, user *User) error {
+	return updateUser(ctx, conn(), user)
+}
+
+// UpdateUserTx is UpdateUser inside transaction
+func UpdateUserTx(tx *Tx, user *User) error {
+	return updateUser(tx.ctx, tx.conn(), user)
+}
+
+func updateUser(ctx context.Context, db dbConn, user *User) error {
+	ctx, end := startOp(ctx, "UpdateUser")
+	defer end()
+	dbU := userToDbUser(user)
+	res, err := db.ExecContext(ctx, "UPDATE users set is_admin=?, user_name=?, password_hash=?, email=?, balance=?, frozen_amount=?, disabled=?, totp_secret=?, totp_enabled=?, totp_last_step=?, email_verified=?, bio=?, version=version+1 WHERE id=? AND version=?",
+		dbU.IsAdmin,
+		dbU.UserName,
+		dbU.PasswordHash,
+		dbU.Email,
+		dbU.Balance,
+		dbU.FrozenAmount,
+		dbU.Disabled,
+		dbU.TOTPSecret,
+		dbU.TOTPEnabled,
+		dbU.TOTPLastStep,
+		dbU.EmailVerified,
+		dbU.Bio,
+		dbU.ID,
+		dbU.Version)
+	if err != nil {
+		return wrapError(ctx, "UpdateUser", err)
+	}
+	if err := checkVersion(ctx, db, "UpdateUser", "users", dbU.ID, res); err != nil {
+		return err
+	}
+	user.Version++
+	return nil
+}
+
+// DeleteUser deletes user of given version. Returns ErrNotFound if there
+// was no such user and ErrConflict if user was changed meanwhile
+func DeleteUser(ctx context.Context, userID, version int) error {
+	ctx, end := startOp(ctx, "DeleteUser")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE FROM users WHERE id=? AND version=?", userID, version)
+	if err != nil {
+		return wrapError(ctx, "DeleteUser", err)
+	}
+	return checkVersion(ctx, conn(), "DeleteUser", "users", userID, res)
+}
+
+// checkVersion tells apart missing row and version mismatch when
+// conditional statement touched no rows
+func checkVersion(ctx context.Context, db dbConn, op, table string, id int, res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, op, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	var count int
+	if err := sqlx.GetContext(ctx, db, &count, "SELECT COUNT(*) FROM "+table+" WHERE id=?", id); err != nil {
+		return wrapError(ctx, op, err)
+	}
+	if count == 0 {
+		return notFound(op)
+	}
+	countError(op, ErrConflict)
+	return &Error{Op: op, Kind: ErrConflict}
+}
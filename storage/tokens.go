@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbUserToken struct {
+	Hash      string         `db:"token_hash"`
+	UserID    int            `db:"user_id"`
+	Purpose   string         `db:"purpose"`
+	CreatedAt string         `db:"created_at"`
+	ExpiresAt string         `db:"expires_at"`
+	UsedAt    sql.NullString `db:"used_at"`
+}
+
+func dbUserTokenToUserToken(val *dbUserToken) *UserToken {
+	t := UserToken{
+		Hash:      val.Hash,
+		UserID:    val.UserID,
+		Purpose:   TokenPurpose(val.Purpose),
+		CreatedAt: parseLocalTime(timeStringLayout, val.CreatedAt),
+		ExpiresAt: parseLocalTime(timeStringLayout, val.ExpiresAt)}
+	if val.UsedAt.Valid {
+		t.UsedAt = parseLocalTime(timeStringLayout, val.UsedAt.String)
+	}
+	return &t
+}
+
+// CreateUserToken saves token sent to user
+func CreateUserToken(ctx context.Context, t *UserToken) error {
+	ctx, end := startOp(ctx, "CreateUserToken")
+	defer end()
+	_, err := conn().ExecContext(ctx, "INSERT INTO user_tokens (token_hash, user_id, purpose, created_at, expires_at) VALUES(?, ?, ?, ?, ?)",
+		t.Hash,
+		t.UserID,
+		string(t.Purpose),
+		t.CreatedAt.Format(timeStringLayout),
+		t.ExpiresAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "CreateUserToken", err)
+	}
+	return nil
+}
+
+// GetUserToken returns unused and not expired token of purpose by its
+// hash, ErrNotFound if there is no such token
+func GetUserToken(ctx context.Context, purpose TokenPurpose, hash string) (*UserToken, error) {
+	ctx, end := startOp(ctx, "GetUserToken")
+	defer end()
+	var row dbUserToken
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM user_tokens WHERE token_hash=? AND purpose=? AND used_at IS NULL AND expires_at>?",
+		hash,
+		string(purpose),
+		time.Now().Format(timeStringLayout))
+	if err != nil {
+		return nil, wrapError(ctx, "GetUserToken", err)
+	}
+	return dbUserTokenToUserToken(&row), nil
+}
+
+// UseUserTokenTx marks unused and not expired token as used, together with
+// all other unused tokens of the same user and purpose, so earlier links
+// stop working. Returns ErrNotFound if token is already used or expired
+func UseUserTokenTx(tx *Tx, purpose TokenPurpose, hash string) (*UserToken, error) {
+	ctx, end := startOp(tx.ctx, "UseUserToken")
+	defer end()
+	now := time.Now().Format(timeStringLayout)
+	var row dbUserToken
+	err := sqlx.GetContext(ctx, tx.conn(), &row, "SELECT * FROM user_tokens WHERE token_hash=? AND purpose=? AND used_at IS NULL AND expires_at>? FOR UPDATE",
+		hash,
+		string(purpose),
+		now)
+	if err != nil {
+		return nil, wrapError(ctx, "UseUserToken", err)
+	}
+	_, err = tx.conn().ExecContext(ctx, "UPDATE user_tokens SET used_at=? WHERE user_id=? AND purpose=? AND used_at IS NULL",
+		now,
+		row.UserID,
+		string(purpose))
+	if err != nil {
+		return nil, wrapError(ctx, "UseUserToken", err)
+	}
+	return dbUserTokenToUserToken(&row), nil
+}
@@ -0,0 +1,95 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("freelance_stock/storage")
+
+// string and number literals, replaced by ? so values never reach traces
+var sqlLiterals = regexp.MustCompile(`'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"|\b\d+(?:\.\d+)?\b`)
+
+func sanitizeSQL(query string) string {
+	return sqlLiterals.ReplaceAllString(query, "?")
+}
+
+// startOp starts span of storage operation, returned function ends it
+// and records operation duration. Usage:
+//
+//	ctx, end := startOp(ctx, "GetTaskByID")
+//	defer end()
+func startOp(ctx context.Context, op string) (context.Context, func()) {
+	start := time.Now()
+	ctx, span := tracer.Start(ctx, "storage."+op)
+	return ctx, func() {
+		span.End()
+		queryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	}
+}
+
+// recordError marks span of ctx as failed, missing rows are not failures
+func recordError(ctx context.Context, err *Error) {
+	span := trace.SpanFromContext(ctx)
+	span.RecordError(err)
+	if err.Kind != ErrNotFound {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// tracedConn starts span with sanitized SQL for every statement but
+// single row queries
+type tracedConn struct {
+	db dbConn
+}
+
+func startQuery(ctx context.Context, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "storage.query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", "mysql"),
+			attribute.String("db.query.text", sanitizeSQL(query))))
+}
+
+func endQuery(span trace.Span, err error) {
+	if err != nil && err != sql.ErrNoRows {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (c tracedConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	ctx, span := startQuery(ctx, query)
+	res, err := c.db.ExecContext(ctx, query, args...)
+	endQuery(span, err)
+	return res, err
+}
+
+func (c tracedConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	rows, err := c.db.QueryContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+func (c tracedConn) QueryxContext(ctx context.Context, query string, args ...interface{}) (*sqlx.Rows, error) {
+	ctx, span := startQuery(ctx, query)
+	rows, err := c.db.QueryxContext(ctx, query, args...)
+	endQuery(span, err)
+	return rows, err
+}
+
+// QueryRowxContext isn't traced: the row is read by Scan after it returns,
+// which a span ending here would miss. Operation span of startOp covers it
+func (c tracedConn) QueryRowxContext(ctx context.Context, query string, args ...interface{}) *sqlx.Row {
+	return c.db.QueryRowxContext(ctx, query, args...)
+}
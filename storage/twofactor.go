@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ReplaceRecoveryCodesTx deletes all recovery codes of user and inserts
+// new ones by their hashes, nil hashes just delete codes
+func ReplaceRecoveryCodesTx(tx *Tx, userID int, hashes []string) error {
+	ctx, end := startOp(tx.ctx, "ReplaceRecoveryCodes")
+	defer end()
+	if _, err := tx.conn().ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id=?", userID); err != nil {
+		return wrapError(ctx, "ReplaceRecoveryCodes", err)
+	}
+	for _, hash := range hashes {
+		if _, err := tx.conn().ExecContext(ctx, "INSERT INTO recovery_codes (user_id, code_hash) VALUES(?, ?)", userID, hash); err != nil {
+			return wrapError(ctx, "ReplaceRecoveryCodes", err)
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks unused recovery code of user as used. Returns
+// ErrNotFound if there is no such code or it is already used
+func UseRecoveryCode(ctx context.Context, userID int, hash string) error {
+	ctx, end := startOp(ctx, "UseRecoveryCode")
+	defer end()
+	res, err := conn().ExecContext(ctx, "UPDATE recovery_codes SET used_at=? WHERE user_id=? AND code_hash=? AND used_at IS NULL",
+		time.Now().Format(timeStringLayout),
+		userID,
+		hash)
+	if err != nil {
+		return wrapError(ctx, "UseRecoveryCode", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "UseRecoveryCode", err)
+	}
+	if n == 0 {
+		return notFound("UseRecoveryCode")
+	}
+	return nil
+}
+
+// CountRecoveryCodes returns number of unused recovery codes of user
+func CountRecoveryCodes(ctx context.Context, userID int) (int, error) {
+	ctx, end := startOp(ctx, "CountRecoveryCodes")
+	defer end()
+	var n int
+	err := sqlx.GetContext(ctx, conn(), &n, "SELECT COUNT(*) FROM recovery_codes WHERE user_id=? AND used_at IS NULL", userID)
+	if err != nil {
+		return 0, wrapError(ctx, "CountRecoveryCodes", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type dbWebhook struct {
+	ID        int    `db:"id"`
+	UserID    int    `db:"user_id"`
+	URL       string `db:"url"`
+	Secret    string `db:"secret"`
+	Events    string `db:"events"`
+	CreatedAt string `db:"created_at"`
+}
+
+type dbWebhookEvent struct {
+	ID           int            `db:"id"`
+	Type         string         `db:"event_type"`
+	TaskID       int            `db:"task_id"`
+	CustomerID   int            `db:"customer_id"`
+	ExecutorID   int            `db:"executor_id"`
+	Public       bool           `db:"public"`
+	Payload      string         `db:"payload"`
+	CreatedAt    string         `db:"created_at"`
+	DispatchedAt sql.NullString `db:"dispatched_at"`
+}
+
+// webhookSubscriber : enabled user's webhook subscribed to event type
+type webhookSubscriber struct {
+	ID      int  `db:"id"`
+	UserID  int  `db:"user_id"`
+	IsAdmin bool `db:"is_admin"`
+}
+
+// visibleTo tells if event is delivered to subscriber: public events to
+// everybody, others only to task customer, task executor and admins
+func (e *dbWebhookEvent) visibleTo(s webhookSubscriber) bool {
+	return e.Public || s.IsAdmin || s.UserID == e.CustomerID || (e.ExecutorID != 0 && s.UserID == e.ExecutorID)
+}
+
+type dbWebhookDelivery struct {
+	ID            int            `db:"id"`
+	WebhookID     int            `db:"webhook_id"`
+	EventID       int            `db:"event_id"`
+	Status        string         `db:"status"`
+	Attempts      int            `db:"attempts"`
+	NextAttemptAt string         `db:"next_attempt_at"`
+	LastStatus    int            `db:"last_status"`
+	LastError     string         `db:"last_error"`
+	CreatedAt     string         `db:"created_at"`
+	DeliveredAt   sql.NullString `db:"delivered_at"`
+}
+
+type dbWebhookJob struct {
+	dbWebhookDelivery
+	URL            string `db:"url"`
+	Secret         string `db:"secret"`
+	EventType      string `db:"event_type"`
+	TaskID         int    `db:"task_id"`
+	Payload        string `db:"payload"`
+	EventCreatedAt string `db:"event_created_at"`
+}
+
+func dbWebhookToWebhook(val *dbWebhook) *Webhook {
+	return &Webhook{
+		ID:        val.ID,
+		UserID:    val.UserID,
+		URL:       val.URL,
+		Secret:    val.Secret,
+		Events:    strings.Split(val.Events, ","),
+		CreatedAt: parseLocalTime(timeStringLayout, val.CreatedAt)}
+}
+
+func dbWebhookDeliveryToWebhookDelivery(val *dbWebhookDelivery) *WebhookDelivery {
+	d := WebhookDelivery{
+		ID:            val.ID,
+		WebhookID:     val.WebhookID,
+		EventID:       val.EventID,
+		Status:        val.Status,
+		Attempts:      val.Attempts,
+		NextAttemptAt: parseLocalTime(timeStringLayout, val.NextAttemptAt),
+		LastStatus:    val.LastStatus,
+		LastError:     val.LastError,
+		CreatedAt:     parseLocalTime(timeStringLayout, val.CreatedAt)}
+	if val.DeliveredAt.Valid {
+		d.DeliveredAt = parseLocalTime(timeStringLayout, val.DeliveredAt.String)
+	}
+	return &d
+}
+
+// CreateWebhook saves webhook and sets its ID
+func CreateWebhook(ctx context.Context, w *Webhook) error {
+	ctx, end := startOp(ctx, "CreateWebhook")
+	defer end()
+	res, err := conn().ExecContext(ctx, "INSERT INTO webhooks (user_id, url, secret, events, created_at) VALUES(?, ?, ?, ?, ?)",
+		w.UserID,
+		w.URL,
+		w.Secret,
+		strings.Join(w.Events, ","),
+		w.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "CreateWebhook", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "CreateWebhook", err)
+	}
+	w.ID = int(id)
+	return nil
+}
+
+// GetWebhooks returns webhooks of user
+func GetWebhooks(ctx context.Context, userID int) ([]*Webhook, error) {
+	ctx, end := startOp(ctx, "GetWebhooks")
+	defer end()
+	var rows []dbWebhook
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM webhooks WHERE user_id=? ORDER BY id", userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetWebhooks", err)
+	}
+	webhooks := make([]*Webhook, 0, len(rows))
+	for i := range rows {
+		webhooks = append(webhooks, dbWebhookToWebhook(&rows[i]))
+	}
+	return webhooks, nil
+}
+
+// GetWebhook returns webhook of user, ErrNotFound if user has no such webhook
+func GetWebhook(ctx context.Context, userID, webhookID int) (*Webhook, error) {
+	ctx, end := startOp(ctx, "GetWebhook")
+	defer end()
+	var row dbWebhook
+	err := sqlx.GetContext(ctx, conn(), &row, "SELECT * FROM webhooks WHERE id=? AND user_id=?", webhookID, userID)
+	if err != nil {
+		return nil, wrapError(ctx, "GetWebhook", err)
+	}
+	return dbWebhookToWebhook(&row), nil
+}
+
+// DeleteWebhook removes webhook of user with its deliveries, ErrNotFound
+// if user has no such webhook
+func DeleteWebhook(ctx context.Context, userID, webhookID int) error {
+	ctx, end := startOp(ctx, "DeleteWebhook")
+	defer end()
+	res, err := conn().ExecContext(ctx, "DELETE w, d FROM webhooks w LEFT JOIN webhook_deliveries d ON d.webhook_id=w.id WHERE w.id=? AND w.user_id=?", webhookID, userID)
+	if err != nil {
+		return wrapError(ctx, "DeleteWebhook", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "DeleteWebhook", err)
+	}
+	if n == 0 {
+		return notFound("DeleteWebhook")
+	}
+	return nil
+}
+
+// AddWebhookEventTx puts event into outbox in transaction of the change
+// the event is about, so event is emitted if and only if change is committed
+func AddWebhookEventTx(tx *Tx, e *WebhookEvent) error {
+	ctx, end := startOp(tx.ctx, "AddWebhookEvent")
+	defer end()
+	res, err := tx.conn().ExecContext(ctx, "INSERT INTO webhook_events (event_type, task_id, customer_id, executor_id, public, payload, created_at) VALUES(?, ?, ?, ?, ?, ?, ?)",
+		e.Type,
+		e.TaskID,
+		e.CustomerID,
+		e.ExecutorID,
+		e.Public,
+		e.Payload,
+		e.CreatedAt.Format(timeStringLayout))
+	if err != nil {
+		return wrapError(ctx, "AddWebhookEvent", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return wrapError(ctx, "AddWebhookEvent", err)
+	}
+	e.ID = int(id)
+	return nil
+}
+
+// FanOutWebhookEvents creates deliveries of up to limit outbox events to
+// enabled users' webhooks subscribed to their type which may see them and
+// marks events dispatched. Returns number of dispatched events
+func FanOutWebhookEvents(ctx context.Context, limit int) (int, error) {
+	ctx, end := startOp(ctx, "FanOutWebhookEvents")
+	defer end()
+	tx, err := BeginTransaction(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer RollbackTransaction(tx)
+	var events []dbWebhookEvent
+	// concurrent dispatchers of other servers skip events taken by this one
+	err = sqlx.SelectContext(tx.ctx, tx.conn(), &events, "SELECT * FROM webhook_events WHERE dispatched_at IS NULL ORDER BY id LIMIT ? FOR UPDATE SKIP LOCKED", limit)
+	if err != nil {
+		return 0, wrapError(ctx, "FanOutWebhookEvents", err)
+	}
+	now := time.Now().Format(timeStringLayout)
+	for i := range events {
+		e := &events[i]
+		var subscribers []webhookSubscriber
+		err := sqlx.SelectContext(tx.ctx, tx.conn(), &subscribers, "SELECT w.id, w.user_id, u.is_admin FROM webhooks w JOIN users u ON u.id=w.user_id "+
+			"WHERE FIND_IN_SET(?, w.events) AND u.disabled=0 ORDER BY w.id", e.Type)
+		if err != nil {
+			return 0, wrapError(ctx, "FanOutWebhookEvents", err)
+		}
+		for _, s := range subscribers {
+			if !e.visibleTo(s) {
+				continue
+			}
+			_, err := tx.conn().ExecContext(tx.ctx, "INSERT INTO webhook_deliveries (webhook_id, event_id, status, attempts, next_attempt_at, last_status, last_error, created_at) VALUES(?, ?, ?, 0, ?, 0, '', ?)",
+				s.ID, e.ID, DeliveryPending, now, now)
+			if err != nil {
+				return 0, wrapError(ctx, "FanOutWebhookEvents", err)
+			}
+		}
+		_, err = tx.conn().ExecContext(tx.ctx, "UPDATE webhook_events SET dispatched_at=? WHERE id=?", now, e.ID)
+		if err != nil {
+			return 0, wrapError(ctx, "FanOutWebhookEvents", err)
+		}
+	}
+	if err := CommitTransaction(tx); err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// GetDueWebhookJobs returns up to limit pending deliveries whose next
+// attempt is due, the most overdue first
+func GetDueWebhookJobs(ctx context.Context, limit int) ([]*WebhookJob, error) {
+	ctx, end := startOp(ctx, "GetDueWebhookJobs")
+	defer end()
+	var rows []dbWebhookJob
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT d.*, w.url, w.secret, e.event_type, e.task_id, e.payload, e.created_at AS event_created_at "+
+		"FROM webhook_deliveries d JOIN webhooks w ON w.id=d.webhook_id JOIN webhook_events e ON e.id=d.event_id "+
+		"WHERE d.status=? AND d.next_attempt_at<=? ORDER BY d.next_attempt_at LIMIT ?",
+		DeliveryPending,
+		time.Now().Format(timeStringLayout),
+		limit)
+	if err != nil {
+		return nil, wrapError(ctx, "GetDueWebhookJobs", err)
+	}
+	jobs := make([]*WebhookJob, 0, len(rows))
+	for i := range rows {
+		r := &rows[i]
+		jobs = append(jobs, &WebhookJob{
+			WebhookDelivery: *dbWebhookDeliveryToWebhookDelivery(&r.dbWebhookDelivery),
+			URL:             r.URL,
+			Secret:          r.Secret,
+			Event: WebhookEvent{
+				ID:        r.EventID,
+				Type:      r.EventType,
+				TaskID:    r.TaskID,
+				Payload:   r.Payload,
+				CreatedAt: parseLocalTime(timeStringLayout, r.EventCreatedAt)}})
+	}
+	return jobs, nil
+}
+
+// ClaimWebhookDelivery postpones due pending delivery until leaseUntil, so
+// other dispatchers don't send it meanwhile. Returns false if the delivery
+// is not due anymore, e.g. claimed by other dispatcher
+func ClaimWebhookDelivery(ctx context.Context, deliveryID int, leaseUntil time.Time) (bool, error) {
+	ctx, end := startOp(ctx, "ClaimWebhookDelivery")
+	defer end()
+	res, err := conn().ExecContext(ctx, "UPDATE webhook_deliveries SET next_attempt_at=? WHERE id=? AND status=? AND next_attempt_at<=?",
+		leaseUntil.Format(timeStringLayout),
+		deliveryID,
+		DeliveryPending,
+		time.Now().Format(timeStringLayout))
+	if err != nil {
+		return false, wrapError(ctx, "ClaimWebhookDelivery", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, wrapError(ctx, "ClaimWebhookDelivery", err)
+	}
+	return n > 0, nil
+}
+
+// SaveWebhookAttempt records result of delivery attempt
+func SaveWebhookAttempt(ctx context.Context, d *WebhookDelivery) error {
+	ctx, end := startOp(ctx, "SaveWebhookAttempt")
+	defer end()
+	var deliveredAt sql.NullString
+	if !d.DeliveredAt.IsZero() {
+		deliveredAt = sql.NullString{String: d.DeliveredAt.Format(timeStringLayout), Valid: true}
+	}
+	_, err := conn().ExecContext(ctx, "UPDATE webhook_deliveries SET status=?, attempts=?, next_attempt_at=?, last_status=?, last_error=?, delivered_at=? WHERE id=?",
+		d.Status,
+		d.Attempts,
+		d.NextAttemptAt.Format(timeStringLayout),
+		d.LastStatus,
+		d.LastError,
+		deliveredAt,
+		d.ID)
+	if err != nil {
+		return wrapError(ctx, "SaveWebhookAttempt", err)
+	}
+	return nil
+}
+
+// GetWebhookDeliveries returns up to limit deliveries of webhook, newest first
+func GetWebhookDeliveries(ctx context.Context, webhookID, limit int) ([]*WebhookDelivery, error) {
+	ctx, end := startOp(ctx, "GetWebhookDeliveries")
+	defer end()
+	var rows []dbWebhookDelivery
+	err := sqlx.SelectContext(ctx, conn(), &rows, "SELECT * FROM webhook_deliveries WHERE webhook_id=? ORDER BY id DESC LIMIT ?", webhookID, limit)
+	if err != nil {
+		return nil, wrapError(ctx, "GetWebhookDeliveries", err)
+	}
+	deliveries := make([]*WebhookDelivery, 0, len(rows))
+	for i := range rows {
+		deliveries = append(deliveries, dbWebhookDeliveryToWebhookDelivery(&rows[i]))
+	}
+	return deliveries, nil
+}
+
+// RedeliverWebhookDelivery makes delivery of webhook pending again with
+// fresh attempts, ErrNotFound if webhook has no such delivery
+func RedeliverWebhookDelivery(ctx context.Context, webhookID, deliveryID int) error {
+	ctx, end := startOp(ctx, "RedeliverWebhookDelivery")
+	defer end()
+	res, err := conn().ExecContext(ctx, "UPDATE webhook_deliveries SET status=?, attempts=0, next_attempt_at=? WHERE id=? AND webhook_id=?",
+		DeliveryPending,
+		time.Now().Format(timeStringLayout),
+		deliveryID,
+		webhookID)
+	if err != nil {
+		return wrapError(ctx, "RedeliverWebhookDelivery", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return wrapError(ctx, "RedeliverWebhookDelivery", err)
+	}
+	if n == 0 {
+		return notFound("RedeliverWebhookDelivery")
+	}
+	return nil
+}
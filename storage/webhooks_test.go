@@ -0,0 +1,29 @@
+package storage
+
+import "testing"
+
+func TestWebhookEventVisibleTo(t *testing.T) {
+	const customer, executor, other = 1, 2, 3
+	tests := []struct {
+		name       string
+		public     bool
+		executorID int
+		subscriber webhookSubscriber
+		want       bool
+	}{
+		{"public to anybody", true, executor, webhookSubscriber{UserID: other}, true},
+		{"customer", false, executor, webhookSubscriber{UserID: customer}, true},
+		{"executor", false, executor, webhookSubscriber{UserID: executor}, true},
+		{"admin", false, executor, webhookSubscriber{UserID: other, IsAdmin: true}, true},
+		{"other user", false, executor, webhookSubscriber{UserID: other}, false},
+		{"no executor", false, 0, webhookSubscriber{UserID: other}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &dbWebhookEvent{Public: tt.public, CustomerID: customer, ExecutorID: tt.executorID}
+			if got := e.visibleTo(tt.subscriber); got != tt.want {
+				t.Errorf("visible %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"./metrics"
+	"./storage"
+	"./stream"
+	"./webhooks"
+	"github.com/labstack/echo"
+)
+
+const (
+	// streamHeartbeat : how often idle stream is pinged and session rechecked
+	streamHeartbeat = 15 * time.Second
+	// streamWriteTimeout : client not taking event for so long is disconnected
+	streamWriteTimeout = 10 * time.Second
+	// streamRetry : reconnection delay suggested to EventSource, milliseconds
+	streamRetry = 3000
+)
+
+// streamHub : task events of this server for /api/v1/stream clients. The
+// latest 1000 events are kept for resume, clients with 64 events not taken
+// yet are dropped
+var streamHub = newStreamHub()
+
+func newStreamHub() *stream.Hub {
+	hub := stream.NewHub(1000, 64)
+	hub.OnDrop = metrics.StreamDropped.Inc
+	return hub
+}
+
+// publishTaskEvent sends committed task event to stream clients
+func publishTaskEvent(e *storage.WebhookEvent, t *storage.Task) {
+	streamHub.Publish(stream.Event{
+		Type:       e.Type,
+		TaskID:     t.ID,
+		CustomerID: t.CustomerID,
+		ExecutorID: t.ExecutionerID,
+		Public:     e.Public,
+		Cost:       t.Cost.GetVal(),
+		Data:       []byte(e.Payload)})
+}
+
+// writeStreamEvent writes event in Server-Sent Events format
+func writeStreamEvent(w io.Writer, e stream.Event) error {
+	if e.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", e.ID); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, e.Data)
+	return err
+}
+
+// streamFilter selects events for user. As with webhooks only public events
+// go to everyone, others to task participants and admins. Client narrows
+// them by types, tasks of the user only and minimal cost
+func streamFilter(u *storage.User, admin bool, req streamRequest) func(stream.Event) bool {
+	types := webhooks.Events
+	if req.Events != nil {
+		types = strings.Split(*req.Events, ",")
+	}
+	mine := req.Mine != nil && *req.Mine
+	return func(e stream.Event) bool {
+		if !hasScope(types, e.Type) {
+			return false
+		}
+		participant := e.CustomerID == u.ID || e.ExecutorID == u.ID
+		if !e.Public && !participant && !admin {
+			return false
+		}
+		if mine && !participant {
+			return false
+		}
+		return req.MinCost == nil || e.Cost >= *req.MinCost
+	}
+}
+
+// streamHandler pushes task events as Server-Sent Events, see streamFilter.
+// Client reconnecting with Last-Event-ID gets events it missed, or reset
+// event when they are gone and tasks have to be reloaded
+func streamHandler(c echo.Context) error {
+	// EventSource can't send headers, so token may come in query
+	if token := c.QueryParam("token"); token != "" && c.Request().Header.Get("Authorization") == "" {
+		c.Request().Header.Set("Authorization", "Bearer "+token)
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	var req streamRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	filter := streamFilter(u, isAdmin(c, u), req)
+	lastEventID := c.Request().Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.QueryParam("last_event_id")
+	}
+	sub, missed, reset := streamHub.Subscribe(lastEventID, filter)
+	defer streamHub.Unsubscribe(sub)
+	metrics.StreamClients.Inc()
+	defer metrics.StreamClients.Dec()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	// proxies mustn't buffer the stream
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	// a client not reading the stream is disconnected instead of blocking
+	// its handler forever, it reconnects with Last-Event-ID later
+	rc := http.NewResponseController(res.Writer)
+	write := func(write func() error) bool {
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if err := write(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	ok := write(func() error {
+		if _, err := fmt.Fprintf(res, "retry: %d\n\n", streamRetry); err != nil {
+			return err
+		}
+		if reset {
+			return writeStreamEvent(res, stream.Event{Type: "reset", Data: []byte("{}")})
+		}
+		for _, e := range missed {
+			if err := writeStreamEvent(res, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	ctx := c.Request().Context()
+	for ok {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, open := <-sub.Events:
+			if !open {
+				// dropped for being slow or server shuts down
+				return nil
+			}
+			ok = write(func() error { return writeStreamEvent(res, e) })
+		case <-heartbeat.C:
+			// session may have ended or user may be disabled meanwhile
+			if _, isKey := c.Get(contextAPIKeyUser).(*storage.User); !isKey {
+				// storage failure isn't ended session, check again on next ping
+				if _, isAuthorized, err := storage.Auth(c.Request()); err == nil && !isAuthorized {
+					return nil
+				}
+			}
+			ok = write(func() error {
+				_, err := io.WriteString(res, ": ping\n\n")
+				return err
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+// Package stream is in-process pub/sub hub of task events for clients of
+// the event stream. Recent events are kept, so reconnecting clients resume
+// after the last event they got. Subscribers too slow to take events are
+// dropped instead of slowing down publishers
+package stream
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event : task event sent to subscribers
+type Event struct {
+	ID         string // "<hub epoch>-<sequence>", set by Publish
+	Type       string // e.g. "task.acquired"
+	TaskID     int
+	CustomerID int
+	ExecutorID int
+	Public     bool // for all users, otherwise for task participants and admins
+	Cost       float64
+	Data       []byte // JSON of task after the change
+
+	seq int64
+}
+
+// Subscription : events matching filter of one client. Events channel is
+// closed when the subscriber is dropped for being slow or hub is closed
+type Subscription struct {
+	Events <-chan Event
+
+	events chan Event
+	filter func(Event) bool
+}
+
+// Hub fans published events out to subscribers
+type Hub struct {
+	epoch      string // tells event IDs of this process from earlier ones
+	bufferSize int
+
+	lock    sync.Mutex
+	seq     int64
+	history []Event // the latest events, oldest first
+	size    int     // history capacity
+	subs    map[*Subscription]struct{}
+	closed  bool
+
+	// OnDrop is called with hub lock held when slow subscriber is dropped
+	OnDrop func()
+}
+
+// NewHub returns hub keeping historySize latest events for resume and
+// buffering up to bufferSize events of each subscriber
+func NewHub(historySize, bufferSize int) *Hub {
+	return &Hub{
+		epoch:      strconv.FormatInt(time.Now().Unix(), 36),
+		bufferSize: bufferSize,
+		size:       historySize,
+		subs:       make(map[*Subscription]struct{})}
+}
+
+// Publish assigns ID to event, remembers it and sends it to subscribers
+// whose filter matches. Never blocks: subscriber with full buffer is dropped
+func (h *Hub) Publish(e Event) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		return
+	}
+	h.seq++
+	e.seq = h.seq
+	e.ID = fmt.Sprintf("%s-%d", h.epoch, e.seq)
+	if len(h.history) == h.size {
+		h.history = append(h.history[:0], h.history[1:]...)
+	}
+	h.history = append(h.history, e)
+	for s := range h.subs {
+		if !s.filter(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			h.drop(s)
+			if h.OnDrop != nil {
+				h.OnDrop()
+			}
+		}
+	}
+}
+
+// Subscribe starts subscription of events matching filter. lastEventID is
+// ID of the last event client got or empty for new client. Matching
+// events after it are returned as missed; reset is true when they can't
+// be replayed because the ID is unknown or too old, client then has to
+// reload tasks
+func (h *Hub) Subscribe(lastEventID string, filter func(Event) bool) (sub *Subscription, missed []Event, reset bool) {
+	events := make(chan Event, h.bufferSize)
+	sub = &Subscription{Events: events, events: events, filter: filter}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.closed {
+		close(events)
+		return sub, nil, false
+	}
+	h.subs[sub] = struct{}{}
+	if lastEventID == "" {
+		return sub, nil, false
+	}
+	seq, ok := h.parseID(lastEventID)
+	oldest := h.seq - int64(len(h.history)) // sequence of the last evicted event
+	if !ok || seq > h.seq || seq < oldest {
+		return sub, nil, true
+	}
+	for _, e := range h.history {
+		if e.seq > seq && filter(e) {
+			missed = append(missed, e)
+		}
+	}
+	return sub, missed, false
+}
+
+// Unsubscribe stops subscription, it may be dropped already
+func (h *Hub) Unsubscribe(sub *Subscription) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		h.drop(sub)
+	}
+}
+
+// Close drops all subscribers, e.g. on shutdown. Later publishes are ignored
+func (h *Hub) Close() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.closed = true
+	for s := range h.subs {
+		h.drop(s)
+	}
+}
+
+func (h *Hub) drop(s *Subscription) {
+	delete(h.subs, s)
+	close(s.events)
+}
+
+// parseID returns sequence of event ID issued by this hub
+func (h *Hub) parseID(id string) (int64, bool) {
+	epoch, seq, ok := strings.Cut(id, "-")
+	if !ok || epoch != h.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(seq, 10, 64)
+	return n, err == nil
+}
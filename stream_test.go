@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"./storage"
+	"./stream"
+)
+
+func TestStreamFilter(t *testing.T) {
+	const customer, executor, stranger = 1, 2, 3
+	yes := true
+	events := "task.created,task.accepted"
+	minCost := 10.0
+	public := stream.Event{Type: "task.created", CustomerID: customer, Public: true, Cost: 20}
+	private := stream.Event{Type: "task.accepted", CustomerID: customer, ExecutorID: executor, Cost: 5}
+	tests := []struct {
+		name  string
+		user  int
+		admin bool
+		req   streamRequest
+		event stream.Event
+		want  bool
+	}{
+		{"public event to stranger", stranger, false, streamRequest{}, public, true},
+		{"private event to stranger", stranger, false, streamRequest{}, private, false},
+		{"private event to customer", customer, false, streamRequest{}, private, true},
+		{"private event to executor", executor, false, streamRequest{}, private, true},
+		{"private event to admin", stranger, true, streamRequest{}, private, true},
+		{"mine skips public events of others", stranger, false, streamRequest{Mine: &yes}, public, false},
+		{"mine skips private events of others for admin", stranger, true, streamRequest{Mine: &yes}, private, false},
+		{"type not asked", customer, false, streamRequest{Events: &[]string{"task.created"}[0]}, private, false},
+		{"type asked", customer, false, streamRequest{Events: &events}, private, true},
+		{"cheaper than asked", customer, false, streamRequest{MinCost: &minCost}, private, false},
+		{"not cheaper than asked", stranger, false, streamRequest{MinCost: &minCost}, public, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := streamFilter(&storage.User{ID: tt.user}, tt.admin, tt.req)
+			if got := filter(tt.event); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package totp
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret : base32 of ASCII "12345678901234567890", the SHA1 key of
+// RFC 6238 Appendix B
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// RFC 6238 Appendix B gives 8 digit codes, 6 digit ones are their ends
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+	for _, tt := range tests {
+		step := Step(time.Unix(tt.unix, 0))
+		got, err := Code(rfcSecret, step)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tt.code[2:]; got != want {
+			t.Errorf("code at %d is %s, want %s", tt.unix, got, want)
+		}
+		if lower, _ := Code(strings.ToLower(rfcSecret), step); lower != got {
+			t.Errorf("lower case secret gives %s, want %s", lower, got)
+		}
+	}
+	if _, err := Code("not base32!", 1); err == nil {
+		t.Error("bad secret accepted")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := Step(now)
+	code := func(s int64) string {
+		c, err := Code(rfcSecret, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	tests := []struct {
+		name     string
+		code     string
+		lastStep int64
+		want     int64 // 0 when rejected
+	}{
+		{"current step", code(step), 0, step},
+		{"spaces around", " " + code(step) + "\n", 0, step},
+		{"previous step within skew", code(step - 1), 0, step - 1},
+		{"next step within skew", code(step + 1), 0, step + 1},
+		{"two steps ago", code(step - 2), 0, 0},
+		{"two steps ahead", code(step + 2), 0, 0},
+		{"replayed code", code(step), step, 0},
+		{"code older than last accepted", code(step - 1), step, 0},
+		{"newer code after last accepted", code(step + 1), step, step + 1},
+		{"wrong code", "000000", 0, 0},
+		{"short code", code(step)[:5], 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Validate(rfcSecret, tt.code, now, tt.lastStep)
+			if got != tt.want || ok != (tt.want != 0) {
+				t.Errorf("Validate %d %v, want %d %v", got, ok, tt.want, tt.want != 0)
+			}
+		})
+	}
+}
+
+func TestGenerateSecret(t *testing.T) {
+	a, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := GenerateSecret()
+	if a == b || len(a) != 32 {
+		t.Errorf("secrets %q and %q", a, b)
+	}
+	if _, err := Code(a, 1); err != nil {
+		t.Errorf("generated secret can't make code: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HeaderTraceID : response header carrying trace ID of request
+const HeaderTraceID = "X-Trace-ID"
+
+var tracer = otel.Tracer("freelance_stock/http")
+
+// Middleware starts server span for every request, continuing trace from
+// traceparent header if client sent one, and returns trace ID in
+// X-Trace-ID header. Span is named after route, e.g. "POST /api/v1/tasks/:task_id/:command"
+func Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		ctx, span := tracer.Start(ctx, req.Method+" "+c.Path(),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.Method),
+				attribute.String("http.route", c.Path()),
+				attribute.String("url.path", req.URL.Path),
+				attribute.String("client.address", c.RealIP()),
+				attribute.String("request_id", c.Response().Header().Get(echo.HeaderXRequestID))))
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+		if traceID := TraceID(ctx); traceID != "" {
+			c.Response().Header().Set(HeaderTraceID, traceID)
+		}
+
+		err := next(c)
+		status := c.Response().Status
+		if err != nil {
+			span.RecordError(err)
+			status = http.StatusInternalServerError
+			if httpErr, ok := err.(*echo.HTTPError); ok {
+				status = httpErr.Code
+			}
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		return err
+	}
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	"./audit"
+	"./metrics"
+	"./storage"
+	"./totp"
+	"./validate"
+	"github.com/labstack/echo"
+)
+
+// totpIssuer names the service in authenticator apps
+const totpIssuer = "freelance_stock"
+
+// recoveryCodeCount : how many recovery codes are issued at once
+const recoveryCodeCount = 10
+
+// adminTwoFactorRequired : admins can't log in without second factor, set up in run
+var adminTwoFactorRequired = true
+
+type loginAnswer struct {
+	Token         string   `json:"token"`
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	ErrorMessage  string   `json:"errror_message"`
+	ErrorCode     int      `json:"error_code"`
+}
+
+type enrollAnswer struct {
+	Secret    string `json:"secret"`
+	URI       string `json:"uri"` // otpauth:// URI to be shown as QR code
+	ErrorCode int    `json:"error_code"`
+}
+
+type recoveryCodesAnswer struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+	ErrorMessage  string   `json:"error_message"`
+	ErrorCode     int      `json:"error_code"`
+}
+
+// hashRecoveryCode returns stored form of recovery code, case, spaces
+// and dashes don't matter
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// newRecoveryCodes returns codes to be shown to user once and their hashes to be stored
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	// no 0, o, 1, i, l, they are easy to confuse
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 8)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+			if err != nil {
+				return nil, nil, err
+			}
+			b[j] = alphabet[n.Int64()]
+		}
+		code := string(b[:4]) + "-" + string(b[4:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// checkSecondFactor accepts TOTP code or unused recovery code of user.
+// Accepted codes can't be used again
+func checkSecondFactor(ctx context.Context, u *storage.User, code string) (bool, error) {
+	if step, ok := totp.Validate(u.TOTPSecret, code, time.Now(), u.TOTPLastStep); ok {
+		u.TOTPLastStep = step
+		// version check fails concurrent use of the same code
+		if err := storage.UpdateUser(ctx, u); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+	err := storage.UseRecoveryCode(ctx, u.ID, hashRecoveryCode(code))
+	if errors.Is(err, storage.ErrNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// saveTwoFactor saves user and replaces recovery codes in one transaction
+func saveTwoFactor(ctx context.Context, u *storage.User, hashes []string) error {
+	tx, err := storage.BeginTransaction(ctx)
+	if err != nil {
+		return err
+	}
+	defer storage.RollbackTransaction(tx)
+	if err := storage.UpdateUserTx(tx, u); err != nil {
+		return err
+	}
+	if err := storage.ReplaceRecoveryCodesTx(tx, u.ID, hashes); err != nil {
+		return err
+	}
+	return storage.CommitTransaction(tx)
+}
+
+// enableTwoFactor turns second factor on and returns new recovery codes
+func enableTwoFactor(ctx context.Context, u *storage.User) ([]string, error) {
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	u.TOTPEnabled = true
+	if err := saveTwoFactor(ctx, u, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// rejectSecondFactor counts wrong code as failed login attempt of account
+func rejectSecondFactor(ctx context.Context, account string) error {
+	metrics.LoginRejected.WithLabelValues("bad_second_factor").Inc()
+	_, err := loginLimiter.Fail(ctx, account)
+	return err
+}
+
+// enrollTwoFactor generates new secret of user and answers it with QR URI.
+// Second factor is enabled once code of the secret is verified
+func enrollTwoFactor(c echo.Context, u *storage.User) error {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	before := audit.UserSnapshot(u)
+	u.TOTPSecret, u.TOTPLastStep = secret, 0
+	if err := storage.UpdateUser(c.Request().Context(), u); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(u.ID), before, audit.UserSnapshot(u))
+	answer, _ := json.Marshal(enrollAnswer{secret, totp.URI(totpIssuer, u.UserName, secret), 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// secondFactorChallenge returns answer with challenge when user has to pass
+// second factor before getting session token, by password or SSO. Returns
+// empty string when token may be issued right away
+func secondFactorChallenge(u *storage.User) string {
+	switch {
+	case u.TOTPEnabled:
+		challenge := storage.NewChallenge(u, storage.ChallengeVerify)
+		return fmt.Sprintf(`{"challenge": "%s", "errror_message": "second factor required", "error_code": 6}`, challenge)
+	case u.IsAdmin && adminTwoFactorRequired:
+		challenge := storage.NewChallenge(u, storage.ChallengeEnroll)
+		return fmt.Sprintf(`{"challenge": "%s", "errror_message": "two-factor enrollment required", "error_code": 7}`, challenge)
+	}
+	return ""
+}
+
+// loginChallengeUser returns user of login challenge, on failure writes
+// answer and returns nil
+func loginChallengeUser(c echo.Context, token string) (*storage.Challenge, *storage.User, error) {
+	ch, ok := storage.UseChallenge(token)
+	if !ok {
+		return nil, nil, c.JSONBlob(http.StatusUnauthorized, []byte(`{"errror_message": "login challenge expired, log in again", "error_code": 9}`))
+	}
+	u, err := storage.GetUserByID(c.Request().Context(), ch.UserID)
+	if err != nil {
+		return nil, nil, storageErrorAnswer(c, err)
+	}
+	audit.SetActor(c, u.UserName)
+	if u.Disabled {
+		return nil, nil, c.JSONBlob(http.StatusUnauthorized, []byte(`{"errror_message": "user is disabled", "error_code": 4}`))
+	}
+	return &ch, u, nil
+}
+
+// loginSecondFactorHandler is the second login step: checks code of
+// challenge returned by loginHandler or ssoCallbackHandler and issues session token. For
+// enrollment challenge code of new secret enables second factor
+func loginSecondFactorHandler(c echo.Context) error {
+	var req loginSecondFactorRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.login_2fa")
+	ctx := c.Request().Context()
+	ch, u, err := loginChallengeUser(c, req.Challenge)
+	if u == nil {
+		return err
+	}
+	account := accountLockoutName(u.UserName)
+	if ok, err := allowLoginAttempt(c, account); !ok {
+		return err
+	}
+
+	var passed bool
+	if ch.Purpose == storage.ChallengeEnroll {
+		if u.TOTPSecret == "" {
+			return c.JSONBlob(http.StatusConflict, []byte(`{"errror_message": "two-factor authentication is not enrolled", "error_code": 141}`))
+		}
+		var step int64
+		step, passed = totp.Validate(u.TOTPSecret, req.Code, time.Now(), u.TOTPLastStep)
+		u.TOTPLastStep = step
+	} else if passed, err = checkSecondFactor(ctx, u, req.Code); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !passed {
+		if err := rejectSecondFactor(ctx, account); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		return c.JSONBlob(http.StatusUnauthorized, []byte(`{"errror_message": "wrong two-factor code", "error_code": 8}`))
+	}
+
+	var codes []string
+	if ch.Purpose == storage.ChallengeEnroll {
+		audit.SetAction(c, "user.2fa_enable")
+		before := audit.UserSnapshot(u)
+		if codes, err = enableTwoFactor(ctx, u); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		audit.AddChange(c, audit.UserTarget(u.ID), before, audit.UserSnapshot(u))
+	}
+	storage.DeleteChallenge(req.Challenge)
+	if err := loginLimiter.Reset(ctx, account); err != nil {
+		slog.WarnContext(ctx, "can't reset login failures", "err", err)
+	}
+	answer, _ := json.Marshal(loginAnswer{storage.StartSession(u), codes, "OK", 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// loginEnrollHandler generates secret for admin who has to enroll second
+// factor before login
+func loginEnrollHandler(c echo.Context) error {
+	var req loginEnrollRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	audit.SetAction(c, "user.2fa_enroll")
+	ch, u, err := loginChallengeUser(c, req.Challenge)
+	if u == nil {
+		return err
+	}
+	if ch.Purpose != storage.ChallengeEnroll {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"errror_message": "two-factor authentication is already enabled", "error_code": 140}`))
+	}
+	return enrollTwoFactor(c, u)
+}
+
+// twoFactorOwner authorizes request to two-factor settings of user in
+// slug, only the user may change them. On failure writes answer and returns nil
+func twoFactorOwner(c echo.Context) (*storage.User, error) {
+	u, err := authorize(c)
+	if u == nil {
+		return nil, err
+	}
+	if u.UserName != c.Param("slug") {
+		return nil, c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "two-factor authentication is set up by its owner only", "error_code": 3}`))
+	}
+	return u, nil
+}
+
+func usersTwoFactorEnrollHandler(c echo.Context) error {
+	u, err := twoFactorOwner(c)
+	if u == nil {
+		return err
+	}
+	audit.SetAction(c, "user.2fa_enroll")
+	if u.TOTPEnabled {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "two-factor authentication is already enabled", "error_code": 140}`))
+	}
+	return enrollTwoFactor(c, u)
+}
+
+// usersTwoFactorVerifyHandler enables second factor once code of enrolled
+// secret is entered, answers recovery codes
+func usersTwoFactorVerifyHandler(c echo.Context) error {
+	var req twoFactorCodeRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := twoFactorOwner(c)
+	if u == nil {
+		return err
+	}
+	audit.SetAction(c, "user.2fa_enable")
+	ctx := c.Request().Context()
+	if u.TOTPEnabled {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "two-factor authentication is already enabled", "error_code": 140}`))
+	}
+	if u.TOTPSecret == "" {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "two-factor authentication is not enrolled", "error_code": 141}`))
+	}
+	account := accountLockoutName(u.UserName)
+	if ok, err := allowLoginAttempt(c, account); !ok {
+		return err
+	}
+	step, ok := totp.Validate(u.TOTPSecret, req.Code, time.Now(), u.TOTPLastStep)
+	if !ok {
+		if err := rejectSecondFactor(ctx, account); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "wrong two-factor code", "error_code": 142}`))
+	}
+	before := audit.UserSnapshot(u)
+	u.TOTPLastStep = step
+	codes, err := enableTwoFactor(ctx, u)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(u.ID), before, audit.UserSnapshot(u))
+	answer, _ := json.Marshal(recoveryCodesAnswer{codes, "two-factor authentication enabled", 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// usersTwoFactorRecoveryCodesHandler replaces recovery codes with new ones
+func usersTwoFactorRecoveryCodesHandler(c echo.Context) error {
+	var req twoFactorCodeRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := twoFactorOwner(c)
+	if u == nil {
+		return err
+	}
+	audit.SetAction(c, "user.2fa_recovery_codes")
+	ctx := c.Request().Context()
+	if !u.TOTPEnabled {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "two-factor authentication is not enabled", "error_code": 141}`))
+	}
+	account := accountLockoutName(u.UserName)
+	if ok, err := allowLoginAttempt(c, account); !ok {
+		return err
+	}
+	passed, err := checkSecondFactor(ctx, u, req.Code)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if !passed {
+		if err := rejectSecondFactor(ctx, account); err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "wrong two-factor code", "error_code": 142}`))
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if err := saveTwoFactor(ctx, u, hashes); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(u.ID), audit.UserSnapshot(u), audit.UserSnapshot(u))
+	answer, _ := json.Marshal(recoveryCodesAnswer{codes, "recovery codes replaced", 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// usersTwoFactorDeleteHandler disables second factor. User confirms it
+// with code, admin resets it of other user without code
+func usersTwoFactorDeleteHandler(c echo.Context) error {
+	var req twoFactorDisableRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	audit.SetAction(c, "user.2fa_disable")
+	ctx := c.Request().Context()
+	target := u
+	if slug := c.Param("slug"); slug != u.UserName {
+		if !isAdmin(c, u) {
+			return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "insufficient permission to reset two-factor authentication", "error_code": 3}`))
+		}
+		var err error
+		target, err = storage.GetUserByName(ctx, slug)
+		if errors.Is(err, storage.ErrNotFound) {
+			return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "user not found", "error_code": 123}`))
+		}
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if !target.TOTPEnabled && target.TOTPSecret == "" {
+		return c.JSONBlob(http.StatusConflict, []byte(`{"error_message": "two-factor authentication is not enabled", "error_code": 141}`))
+	}
+	if target == u {
+		if u.IsAdmin && adminTwoFactorRequired {
+			return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "two-factor authentication is mandatory for admins", "error_code": 143}`))
+		}
+		if req.Code == "" {
+			var errs validate.Errors
+			errs.Add("code", "is required")
+			return validationErrorAnswer(c, errs)
+		}
+		account := accountLockoutName(u.UserName)
+		if ok, err := allowLoginAttempt(c, account); !ok {
+			return err
+		}
+		passed, err := checkSecondFactor(ctx, u, req.Code)
+		if err != nil {
+			return storageErrorAnswer(c, err)
+		}
+		if !passed {
+			if err := rejectSecondFactor(ctx, account); err != nil {
+				return storageErrorAnswer(c, err)
+			}
+			return c.JSONBlob(http.StatusForbidden, []byte(`{"error_message": "wrong two-factor code", "error_code": 142}`))
+		}
+	}
+	before := audit.UserSnapshot(target)
+	target.TOTPSecret, target.TOTPEnabled, target.TOTPLastStep = "", false, 0
+	if err := saveTwoFactor(ctx, target, nil); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, audit.UserTarget(target.ID), before, audit.UserSnapshot(target))
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "two-factor authentication disabled", "error_code": 0}`))
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"./storage"
+)
+
+func TestSecondFactorChallenge(t *testing.T) {
+	defer func(required bool) { adminTwoFactorRequired = required }(adminTwoFactorRequired)
+	tests := []struct {
+		name     string
+		user     storage.User
+		required bool
+		code     int
+		purpose  storage.ChallengePurpose
+	}{
+		{"user without second factor", storage.User{ID: 1}, true, 0, 0},
+		{"user with second factor", storage.User{ID: 1, TOTPEnabled: true}, true, 6, storage.ChallengeVerify},
+		{"admin with second factor", storage.User{ID: 1, IsAdmin: true, TOTPEnabled: true}, true, 6, storage.ChallengeVerify},
+		{"admin without second factor", storage.User{ID: 1, IsAdmin: true}, true, 7, storage.ChallengeEnroll},
+		{"admin when it isn't required", storage.User{ID: 1, IsAdmin: true}, false, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adminTwoFactorRequired = tt.required
+			answer := secondFactorChallenge(&tt.user)
+			if tt.code == 0 {
+				if answer != "" {
+					t.Fatalf("got challenge %s, want none", answer)
+				}
+				return
+			}
+			var got struct {
+				Challenge string `json:"challenge"`
+				ErrorCode int    `json:"error_code"`
+			}
+			if err := json.Unmarshal([]byte(answer), &got); err != nil {
+				t.Fatalf("answer %q is not JSON: %v", answer, err)
+			}
+			if got.ErrorCode != tt.code {
+				t.Errorf("error_code %d, want %d", got.ErrorCode, tt.code)
+			}
+			ch, ok := storage.UseChallenge(got.Challenge)
+			if !ok || ch.UserID != tt.user.ID || ch.Purpose != tt.purpose {
+				t.Errorf("challenge %+v (%v), want purpose %v of user %d", ch, ok, tt.purpose, tt.user.ID)
+			}
+		})
+	}
+}
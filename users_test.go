@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"./storage"
+)
+
+func TestEmailChangeNeedsVerification(t *testing.T) {
+	tests := []struct {
+		name         string
+		email        *string // nil keeps email
+		vouched      bool
+		wantEmail    string
+		wantVerified bool
+		wantVerify   bool
+	}{
+		{"email kept", nil, false, "old@example.com", true, false},
+		{"same email", &[]string{"old@example.com"}[0], false, "old@example.com", true, false},
+		{"changed email", &[]string{"new@example.com"}[0], false, "new@example.com", false, true},
+		{"changed by admin for other user", &[]string{"new@example.com"}[0], true, "new@example.com", true, false},
+		{"cleared email", &[]string{""}[0], false, "", true, false},
+	}
+	for _, tt := range tests {
+		t.Run("PUT "+tt.name, func(t *testing.T) {
+			u := &storage.User{ID: 1, Email: "old@example.com", EmailVerified: true}
+			verify := updateUser(u, userUpdateRequest{Email: tt.email}, tt.vouched)
+			if u.Email != tt.wantEmail || u.EmailVerified != tt.wantVerified || verify != tt.wantVerify {
+				t.Errorf("email %q verified %v verify %v, want %q %v %v", u.Email, u.EmailVerified, verify, tt.wantEmail, tt.wantVerified, tt.wantVerify)
+			}
+		})
+		t.Run("PATCH "+tt.name, func(t *testing.T) {
+			u := &storage.User{ID: 1, Email: "old@example.com", EmailVerified: true}
+			patch := mergePatch{}
+			if tt.email != nil {
+				patch["email"], _ = json.Marshal(*tt.email)
+				if *tt.email == "" {
+					patch["email"] = json.RawMessage("null")
+				}
+			}
+			errs, verify, err := patchUser(context.Background(), u, patch, false, tt.vouched)
+			if err != nil || len(errs) > 0 {
+				t.Fatalf("unexpected errors %v %v", errs, err)
+			}
+			if u.Email != tt.wantEmail || u.EmailVerified != tt.wantVerified || verify != tt.wantVerify {
+				t.Errorf("email %q verified %v verify %v, want %q %v %v", u.Email, u.EmailVerified, verify, tt.wantEmail, tt.wantVerified, tt.wantVerify)
+			}
+		})
+	}
+}
+
+func TestPatchUserRejectedKeepsEmail(t *testing.T) {
+	u := &storage.User{ID: 1, Email: "old@example.com", EmailVerified: true}
+	patch := mergePatch{"email": json.RawMessage(`"new@example.com"`), "is_admin": json.RawMessage("true")}
+	errs, verify, err := patchUser(context.Background(), u, patch, false, false)
+	if err != nil || len(errs) == 0 {
+		t.Fatalf("want is_admin rejected, got %v %v", errs, err)
+	}
+	if u.Email != "old@example.com" || !u.EmailVerified || verify {
+		t.Errorf("rejected patch changed email to %q verified %v verify %v", u.Email, u.EmailVerified, verify)
+	}
+}
+
+func TestPatchUserPassword(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		errs     []string
+	}{
+		{"long enough", `"password123"`, nil},
+		{"short", `"1234567"`, []string{"password: must be at least 8 characters long"}},
+		{"empty", `""`, []string{"password: can't be empty"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &storage.User{ID: 1, PasswordHash: "old"}
+			errs, _, err := patchUser(context.Background(), u, mergePatch{"password": json.RawMessage(tt.password)}, false, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := tt.errs
+			if want == nil {
+				want = []string{}
+			}
+			if got := fieldErrors(errs); !reflect.DeepEqual(got, want) {
+				t.Errorf("errors %q, want %q", got, want)
+			}
+			if changed := u.PasswordHash != "old"; changed != (tt.errs == nil) {
+				t.Errorf("password changed %v, want %v", changed, tt.errs == nil)
+			}
+		})
+	}
+}
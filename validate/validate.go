@@ -0,0 +1,296 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// TimeLayout : format of time values in requests
+const TimeLayout = "2006-01-02 15:04:05"
+
+// FieldError : validation error of single request field
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Errors : all validation errors of request
+type Errors []FieldError
+
+// Add appends error for field
+func (errs *Errors) Add(field, format string, args ...interface{}) {
+	*errs = append(*errs, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Only returns errors of listed fields
+func (errs Errors) Only(fields []string) Errors {
+	var retVal Errors
+	for _, e := range errs {
+		for _, f := range fields {
+			if e.Field == f {
+				retVal = append(retVal, e)
+				break
+			}
+		}
+	}
+	return retVal
+}
+
+// Source returns raw request value by name, ok is false if value is absent
+type Source func(name string) (value string, ok bool)
+
+// Rule checks dereferenced field value against rule parameter
+// and returns error message or empty string
+type Rule func(value interface{}, param string) string
+
+// LookupRule is Rule looking value up somewhere, e.g. in database, within
+// ctx of request. Failed lookup is returned as error and stops validation
+type LookupRule func(ctx context.Context, value interface{}, param string) (string, error)
+
+var rules = map[string]LookupRule{
+	"min":      simple(minRule),
+	"max":      simple(maxRule),
+	"minlen":   simple(minLenRule),
+	"maxlen":   simple(maxLenRule),
+	"maxbytes": simple(maxBytesRule),
+	"email":    simple(emailRule),
+	"url":      simple(urlRule),
+}
+
+func simple(rule Rule) LookupRule {
+	return func(ctx context.Context, value interface{}, param string) (string, error) {
+		return rule(value, param), nil
+	}
+}
+
+// RegisterRule adds custom rule usable in validate tags. Not safe to call
+// concurrently with validation, register rules on startup
+func RegisterRule(name string, rule Rule) {
+	rules[name] = simple(rule)
+}
+
+// RegisterLookupRule adds custom rule which may fail to check value
+func RegisterLookupRule(name string, rule LookupRule) {
+	rules[name] = rule
+}
+
+// Bind fills fields of dto struct tagged with `form:"name"` from src and
+// validates them by `validate:"rule,rule=param"` tags. Supported field types
+// are string, int, float64, bool, time.Time and pointers to them. Pointer
+// fields stay nil when value is absent or empty. Error is returned only when
+// LookupRule fails
+func Bind(ctx context.Context, src Source, dto interface{}) (Errors, error) {
+	var errs Errors
+	v := reflect.ValueOf(dto).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Tag.Get("form")
+		if name == "" {
+			continue
+		}
+		raw, ok := src(name)
+		if !ok || raw == "" {
+			if isRequired(t.Field(i).Tag.Get("validate")) {
+				errs.Add(name, "is required")
+			}
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.Ptr {
+			field.Set(reflect.New(field.Type().Elem()))
+			field = field.Elem()
+		}
+		if msg := parse(raw, field); msg != "" {
+			errs.Add(name, "%s", msg)
+		}
+	}
+	structErrs, err := Struct(ctx, dto)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range structErrs {
+		if !hasError(errs, e.Field) {
+			errs = append(errs, e)
+		}
+	}
+	return errs, nil
+}
+
+// Struct validates dto fields by `validate` tags. Nil pointers are
+// checked only by required rule. Error is returned only when LookupRule fails
+func Struct(ctx context.Context, dto interface{}) (Errors, error) {
+	var errs Errors
+	v := reflect.Indirect(reflect.ValueOf(dto))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("validate")
+		if tag == "" {
+			continue
+		}
+		name := t.Field(i).Tag.Get("form")
+		if name == "" {
+			name = t.Field(i).Name
+		}
+		field := v.Field(i)
+		isSet := !(field.Kind() == reflect.Ptr && field.IsNil()) && !(field.Kind() == reflect.String && field.Len() == 0)
+		for _, rule := range strings.Split(tag, ",") {
+			ruleName, param := rule, ""
+			if idx := strings.Index(rule, "="); idx >= 0 {
+				ruleName, param = rule[:idx], rule[idx+1:]
+			}
+			if ruleName == "required" {
+				if !isSet {
+					errs.Add(name, "is required")
+					break
+				}
+				continue
+			}
+			if !isSet {
+				break
+			}
+			check, ok := rules[ruleName]
+			if !ok {
+				panic("validate: unknown rule " + ruleName)
+			}
+			msg, err := check(ctx, reflect.Indirect(field).Interface(), param)
+			if err != nil {
+				return nil, err
+			}
+			if msg != "" {
+				errs.Add(name, "%s", msg)
+				break
+			}
+		}
+	}
+	return errs, nil
+}
+
+func isRequired(tag string) bool {
+	for _, rule := range strings.Split(tag, ",") {
+		if rule == "required" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasError(errs Errors, field string) bool {
+	for _, e := range errs {
+		if e.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+func parse(raw string, field reflect.Value) string {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(raw)
+	case int:
+		val, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return "must be integer"
+		}
+		field.SetInt(val)
+	case float64:
+		val, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return "must be in float number format"
+		}
+		field.SetFloat(val)
+	case bool:
+		val, err := strconv.ParseBool(raw)
+		if err != nil {
+			return "must be true or false"
+		}
+		field.SetBool(val)
+	case time.Time:
+		val, err := time.Parse(TimeLayout, raw)
+		if err != nil {
+			return "must be like " + TimeLayout
+		}
+		field.Set(reflect.ValueOf(val))
+	default:
+		panic("validate: unsupported field type " + field.Type().String())
+	}
+	return ""
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func minRule(value interface{}, param string) string {
+	limit, _ := strconv.ParseFloat(param, 64)
+	if val, ok := toFloat(value); ok && val < limit {
+		return "must be at least " + param
+	}
+	return ""
+}
+
+func maxRule(value interface{}, param string) string {
+	limit, _ := strconv.ParseFloat(param, 64)
+	if val, ok := toFloat(value); ok && val > limit {
+		return "must be at most " + param
+	}
+	return ""
+}
+
+// minLenRule requires string length in characters, e.g. of passwords
+func minLenRule(value interface{}, param string) string {
+	limit, _ := strconv.Atoi(param)
+	if str, ok := value.(string); ok && utf8.RuneCountInString(str) < limit {
+		return fmt.Sprintf("must be at least %d characters long", limit)
+	}
+	return ""
+}
+
+// maxLenRule limits string length in characters, like varchar columns do
+func maxLenRule(value interface{}, param string) string {
+	limit, _ := strconv.Atoi(param)
+	if str, ok := value.(string); ok && utf8.RuneCountInString(str) > limit {
+		return fmt.Sprintf("must be at most %d characters long", limit)
+	}
+	return ""
+}
+
+// maxBytesRule limits string length in bytes, like blob columns do
+func maxBytesRule(value interface{}, param string) string {
+	limit, _ := strconv.Atoi(param)
+	if str, ok := value.(string); ok && len(str) > limit {
+		return fmt.Sprintf("must be at most %d bytes long", limit)
+	}
+	return ""
+}
+
+func emailRule(value interface{}, param string) string {
+	str, _ := value.(string)
+	if addr, err := mail.ParseAddress(str); err != nil || addr.Address != str {
+		return "must be valid email address"
+	}
+	return ""
+}
+
+// urlRule requires absolute http or https URL
+func urlRule(value interface{}, param string) string {
+	str, _ := value.(string)
+	u, err := url.Parse(str)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "must be http or https URL"
+	}
+	return ""
+}
@@ -0,0 +1,265 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  Rule
+		value interface{}
+		param string
+		want  string
+	}{
+		{"min int ok", minRule, 0, "0", ""},
+		{"min int below", minRule, -1, "0", "must be at least 0"},
+		{"min float ok", minRule, 0.5, "0.5", ""},
+		{"min float below", minRule, 0.4, "0.5", "must be at least 0.5"},
+		{"min ignores strings", minRule, "a", "5", ""},
+		{"max int ok", maxRule, 6, "6", ""},
+		{"max int above", maxRule, 7, "6", "must be at most 6"},
+		{"max float above", maxRule, 1000000000000.01, "1000000000000", "must be at most 1000000000000"},
+		{"max ignores strings", maxRule, "aaaaaaa", "1", ""},
+		{"minlen ok", minLenRule, "12345678", "8", ""},
+		{"minlen short", minLenRule, "1234567", "8", "must be at least 8 characters long"},
+		{"minlen counts characters", minLenRule, "пароль12", "8", ""},
+		{"maxlen ok", maxLenRule, "abc", "3", ""},
+		{"maxlen long", maxLenRule, "abcd", "3", "must be at most 3 characters long"},
+		{"maxlen counts characters", maxLenRule, "абв", "3", ""},
+		{"maxbytes ok", maxBytesRule, "abc", "3", ""},
+		{"maxbytes counts bytes", maxBytesRule, "абв", "3", "must be at most 3 bytes long"},
+		{"email ok", emailRule, "nurbek@example.com", "", ""},
+		{"email without domain", emailRule, "nurbek", "", "must be valid email address"},
+		{"email with name", emailRule, "Nurbek <nurbek@example.com>", "", "must be valid email address"},
+		{"url http", urlRule, "http://example.com/hook", "", ""},
+		{"url https", urlRule, "https://example.com", "", ""},
+		{"url other scheme", urlRule, "ftp://example.com", "", "must be http or https URL"},
+		{"url relative", urlRule, "/hook", "", "must be http or https URL"},
+		{"url without host", urlRule, "http://", "", "must be http or https URL"},
+		{"url malformed", urlRule, "http://%zz", "", "must be http or https URL"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rule(tt.value, tt.param); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type bindDTO struct {
+	Name     string     `form:"name" validate:"required,maxlen=5"`
+	Count    int        `form:"count" validate:"min=1,max=10"`
+	Cost     float64    `form:"cost" validate:"min=0"`
+	Flag     bool       `form:"flag"`
+	When     time.Time  `form:"when"`
+	Limit    *int       `form:"limit" validate:"min=1"`
+	Email    *string    `form:"email" validate:"email"`
+	Since    *time.Time `form:"since"`
+	Internal string
+}
+
+func source(values map[string]string) Source {
+	return func(name string) (string, bool) {
+		val, ok := values[name]
+		return val, ok
+	}
+}
+
+func str(s string) *string { return &s }
+
+func num(n int) *int { return &n }
+
+func fields(errs Errors) []string {
+	names := []string{}
+	for _, e := range errs {
+		names = append(names, e.Field+": "+e.Message)
+	}
+	return names
+}
+
+func TestBind(t *testing.T) {
+	since := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   bindDTO
+		errs   []string
+	}{
+		{"required only", map[string]string{"name": "abc", "count": "1"},
+			bindDTO{Name: "abc", Count: 1}, []string{}},
+		{"all fields", map[string]string{"name": "abc", "count": "10", "cost": "1.5", "flag": "true", "when": "2024-03-01 10:00:00",
+			"limit": "3", "email": "a@b.c", "since": "2024-03-01 10:00:00"},
+			bindDTO{Name: "abc", Count: 10, Cost: 1.5, Flag: true, When: since, Limit: num(3), Email: str("a@b.c"), Since: &since}, []string{}},
+		{"missing required", map[string]string{"count": "1"},
+			bindDTO{Count: 1}, []string{"name: is required"}},
+		{"empty required", map[string]string{"name": "", "count": "1"},
+			bindDTO{Count: 1}, []string{"name: is required"}},
+		{"empty pointer stays nil", map[string]string{"name": "abc", "count": "1", "limit": "", "email": ""},
+			bindDTO{Name: "abc", Count: 1}, []string{}},
+		{"bad formats", map[string]string{"name": "abc", "count": "x", "cost": "x", "flag": "x", "when": "2024-03-01", "limit": "1.5"},
+			bindDTO{Name: "abc", Limit: num(0)}, []string{"count: must be integer", "cost: must be in float number format", "flag: must be true or false",
+				"when: must be like 2006-01-02 15:04:05", "limit: must be integer"}},
+		{"rules after parsing", map[string]string{"name": "abcdef", "count": "11", "cost": "-1", "limit": "0", "email": "x"},
+			bindDTO{Name: "abcdef", Count: 11, Cost: -1, Limit: num(0), Email: str("x")},
+			[]string{"name: must be at most 5 characters long", "count: must be at most 10", "cost: must be at least 0",
+				"limit: must be at least 1", "email: must be valid email address"}},
+		{"absent int is zero and checked", map[string]string{"name": "abc"},
+			bindDTO{Name: "abc"}, []string{"count: must be at least 1"}},
+		{"untagged field ignored", map[string]string{"name": "abc", "count": "1", "Internal": "x"},
+			bindDTO{Name: "abc", Count: 1}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got bindDTO
+			errs, err := Bind(context.Background(), source(tt.values), &got)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(fields(errs), tt.errs) {
+				t.Errorf("errors %q, want %q", fields(errs), tt.errs)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+type structDTO struct {
+	Title *string `form:"title" validate:"required,maxlen=3"`
+	State *int    `form:"state" validate:"min=0,max=6"`
+	Note  string  `validate:"maxlen=2"`
+}
+
+func TestStruct(t *testing.T) {
+	tests := []struct {
+		name string
+		dto  interface{}
+		errs []string
+	}{
+		{"valid", structDTO{Title: str("abc"), State: num(6)}, []string{}},
+		{"pointer to dto", &structDTO{Title: str("abc")}, []string{}},
+		{"nil required pointer", structDTO{}, []string{"title: is required"}},
+		{"pointer to empty string is set", structDTO{Title: str("")}, []string{}},
+		{"nil optional pointer skipped", structDTO{Title: str("a"), State: nil}, []string{}},
+		{"first failed rule only", structDTO{Title: str("abcd"), State: num(-1)}, []string{"title: must be at most 3 characters long", "state: must be at least 0"}},
+		{"field name without form tag", structDTO{Title: str("a"), Note: "abc"}, []string{"Note: must be at most 2 characters long"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, err := Struct(context.Background(), tt.dto)
+			if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if !reflect.DeepEqual(fields(errs), tt.errs) {
+				t.Errorf("errors %q, want %q", fields(errs), tt.errs)
+			}
+		})
+	}
+}
+
+func TestCustomRules(t *testing.T) {
+	errLookup := errors.New("lookup failed")
+	RegisterRule("test_even", func(value interface{}, param string) string {
+		if n, _ := value.(int); n%2 != 0 {
+			return "must be even"
+		}
+		return ""
+	})
+	RegisterLookupRule("test_lookup", func(ctx context.Context, value interface{}, param string) (string, error) {
+		switch n, _ := value.(int); n {
+		case 0:
+			return "", errLookup
+		case 1:
+			return "must exist", nil
+		}
+		return "", nil
+	})
+	type dto struct {
+		Even int `form:"even" validate:"test_even"`
+		ID   int `form:"id" validate:"test_lookup"`
+	}
+	tests := []struct {
+		name   string
+		values map[string]string
+		errs   []string
+		err    error
+	}{
+		{"rules pass", map[string]string{"even": "2", "id": "2"}, []string{}, nil},
+		{"rules fail", map[string]string{"even": "3", "id": "1"}, []string{"even: must be even", "id: must exist"}, nil},
+		{"lookup error stops validation", map[string]string{"even": "3", "id": "0"}, nil, errLookup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs, err := Bind(context.Background(), source(tt.values), &dto{})
+			if err != tt.err {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && !reflect.DeepEqual(fields(errs), tt.errs) {
+				t.Errorf("errors %q, want %q", fields(errs), tt.errs)
+			}
+		})
+	}
+}
+
+func TestPanics(t *testing.T) {
+	tests := []struct {
+		name  string
+		bind  func()
+		panic string
+	}{
+		{"unknown rule", func() {
+			Struct(context.Background(), struct {
+				Name string `form:"name" validate:"no_such_rule"`
+			}{Name: "a"})
+		}, "validate: unknown rule no_such_rule"},
+		{"unknown rule with parameter", func() {
+			Struct(context.Background(), struct {
+				Name string `form:"name" validate:"maxlen=5,no_such_rule=1"`
+			}{Name: "a"})
+		}, "validate: unknown rule no_such_rule"},
+		{"unsupported field type", func() {
+			var dto struct {
+				IDs []int `form:"ids"`
+			}
+			Bind(context.Background(), source(map[string]string{"ids": "1"}), &dto)
+		}, "validate: unsupported field type []int"},
+		{"unsupported pointer type", func() {
+			var dto struct {
+				Count *int64 `form:"count"`
+			}
+			Bind(context.Background(), source(map[string]string{"count": "1"}), &dto)
+		}, "validate: unsupported field type int64"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				got, _ := recover().(string)
+				if got != tt.panic {
+					t.Errorf("panic %q, want %q", got, tt.panic)
+				}
+			}()
+			tt.bind()
+		})
+	}
+}
+
+func TestOnly(t *testing.T) {
+	var errs Errors
+	errs.Add("a", "bad %s", "a")
+	errs.Add("b", "bad")
+	errs.Add("c", "bad")
+	got := fields(errs.Only([]string{"c", "a", "x"}))
+	if want := []string{"a: bad a", "c: bad"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := errs.Only(nil); len(got) != 0 {
+		t.Errorf("got %q for no fields", fields(got))
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"./audit"
+	"./storage"
+	"./validate"
+	"./webhooks"
+	"github.com/labstack/echo"
+)
+
+// maxWebhooks : webhooks one user may have
+const maxWebhooks = 10
+
+// webhookDeliveriesShown : how many latest deliveries are listed
+const webhookDeliveriesShown = 100
+
+type webhookView struct {
+	ID        int      `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	CreatedAt string   `json:"created_at"`
+}
+
+type webhookDeliveryView struct {
+	ID            int    `json:"id"`
+	EventID       int    `json:"event_id"`
+	Status        string `json:"status"`
+	Attempts      int    `json:"attempts"`
+	NextAttemptAt string `json:"next_attempt_at,omitempty"`
+	LastStatus    int    `json:"last_status"`
+	LastError     string `json:"last_error"`
+	CreatedAt     string `json:"created_at"`
+	DeliveredAt   string `json:"delivered_at,omitempty"`
+}
+
+func toWebhookView(w *storage.Webhook) webhookView {
+	return webhookView{ID: w.ID, URL: w.URL, Events: w.Events, CreatedAt: w.CreatedAt.Format(validate.TimeLayout)}
+}
+
+func toWebhookDeliveryView(d *storage.WebhookDelivery) webhookDeliveryView {
+	v := webhookDeliveryView{
+		ID:         d.ID,
+		EventID:    d.EventID,
+		Status:     d.Status,
+		Attempts:   d.Attempts,
+		LastStatus: d.LastStatus,
+		LastError:  d.LastError,
+		CreatedAt:  d.CreatedAt.Format(validate.TimeLayout)}
+	if d.Status == storage.DeliveryPending {
+		v.NextAttemptAt = d.NextAttemptAt.Format(validate.TimeLayout)
+	}
+	if !d.DeliveredAt.IsZero() {
+		v.DeliveredAt = d.DeliveredAt.Format(validate.TimeLayout)
+	}
+	return v
+}
+
+// newTaskEvent returns outbox event about task after change. New tasks
+// are announced to all subscribers, they are open to every executor
+func newTaskEvent(eventType string, t *storage.Task) *storage.WebhookEvent {
+	payload, _ := json.Marshal(struct {
+		ID            int     `json:"id"`
+		Title         string  `json:"title"`
+		CustomerID    int     `json:"customer_id"`
+		ExecutionerID int     `json:"executioner_id"`
+		State         int     `json:"state"`
+		Cost          float64 `json:"cost"`
+		Version       int     `json:"version"`
+	}{t.ID, t.Title, t.CustomerID, t.ExecutionerID, int(t.State), t.Cost.GetVal(), t.Version})
+	return &storage.WebhookEvent{
+		Type:       eventType,
+		TaskID:     t.ID,
+		CustomerID: t.CustomerID,
+		ExecutorID: t.ExecutionerID,
+		Public:     eventType == webhooks.TaskCreated,
+		Payload:    string(payload),
+		CreatedAt:  time.Now().Truncate(time.Second)}
+}
+
+// webhookOf returns webhook in path of user in slug. On failure writes
+// answer and returns nil
+func webhookOf(c echo.Context, u *storage.User) (*storage.Webhook, error) {
+	owner, err := slugOwner(c, u, "webhooks")
+	if owner == nil {
+		return nil, err
+	}
+	webhookID, err := strconv.Atoi(c.Param("webhook_id"))
+	var w *storage.Webhook
+	if err == nil {
+		w, err = storage.GetWebhook(c.Request().Context(), owner.ID, webhookID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return nil, storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return nil, c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "webhook not found", "error_code": 180}`))
+	}
+	return w, nil
+}
+
+// webhooksHandlerGet lists webhooks of user without secrets. User or admin
+func webhooksHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "webhooks")
+	if owner == nil {
+		return err
+	}
+	hooks, err := storage.GetWebhooks(c.Request().Context(), owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]webhookView, 0, len(hooks))
+	for _, w := range hooks {
+		views = append(views, toWebhookView(w))
+	}
+	answer, _ := json.Marshal(struct {
+		Webhooks  []webhookView `json:"webhooks"`
+		ErrorCode int           `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// webhooksHandlerCreate registers webhook of user, its signing secret is
+// answered once. User or admin
+func webhooksHandlerCreate(c echo.Context) error {
+	var req webhookCreateRequest
+	if ok, err := bindRequest(c, &req); !ok {
+		return err
+	}
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	owner, err := slugOwner(c, u, "webhooks")
+	if owner == nil {
+		return err
+	}
+	audit.SetAction(c, "webhook.create")
+	ctx := c.Request().Context()
+	hooks, err := storage.GetWebhooks(ctx, owner.ID)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	if len(hooks) >= maxWebhooks {
+		return c.JSONBlob(http.StatusConflict, []byte(fmt.Sprintf(`{"error_message": "at most %d webhooks are allowed, delete unused ones", "error_code": 181}`, maxWebhooks)))
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	w := &storage.Webhook{
+		UserID:    owner.ID,
+		URL:       req.URL,
+		Secret:    "whsec_" + hex.EncodeToString(b),
+		Events:    strings.Split(req.Events, ","),
+		CreatedAt: time.Now().Truncate(time.Second)}
+	if err := storage.CreateWebhook(ctx, w); err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "webhook:"+strconv.Itoa(w.ID), nil, map[string]interface{}{
+		"user_id": owner.ID,
+		"url":     w.URL,
+		"events":  req.Events})
+	answer, _ := json.Marshal(struct {
+		webhookView
+		Secret       string `json:"secret"`
+		ErrorMessage string `json:"error_message"`
+		ErrorCode    int    `json:"error_code"`
+	}{toWebhookView(w), w.Secret, "webhook created, secret is shown only once", 0})
+	return c.JSONBlob(http.StatusCreated, answer)
+}
+
+// webhooksHandlerDelete removes webhook with its deliveries. User or admin
+func webhooksHandlerDelete(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	w, err := webhookOf(c, u)
+	if w == nil {
+		return err
+	}
+	audit.SetAction(c, "webhook.delete")
+	err = storage.DeleteWebhook(c.Request().Context(), w.UserID, w.ID)
+	if errors.Is(err, storage.ErrNotFound) {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "webhook not found", "error_code": 180}`))
+	}
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	audit.AddChange(c, "webhook:"+strconv.Itoa(w.ID), map[string]interface{}{"url": w.URL, "events": strings.Join(w.Events, ",")}, nil)
+	return c.JSONBlob(http.StatusOK, []byte(`{"error_message": "webhook deleted", "error_code": 0}`))
+}
+
+// webhookDeliveriesHandlerGet lists latest deliveries of webhook, newest
+// first. User or admin
+func webhookDeliveriesHandlerGet(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	w, err := webhookOf(c, u)
+	if w == nil {
+		return err
+	}
+	deliveries, err := storage.GetWebhookDeliveries(c.Request().Context(), w.ID, webhookDeliveriesShown)
+	if err != nil {
+		return storageErrorAnswer(c, err)
+	}
+	views := make([]webhookDeliveryView, 0, len(deliveries))
+	for _, d := range deliveries {
+		views = append(views, toWebhookDeliveryView(d))
+	}
+	answer, _ := json.Marshal(struct {
+		Deliveries []webhookDeliveryView `json:"deliveries"`
+		ErrorCode  int                   `json:"error_code"`
+	}{views, 0})
+	return c.JSONBlob(http.StatusOK, answer)
+}
+
+// webhookRedeliverHandler sends delivery again with fresh attempts, e.g.
+// after receiver was fixed. User or admin
+func webhookRedeliverHandler(c echo.Context) error {
+	u, err := authorize(c)
+	if u == nil {
+		return err
+	}
+	w, err := webhookOf(c, u)
+	if w == nil {
+		return err
+	}
+	audit.SetAction(c, "webhook.redeliver")
+	deliveryID, err := strconv.Atoi(c.Param("delivery_id"))
+	if err == nil {
+		err = storage.RedeliverWebhookDelivery(c.Request().Context(), w.ID, deliveryID)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return storageErrorAnswer(c, err)
+		}
+	}
+	if err != nil {
+		return c.JSONBlob(http.StatusNotFound, []byte(`{"error_message": "delivery not found", "error_code": 182}`))
+	}
+	audit.AddChange(c, "webhook_delivery:"+strconv.Itoa(deliveryID), nil, map[string]interface{}{"status": storage.DeliveryPending})
+	return c.JSONBlob(http.StatusAccepted, []byte(`{"error_message": "delivery is queued", "error_code": 0}`))
+}
@@ -0,0 +1,246 @@
+// Package webhooks delivers task events from outbox to endpoints registered
+// by users. Payloads are signed with HMAC-SHA256 of webhook secret, failed
+// deliveries are retried with exponential backoff
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"../metrics"
+	"../storage"
+)
+
+// Task event types
+const (
+	TaskCreated  = "task.created"
+	TaskAcquired = "task.acquired"
+	TaskFinished = "task.finished"
+	TaskAccepted = "task.accepted"
+	TaskClosed   = "task.closed"
+	TaskDisputed = "task.disputed"
+	// TaskDisputeResolved is about admin decision, task state tells which
+	TaskDisputeResolved = "task.dispute_resolved"
+)
+
+// Events : all event types webhooks may subscribe to
+var Events = []string{TaskCreated, TaskAcquired, TaskFinished, TaskAccepted, TaskClosed, TaskDisputed, TaskDisputeResolved}
+
+const (
+	timeLayout     = "2006-01-02 15:04:05"
+	requestTimeout = 10 * time.Second
+	// lease keeps claimed delivery from other dispatchers while it is sent
+	lease        = time.Minute
+	backoffBase  = time.Minute
+	backoffMax   = 6 * time.Hour
+	batchSize    = 20
+	parallelism  = 8
+	maxErrorBody = 512
+)
+
+// MaxAttempts : attempts of delivery before it is failed, about 8 hours of retries
+const MaxAttempts = 10
+
+var errPrivateAddress = errors.New("webhook address is in private network")
+
+// Sign returns signature header value of body sent at timestamp. Receivers
+// compute HMAC-SHA256 of "<timestamp>.<body>" with webhook secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Backoff returns delay before next attempt after attempts failed ones
+func Backoff(attempts int) time.Duration {
+	delay := backoffBase
+	for i := 1; i < attempts && delay < backoffMax; i++ {
+		delay *= 2
+	}
+	if delay > backoffMax {
+		delay = backoffMax
+	}
+	return delay
+}
+
+// reservedNets : networks not covered by net.IP checks which webhooks
+// mustn't reach, carrier-grade NAT and "this network"
+var reservedNets = []*net.IPNet{
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+}
+
+// privateAddress tells if ip is in loopback, private, link-local or
+// reserved network
+func privateAddress(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+		return true
+	}
+	for _, n := range reservedNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// denyPrivate is dialer control refusing connections to private addresses.
+// It runs after name resolution, so DNS can't point webhook around it
+func denyPrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if privateAddress(net.ParseIP(host)) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// Dispatcher fans outbox events out to webhooks and sends due deliveries
+type Dispatcher struct {
+	client *http.Client
+}
+
+// NewDispatcher returns dispatcher. Unless allowPrivate is set, webhooks
+// can't reach loopback and private networks, so users can't probe them
+func NewDispatcher(allowPrivate bool) *Dispatcher {
+	dialer := &net.Dialer{Timeout: requestTimeout}
+	if !allowPrivate {
+		dialer.Control = denyPrivate
+	}
+	return &Dispatcher{client: &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: requestTimeout},
+		// redirects aren't followed, receivers answer 2xx to accept delivery
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}}
+}
+
+// Run dispatches events every interval until ctx is done
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			d.dispatch(ctx)
+		}
+	}
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context) {
+	for {
+		n, err := storage.FanOutWebhookEvents(ctx, 100)
+		if err != nil {
+			slog.WarnContext(ctx, "can't fan out webhook events", "err", err)
+			break
+		}
+		if n < 100 {
+			break
+		}
+	}
+	jobs, err := storage.GetDueWebhookJobs(ctx, batchSize)
+	if err != nil {
+		slog.WarnContext(ctx, "can't get due webhook deliveries", "err", err)
+		return
+	}
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, parallelism)
+	for _, job := range jobs {
+		claimed, err := storage.ClaimWebhookDelivery(ctx, job.ID, time.Now().Add(lease))
+		if err != nil {
+			slog.WarnContext(ctx, "can't claim webhook delivery", "delivery_id", job.ID, "err", err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(job *storage.WebhookJob) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// attempt is recorded even if shutdown began meanwhile
+			d.attempt(context.WithoutCancel(ctx), job)
+		}(job)
+	}
+	wg.Wait()
+}
+
+// attempt sends delivery once and records result
+func (d *Dispatcher) attempt(ctx context.Context, job *storage.WebhookJob) {
+	delivery := &job.WebhookDelivery
+	status, errText := d.send(ctx, job)
+	now := time.Now().Truncate(time.Second)
+	delivery.Attempts++
+	delivery.LastStatus = status
+	delivery.LastError = errText
+	result := "delivered"
+	switch {
+	case errText == "":
+		delivery.Status = storage.DeliveryDelivered
+		delivery.DeliveredAt = now
+	case delivery.Attempts >= MaxAttempts:
+		delivery.Status = storage.DeliveryFailed
+		result = "failed"
+	default:
+		delivery.NextAttemptAt = now.Add(Backoff(delivery.Attempts))
+		result = "retry"
+	}
+	metrics.WebhookAttempts.WithLabelValues(result).Inc()
+	slog.InfoContext(ctx, "webhook attempt", "delivery_id", delivery.ID, "webhook_id", delivery.WebhookID, "event", job.Event.Type,
+		"attempt", delivery.Attempts, "result", result, "status", status, "err", errText)
+	if err := storage.SaveWebhookAttempt(ctx, delivery); err != nil {
+		slog.ErrorContext(ctx, "can't save webhook attempt", "delivery_id", delivery.ID, "err", err)
+	}
+}
+
+// send posts signed event, returns answer status and error text which is
+// empty for 2xx answer
+func (d *Dispatcher) send(ctx context.Context, job *storage.WebhookJob) (int, string) {
+	body, _ := json.Marshal(struct {
+		ID         int             `json:"id"`
+		Type       string          `json:"type"`
+		CreatedAt  string          `json:"created_at"`
+		DeliveryID int             `json:"delivery_id"`
+		Task       json.RawMessage `json:"task"`
+	}{job.Event.ID, job.Event.Type, job.Event.CreatedAt.Format(timeLayout), job.ID, json.RawMessage(job.Event.Payload)})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err.Error()
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "freelance_stock-webhooks")
+	req.Header.Set("X-Webhook-Event", job.Event.Type)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(job.ID))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", Sign(job.Secret, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err.Error()
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Sprintf("answered %s: %s", resp.Status, answer)
+	}
+	return resp.StatusCode, ""
+}
@@ -0,0 +1,138 @@
+package webhooks
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"../storage"
+)
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	tests := []struct {
+		secret    string
+		timestamp int64
+		want      string
+	}{
+		{"whsec", 1700000000, "sha256=e79220cb981f992adbc8b93ac6d46028b0217ea19327d27dc9d18bf334403bde"},
+		{"whsec", 1700000001, "sha256=209d3361712c7560cbc1b4a85d0e29ff4ef8285cd863ed7bd1cc993d5b02c138"},
+	}
+	for _, tt := range tests {
+		if got := Sign(tt.secret, tt.timestamp, body); got != tt.want {
+			t.Errorf("Sign at %d = %s, want %s", tt.timestamp, got, tt.want)
+		}
+	}
+	if Sign("other", 1700000000, body) == tests[0].want {
+		t.Error("signature doesn't depend on secret")
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{0, time.Minute},
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{9, 256 * time.Minute},
+		{10, 6 * time.Hour},
+		{100, 6 * time.Hour},
+	}
+	for _, tt := range tests {
+		if got := Backoff(tt.attempts); got != tt.want {
+			t.Errorf("Backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestPrivateAddress(t *testing.T) {
+	tests := []struct {
+		ip      string
+		private bool
+	}{
+		{"93.184.216.34", false},
+		{"100.63.255.255", false},
+		{"100.128.0.0", false},
+		{"2606:2800:220:1::", false},
+		{"127.0.0.1", true},
+		{"10.1.2.3", true},
+		{"172.16.0.1", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.64.0.1", true},
+		{"100.127.255.255", true},
+		{"0.0.0.0", true},
+		{"0.1.2.3", true},
+		{"::1", true},
+		{"fd00::1", true},
+		{"fe80::1", true},
+		{"::ffff:127.0.0.1", true},
+		{"::ffff:100.64.0.1", true},
+	}
+	for _, tt := range tests {
+		if got := privateAddress(net.ParseIP(tt.ip)); got != tt.private {
+			t.Errorf("%s private %v, want %v", tt.ip, got, tt.private)
+		}
+	}
+	if err := denyPrivate("tcp", "100.64.0.1:443", nil); err != errPrivateAddress {
+		t.Errorf("dial to carrier-grade NAT: %v", err)
+	}
+	if err := denyPrivate("tcp", "93.184.216.34:443", nil); err != nil {
+		t.Errorf("dial to public address: %v", err)
+	}
+}
+
+func TestSend(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		if r.URL.Path == "/fail" {
+			http.Error(w, "try later", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	job := &storage.WebhookJob{
+		WebhookDelivery: storage.WebhookDelivery{ID: 7},
+		URL:             server.URL + "/hook",
+		Secret:          "whsec",
+		Event:           storage.WebhookEvent{ID: 3, Type: TaskAcquired, Payload: `{"id":5}`, CreatedAt: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}}
+	ctx := context.Background()
+
+	status, errText := NewDispatcher(false).send(ctx, job)
+	if status != 0 || !strings.Contains(errText, errPrivateAddress.Error()) || got != nil {
+		t.Errorf("private address reached: %d %q", status, errText)
+	}
+
+	d := NewDispatcher(true)
+	status, errText = d.send(ctx, job)
+	if status != http.StatusOK || errText != "" {
+		t.Fatalf("answered %d %q", status, errText)
+	}
+	want := `{"id":3,"type":"task.acquired","created_at":"2024-03-01 12:00:00","delivery_id":7,"task":{"id":5}}`
+	if string(body) != want {
+		t.Errorf("body %s, want %s", body, want)
+	}
+	timestamp, _ := strconv.ParseInt(got.Header.Get("X-Webhook-Timestamp"), 10, 64)
+	if got.Header.Get("X-Webhook-Signature") != Sign("whsec", timestamp, body) {
+		t.Error("signature doesn't match body")
+	}
+	if got.Header.Get("X-Webhook-Event") != TaskAcquired || got.Header.Get("X-Webhook-Delivery") != "7" {
+		t.Errorf("headers %v", got.Header)
+	}
+
+	job.URL = server.URL + "/fail"
+	if status, errText = d.send(ctx, job); status != http.StatusServiceUnavailable || !strings.Contains(errText, "try later") {
+		t.Errorf("failed delivery %d %q", status, errText)
+	}
+}